@@ -0,0 +1,469 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yuriy0803/open-etc-pool-friends/payouts"
+	"github.com/yuriy0803/open-etc-pool-friends/policy"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type adminActorKey struct{}
+
+const defaultAuditLimit = 100
+
+// Requires one of configured bearer tokens, admin API is hidden if there are none
+func (s *ApiServer) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.config.AdminTokens) == 0 {
+			notFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for i, v := range s.config.AdminTokens {
+			if len(v) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(v)) == 1 {
+				// Tokens are identified by index in config for audit trail
+				actor := fmt.Sprintf("token%d@%s", i, r.RemoteAddr)
+				next(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+				return
+			}
+		}
+		log.Printf("Unauthorized admin API request from %v to %v", r.RemoteAddr, r.URL.Path)
+		writeAdminReply(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+	}
+}
+
+func (s *ApiServer) registerAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/admin/reload", s.adminAuth(s.ReloadIndex)).Methods("POST")
+	r.HandleFunc("/admin/bans", s.adminAuth(s.BansIndex)).Methods("GET")
+	r.HandleFunc("/admin/bans", s.adminAuth(s.AddBanIndex)).Methods("POST")
+	r.HandleFunc("/admin/bans/{ip}", s.adminAuth(s.RemoveBanIndex)).Methods("DELETE")
+	r.HandleFunc("/admin/blacklist", s.adminAuth(s.BlacklistIndex)).Methods("GET")
+	r.HandleFunc("/admin/blacklist", s.adminAuth(s.AddBlacklistIndex)).Methods("POST")
+	r.HandleFunc("/admin/blacklist/{login}", s.adminAuth(s.RemoveBlacklistIndex)).Methods("DELETE")
+	r.HandleFunc("/admin/payouts", s.adminAuth(s.PayoutsIndex)).Methods("GET")
+	r.HandleFunc("/admin/payouts/resolve", s.adminAuth(s.ResolvePayoutsIndex)).Methods("POST")
+	r.HandleFunc("/admin/reconcile", s.adminAuth(s.ReconcileIndex)).Methods("GET")
+	r.HandleFunc("/admin/ledger", s.adminAuth(s.LedgerIndex)).Methods("GET")
+	r.HandleFunc("/admin/unlocker", s.adminAuth(s.UnlockerIndex)).Methods("GET")
+	r.HandleFunc("/admin/unlocker/unhalt", s.adminAuth(s.UnhaltUnlockerIndex)).Methods("POST")
+	r.HandleFunc("/admin/sessions", s.adminAuth(s.SessionsIndex)).Methods("GET")
+	r.HandleFunc("/admin/sessions/{node}/{id}", s.adminAuth(s.KickSessionIndex)).Methods("DELETE")
+	r.HandleFunc("/admin/balance", s.adminAuth(s.AdjustBalanceIndex)).Methods("POST")
+	r.HandleFunc("/admin/audit", s.adminAuth(s.AuditIndex)).Methods("GET")
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) ReloadIndex(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		writeAdminReply(w, http.StatusNotImplemented, map[string]interface{}{"error": "reload is not available"})
+		return
+	}
+	report, err := s.reload()
+	if err != nil {
+		writeAdminReply(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, report)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminReply(w, status, map[string]interface{}{"error": err.Error()})
+}
+
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(v)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Malformed request: %v", err))
+		return false
+	}
+	return true
+}
+
+// Every change made via admin API is logged and kept in backend
+func (s *ApiServer) audit(r *http.Request, action, target string, amount int64, details string) {
+	actor, _ := r.Context().Value(adminActorKey{}).(string)
+	log.Printf("Admin %s: %s %s %v %s", actor, action, target, amount, details)
+	entry := &storage.AuditEntry{Actor: actor, Action: action, Target: target, Amount: amount, Details: details}
+	if err := s.backend.WriteAudit(entry); err != nil {
+		log.Printf("Failed to write admin audit entry: %v", err)
+	}
+}
+
+func (s *ApiServer) BansIndex(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.backend.GetBans()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := make([]*storage.Ban, 0, len(bans))
+	for _, v := range bans {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"bans": list})
+}
+
+func (s *ApiServer) AddBanIndex(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IP string `json:"ip"`
+		// Empty for permanent ban
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if net.ParseIP(req.IP) == nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid IP %q", req.IP))
+		return
+	}
+	var until int64
+	if len(req.Duration) > 0 {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid duration %q", req.Duration))
+			return
+		}
+		until = util.MakeTimestamp() + int64(d/time.Millisecond)
+	}
+	if len(req.Reason) == 0 {
+		req.Reason = "admin"
+	}
+	if err := s.backend.WriteBan(req.IP, until, req.Reason); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.audit(r, "ban", req.IP, 0, req.Reason)
+	writeAdminReply(w, http.StatusOK, &storage.Ban{IP: req.IP, Until: until, Reason: req.Reason})
+}
+
+func (s *ApiServer) RemoveBanIndex(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	ok, err := s.backend.DeleteBan(ip)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%v is not banned", ip))
+		return
+	}
+	s.audit(r, "unban", ip, 0, "")
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"ip": ip})
+}
+
+type blacklistEntry struct {
+	Login string `json:"login"`
+	// Listed in blacklist_file, can only be removed by editing it
+	ReadOnly bool `json:"readOnly"`
+}
+
+// Wallets of blacklist_file, none if it is not set or doesn't exist
+func (s *ApiServer) fileBlacklist() ([]string, error) {
+	fileName, _ := s.blacklistFile.Load().(string)
+	if len(fileName) == 0 {
+		return nil, nil
+	}
+	list, err := policy.ReadWalletBlacklist(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return list, err
+}
+
+func (s *ApiServer) BlacklistIndex(w http.ResponseWriter, r *http.Request) {
+	list, err := s.backend.GetWalletBlacklist()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fileList, err := s.fileBlacklist()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	readOnly := make(map[string]bool)
+	for _, login := range list {
+		readOnly[strings.ToLower(login)] = false
+	}
+	for _, login := range fileList {
+		readOnly[strings.ToLower(login)] = true
+	}
+	entries := make([]blacklistEntry, 0, len(readOnly))
+	for login, ro := range readOnly {
+		entries = append(entries, blacklistEntry{Login: login, ReadOnly: ro})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Login < entries[j].Login })
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"blacklist": entries})
+}
+
+func (s *ApiServer) AddBlacklistIndex(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Login  string `json:"login"`
+		Reason string `json:"reason"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	login := strings.ToLower(req.Login)
+	if !util.IsValidHexAddress(login) {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid login %q", req.Login))
+		return
+	}
+	if _, err := s.backend.AddWalletBlacklist(login); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.audit(r, "blacklist", login, 0, req.Reason)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"login": login})
+}
+
+func (s *ApiServer) RemoveBlacklistIndex(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	fileList, err := s.fileBlacklist()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, v := range fileList {
+		if strings.ToLower(v) == login {
+			writeAdminError(w, http.StatusConflict, fmt.Errorf("%v is blacklisted in blacklist_file, remove it there", login))
+			return
+		}
+	}
+	ok, err := s.backend.RemoveWalletBlacklist(login)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%v is not blacklisted", login))
+		return
+	}
+	s.audit(r, "unblacklist", login, 0, "")
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"login": login})
+}
+
+func (s *ApiServer) PayoutsIndex(w http.ResponseWriter, r *http.Request) {
+	locked, err := s.backend.IsPayoutsLocked()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	pending := s.backend.GetPendingPayments()
+	if pending == nil {
+		pending = []*storage.PendingPayment{}
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"locked": locked, "pending": pending})
+}
+
+func (s *ApiServer) ResolvePayoutsIndex(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		// Resolves payments of this login only
+		Login string `json:"login"`
+		// Hash of tx found on chain, payment is logged as paid instead of credited back
+		TxHash string `json:"txHash"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	req.Login = strings.ToLower(req.Login)
+	if len(req.TxHash) > 0 && len(req.Login) == 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Login is required with txHash"))
+		return
+	}
+	resolved, err := payouts.ResolvePayouts(s.backend, req.Login, req.TxHash)
+	for _, v := range resolved {
+		if len(req.TxHash) > 0 {
+			s.audit(r, "resolvePaid", v.Address, v.Amount, req.TxHash)
+		} else {
+			s.audit(r, "resolveRollback", v.Address, v.Amount, "")
+		}
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	locked, _ := s.backend.IsPayoutsLocked()
+	if resolved == nil {
+		resolved = []*storage.PendingPayment{}
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"resolved": resolved, "locked": locked})
+}
+
+func (s *ApiServer) ReconcileIndex(w http.ResponseWriter, r *http.Request) {
+	state, err := s.backend.GetReconcileState()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	failed, err := s.backend.GetFailedPayments(defaultAuditLimit)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"state": state, "failed": failed})
+}
+
+func (s *ApiServer) LedgerIndex(w http.ResponseWriter, r *http.Request) {
+	check, err := s.backend.CheckLedger()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, check)
+}
+
+func (s *ApiServer) UnlockerIndex(w http.ResponseWriter, r *http.Request) {
+	state, err := s.backend.GetUnlockerState()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, state)
+}
+
+func (s *ApiServer) UnhaltUnlockerIndex(w http.ResponseWriter, r *http.Request) {
+	if err := s.backend.RequestUnhalt("unlocker"); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.audit(r, "unhalt", "unlocker", 0, "")
+	writeAdminReply(w, http.StatusAccepted, map[string]interface{}{"unhaltRequested": true})
+}
+
+func (s *ApiServer) SessionsIndex(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.backend.GetNodeStates()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := make(map[string][]map[string]interface{})
+	for _, node := range nodes {
+		name, _ := node["name"].(string)
+		if len(name) == 0 {
+			continue
+		}
+		sessions, err := s.backend.GetSessions(name)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		list := make([]map[string]interface{}, 0, len(sessions))
+		for id, v := range sessions {
+			var session map[string]interface{}
+			if err := json.Unmarshal([]byte(v), &session); err != nil {
+				continue
+			}
+			session["id"] = id
+			list = append(list, session)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i]["id"].(string) < list[j]["id"].(string) })
+		result[name] = list
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"sessions": result})
+}
+
+func (s *ApiServer) KickSessionIndex(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	node, id := vars["node"], vars["id"]
+	sessions, err := s.backend.GetSessions(node)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	session, ok := sessions[id]
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("No session %v on %v", id, node))
+		return
+	}
+	if err := s.backend.KickSession(node, id); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.audit(r, "kick", node+"/"+id, 0, session)
+	// Proxy disconnects it on next state update
+	writeAdminReply(w, http.StatusAccepted, map[string]interface{}{"node": node, "id": id})
+}
+
+func (s *ApiServer) AdjustBalanceIndex(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Login string `json:"login"`
+		// Shannon, negative to debit
+		Amount int64  `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	login := strings.ToLower(req.Login)
+	if !util.IsValidHexAddress(login) {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid login %q", req.Login))
+		return
+	}
+	if req.Amount == 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Amount must not be zero"))
+		return
+	}
+	if len(strings.TrimSpace(req.Reason)) == 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Reason is required"))
+		return
+	}
+	balance, ok, err := s.backend.AdjustBalance(login, req.Amount)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Debit of %v Shannon exceeds balance of %v Shannon", -req.Amount, balance))
+		return
+	}
+	action := "credit"
+	if req.Amount < 0 {
+		action = "debit"
+	}
+	s.audit(r, action, login, req.Amount, req.Reason)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"login": login, "balance": balance})
+}
+
+func (s *ApiServer) AuditIndex(w http.ResponseWriter, r *http.Request) {
+	limit := int64(defaultAuditLimit)
+	if v := r.URL.Query().Get("limit"); len(v) > 0 {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+	entries, err := s.backend.GetAudit(limit)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"audit": entries})
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+const (
+	adminToken = "secret"
+	adminLogin = "0x00000000000000000000000000000000000000aa"
+	otherLogin = "0x00000000000000000000000000000000000000bb"
+)
+
+// Memory backend takes admin calls, other backend methods are not used
+type adminBackend struct {
+	*storage.MemoryBackend
+	unusedBackend
+}
+
+type unusedBackend struct {
+	storage.Backend
+}
+
+func newAdminServer(tokens ...string) (*ApiServer, *storage.MemoryBackend, http.Handler) {
+	backend := storage.NewMemoryBackend(100)
+	s := &ApiServer{config: &ApiConfig{AdminTokens: tokens}, backend: &adminBackend{MemoryBackend: backend}}
+	r := mux.NewRouter()
+	s.registerAdminRoutes(r)
+	return s, backend, r
+}
+
+func adminRequest(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decodeAdminReply(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("Malformed reply %v: %v", w.Body.String(), err)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	_, _, hidden := newAdminServer()
+	_, _, h := newAdminServer("", "other", adminToken)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		token   string
+		status  int
+	}{
+		{"no tokens configured", hidden, adminToken, http.StatusNotFound},
+		{"no tokens configured and no token", hidden, "", http.StatusNotFound},
+		{"no token", h, "", http.StatusUnauthorized},
+		{"bad token", h, "wrong", http.StatusUnauthorized},
+		{"empty configured token never matches", h, " ", http.StatusUnauthorized},
+		{"prefix of token", h, adminToken[:3], http.StatusUnauthorized},
+		{"valid token", h, adminToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := adminRequest(tt.handler, "GET", "/admin/bans", tt.token, "")
+		if w.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v %v", tt.name, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAdminBlacklist(t *testing.T) {
+	s, backend, h := newAdminServer(adminToken)
+	fileName := filepath.Join(t.TempDir(), "blacklist.json")
+	if err := os.WriteFile(fileName, []byte(`["0x00000000000000000000000000000000000000AA"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.SetBlacklistFile(fileName)
+	backend.AddWalletBlacklist(otherLogin)
+
+	var reply struct {
+		Blacklist []blacklistEntry `json:"blacklist"`
+	}
+	w := adminRequest(h, "GET", "/admin/blacklist", adminToken, "")
+	decodeAdminReply(t, w, &reply)
+	expected := []blacklistEntry{{Login: adminLogin, ReadOnly: true}, {Login: otherLogin}}
+	if len(reply.Blacklist) != 2 || reply.Blacklist[0] != expected[0] || reply.Blacklist[1] != expected[1] {
+		t.Errorf("Expected blacklist %+v, got %+v", expected, reply.Blacklist)
+	}
+
+	tests := []struct {
+		name   string
+		login  string
+		status int
+	}{
+		{"listed in blacklist_file", "0x00000000000000000000000000000000000000Aa", http.StatusConflict},
+		{"added via API", otherLogin, http.StatusOK},
+		{"not blacklisted", otherLogin, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := adminRequest(h, "DELETE", "/admin/blacklist/"+tt.login, adminToken, "")
+		if w.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v %v", tt.name, tt.status, w.Code, w.Body.String())
+		}
+	}
+	if list, _ := backend.GetWalletBlacklist(); len(list) != 0 {
+		t.Errorf("Expected blacklist of backend to be empty, got %v", list)
+	}
+	audit, _ := backend.GetAudit(10)
+	if len(audit) != 1 || audit[0].Action != "unblacklist" || audit[0].Target != otherLogin {
+		t.Errorf("Expected only removal via API to be audited, got %+v", audit)
+	}
+}
+
+func TestAdminAdjustBalance(t *testing.T) {
+	_, backend, h := newAdminServer("other", adminToken)
+
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		balance int64
+	}{
+		{"no reason", `{"login": "` + adminLogin + `", "amount": 100}`, http.StatusBadRequest, 0},
+		{"blank reason", `{"login": "` + adminLogin + `", "amount": 100, "reason": "  "}`, http.StatusBadRequest, 0},
+		{"invalid login", `{"login": "0x1", "amount": 100, "reason": "lost share"}`, http.StatusBadRequest, 0},
+		{"zero amount", `{"login": "` + adminLogin + `", "amount": 0, "reason": "lost share"}`, http.StatusBadRequest, 0},
+		{"malformed", `{"login": `, http.StatusBadRequest, 0},
+		{"credit", `{"login": "` + strings.ToUpper(adminLogin) + `", "amount": 100, "reason": "lost share"}`, http.StatusOK, 100},
+		{"debit above balance", `{"login": "` + adminLogin + `", "amount": -101, "reason": "double pay"}`, http.StatusBadRequest, 100},
+		{"debit", `{"login": "` + adminLogin + `", "amount": -40, "reason": "double pay"}`, http.StatusOK, 60},
+	}
+	for _, tt := range tests {
+		w := adminRequest(h, "POST", "/admin/balance", adminToken, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v %v", tt.name, tt.status, w.Code, w.Body.String())
+		}
+		if balance, _ := backend.GetBalance(adminLogin); balance != tt.balance {
+			t.Errorf("%v: expected balance %v, got %v", tt.name, tt.balance, balance)
+		}
+	}
+
+	// Newest first, actor is the index of token
+	audit, _ := backend.GetAudit(10)
+	expected := []storage.AuditEntry{
+		{Action: "debit", Target: adminLogin, Amount: -40, Details: "double pay"},
+		{Action: "credit", Target: adminLogin, Amount: 100, Details: "lost share"},
+	}
+	if len(audit) != len(expected) {
+		t.Fatalf("Expected %v audit entries, got %+v", len(expected), audit)
+	}
+	for i, v := range expected {
+		got := audit[i]
+		if got.Action != v.Action || got.Target != v.Target || got.Amount != v.Amount || got.Details != v.Details || !strings.HasPrefix(got.Actor, "token1@") {
+			t.Errorf("Expected audit entry %+v, got %+v", v, got)
+		}
+	}
+}
+
+func TestAdminResolvePayouts(t *testing.T) {
+	const txHash = "0x5e1f0e2fdd83e1b8f8b1f6a5a5a3ad2d1b9b1b6a4b1c2d3e4f5a6b7c8d9e0f11"
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		// Balances after resolving and whether payouts stay locked
+		balance, otherBalance int64
+		locked                bool
+		actions               []string
+	}{
+		{"tx hash without login", `{"txHash": "` + txHash + `"}`, http.StatusBadRequest, 0, 0, true, nil},
+		{"unknown login", `{"login": "0x00000000000000000000000000000000000000cc"}`, http.StatusInternalServerError, 0, 0, true, nil},
+		{"paid by tx", `{"login": "` + strings.ToUpper(adminLogin) + `", "txHash": "` + txHash + `"}`, http.StatusOK, 0, 0, false, []string{"resolvePaid"}},
+		{"credited back one login", `{"login": "` + otherLogin + `"}`, http.StatusOK, 0, 200, true, []string{"resolveRollback"}},
+		{"credited back all", `{}`, http.StatusOK, 100, 200, false, []string{"resolveRollback", "resolveRollback"}},
+	}
+	for _, tt := range tests {
+		_, backend, h := newAdminServer(adminToken)
+		// Stuck batch payment of both logins
+		backend.AdjustBalance(adminLogin, 100)
+		backend.AdjustBalance(otherLogin, 200)
+		backend.LockPayouts(adminLogin, 300)
+		backend.UpdateBalance(adminLogin, 100)
+		backend.UpdateBalance(otherLogin, 200)
+
+		w := adminRequest(h, "POST", "/admin/payouts/resolve", adminToken, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v %v", tt.name, tt.status, w.Code, w.Body.String())
+		}
+		if balance, _ := backend.GetBalance(adminLogin); balance != tt.balance {
+			t.Errorf("%v: expected balance %v, got %v", tt.name, tt.balance, balance)
+		}
+		if balance, _ := backend.GetBalance(otherLogin); balance != tt.otherBalance {
+			t.Errorf("%v: expected other balance %v, got %v", tt.name, tt.otherBalance, balance)
+		}
+		if locked, _ := backend.IsPayoutsLocked(); locked != tt.locked {
+			t.Errorf("%v: expected payouts locked %v, got %v", tt.name, tt.locked, locked)
+		}
+		audit, _ := backend.GetAudit(10)
+		var actions []string
+		for _, v := range audit {
+			actions = append(actions, v.Action)
+		}
+		if strings.Join(actions, ",") != strings.Join(tt.actions, ",") {
+			t.Errorf("%v: expected audit %v, got %v", tt.name, tt.actions, actions)
+		}
+	}
+}
+
+func TestAdminUnhaltUnlocker(t *testing.T) {
+	_, backend, h := newAdminServer(adminToken)
+
+	var state storage.UnlockerState
+	decodeAdminReply(t, adminRequest(h, "GET", "/admin/unlocker", adminToken, ""), &state)
+	if state.UnhaltRequested {
+		t.Fatal("Expected no unhalt request")
+	}
+
+	w := adminRequest(h, "POST", "/admin/unlocker/unhalt", adminToken, "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected unhalt to be accepted, got %v %v", w.Code, w.Body.String())
+	}
+	decodeAdminReply(t, adminRequest(h, "GET", "/admin/unlocker", adminToken, ""), &state)
+	if !state.UnhaltRequested {
+		t.Error("Expected unhalt request in unlocker state")
+	}
+	audit, _ := backend.GetAudit(10)
+	if len(audit) != 1 || audit[0].Action != "unhalt" || audit[0].Target != "unlocker" {
+		t.Errorf("Expected unhalt to be audited, got %+v", audit)
+	}
+
+	// Unlocker takes the request once
+	if ok, _ := backend.PopUnhaltRequest("unlocker"); !ok {
+		t.Error("Expected unlocker to take unhalt request")
+	}
+	decodeAdminReply(t, adminRequest(h, "GET", "/admin/unlocker", adminToken, ""), &state)
+	if state.UnhaltRequested {
+		t.Error("Expected unhalt request to be taken")
+	}
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -37,17 +38,39 @@ type ApiConfig struct {
 	Blocks               int64  `json:"blocks"`
 	PurgeOnly            bool   `json:"purgeOnly"`
 	PurgeInterval        string `json:"purgeInterval"`
+	// Bearer tokens for /api/admin, admin API is disabled if empty
+	AdminTokens []string `json:"adminTokens"`
+	// Miners may change their payout threshold with a signed message
+	PayoutThreshold ThresholdConfig `json:"payoutThreshold"`
+}
+
+// Result of a config reload
+type ReloadReport struct {
+	// Fields applied live
+	Applied []string `json:"applied"`
+	// Changed fields that need a restart
+	Restart []string `json:"restart"`
 }
 
 type ApiServer struct {
 	config              *ApiConfig
-	backend             *storage.RedisClient
+	coin                string
+	backend             storage.Backend
+	windowsMu           sync.RWMutex
 	hashrateWindow      time.Duration
 	hashrateLargeWindow time.Duration
+	luckWindow          []int
 	stats               atomic.Value
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	server              *http.Server
+	cron                *cron.Cron
+	quit                chan struct{}
+	reload              func() (*ReloadReport, error)
+	blacklistFile       atomic.Value
+	// Routes are served by a listener shared with other coins
+	mounted bool
 }
 
 type Entry struct {
@@ -55,21 +78,75 @@ type Entry struct {
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, backend storage.Backend, coin string) *ApiServer {
 	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
+	luckWindow := append([]int(nil), cfg.LuckWindow...)
+	sort.Ints(luckWindow)
+	if cfg.PayoutThreshold.Enabled {
+		// Payouts use default threshold for values up to 10 Shannon
+		if cfg.PayoutThreshold.Min <= 10 || cfg.PayoutThreshold.Max < cfg.PayoutThreshold.Min {
+			log.Fatalf("Invalid payout threshold bounds %v-%v", cfg.PayoutThreshold.Min, cfg.PayoutThreshold.Max)
+		}
+		util.MustParseDuration(cfg.PayoutThreshold.MaxAge)
+		// Signed messages name the coin
+		if len(coin) == 0 {
+			log.Fatal("Payout threshold requires coin name")
+		}
+	}
 	return &ApiServer{
 		config:              cfg,
+		coin:                coin,
 		backend:             backend,
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
+		luckWindow:          luckWindow,
 		miners:              make(map[string]*Entry),
+		server:              &http.Server{Addr: cfg.Listen},
+		cron:                cron.New(),
+		quit:                make(chan struct{}),
 	}
 }
 
+// Handler of POST /api/admin/reload, must be set before Start
+func (s *ApiServer) SetReloader(reload func() (*ReloadReport, error)) {
+	s.reload = reload
+}
+
+// Wallet blacklist file of proxy policy, its entries are listed read-only by admin API
+func (s *ApiServer) SetBlacklistFile(fileName string) {
+	s.blacklistFile.Store(fileName)
+}
+
+// Applies reloaded hashrate and luck windows
+func (s *ApiServer) ApplyWindows(cfg *ApiConfig) {
+	luckWindow := append([]int(nil), cfg.LuckWindow...)
+	sort.Ints(luckWindow)
+	s.windowsMu.Lock()
+	s.hashrateWindow = util.MustParseDuration(cfg.HashrateWindow)
+	s.hashrateLargeWindow = util.MustParseDuration(cfg.HashrateLargeWindow)
+	s.luckWindow = luckWindow
+	s.windowsMu.Unlock()
+	log.Printf("Set hashrate windows to %v and %v, luck window %v", cfg.HashrateWindow, cfg.HashrateLargeWindow, luckWindow)
+}
+
+func (s *ApiServer) windows() (time.Duration, time.Duration) {
+	s.windowsMu.RLock()
+	defer s.windowsMu.RUnlock()
+	return s.hashrateWindow, s.hashrateLargeWindow
+}
+
+func (s *ApiServer) getLuckWindow() []int {
+	s.windowsMu.RLock()
+	defer s.windowsMu.RUnlock()
+	return s.luckWindow
+}
+
 func (s *ApiServer) Start() {
 	if s.config.PurgeOnly {
 		log.Printf("Starting API in purge-only mode")
+	} else if s.mounted {
+		log.Printf("Starting API on shared listener")
 	} else {
 		log.Printf("Starting API on %v", s.config.Listen)
 	}
@@ -82,8 +159,6 @@ func (s *ApiServer) Start() {
 	purgeTimer := time.NewTimer(purgeIntv)
 	log.Printf("Set purge interval to %v", purgeIntv)
 
-	sort.Ints(s.config.LuckWindow)
-
 	if s.config.PurgeOnly {
 		s.purgeStale()
 	} else {
@@ -102,12 +177,16 @@ func (s *ApiServer) Start() {
 			case <-purgeTimer.C:
 				s.purgeStale()
 				purgeTimer.Reset(purgeIntv)
+			case <-s.quit:
+				statsTimer.Stop()
+				purgeTimer.Stop()
+				return
 			}
 		}
 	}()
 
 	go func() {
-		c := cron.New()
+		c := s.cron
 
 		poolCharts := s.config.PoolCharts
 		log.Printf("Pool charts config is :%v", poolCharts)
@@ -129,8 +208,9 @@ func (s *ApiServer) Start() {
 			if err != nil {
 				log.Println("Get all miners account error: ", err)
 			}
+			hashrateWindow, hashrateLargeWindow := s.windows()
 			for _, login := range miners {
-				miner, _ := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+				miner, _ := s.backend.CollectWorkersStats(hashrateWindow, hashrateLargeWindow, login)
 				s.collectMinerCharts(login, miner["currentHashrate"].(int64), miner["hashrate"].(int64), miner["workersOnline"].(int64))
 			}
 		})
@@ -159,8 +239,9 @@ func (s *ApiServer) Start() {
 			if err != nil {
 				log.Println("Get all miners account error: ", err)
 			}
+			hashrateWindow, hashrateLargeWindow := s.windows()
 			for _, login := range miners {
-				miner, _ := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+				miner, _ := s.backend.CollectWorkersStats(hashrateWindow, hashrateLargeWindow, login)
 				s.collectshareCharts(login, miner["workersOnline"].(int64))
 			}
 
@@ -169,7 +250,7 @@ func (s *ApiServer) Start() {
 		c.Start()
 	}()
 
-	if !s.config.PurgeOnly {
+	if !s.config.PurgeOnly && !s.mounted {
 		s.listen()
 	}
 }
@@ -243,19 +324,58 @@ func (s *ApiServer) collectshareCharts(login string, workerOnline int64) {
 
 func (s *ApiServer) listen() {
 	r := mux.NewRouter()
-	r.HandleFunc("/api/finders", s.FindersIndex)
-	r.HandleFunc("/api/stats", s.StatsIndex)
-	r.HandleFunc("/api/miners", s.MinersIndex)
-	r.HandleFunc("/api/blocks", s.BlocksIndex)
-	r.HandleFunc("/api/payments", s.PaymentsIndex)
-	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
+	s.registerRoutes(r.PathPrefix("/api").Subrouter())
 	r.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServe(s.config.Listen, r)
-	if err != nil {
+	s.server.Handler = r
+	err := s.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start API: %v", err)
 	}
 }
 
+func (s *ApiServer) registerRoutes(r *mux.Router) {
+	r.HandleFunc("/finders", s.FindersIndex)
+	r.HandleFunc("/stats", s.StatsIndex)
+	r.HandleFunc("/miners", s.MinersIndex)
+	r.HandleFunc("/blocks", s.BlocksIndex)
+	r.HandleFunc("/payments", s.PaymentsIndex)
+	r.HandleFunc("/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
+	r.HandleFunc("/accounts/{login:0x[0-9a-fA-F]{40}}/threshold", s.ThresholdIndex).Methods("POST", "OPTIONS")
+	s.registerAdminRoutes(r)
+}
+
+// Serves API of several coins on one listener, each coin under /api/{coin}.
+// Servers of coins don't listen on their own then.
+func NewCoinsServer(listen string, servers map[string]*ApiServer) *http.Server {
+	r := mux.NewRouter()
+	coins := make([]string, 0, len(servers))
+	for coin, s := range servers {
+		s.mounted = true
+		s.registerRoutes(r.PathPrefix("/api/" + coin).Subrouter())
+		coins = append(coins, coin)
+	}
+	sort.Strings(coins)
+	r.HandleFunc("/api/coins", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"coins": coins})
+	})
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	return &http.Server{Addr: listen, Handler: r}
+}
+
+// Stops background jobs and waits for requests in progress
+func (s *ApiServer) Stop(ctx context.Context) {
+	log.Println("Stopping API")
+	close(s.quit)
+	s.cron.Stop()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shutdown API server: %v", err)
+	}
+	log.Println("API stopped")
+}
+
 func notFound(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -265,7 +385,8 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 
 func (s *ApiServer) purgeStale() {
 	start := time.Now()
-	total, err := s.backend.FlushStaleStats(s.hashrateWindow, s.hashrateLargeWindow)
+	hashrateWindow, hashrateLargeWindow := s.windows()
+	total, err := s.backend.FlushStaleStats(hashrateWindow, hashrateLargeWindow)
 	if err != nil {
 		log.Println("Failed to purge stale data from backend:", err)
 	} else {
@@ -275,14 +396,15 @@ func (s *ApiServer) purgeStale() {
 
 func (s *ApiServer) collectStats() {
 	start := time.Now()
-	stats, err := s.backend.CollectStats(s.hashrateWindow, s.config.Blocks, s.config.Payments)
+	hashrateWindow, _ := s.windows()
+	stats, err := s.backend.CollectStats(hashrateWindow, s.config.Blocks, s.config.Payments)
 	if err != nil {
 		log.Printf("Failed to fetch stats from backend: %v", err)
 		return
 	}
-	if len(s.config.LuckWindow) > 0 {
-		stats["luck"], err = s.backend.CollectLuckStats(s.config.LuckWindow)
-		stats["luckCharts"], err = s.backend.CollectLuckCharts(s.config.LuckWindow[0])
+	if luckWindow := s.getLuckWindow(); len(luckWindow) > 0 {
+		stats["luck"], err = s.backend.CollectLuckStats(luckWindow)
+		stats["luckCharts"], err = s.backend.CollectLuckCharts(luckWindow[0])
 		if err != nil {
 			log.Printf("Failed to fetch luck stats from backend: %v", err)
 			return
@@ -339,6 +461,9 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		reply["exchangedata"] = stats["exchangedata"]
 		reply["netCharts"] = stats["netCharts"]
 		reply["workersTotal"] = stats["workersTotal"]
+		reply["soloHashrate"] = stats["soloHashrate"]
+		reply["soloMinersTotal"] = stats["soloMinersTotal"]
+		reply["soloStats"] = stats["soloStats"]
 	}
 
 	err = json.NewEncoder(w).Encode(reply)
@@ -360,6 +485,9 @@ func (s *ApiServer) MinersIndex(w http.ResponseWriter, r *http.Request) {
 		reply["miners"] = stats["miners"]
 		reply["hashrate"] = stats["hashrate"]
 		reply["minersTotal"] = stats["minersTotal"]
+		reply["soloMiners"] = stats["soloMiners"]
+		reply["soloHashrate"] = stats["soloHashrate"]
+		reply["soloMinersTotal"] = stats["soloMinersTotal"]
 	}
 
 	err := json.NewEncoder(w).Encode(reply)
@@ -446,7 +574,8 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Failed to fetch stats from backend: %v", err)
 			return
 		}
-		workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+		hashrateWindow, hashrateLargeWindow := s.windows()
+		workers, err := s.backend.CollectWorkersStats(hashrateWindow, hashrateLargeWindow, login)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("Failed to fetch stats from backend: %v", err)
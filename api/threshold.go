@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type ThresholdConfig struct {
+	Enabled bool `json:"enabled"`
+	// Bounds of threshold miners may choose, in Shannon
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+	// Signed requests older than this are rejected
+	MaxAge string `json:"maxAge"`
+}
+
+// Message miner signs with personal_sign to change payout threshold, names the coin so it can't be replayed on another one
+func ThresholdMessage(coin, login string, threshold, timestamp int64) string {
+	return fmt.Sprintf("Set %s payout threshold of %s to %d Shannon at %d", coin, login, threshold, timestamp)
+}
+
+func (s *ApiServer) ThresholdIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	cfg := s.config.PayoutThreshold
+	if !cfg.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	login := strings.ToLower(mux.Vars(r)["login"])
+
+	var req struct {
+		// In Shannon
+		Threshold int64 `json:"threshold"`
+		// Unix time in seconds the message was signed at
+		Timestamp int64  `json:"timestamp"`
+		Signature string `json:"signature"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	if err != nil {
+		writeThresholdError(w, http.StatusBadRequest, "Malformed request")
+		return
+	}
+	if req.Threshold < cfg.Min || req.Threshold > cfg.Max {
+		writeThresholdError(w, http.StatusBadRequest, fmt.Sprintf("Threshold must be between %v and %v Shannon", cfg.Min, cfg.Max))
+		return
+	}
+	maxAge := int64(util.MustParseDuration(cfg.MaxAge) / time.Second)
+	now := util.MakeTimestamp() / 1000
+	if req.Timestamp < now-maxAge || req.Timestamp > now+maxAge {
+		writeThresholdError(w, http.StatusBadRequest, "Signature expired, check your clock and sign again")
+		return
+	}
+
+	signer, err := util.RecoverPersonalSign(ThresholdMessage(s.coin, login, req.Threshold, req.Timestamp), req.Signature)
+	if err != nil || signer != login {
+		writeThresholdError(w, http.StatusForbidden, "Signature doesn't match account")
+		return
+	}
+
+	exist, err := s.backend.IsMinerExists(login)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch stats from backend: %v", err)
+		return
+	}
+	if !exist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Signed message can only be used once
+	ok, err := s.backend.SetTreshold(login, req.Threshold, req.Timestamp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to set threshold of %v: %v", login, err)
+		return
+	}
+	if !ok {
+		writeThresholdError(w, http.StatusConflict, "Threshold was changed after this message was signed")
+		return
+	}
+	log.Printf("Payout threshold of %v set to %v Shannon", login, req.Threshold)
+
+	// Account page shows new threshold immediately
+	s.minersMu.Lock()
+	delete(s.miners, login)
+	s.minersMu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"threshold": req.Threshold, "timestamp": req.Timestamp})
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func writeThresholdError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Keeps threshold history of existing miners, other backend methods are not used
+type thresholdBackend struct {
+	storage.Backend
+	miners  map[string]bool
+	history map[string][]*storage.ThresholdChange
+}
+
+func (b *thresholdBackend) IsMinerExists(login string) (bool, error) {
+	return b.miners[login], nil
+}
+
+func (b *thresholdBackend) SetTreshold(login string, threshold, ts int64) (bool, error) {
+	if last := b.history[login]; len(last) > 0 && last[0].Timestamp >= ts {
+		return false, nil
+	}
+	b.history[login] = append([]*storage.ThresholdChange{{Timestamp: ts, Threshold: threshold}}, b.history[login]...)
+	return true, nil
+}
+
+func newThresholdServer(logins ...string) (*ApiServer, *thresholdBackend) {
+	backend := &thresholdBackend{miners: make(map[string]bool), history: make(map[string][]*storage.ThresholdChange)}
+	for _, login := range logins {
+		backend.miners[login] = true
+	}
+	cfg := &ApiConfig{PayoutThreshold: ThresholdConfig{Enabled: true, Min: 100000000, Max: 10000000000, MaxAge: "10m"}}
+	return &ApiServer{config: cfg, coin: "etc", backend: backend, miners: make(map[string]*Entry)}, backend
+}
+
+// Signature of threshold message by key with 27/28 recovery id, as wallets make it
+func signThreshold(t *testing.T, key *ecdsa.PrivateKey, coin, login string, threshold, timestamp int64) string {
+	message := ThresholdMessage(coin, login, threshold, timestamp)
+	hash := crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(message))), []byte(message))
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return hexutil.Encode(sig)
+}
+
+func postThreshold(s *ApiServer, login string, threshold, timestamp int64, signature string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]interface{}{"threshold": threshold, "timestamp": timestamp, "signature": signature})
+	r := httptest.NewRequest("POST", "/api/accounts/"+login+"/threshold", bytes.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"login": login})
+	w := httptest.NewRecorder()
+	s.ThresholdIndex(w, r)
+	return w
+}
+
+func TestThresholdIndex(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	login := strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+	now := util.MakeTimestamp() / 1000
+
+	tests := []struct {
+		name      string
+		threshold int64
+		timestamp int64
+		key       *ecdsa.PrivateKey
+		coin      string
+		status    int
+	}{
+		{"below min", 10000000, now, key, "etc", http.StatusBadRequest},
+		{"above max", 20000000000, now, key, "etc", http.StatusBadRequest},
+		{"stale", 500000000, now - 601, key, "etc", http.StatusBadRequest},
+		{"future", 500000000, now + 601, key, "etc", http.StatusBadRequest},
+		{"wrong signer", 500000000, now, other, "etc", http.StatusForbidden},
+		{"signed for other coin", 500000000, now - 30, key, "ubq", http.StatusForbidden},
+		{"at min", 100000000, now - 10, key, "etc", http.StatusOK},
+		{"replay", 100000000, now - 10, key, "etc", http.StatusConflict},
+		{"older than last change", 200000000, now - 20, key, "etc", http.StatusConflict},
+		{"at max", 10000000000, now, key, "etc", http.StatusOK},
+	}
+	s, backend := newThresholdServer(login)
+	for _, tt := range tests {
+		w := postThreshold(s, login, tt.threshold, tt.timestamp, signThreshold(t, tt.key, tt.coin, login, tt.threshold, tt.timestamp))
+		if w.Code != tt.status {
+			t.Errorf("%v: expected status %v, got %v %s", tt.name, tt.status, w.Code, w.Body)
+		}
+	}
+	history := backend.history[login]
+	if len(history) != 2 || history[0].Threshold != 10000000000 || history[1].Threshold != 100000000 {
+		t.Errorf("Expected two threshold changes, got %v", history)
+	}
+}
+
+func TestThresholdIndexRecoveryID(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	login := strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+	now := util.MakeTimestamp() / 1000
+	s, _ := newThresholdServer(login)
+
+	// Some wallets sign with 0/1 recovery id
+	sig, _ := hexutil.Decode(signThreshold(t, key, "etc", login, 500000000, now))
+	sig[crypto.RecoveryIDOffset] -= 27
+	if w := postThreshold(s, login, 500000000, now, hexutil.Encode(sig)); w.Code != http.StatusOK {
+		t.Errorf("Expected signature with 0/1 recovery id to be accepted, got %v %s", w.Code, w.Body)
+	}
+}
+
+func TestThresholdIndexUnknownMiner(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	login := strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+	now := util.MakeTimestamp() / 1000
+	s, _ := newThresholdServer()
+
+	if w := postThreshold(s, login, 500000000, now, signThreshold(t, key, "etc", login, 500000000, now)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown miner to be refused, got %v", w.Code)
+	}
+	s.config.PayoutThreshold.Enabled = false
+	if w := postThreshold(s, login, 500000000, now, signThreshold(t, key, "etc", login, 500000000, now)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected disabled threshold change to be refused, got %v", w.Code)
+	}
+}
@@ -0,0 +1,230 @@
+//go:build go1.9
+// +build go1.9
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/yuriy0803/open-etc-pool-friends/api"
+	"github.com/yuriy0803/open-etc-pool-friends/exchange"
+	"github.com/yuriy0803/open-etc-pool-friends/ledger"
+	"github.com/yuriy0803/open-etc-pool-friends/payouts"
+	"github.com/yuriy0803/open-etc-pool-friends/proxy"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Modules of one coin, each coin has its own Redis prefix, stratum ports, upstreams, unlocker and payouts
+type coinPool struct {
+	cfg     proxy.Config
+	backend *storage.RedisClient
+	scheme  payouts.RewardScheme
+
+	// Config in effect, live fields are updated on every reload
+	running proxy.Config
+
+	// Modules enabled for this coin
+	proxyServer   *proxy.ProxyServer
+	apiServer     *api.ApiServer
+	unlocker      *payouts.BlockUnlocker
+	payer         *payouts.PayoutsProcessor
+	reconciler    *payouts.Reconciler
+	ledgerChecker *payouts.LedgerChecker
+	ledgerDB      *ledger.Ledger
+}
+
+func newCoinPool(cfg *proxy.Config) *coinPool {
+	p := &coinPool{cfg: *cfg, running: *cfg}
+	p.backend = storage.NewRedisClient(&p.cfg.Redis, p.cfg.Coin, p.cfg.Pplns, p.cfg.CoinName)
+	p.scheme = payouts.NewRewardScheme(&p.cfg.RewardScheme, &p.cfg.BlockUnlocker, p.cfg.Network)
+	p.backend.SetShareWindow(p.scheme.ShareWindow())
+
+	pong, err := p.backend.Check()
+	if err != nil {
+		log.Printf("Can't establish connection to %v backend: %v", p.cfg.Coin, err)
+	} else {
+		log.Printf("Backend check reply of %v: %v", p.cfg.Coin, pong)
+	}
+	return p
+}
+
+// Starts enabled modules except API, it is started by main once routes of all coins are mounted
+func (p *coinPool) start() {
+	if p.cfg.Ledger.Enabled {
+		// Before any module, so no balance change misses the ledger
+		p.ledgerDB = p.startLedger()
+		if len(p.cfg.Ledger.CheckInterval) > 0 {
+			p.ledgerChecker = p.startLedgerChecker()
+		}
+	}
+
+	if p.cfg.Proxy.Enabled {
+		p.proxyServer = p.startProxy()
+	}
+	if p.cfg.Api.Enabled {
+		p.apiServer = api.NewApiServer(&p.cfg.Api, p.backend, p.cfg.Coin)
+		p.apiServer.SetReloader(reloadConfig)
+		p.apiServer.SetBlacklistFile(p.cfg.Proxy.Policy.Walletblacklist)
+	}
+	if p.cfg.BlockUnlocker.Enabled {
+		p.unlocker = p.startBlockUnlocker()
+	}
+	if p.cfg.Payouts.Enabled {
+		p.payer = p.startPayoutsProcessor()
+	}
+	if p.cfg.Payouts.Reconcile.Enabled {
+		p.reconciler = p.startReconciler()
+	}
+	if p.cfg.Exchange.Enabled {
+		go p.startExchangeProcessor()
+	}
+}
+
+// Stops modules but proxy and payouts, miners of all coins are stopped first
+func (p *coinPool) stop(ctx context.Context) {
+	if p.unlocker != nil {
+		p.unlocker.Stop()
+	}
+	if p.reconciler != nil {
+		p.reconciler.Stop()
+	}
+	if p.ledgerChecker != nil {
+		p.ledgerChecker.Stop()
+	}
+	if p.apiServer != nil {
+		p.apiServer.Stop(ctx)
+	}
+	if p.ledgerDB != nil {
+		p.ledgerDB.Close()
+	}
+}
+
+func (p *coinPool) startProxy() *proxy.ProxyServer {
+	s := proxy.NewProxy(&p.cfg, p.backend, p.scheme)
+	go s.Start()
+	return s
+}
+
+func (p *coinPool) startBlockUnlocker() *payouts.BlockUnlocker {
+	u := payouts.NewBlockUnlocker(&p.cfg.BlockUnlocker, p.backend, p.cfg.Network, p.scheme, p.cfg.Coin)
+	go u.Start()
+	return u
+}
+
+func (p *coinPool) startPayoutsProcessor() *payouts.PayoutsProcessor {
+	u := payouts.NewPayoutsProcessor(&p.cfg.Payouts, p.backend, p.cfg.Coin)
+	go u.Start()
+	return u
+}
+
+func (p *coinPool) startReconciler() *payouts.Reconciler {
+	r := payouts.NewReconciler(&p.cfg.Payouts, p.backend, p.cfg.Coin)
+	go r.Start()
+	return r
+}
+
+func (p *coinPool) startLedger() *ledger.Ledger {
+	l, err := ledger.New(&p.cfg.Ledger)
+	if err != nil {
+		log.Fatalf("Can't open %v ledger: %v", p.cfg.Coin, err)
+	}
+	if err := p.backend.SetLedger(l); err != nil {
+		log.Fatalf("Can't start %v ledger: %v", p.cfg.Coin, err)
+	}
+	log.Printf("Recording %v balance changes in %v ledger", p.cfg.Coin, p.cfg.Ledger.Driver)
+	return l
+}
+
+func (p *coinPool) startLedgerChecker() *payouts.LedgerChecker {
+	c := payouts.NewLedgerChecker(util.MustParseDuration(p.cfg.Ledger.CheckInterval), p.backend, p.cfg.Coin)
+	go c.Start()
+	return c
+}
+
+func (p *coinPool) startExchangeProcessor() {
+	u := exchange.StartExchangeProcessor(&p.cfg.Exchange, p.backend)
+	u.Start()
+}
+
+// Config of every coin served, file config itself if it has no coins.
+// Each coin entry is merged into file config, so it only sets fields that differ.
+func loadCoinConfigs(fileName string, cfg *proxy.Config) ([]proxy.Config, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("File error: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("Config error: %v", err)
+	}
+	if len(cfg.Coins) == 0 {
+		return []proxy.Config{*cfg}, nil
+	}
+
+	coins := make([]proxy.Config, 0, len(cfg.Coins))
+	seen := make(map[string]bool)
+	ledgers := make(map[string]string)
+	ports := make(map[string]string)
+	for i, raw := range cfg.Coins {
+		var coin proxy.Config
+		if err := json.Unmarshal(mergeJSON(data, raw), &coin); err != nil {
+			return nil, fmt.Errorf("Config error in coin %d: %v", i, err)
+		}
+		coin.Coins = nil
+		if len(coin.Coin) == 0 || seen[coin.Coin] {
+			return nil, fmt.Errorf("Coin %d must have a unique coin name, got %q", i, coin.Coin)
+		}
+		seen[coin.Coin] = true
+		for _, addr := range listenAddrs(&coin) {
+			port := addr
+			if _, p, err := net.SplitHostPort(addr); err == nil {
+				port = p
+			}
+			if other, ok := ports[port]; ok {
+				return nil, fmt.Errorf("Coins %v and %v can't both listen on port %v", other, coin.Coin, port)
+			}
+			ports[port] = coin.Coin
+		}
+		if coin.Ledger.Enabled {
+			key := coin.Ledger.Driver + " " + coin.Ledger.DSN
+			if other, ok := ledgers[key]; ok {
+				return nil, fmt.Errorf("Coins %v and %v can't share a ledger", other, coin.Coin)
+			}
+			ledgers[key] = coin.Coin
+		}
+		coins = append(coins, coin)
+	}
+	return coins, nil
+}
+
+// Addresses proxy of a coin binds, inherited from file config unless the coin sets its own
+func listenAddrs(c *proxy.Config) []string {
+	if !c.Proxy.Enabled {
+		return nil
+	}
+	addrs := []string{c.Proxy.Listen}
+	for _, v := range c.Proxy.Stratum {
+		if v.Enabled {
+			addrs = append(addrs, v.Listen)
+		}
+	}
+	return addrs
+}
+
+// Sets fields of over on base, objects are merged key by key and other values replaced
+func mergeJSON(base, over json.RawMessage) json.RawMessage {
+	var a, b map[string]json.RawMessage
+	if json.Unmarshal(base, &a) != nil || json.Unmarshal(over, &b) != nil || a == nil || b == nil {
+		return over
+	}
+	for k, v := range b {
+		a[k] = mergeJSON(a[k], v)
+	}
+	merged, _ := json.Marshal(a)
+	return merged
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yuriy0803/open-etc-pool-friends/proxy"
+)
+
+func TestMergeJSON(t *testing.T) {
+	tests := []struct {
+		base, over, merged string
+	}{
+		{`{"a":1,"b":{"c":2,"d":3}}`, `{"b":{"d":4},"e":5}`, `{"a":1,"b":{"c":2,"d":4},"e":5}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`{"a":{"b":1}}`, `{"a":null}`, `{"a":null}`},
+		{`{"a":1}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+		{`[1]`, `{"a":1}`, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		merged := mergeJSON(json.RawMessage(tt.base), json.RawMessage(tt.over))
+		var got, expected interface{}
+		json.Unmarshal(merged, &got)
+		json.Unmarshal([]byte(tt.merged), &expected)
+		if b1, b2 := mustMarshal(got), mustMarshal(expected); b1 != b2 {
+			t.Errorf("Merging %v into %v: expected %v, got %v", tt.over, tt.base, b2, b1)
+		}
+	}
+}
+
+func mustMarshal(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+const testBaseConfig = `"name": "main", "upstream": [{"name": "main", "url": "http://127.0.0.1:8545", "timeout": "10s"}],
+	"proxy": {"enabled": true, "listen": "0.0.0.0:8888", "stratum": [{"enabled": true, "listen": "0.0.0.0:8008"}, {"listen": "0.0.0.0:8009"}]}`
+
+func loadTestCoins(t *testing.T, coins string) ([]proxy.Config, error) {
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	data := "{" + testBaseConfig
+	if len(coins) > 0 {
+		data += `, "coins": [` + coins + `]`
+	}
+	if err := os.WriteFile(fileName, []byte(data+"}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var cfg proxy.Config
+	return loadCoinConfigs(fileName, &cfg)
+}
+
+func TestLoadCoinConfigs(t *testing.T) {
+	coins, err := loadTestCoins(t, "")
+	if err != nil || len(coins) != 1 || coins[0].Proxy.Listen != "0.0.0.0:8888" {
+		t.Fatalf("Expected file config as single coin, got %v %v", coins, err)
+	}
+
+	coins, err = loadTestCoins(t, `{"coin": "etc"},
+		{"coin": "eth", "proxy": {"listen": "0.0.0.0:8889", "stratum": [{"enabled": true, "listen": "0.0.0.0:8009"}]},
+		"upstream": [{"name": "main", "url": "http://127.0.0.1:8555", "timeout": "10s"}]}`)
+	if err != nil || len(coins) != 2 {
+		t.Fatalf("Expected two coins, got %v", err)
+	}
+	etc, eth := coins[0], coins[1]
+	if etc.Coin != "etc" || etc.Proxy.Listen != "0.0.0.0:8888" || len(etc.Proxy.Stratum) != 2 || etc.Coins != nil {
+		t.Errorf("Expected etc to inherit file config, got %+v", etc.Proxy)
+	}
+	if eth.Name != "main" || !eth.Proxy.Enabled || eth.Proxy.Listen != "0.0.0.0:8889" || len(eth.Proxy.Stratum) != 1 || eth.Upstream[0].Url != "http://127.0.0.1:8555" {
+		t.Errorf("Expected eth to override proxy ports and upstreams, got %+v %+v", eth.Proxy, eth.Upstream)
+	}
+}
+
+func TestLoadCoinConfigsRefused(t *testing.T) {
+	tests := []struct {
+		name, coins, err string
+	}{
+		{"no name", `{"coin": "etc"}, {"network": "ethereum"}`, "unique coin name"},
+		{"same name", `{"coin": "etc"}, {"coin": "etc", "proxy": {"enabled": false}}`, "unique coin name"},
+		{"inherited ports", `{"coin": "etc"}, {"coin": "eth"}`, "port 8888"},
+		{"inherited stratum port", `{"coin": "etc"}, {"coin": "eth", "proxy": {"listen": "0.0.0.0:8889"}}`, "port 8008"},
+		{"stratum port", `{"coin": "etc"}, {"coin": "eth", "proxy": {"listen": "0.0.0.0:8889", "stratum": [{"enabled": true, "listen": "127.0.0.1:8888"}]}}`, "port 8888"},
+		{"shared ledger", `{"coin": "etc", "ledger": {"enabled": true, "driver": "sqlite3", "dsn": "ledger.db"}},
+			{"coin": "eth", "proxy": {"enabled": false}, "ledger": {"enabled": true, "driver": "sqlite3", "dsn": "ledger.db"}}`, "share a ledger"},
+	}
+	for _, tt := range tests {
+		if _, err := loadTestCoins(t, tt.coins); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: expected error with %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	// Disabled proxy binds nothing, disabled stratum port neither
+	if _, err := loadTestCoins(t, `{"coin": "etc"}, {"coin": "eth", "proxy": {"enabled": false}}`); err != nil {
+		t.Errorf("Expected coin without proxy to be accepted, got %v", err)
+	}
+	if _, err := loadTestCoins(t, `{"coin": "etc"}, {"coin": "eth", "proxy": {"listen": "0.0.0.0:8889", "stratum": [{"enabled": true, "listen": "0.0.0.0:8010"}, {"listen": "0.0.0.0:8008"}]}}`); err != nil {
+		t.Errorf("Expected disabled stratum port to be ignored, got %v", err)
+	}
+}
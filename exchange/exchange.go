@@ -14,7 +14,7 @@ import (
 
 type ExchangeProcessor struct {
 	ExchangeConfig *ExchangeConfig
-	backend        *storage.RedisClient
+	backend        storage.StatsBackend
 	rpc            *RestClient
 	halt           bool
 }
@@ -75,7 +75,7 @@ func (r *RestClient) GetData() (ExchangeReply, error) {
 	return nil, err
 }
 
-func StartExchangeProcessor(cfg *ExchangeConfig, backend *storage.RedisClient) *ExchangeProcessor {
+func StartExchangeProcessor(cfg *ExchangeConfig, backend storage.StatsBackend) *ExchangeProcessor {
 	u := &ExchangeProcessor{ExchangeConfig: cfg, backend: backend}
 	u.rpc = NewRestClient("ExchangeProcessor", cfg.Url, cfg.Timeout)
 	return u
@@ -0,0 +1,242 @@
+// Package ledger keeps an append-only double-entry record of all balance
+// changes in SQL, next to the counters in Redis.
+package ledger
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// "postgres" or "sqlite3"
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+	// Compare ledger with Redis counters, disabled if empty
+	CheckInterval string `json:"checkInterval"`
+}
+
+// Accounts, suffixed by miner's login. Sum of each account mirrors Redis counter of miner.
+const (
+	AccountBalance = "balance"
+	AccountPending = "pending"
+	AccountPaid    = "paid"
+)
+
+// Counter accounts of pool, money enters miners' accounts from them
+const (
+	PoolRewards      = "pool:rewards"
+	PoolShareRewards = "pool:shareRewards"
+	PoolAdjustments  = "pool:adjustments"
+	PoolOpening      = "pool:opening"
+)
+
+// Kinds of transactions
+const (
+	KindReward      = "reward"
+	KindShareReward = "shareReward"
+	KindDebit       = "debit"
+	KindRollback    = "rollback"
+	KindPayment     = "payment"
+	KindRevert      = "revert"
+	KindAdjust      = "adjust"
+	// Recorded once when ledger is started on existing Redis data
+	KindOpening = "opening"
+)
+
+type Posting struct {
+	Account string
+	Amount  int64
+}
+
+func Account(kind, login string) string {
+	return kind + ":" + login
+}
+
+type Ledger struct {
+	db     *sql.DB
+	driver string
+}
+
+func New(cfg *Config) (*Ledger, error) {
+	if cfg.Driver != "postgres" && cfg.Driver != "sqlite3" {
+		return nil, fmt.Errorf("Unsupported ledger driver %q", cfg.Driver)
+	}
+	if !builtIn(cfg.Driver) {
+		return nil, fmt.Errorf("Ledger driver %q is not built in, check build tags and cgo", cfg.Driver)
+	}
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Driver == "sqlite3" {
+		// Single writer, concurrent writes would fail with database is locked
+		db.SetMaxOpenConns(1)
+	}
+	l := &Ledger{db: db, driver: cfg.Driver}
+	if err := l.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to create ledger schema: %v", err)
+	}
+	return l, nil
+}
+
+// Drivers are registered by files built with their tags
+func builtIn(driver string) bool {
+	for _, v := range sql.Drivers() {
+		if v == driver {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+func (l *Ledger) migrate() error {
+	id := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if l.driver == "postgres" {
+		id = "BIGSERIAL PRIMARY KEY"
+	}
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ledger_transactions (
+			id ` + id + `,
+			kind TEXT NOT NULL,
+			reference TEXT NOT NULL,
+			created_at BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS ledger_entries (
+			id ` + id + `,
+			tx_id BIGINT NOT NULL REFERENCES ledger_transactions (id),
+			account TEXT NOT NULL,
+			amount BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ledger_entries_account ON ledger_entries (account)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS ledger_transactions_opening ON ledger_transactions (kind) WHERE kind = 'opening'`,
+	}
+	if l.driver == "postgres" {
+		stmts = append(stmts, `CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'ledger is append-only';
+			END;
+			$$ LANGUAGE plpgsql`)
+	}
+	for _, table := range []string{"ledger_transactions", "ledger_entries"} {
+		if l.driver == "postgres" {
+			stmts = append(stmts,
+				`DROP TRIGGER IF EXISTS `+table+`_append_only ON `+table,
+				`CREATE TRIGGER `+table+`_append_only BEFORE UPDATE OR DELETE ON `+table+`
+				FOR EACH ROW EXECUTE PROCEDURE ledger_append_only()`,
+			)
+		} else {
+			for _, op := range []string{"update", "delete"} {
+				stmts = append(stmts, `CREATE TRIGGER IF NOT EXISTS `+table+`_no_`+op+` BEFORE `+strings.ToUpper(op)+` ON `+table+`
+				BEGIN
+					SELECT RAISE(ABORT, 'ledger is append-only');
+				END`)
+			}
+		}
+	}
+	for _, stmt := range stmts {
+		if _, err := l.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Positional parameters are $n in PostgreSQL
+func (l *Ledger) rebind(query string) string {
+	if l.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// Writes transaction without committing it, so caller commits it together with Redis.
+// Postings must balance to zero.
+func (l *Ledger) Begin(kind, reference string, postings []Posting) (*sql.Tx, error) {
+	sum := int64(0)
+	for _, v := range postings {
+		sum += v.Amount
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("Unbalanced %v transaction %v, sum of postings is %v", kind, reference, sum)
+	}
+	tx, err := l.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	err = tx.QueryRow(l.rebind("INSERT INTO ledger_transactions (kind, reference, created_at) VALUES (?, ?, ?) RETURNING id"),
+		kind, reference, time.Now().Unix()).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	stmt, err := tx.Prepare(l.rebind("INSERT INTO ledger_entries (tx_id, account, amount) VALUES (?, ?, ?)"))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer stmt.Close()
+	for _, v := range postings {
+		if v.Amount == 0 {
+			continue
+		}
+		if _, err := stmt.Exec(id, v.Account, v.Amount); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+func (l *Ledger) Record(kind, reference string, postings []Posting) error {
+	tx, err := l.Begin(kind, reference, postings)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (l *Ledger) HasOpening() (bool, error) {
+	var n int64
+	err := l.db.QueryRow(l.rebind("SELECT COUNT(*) FROM ledger_transactions WHERE kind = ?"), KindOpening).Scan(&n)
+	return n > 0, err
+}
+
+// Sum of every account
+func (l *Ledger) Balances() (map[string]int64, error) {
+	rows, err := l.db.Query("SELECT account, SUM(amount) FROM ledger_entries GROUP BY account")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]int64)
+	for rows.Next() {
+		var account string
+		var sum int64
+		if err := rows.Scan(&account, &sum); err != nil {
+			return nil, err
+		}
+		result[account] = sum
+	}
+	return result, rows.Err()
+}
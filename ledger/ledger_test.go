@@ -0,0 +1,118 @@
+package ledger
+
+import (
+	"testing"
+)
+
+func newTestLedger(t *testing.T) *Ledger {
+	if !builtIn("sqlite3") {
+		t.Skip("SQLite driver is not built in")
+	}
+	l, err := New(&Config{Driver: "sqlite3", DSN: ":memory:"})
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestRecordAndBalances(t *testing.T) {
+	l := newTestLedger(t)
+	login := "0xabc"
+
+	err := l.Record(KindReward, "0xblock", []Posting{
+		{Account: Account(AccountBalance, login), Amount: 1000},
+		{Account: PoolRewards, Amount: -1000},
+	})
+	if err != nil {
+		t.Fatalf("Failed to record reward: %v", err)
+	}
+	err = l.Record(KindDebit, login, []Posting{
+		{Account: Account(AccountBalance, login), Amount: -600},
+		{Account: Account(AccountPending, login), Amount: 600},
+	})
+	if err != nil {
+		t.Fatalf("Failed to record debit: %v", err)
+	}
+
+	balances, err := l.Balances()
+	if err != nil {
+		t.Fatalf("Failed to get balances: %v", err)
+	}
+	expected := map[string]int64{
+		Account(AccountBalance, login): 400,
+		Account(AccountPending, login): 600,
+		PoolRewards:                    -1000,
+	}
+	for account, amount := range expected {
+		if balances[account] != amount {
+			t.Errorf("Expected %v of %v, got %v", amount, account, balances[account])
+		}
+	}
+}
+
+func TestUnbalancedTransaction(t *testing.T) {
+	l := newTestLedger(t)
+
+	err := l.Record(KindAdjust, "0xabc", []Posting{{Account: Account(AccountBalance, "0xabc"), Amount: 5}})
+	if err == nil {
+		t.Fatal("Expected unbalanced transaction to fail")
+	}
+}
+
+func TestRollbackLeavesNoEntries(t *testing.T) {
+	l := newTestLedger(t)
+
+	tx, err := l.Begin(KindPayment, "0xtx", []Posting{
+		{Account: Account(AccountPending, "0xabc"), Amount: -10},
+		{Account: Account(AccountPaid, "0xabc"), Amount: 10},
+	})
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	tx.Rollback()
+
+	balances, err := l.Balances()
+	if err != nil {
+		t.Fatalf("Failed to get balances: %v", err)
+	}
+	if len(balances) != 0 {
+		t.Errorf("Expected empty ledger, got %v", balances)
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	l := newTestLedger(t)
+
+	err := l.Record(KindOpening, "redis", []Posting{
+		{Account: Account(AccountBalance, "0xabc"), Amount: 7},
+		{Account: PoolOpening, Amount: -7},
+	})
+	if err != nil {
+		t.Fatalf("Failed to record opening: %v", err)
+	}
+	if _, err := l.db.Exec("UPDATE ledger_entries SET amount = 0"); err == nil {
+		t.Error("Expected update of ledger entries to fail")
+	}
+	if _, err := l.db.Exec("DELETE FROM ledger_transactions"); err == nil {
+		t.Error("Expected delete of ledger transactions to fail")
+	}
+
+	ok, err := l.HasOpening()
+	if err != nil || !ok {
+		t.Errorf("Expected opening to be recorded, got %v, %v", ok, err)
+	}
+	err = l.Record(KindOpening, "redis", []Posting{})
+	if err == nil {
+		t.Error("Expected second opening to fail")
+	}
+}
+
+func TestDriverNotBuiltIn(t *testing.T) {
+	if builtIn("sqlite3") {
+		t.Skip("SQLite driver is built in")
+	}
+	if _, err := New(&Config{Driver: "sqlite3", DSN: ":memory:"}); err == nil {
+		t.Error("Expected ledger on driver left out of build to be refused")
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !nopostgres
+
+package ledger
+
+// Pure Go driver, nopostgres tag leaves it out
+import _ "github.com/lib/pq"
@@ -0,0 +1,6 @@
+//go:build cgo && !nosqlite
+
+package ledger
+
+// SQLite driver needs cgo, builds without cgo or with nosqlite tag have no sqlite3 ledger
+import _ "github.com/mattn/go-sqlite3"
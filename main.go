@@ -4,49 +4,46 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/yvasiyarov/gorelic"
 
 	"github.com/yuriy0803/open-etc-pool-friends/api"
-	"github.com/yuriy0803/open-etc-pool-friends/exchange"
-	"github.com/yuriy0803/open-etc-pool-friends/payouts"
+	"github.com/yuriy0803/open-etc-pool-friends/metrics"
 	"github.com/yuriy0803/open-etc-pool-friends/proxy"
 	"github.com/yuriy0803/open-etc-pool-friends/storage"
 )
 
-var cfg proxy.Config
-var backend *storage.RedisClient
-
-func startProxy() {
-	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
-}
+// Time given to modules to finish their work on shutdown
+const shutdownTimeout = 30 * time.Second
 
-func startApi() {
-	s := api.NewApiServer(&cfg.Api, backend)
-	s.Start()
-}
+// File config, process wide settings are taken from it
+var cfg proxy.Config
+var configFileName string
 
-func startBlockUnlocker() {
-	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend, cfg.Network)
-	u.Start()
-}
+// Coins served by this process, one if config has no coins
+var pools []*coinPool
 
-func startPayoutsProcessor() {
-	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-	u.Start()
-}
+// API of all coins in multi-coin mode
+var coinsApi *http.Server
 
-func startExchangeProcessor() {
-	u := exchange.StartExchangeProcessor(&cfg.Exchange, backend)
-	u.Start()
+// Copies keys of configured single instance or sentinel into cluster layout
+func migrateCluster(cfg *proxy.Config) {
+	log.Printf("Migrating %v keys from %v into cluster %v", cfg.Coin, cfg.Redis.Endpoint, cfg.Redis.ClusterAddrs)
+	n, err := storage.MigrateToCluster(&cfg.Redis, cfg.Coin)
+	if err != nil {
+		log.Fatalf("Migration failed after %v keys: %v", n, err)
+	}
+	log.Printf("Migrated %v keys, set clusterEnabled to use them", n)
 }
 
 func startNewrelic() {
@@ -59,27 +56,43 @@ func startNewrelic() {
 	}
 }
 
-func readConfig(cfg *proxy.Config) {
-	configFileName := "config.json"
+func readConfig(cfg *proxy.Config) []proxy.Config {
+	configFileName = "config.json"
 	if len(os.Args) > 1 {
 		configFileName = os.Args[1]
 	}
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
 
-	configFile, err := os.Open(configFileName)
+	coins, err := loadCoinConfigs(configFileName, cfg)
 	if err != nil {
-		log.Fatal("File error: ", err.Error())
+		log.Fatal(err)
+	}
+	return coins
+}
+
+// Mounts API of every coin under /api/{coin} on api.listen of file config
+func startCoinsApi() {
+	servers := make(map[string]*api.ApiServer)
+	for _, p := range pools {
+		if p.apiServer != nil {
+			servers[p.cfg.Coin] = p.apiServer
+		}
 	}
-	defer configFile.Close()
-	jsonParser := json.NewDecoder(configFile)
-	if err := jsonParser.Decode(&cfg); err != nil {
-		log.Fatal("Config error: ", err.Error())
+	if len(servers) == 0 {
+		return
 	}
+	coinsApi = api.NewCoinsServer(cfg.Api.Listen, servers)
+	go func() {
+		log.Printf("Starting API of %v coins on %v", len(servers), cfg.Api.Listen)
+		if err := coinsApi.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start API: %v", err)
+		}
+	}()
 }
 
 func main() {
-	readConfig(&cfg)
+	coins := readConfig(&cfg)
 	rand.Seed(time.Now().UnixNano())
 
 	if cfg.Threads > 0 {
@@ -87,31 +100,107 @@ func main() {
 		log.Printf("Running with %v threads", cfg.Threads)
 	}
 
+	if len(os.Args) > 2 && os.Args[2] == "migrate-cluster" {
+		for i := range coins {
+			migrateCluster(&coins[i])
+		}
+		return
+	}
+
 	startNewrelic()
 
-	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin, cfg.Pplns, cfg.CoinName)
-	pong, err := backend.Check()
-	if err != nil {
-		log.Printf("Can't establish connection to backend: %v", err)
-	} else {
-		log.Printf("Backend check reply: %v", pong)
+	for i := range coins {
+		p := newCoinPool(&coins[i])
+		p.start()
+		pools = append(pools, p)
 	}
+	if len(cfg.Coins) > 0 {
+		startCoinsApi()
+	}
+	for _, p := range pools {
+		if p.apiServer != nil {
+			go p.apiServer.Start()
+		}
+	}
+	if cfg.Metrics.Enabled {
+		go metrics.Start(&cfg.Metrics)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := waitSignal(sigc, func() { reloadConfig() })
+	signal.Ignore(syscall.SIGHUP)
+	log.Printf("Received %v, shutting down, send it again to exit once payments in flight are written", sig)
 
-	if cfg.Proxy.Enabled {
-		go startProxy()
+	if !shutdown(sigc, shutdownTimeout, stopModules, stopPayouts) {
+		os.Exit(1)
 	}
-	if cfg.Api.Enabled {
-		go startApi()
+}
+
+// Blocks until SIGINT or SIGTERM, config is reloaded on every SIGHUP
+func waitSignal(sigc <-chan os.Signal, reload func()) os.Signal {
+	sig := <-sigc
+	for ; sig == syscall.SIGHUP; sig = <-sigc {
+		reload()
 	}
-	if cfg.BlockUnlocker.Enabled {
-		go startBlockUnlocker()
+	return sig
+}
+
+// Stops all modules, false if they didn't stop within timeout or on another signal.
+// Payouts are never cut off, a payment in flight is written before returning.
+func shutdown(sigc <-chan os.Signal, timeout time.Duration, stopModules func(ctx context.Context), stopPayouts func()) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	payoutsDone := make(chan struct{})
+	go func() {
+		stopPayouts()
+		close(payoutsDone)
+	}()
+	done := make(chan struct{})
+	go func() {
+		stopModules(ctx)
+		<-payoutsDone
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("Shutdown complete")
+		return true
+	case <-ctx.Done():
+		log.Println("Shutdown timed out")
+	case sig := <-sigc:
+		log.Printf("Received %v, exiting", sig)
 	}
-	if cfg.Payouts.Enabled {
-		go startPayoutsProcessor()
+	select {
+	case <-payoutsDone:
+	default:
+		log.Println("Waiting for payment in flight to be written")
+		<-payoutsDone
 	}
-	if cfg.Exchange.Enabled {
-		go startExchangeProcessor()
+	return false
+}
+
+func stopModules(ctx context.Context) {
+	// Miners first, so no new shares or blocks arrive while others finish
+	for _, p := range pools {
+		if p.proxyServer != nil {
+			p.proxyServer.Stop(ctx)
+		}
+	}
+	for _, p := range pools {
+		p.stop(ctx)
+	}
+	if coinsApi != nil {
+		coinsApi.Shutdown(ctx)
+	}
+}
+
+// Waits for payments in flight of every coin, payer holds its lock until the payment is written
+func stopPayouts() {
+	for _, p := range pools {
+		if p.payer != nil {
+			p.payer.Stop()
+		}
 	}
-	quit := make(chan bool)
-	<-quit
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWaitSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+		reloads := make(chan struct{})
+		received := make(chan os.Signal, 1)
+		go func() {
+			received <- waitSignal(sigc, func() { reloads <- struct{}{} })
+		}()
+
+		// Every SIGHUP reloads config and keeps running
+		for i := 0; i < 2; i++ {
+			syscall.Kill(os.Getpid(), syscall.SIGHUP)
+			select {
+			case <-reloads:
+			case <-received:
+				t.Fatalf("%v: stopped waiting on SIGHUP", sig)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%v: config not reloaded on SIGHUP", sig)
+			}
+		}
+		syscall.Kill(os.Getpid(), sig)
+		select {
+		case got := <-received:
+			if got != sig {
+				t.Errorf("Expected %v, got %v", sig, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected %v to end waiting", sig)
+		}
+		signal.Stop(sigc)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	blockUntilDone := func(ctx context.Context) { <-ctx.Done() }
+	tests := []struct {
+		name        string
+		stopModules func(ctx context.Context)
+		// Payouts stop this long after shutdown starts
+		payoutsDelay time.Duration
+		signal       bool
+		ok           bool
+		// Min time shutdown takes
+		min time.Duration
+	}{
+		{"all stopped", func(context.Context) {}, 0, false, true, 0},
+		{"payment written in time", func(context.Context) {}, 50 * time.Millisecond, false, true, 50 * time.Millisecond},
+		{"modules timed out", blockUntilDone, 0, false, false, 100 * time.Millisecond},
+		{"payment outlasts timeout", blockUntilDone, 300 * time.Millisecond, false, false, 300 * time.Millisecond},
+		{"second signal", blockUntilDone, 0, true, false, 0},
+		{"second signal during payment", blockUntilDone, 300 * time.Millisecond, true, false, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		sigc := make(chan os.Signal, 1)
+		if tt.signal {
+			sigc <- syscall.SIGTERM
+		}
+		stopPayouts := func() { time.Sleep(tt.payoutsDelay) }
+
+		start := time.Now()
+		ok := shutdown(sigc, 100*time.Millisecond, tt.stopModules, stopPayouts)
+		elapsed := time.Since(start)
+		if ok != tt.ok {
+			t.Errorf("%v: expected %v, got %v", tt.name, tt.ok, ok)
+		}
+		if elapsed < tt.min {
+			t.Errorf("%v: expected shutdown to wait at least %v, returned after %v", tt.name, tt.min, elapsed)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Package metrics is a minimal Prometheus registry, every module registers
+// its collectors at init and they are exposed in text format on /metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+}
+
+// Latency buckets in seconds
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	names      map[string]bool
+	collectors []collector
+	hooks      []func()
+}{names: make(map[string]bool)}
+
+func register(name string, c collector) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.names[name] {
+		log.Panicf("Metric %s registered twice", name)
+	}
+	registry.names[name] = true
+	registry.collectors = append(registry.collectors, c)
+}
+
+// Registers a function called before every scrape, meant to refresh gauges
+// that are cheaper to compute on demand than to keep up to date.
+func OnCollect(fn func()) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.hooks = append(registry.hooks, fn)
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, d.labels[i]+"=\""+escapeLabel(v)+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+extra[i+1]+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Float64 updated atomically
+type value struct {
+	bits uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+type Counter struct {
+	value
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) SetBool(b bool) {
+	if b {
+		g.Set(1)
+	} else {
+		g.Set(0)
+	}
+}
+
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Children of a vector keyed by joined label values
+type vec struct {
+	desc
+	sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+	create   func() interface{}
+}
+
+func newVec(name, help, kind string, labels []string, create func() interface{}) *vec {
+	return &vec{
+		desc:     desc{name: name, help: help, kind: kind, labels: labels},
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		create:   create,
+	}
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		log.Panicf("Metric %s expects %d label values, got %d", v.name, len(v.labels), len(values))
+	}
+	key := strings.Join(values, "\xff")
+	v.RLock()
+	child, ok := v.children[key]
+	v.RUnlock()
+	if ok {
+		return child
+	}
+	v.Lock()
+	defer v.Unlock()
+	if child, ok = v.children[key]; !ok {
+		child = v.create()
+		v.children[key] = child
+		v.values[key] = append([]string(nil), values...)
+	}
+	return child
+}
+
+// Calls fn for every child in stable order
+func (v *vec) each(fn func(values []string, child interface{})) {
+	v.RLock()
+	defer v.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fn(v.values[k], v.children[k])
+	}
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(name, help, "counter", labels, func() interface{} { return &Counter{} })}
+	register(name, v)
+	return v
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values).(*Counter)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(values), formatFloat(child.(*Counter).Get()))
+	})
+}
+
+type GaugeVec struct {
+	*vec
+}
+
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec(name, help, "gauge", labels, func() interface{} { return &Gauge{} })}
+	register(name, v)
+	return v
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values).(*Gauge)
+}
+
+func (v *GaugeVec) write(w io.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(values), formatFloat(child.(*Gauge).Get()))
+	})
+}
+
+type HistogramVec struct {
+	*vec
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	create := func() interface{} {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	}
+	v := &HistogramVec{newVec(name, help, "histogram", labels, create)}
+	register(name, v)
+	return v
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values).(*Histogram)
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, child interface{}) {
+		h := child.(*Histogram)
+		h.Lock()
+		defer h.Unlock()
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelPairs(values, "le", formatFloat(le)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelPairs(values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelPairs(values), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelPairs(values), h.count)
+	})
+}
+
+var goroutines = NewGauge("go_goroutines", "Number of goroutines that currently exist.")
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goroutines.With().Set(float64(runtime.NumGoroutine()))
+
+		registry.Lock()
+		hooks := registry.hooks
+		collectors := registry.collectors
+		registry.Unlock()
+
+		for _, fn := range hooks {
+			fn()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, c := range collectors {
+			c.write(w)
+		}
+	})
+}
+
+func Start(cfg *Config) {
+	log.Printf("Starting metrics on %v", cfg.Listen)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	err := http.ListenAndServe(cfg.Listen, mux)
+	if err != nil {
+		log.Fatalf("Failed to start metrics: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterExposition(t *testing.T) {
+	c := NewCounter("test_shares_total", "Shares by result.", "coin", "result")
+	c.With("etc", "valid").Inc()
+	c.With("etc", "valid").Add(2.5)
+	c.With("etc", "invalid").Inc()
+	c.With("ubq", "valid").Add(1e21)
+
+	expected := `# HELP test_shares_total Shares by result.
+# TYPE test_shares_total counter
+test_shares_total{coin="etc",result="invalid"} 1
+test_shares_total{coin="etc",result="valid"} 3.5
+test_shares_total{coin="ubq",result="valid"} 1e+21
+`
+	checkExposition(t, c, expected)
+}
+
+func TestGaugeExposition(t *testing.T) {
+	g := NewGauge("test_sessions", "Connected sessions.")
+	g.With().Set(3)
+	g.With().Inc()
+	g.With().Dec()
+	g.With().Dec()
+
+	inf := NewGauge("test_infinite", "Infinite values.", "sign")
+	inf.With("neg").Set(math.Inf(-1))
+	inf.With("pos").Set(math.Inf(1))
+	inf.With("zero").SetBool(false)
+
+	checkExposition(t, g, `# HELP test_sessions Connected sessions.
+# TYPE test_sessions gauge
+test_sessions 2
+`)
+	checkExposition(t, inf, `# HELP test_infinite Infinite values.
+# TYPE test_infinite gauge
+test_infinite{sign="neg"} -Inf
+test_infinite{sign="pos"} +Inf
+test_infinite{sign="zero"} 0
+`)
+}
+
+func TestLabelEscaping(t *testing.T) {
+	g := NewGauge("test_escaped", "Label values with special chars.", "upstream")
+	g.With(`node "main"`).Set(1)
+	g.With(`C:\node`).Set(2)
+	g.With("multi\nline").Set(3)
+
+	checkExposition(t, g, `# HELP test_escaped Label values with special chars.
+# TYPE test_escaped gauge
+test_escaped{upstream="C:\\node"} 2
+test_escaped{upstream="multi\nline"} 3
+test_escaped{upstream="node \"main\""} 1
+`)
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Duration of things.", []float64{0.5, 1, 5}, "coin")
+	for _, v := range []float64{0.25, 0.5, 1, 3, 10} {
+		h.With("etc").Observe(v)
+	}
+	h.With("ubq").Observe(0.75)
+
+	checkExposition(t, h, `# HELP test_duration_seconds Duration of things.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{coin="etc",le="0.5"} 2
+test_duration_seconds_bucket{coin="etc",le="1"} 3
+test_duration_seconds_bucket{coin="etc",le="5"} 4
+test_duration_seconds_bucket{coin="etc",le="+Inf"} 5
+test_duration_seconds_sum{coin="etc"} 14.75
+test_duration_seconds_count{coin="etc"} 5
+test_duration_seconds_bucket{coin="ubq",le="0.5"} 0
+test_duration_seconds_bucket{coin="ubq",le="1"} 1
+test_duration_seconds_bucket{coin="ubq",le="5"} 1
+test_duration_seconds_bucket{coin="ubq",le="+Inf"} 1
+test_duration_seconds_sum{coin="ubq"} 0.75
+test_duration_seconds_count{coin="ubq"} 1
+`)
+}
+
+func TestHistogramDefaultBuckets(t *testing.T) {
+	h := NewHistogram("test_default_seconds", "Default buckets.", nil)
+	h.With().Observe(0.003)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// Help, type, a line per bucket, +Inf, sum and count
+	if len(lines) != 2+len(DefBuckets)+3 {
+		t.Fatalf("Expected %v lines, got:\n%v", 2+len(DefBuckets)+3, buf.String())
+	}
+	for _, line := range []string{
+		`test_default_seconds_bucket{le="0.0025"} 0`,
+		`test_default_seconds_bucket{le="0.005"} 1`,
+		`test_default_seconds_bucket{le="10"} 1`,
+		`test_default_seconds_bucket{le="+Inf"} 1`,
+		`test_default_seconds_sum 0.003`,
+		`test_default_seconds_count 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected line %q in:\n%v", line, buf.String())
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	g := NewGauge("test_collected", "Gauge refreshed on scrape.")
+	OnCollect(func() { g.With().Set(7) })
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Wrong content type %v", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "# TYPE go_goroutines gauge\ngo_goroutines ") {
+		t.Errorf("Expected go_goroutines in:\n%v", body)
+	}
+	if !strings.Contains(body, "# HELP test_collected Gauge refreshed on scrape.\n# TYPE test_collected gauge\ntest_collected 7\n") {
+		t.Errorf("Expected gauge set by collect hook in:\n%v", body)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	NewCounter("test_twice_total", "Registered twice.")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic on metric registered twice")
+		}
+	}()
+	NewGauge("test_twice_total", "Registered twice.")
+}
+
+func checkExposition(t *testing.T, c collector, expected string) {
+	t.Helper()
+	var buf bytes.Buffer
+	c.write(&buf)
+	if buf.String() != expected {
+		t.Errorf("Wrong exposition:\n%v\nexpected:\n%v", buf.String(), expected)
+	}
+}
@@ -0,0 +1,234 @@
+package payouts
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type BatchConfig struct {
+	Enabled bool `json:"enabled"`
+	// Disperse contract with disperseEther(address[],uint256[]) payable method
+	Contract  string `json:"contract"`
+	MaxPayees int    `json:"maxPayees"`
+	// Gas limit of batch tx, estimated by node if empty
+	Gas string `json:"gas"`
+}
+
+var disperseEtherSelector = crypto.Keccak256([]byte("disperseEther(address[],uint256[])"))[:4]
+
+// Bookkeeping of batch payments, every call applies to whole batch or fails
+type batchLedger interface {
+	LockPayouts(login string, amount int64) error
+	UnlockPayouts() error
+	UpdateBalances(payments []*storage.PendingPayment) error
+	RollbackBalances(payments []*storage.PendingPayment) error
+	WriteBatchPayment(txHash string, payments []*storage.PendingPayment) error
+}
+
+type batchPayer struct {
+	config *PayoutsConfig
+	ledger batchLedger
+	rpc    *rpc.RPCClient
+	sender *txSender
+}
+
+// Payment failed before reaching the chain and balances were credited back
+var errBatchRolledBack = errors.New("batch payment rolled back")
+
+// ABI encoded call of disperseEther(recipients, values), values in Wei
+func encodeDisperseEther(recipients []string, values []*big.Int) []byte {
+	n := len(recipients)
+	word := func(x *big.Int) []byte {
+		return leftPad32(x.Bytes())
+	}
+	data := append([]byte{}, disperseEtherSelector...)
+	// Offsets of both dynamic arrays, then arrays prefixed by length
+	data = append(data, word(big.NewInt(64))...)
+	data = append(data, word(big.NewInt(int64(64+32*(n+1))))...)
+	data = append(data, word(big.NewInt(int64(n)))...)
+	for _, v := range recipients {
+		addr, _ := hex.DecodeString(strings.TrimPrefix(v, "0x"))
+		data = append(data, leftPad32(addr)...)
+	}
+	data = append(data, word(big.NewInt(int64(n)))...)
+	for _, v := range values {
+		data = append(data, word(v)...)
+	}
+	return data
+}
+
+// Left pads to 32 bytes
+func leftPad32(b []byte) []byte {
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return padded
+}
+
+// Sends all payments in a single tx. Balances are debited and payouts locked
+// for the whole batch, credited back if the tx can't be sent and logged as
+// paid with its hash otherwise. On any other error payouts stay locked.
+func (b *batchPayer) pay(payments []*storage.PendingPayment) (string, error) {
+	recipients := make([]string, len(payments))
+	values := make([]*big.Int, len(payments))
+	total := new(big.Int)
+	totalShannon := int64(0)
+	for i, v := range payments {
+		recipients[i] = v.Address
+		values[i] = new(big.Int).Mul(big.NewInt(v.Amount), util.Shannon)
+		total.Add(total, values[i])
+		totalShannon += v.Amount
+	}
+
+	poolBalance, err := b.rpc.GetBalance(b.config.Address)
+	if err != nil {
+		return "", err
+	}
+	if poolBalance.Cmp(total) < 0 {
+		return "", fmt.Errorf("Not enough balance for batch payment, need %s Wei, pool has %s Wei",
+			total.String(), poolBalance.String())
+	}
+
+	err = b.ledger.LockPayouts("batch", totalShannon)
+	if err != nil {
+		return "", fmt.Errorf("Failed to lock batch payment: %v", err)
+	}
+	err = b.ledger.UpdateBalances(payments)
+	if err != nil {
+		if err := b.ledger.UnlockPayouts(); err != nil {
+			log.Println("Failed to unlock payouts:", err)
+		}
+		return "", fmt.Errorf("Failed to update balances for batch payment: %v", err)
+	}
+	log.Printf("Locked batch payment to %v payees, %v Shannon", len(payments), totalShannon)
+
+	value := hexutil.EncodeBig(total)
+	callData := encodeDisperseEther(recipients, values)
+	data := hexutil.Encode(callData)
+	contract := b.config.Batch.Contract
+
+	gas := b.config.Batch.Gas
+	if len(gas) == 0 {
+		// Estimation fails if contract would revert, nothing is sent then
+		estimate, err := b.rpc.EstimateGas(b.config.Address, contract, value, data)
+		if err != nil {
+			return "", b.rollback(payments, fmt.Errorf("Failed to estimate gas of batch payment: %v", err))
+		}
+		gas = hexutil.EncodeUint64(uint64(estimate + estimate/5))
+	} else {
+		gas = hexutil.EncodeBig(util.String2Big(gas))
+	}
+
+	txHash, err := b.sender.send(contract, gas, total, callData)
+	if err != nil {
+		// Tx rejected by node was never broadcast
+		if _, ok := err.(*rpc.Error); ok {
+			return "", b.rollback(payments, fmt.Errorf("Node rejected batch payment: %v", err))
+		}
+		return "", fmt.Errorf("Failed to send batch payment, %v Shannon: %v. Check outgoing tx of %s in block explorer and docs/PAYOUTS.md",
+			totalShannon, err, b.config.Address)
+	}
+
+	err = b.ledger.WriteBatchPayment(txHash, payments)
+	if err != nil {
+		return txHash, fmt.Errorf("Failed to log batch payment, %v Shannon, tx: %s: %v", totalShannon, txHash, err)
+	}
+	return txHash, nil
+}
+
+func (b *batchPayer) rollback(payments []*storage.PendingPayment, cause error) error {
+	log.Println(cause)
+	if err := b.ledger.RollbackBalances(payments); err != nil {
+		return fmt.Errorf("%v, failed to credit balances back: %v", cause, err)
+	}
+	log.Printf("Credited back batch payment to %v payees", len(payments))
+	return fmt.Errorf("%w: %v", errBatchRolledBack, cause)
+}
+
+// Pays in batches of up to maxPayees, waiting for every tx to confirm
+func (u *PayoutsProcessor) payBatches(payments []*storage.PendingPayment) (int, *big.Int) {
+	minersPaid := 0
+	totalAmount := big.NewInt(0)
+	max := u.config.Batch.MaxPayees
+
+	for len(payments) > 0 && !u.stopping() {
+		n := len(payments)
+		if n > max {
+			n = max
+		}
+		batch := payments[:n]
+		payments = payments[n:]
+
+		txHash, err := u.batch.pay(batch)
+		if err != nil {
+			log.Println(err)
+			u.halt = true
+			u.lastFail = err
+			break
+		}
+		u.recordNonce(txHash)
+		// One tx pays the whole batch
+		payoutsCount.With(u.coin).Inc()
+		for _, v := range batch {
+			payoutsPaid.With(u.coin).Add(float64(v.Amount))
+			totalAmount.Add(totalAmount, big.NewInt(v.Amount))
+			log.Printf("Paid %v Shannon to %v, TxHash: %v", v.Amount, v.Address, txHash)
+		}
+		minersPaid += len(batch)
+
+		payoutsPendingTx.With(u.coin).Inc()
+		err = u.waitBatchTx(txHash, batch)
+		payoutsPendingTx.With(u.coin).Dec()
+		if err != nil {
+			log.Println(err)
+			u.halt = true
+			u.lastFail = err
+			break
+		}
+	}
+	return minersPaid, totalAmount
+}
+
+// Batch tx must succeed before the next one, payments of a reverted one are credited back
+func (u *PayoutsProcessor) waitBatchTx(txHash string, payments []*storage.PendingPayment) error {
+	txHash, receipt := u.waitTx(txHash, payments)
+	if receipt == nil {
+		return nil
+	}
+	if !receipt.Successful() {
+		if err := revertBatchPayment(u.backend, txHash, payments); err != nil {
+			return fmt.Errorf("Batch payout tx failed: %s, payments are logged as paid and crediting them back failed: %v. Credit them back with /api/admin/balance unless reconciliation is enabled and resume with /api/admin/payouts/resolve", txHash, err)
+		}
+		return fmt.Errorf("Batch payout tx failed: %s, payments are credited back, check the contract and resume with /api/admin/payouts/resolve", txHash)
+	}
+	log.Printf("Batch payout tx successful: %s", txHash)
+	return nil
+}
+
+// Moves payments of reverted batch tx out of payments log and credits them back in one transaction,
+// reconciliation skips the tx then
+func revertBatchPayment(backend Backend, txHash string, payments []*storage.PendingPayment) error {
+	now := util.MakeTimestamp() / 1000
+	logged := make([]*storage.LoggedPayment, len(payments))
+	for i, v := range payments {
+		logged[i] = &storage.LoggedPayment{TxHash: txHash, Address: v.Address, Amount: v.Amount, Timestamp: now}
+	}
+	ok, err := backend.RevertPayment(txHash, storage.PaymentFailed, logged)
+	if err != nil {
+		return err
+	}
+	if ok {
+		log.Printf("Credited back batch payment to %v payees, tx: %s", len(payments), txHash)
+	}
+	return nil
+}
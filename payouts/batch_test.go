@@ -0,0 +1,264 @@
+package payouts
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+// In-memory stand-in of redis bookkeeping
+type testLedger struct {
+	locked   bool
+	balances map[string]int64
+	pending  map[string]int64
+	paid     map[string]string
+}
+
+func newTestLedger(balances map[string]int64) *testLedger {
+	return &testLedger{balances: balances, pending: map[string]int64{}, paid: map[string]string{}}
+}
+
+func (l *testLedger) LockPayouts(login string, amount int64) error {
+	if l.locked {
+		return errors.New("locked")
+	}
+	l.locked = true
+	return nil
+}
+
+func (l *testLedger) UnlockPayouts() error {
+	l.locked = false
+	return nil
+}
+
+func (l *testLedger) UpdateBalances(payments []*storage.PendingPayment) error {
+	for _, v := range payments {
+		l.balances[v.Address] -= v.Amount
+		l.pending[v.Address] += v.Amount
+	}
+	return nil
+}
+
+func (l *testLedger) RollbackBalances(payments []*storage.PendingPayment) error {
+	for _, v := range payments {
+		l.balances[v.Address] += v.Amount
+		l.pending[v.Address] -= v.Amount
+	}
+	l.locked = false
+	return nil
+}
+
+func (l *testLedger) WriteBatchPayment(txHash string, payments []*storage.PendingPayment) error {
+	for _, v := range payments {
+		l.pending[v.Address] -= v.Amount
+		l.paid[v.Address] = txHash
+	}
+	l.locked = false
+	return nil
+}
+
+const (
+	testPool     = "0x0000000000000000000000000000000000000001"
+	testContract = "0xd152f549545093347a162dce210e7293f1452150"
+	testTxHash   = "0x5e1f0e2fdd83e1b8f8b1f6a5a5a3ad2d1b9b1b6a4b1c2d3e4f5a6b7c8d9e0f11"
+)
+
+var testPayments = []*storage.PendingPayment{
+	{Address: "0x00000000000000000000000000000000000000aa", Amount: 1000000000},
+	{Address: "0x00000000000000000000000000000000000000bb", Amount: 2500000000},
+}
+
+func newTestBatchPayer(node *testNode, ledger batchLedger) (*batchPayer, func()) {
+	server := httptest.NewServer(node)
+	cfg := &PayoutsConfig{Address: testPool, AutoGas: true, Batch: BatchConfig{Enabled: true, Contract: testContract, MaxPayees: 100}}
+	client := rpc.NewRPCClient("test", server.URL, "5s")
+	return &batchPayer{config: cfg, ledger: ledger, rpc: client, sender: &txSender{config: cfg, rpc: client}}, server.Close
+}
+
+func okEstimate(map[string]string) (interface{}, string) {
+	return "0x186a0", ""
+}
+
+func okSend(map[string]string) (interface{}, string) {
+	return testTxHash, ""
+}
+
+func testBalances() map[string]int64 {
+	return map[string]int64{testPayments[0].Address: 1500000000, testPayments[1].Address: 2500000000}
+}
+
+func TestEncodeDisperseEther(t *testing.T) {
+	values := []*big.Int{big.NewInt(1), big.NewInt(256)}
+	data := hex.EncodeToString(encodeDisperseEther([]string{testPayments[0].Address, testPayments[1].Address}, values))
+
+	words := []string{
+		"0000000000000000000000000000000000000000000000000000000000000040",
+		"00000000000000000000000000000000000000000000000000000000000000a0",
+		"0000000000000000000000000000000000000000000000000000000000000002",
+		"00000000000000000000000000000000000000000000000000000000000000aa",
+		"00000000000000000000000000000000000000000000000000000000000000bb",
+		"0000000000000000000000000000000000000000000000000000000000000002",
+		"0000000000000000000000000000000000000000000000000000000000000001",
+		"0000000000000000000000000000000000000000000000000000000000000100",
+	}
+	expected := "e63d38ed" + strings.Join(words, "")
+	if data != expected {
+		t.Errorf("Wrong call data:\n%v\nexpected:\n%v", data, expected)
+	}
+}
+
+func TestBatchPay(t *testing.T) {
+	node := &testNode{balance: "0x8ac7230489e80000", estimate: okEstimate, send: okSend}
+	ledger := newTestLedger(testBalances())
+	payer, stop := newTestBatchPayer(node, ledger)
+	defer stop()
+
+	txHash, err := payer.pay(testPayments)
+	if err != nil {
+		t.Fatalf("Batch payment failed: %v", err)
+	}
+	if txHash != testTxHash {
+		t.Errorf("Wrong tx hash %v", txHash)
+	}
+	if node.call["to"] != testContract {
+		t.Errorf("Tx must be sent to contract, got %v", node.call["to"])
+	}
+	// 3.5 Ether in Wei
+	if node.call["value"] != "0x30927f74c9de0000" {
+		t.Errorf("Tx value must be total of batch, got %v", node.call["value"])
+	}
+	// Estimate with 20% margin
+	if node.call["gas"] != "0x1d4c0" {
+		t.Errorf("Wrong gas %v", node.call["gas"])
+	}
+	if !strings.HasPrefix(node.call["data"], "0xe63d38ed") {
+		t.Errorf("Tx must call disperseEther, got %v", node.call["data"])
+	}
+	for _, v := range testPayments {
+		if ledger.paid[v.Address] != testTxHash || ledger.pending[v.Address] != 0 {
+			t.Errorf("Payment to %v must be logged with tx hash", v.Address)
+		}
+	}
+	if ledger.balances[testPayments[0].Address] != 500000000 || ledger.balances[testPayments[1].Address] != 0 {
+		t.Errorf("Balances must be debited, got %v", ledger.balances)
+	}
+	if ledger.locked {
+		t.Error("Payouts must be unlocked")
+	}
+}
+
+func TestBatchPayRollback(t *testing.T) {
+	failEstimate := func(map[string]string) (interface{}, string) {
+		return nil, "execution reverted"
+	}
+	rejectSend := func(map[string]string) (interface{}, string) {
+		return nil, "insufficient funds for gas * price + value"
+	}
+	tests := map[string]*testNode{
+		"revert": {balance: "0x8ac7230489e80000", estimate: failEstimate, send: okSend},
+		"reject": {balance: "0x8ac7230489e80000", estimate: okEstimate, send: rejectSend},
+	}
+	for name, node := range tests {
+		ledger := newTestLedger(testBalances())
+		payer, stop := newTestBatchPayer(node, ledger)
+
+		_, err := payer.pay(testPayments)
+		stop()
+		if !errors.Is(err, errBatchRolledBack) {
+			t.Errorf("%v: batch must be rolled back, got %v", name, err)
+		}
+		if fmt.Sprint(ledger.balances) != fmt.Sprint(testBalances()) {
+			t.Errorf("%v: balances must be credited back, got %v", name, ledger.balances)
+		}
+		for _, v := range testPayments {
+			if ledger.pending[v.Address] != 0 || len(ledger.paid[v.Address]) > 0 {
+				t.Errorf("%v: payment to %v must not stay pending or paid", name, v.Address)
+			}
+		}
+		if ledger.locked {
+			t.Errorf("%v: payouts must be unlocked", name)
+		}
+	}
+}
+
+func TestBatchPayStaysLockedIfSendUnknown(t *testing.T) {
+	node := &testNode{balance: "0x8ac7230489e80000", estimate: okEstimate}
+	server := httptest.NewServer(node)
+	node.send = func(map[string]string) (interface{}, string) {
+		// Connection lost after tx was submitted
+		server.CloseClientConnections()
+		return testTxHash, ""
+	}
+	ledger := newTestLedger(testBalances())
+	cfg := &PayoutsConfig{Address: testPool, AutoGas: true, Batch: BatchConfig{Enabled: true, Contract: testContract, MaxPayees: 100}}
+	client := rpc.NewRPCClient("test", server.URL, "5s")
+	payer := &batchPayer{config: cfg, ledger: ledger, rpc: client, sender: &txSender{config: cfg, rpc: client}}
+	defer server.Close()
+
+	_, err := payer.pay(testPayments)
+	if err == nil || errors.Is(err, errBatchRolledBack) {
+		t.Fatalf("Batch with unknown outcome must not be rolled back, got %v", err)
+	}
+	if !ledger.locked {
+		t.Error("Payouts must stay locked")
+	}
+	for _, v := range testPayments {
+		if ledger.pending[v.Address] != v.Amount {
+			t.Errorf("Payment to %v must stay pending", v.Address)
+		}
+	}
+}
+
+func TestBatchPayNotEnoughBalance(t *testing.T) {
+	node := &testNode{balance: "0x1", estimate: okEstimate, send: okSend}
+	ledger := newTestLedger(testBalances())
+	payer, stop := newTestBatchPayer(node, ledger)
+	defer stop()
+
+	if _, err := payer.pay(testPayments); err == nil {
+		t.Fatal("Batch exceeding pool balance must fail")
+	}
+	if ledger.locked || node.sent != nil || fmt.Sprint(ledger.balances) != fmt.Sprint(testBalances()) {
+		t.Error("Nothing must be locked, debited or sent")
+	}
+}
+
+func TestRevertBatchPayment(t *testing.T) {
+	backend := storage.NewMemoryBackend(100)
+	for _, v := range testPayments {
+		backend.AdjustBalance(v.Address, v.Amount)
+	}
+	backend.LockPayouts("batch", 3500000000)
+	backend.UpdateBalances(testPayments)
+	backend.WriteBatchPayment(testTxHash, testPayments)
+
+	if err := revertBatchPayment(backend, testTxHash, testPayments); err != nil {
+		t.Fatalf("Failed to revert batch payment: %v", err)
+	}
+	for _, v := range testPayments {
+		if balance, _ := backend.GetBalance(v.Address); balance != v.Amount {
+			t.Errorf("Expected %v credited back to %v, got %v", v.Amount, v.Address, balance)
+		}
+	}
+	if txs, _ := backend.GetUnreconciledPayments(0); len(txs) != 0 {
+		t.Errorf("Expected reverted batch to leave payments log, got %v", txs)
+	}
+	if failed, _ := backend.GetFailedPayments(10); len(failed) != 2 || failed[0].Status != storage.PaymentFailed {
+		t.Errorf("Expected two failed payments, got %v", failed)
+	}
+
+	// Already reverted, e.g. by reconciliation
+	if err := revertBatchPayment(backend, testTxHash, testPayments); err != nil {
+		t.Fatalf("Failed to revert batch payment again: %v", err)
+	}
+	if balance, _ := backend.GetBalance(testPayments[0].Address); balance != testPayments[0].Amount {
+		t.Errorf("Expected batch credited back only once, got balance %v", balance)
+	}
+}
@@ -0,0 +1,272 @@
+package payouts
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type FeeConfig struct {
+	// Estimate tip of EIP-1559 txs from eth_feeHistory instead of fixed maxPriorityFee
+	Dynamic       bool    `json:"dynamic"`
+	HistoryBlocks int     `json:"historyBlocks"`
+	TipPercentile float64 `json:"tipPercentile"`
+	// Upper bound of gas price or fee cap in Wei, replacements included, none if empty
+	MaxFee string `json:"maxFee"`
+	// Replace tx not mined within this many blocks with same nonce and bumped fees, 0 disables
+	ReplaceAfter int64 `json:"replaceAfter"`
+	// Percent fees are raised by on replacement, nodes require at least 10
+	Bump int64 `json:"bump"`
+}
+
+const minFeeBump = 10
+
+// Replacement would need fees above maxFee, tx is left waiting
+var errMaxFeeReached = errors.New("replacement fees would exceed maxFee")
+
+// Gas price of legacy tx, or tip and fee cap of EIP-1559 tx
+type txFees struct {
+	gasPrice *big.Int
+	tipCap   *big.Int
+	feeCap   *big.Int
+}
+
+func (s *txSender) suggestFees() (*txFees, error) {
+	cfg := &s.config.Fees
+	if !cfg.Dynamic && len(s.config.MaxPriorityFee) == 0 {
+		gasPrice := util.String2Big(s.config.GasPrice)
+		if s.config.AutoGas {
+			price, err := s.rpc.GetGasPrice()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get gas price: %v", err)
+			}
+			gasPrice = big.NewInt(price)
+		}
+		return &txFees{gasPrice: s.capFee(gasPrice)}, nil
+	}
+
+	baseFee, err := s.rpc.GetBaseFee()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get base fee: %v", err)
+	}
+	if baseFee == nil {
+		return nil, errors.New("Node has no base fee, unset maxPriorityFee and dynamic fees to send legacy txs")
+	}
+	tip := util.String2Big(s.config.MaxPriorityFee)
+	if cfg.Dynamic {
+		tip, err = s.estimateTip()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Stays valid while base fee doubles
+	feeCap := s.capFee(new(big.Int).Add(new(big.Int).Mul(baseFee, big.NewInt(2)), tip))
+	if tip.Cmp(feeCap) > 0 {
+		tip = feeCap
+	}
+	return &txFees{tipCap: tip, feeCap: feeCap}, nil
+}
+
+// Median of tips paid at configured percentile over recent blocks
+func (s *txSender) estimateTip() (*big.Int, error) {
+	cfg := &s.config.Fees
+	history, err := s.rpc.GetFeeHistory(cfg.HistoryBlocks, []float64{cfg.TipPercentile})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get fee history: %v", err)
+	}
+	var tips []*big.Int
+	for _, v := range history.Reward {
+		if len(v) == 0 {
+			continue
+		}
+		if tip, err := hexutil.DecodeBig(v[0]); err == nil {
+			tips = append(tips, tip)
+		}
+	}
+	if len(tips) == 0 {
+		return nil, errors.New("No tips in fee history")
+	}
+	sort.Slice(tips, func(i, j int) bool { return tips[i].Cmp(tips[j]) < 0 })
+	return tips[len(tips)/2], nil
+}
+
+func (s *txSender) capFee(fee *big.Int) *big.Int {
+	if len(s.config.Fees.MaxFee) == 0 {
+		return fee
+	}
+	if max := util.String2Big(s.config.Fees.MaxFee); fee.Cmp(max) > 0 {
+		return max
+	}
+	return fee
+}
+
+// Same tx with fees raised by bump percent, or to current estimate if it's higher
+func (s *txSender) bumpFees(prev types.TxData) (types.TxData, error) {
+	bump := s.config.Fees.Bump
+	if bump < minFeeBump {
+		bump = minFeeBump
+	}
+	raise := func(fee, suggested *big.Int) (*big.Int, error) {
+		bumped := new(big.Int).Mul(fee, big.NewInt(100+bump))
+		bumped.Div(bumped, big.NewInt(100))
+		if suggested != nil && suggested.Cmp(bumped) > 0 {
+			bumped = suggested
+		}
+		if len(s.config.Fees.MaxFee) > 0 && bumped.Cmp(util.String2Big(s.config.Fees.MaxFee)) > 0 {
+			return nil, errMaxFeeReached
+		}
+		return bumped, nil
+	}
+
+	suggested, err := s.suggestFees()
+	if err != nil {
+		log.Printf("Bumping fees without estimate: %v", err)
+		suggested = &txFees{}
+	}
+	tx := types.NewTx(prev)
+	if tx.Type() == types.DynamicFeeTxType {
+		tip, err := raise(tx.GasTipCap(), suggested.tipCap)
+		if err != nil {
+			return nil, err
+		}
+		feeCap, err := raise(tx.GasFeeCap(), suggested.feeCap)
+		if err != nil {
+			return nil, err
+		}
+		return &types.DynamicFeeTx{
+			ChainID:   tx.ChainId(),
+			Nonce:     tx.Nonce(),
+			GasTipCap: tip,
+			GasFeeCap: feeCap,
+			Gas:       tx.Gas(),
+			To:        tx.To(),
+			Value:     tx.Value(),
+			Data:      tx.Data(),
+		}, nil
+	}
+	gasPrice, err := raise(tx.GasPrice(), suggested.gasPrice)
+	if err != nil {
+		return nil, err
+	}
+	return &types.LegacyTx{
+		Nonce:    tx.Nonce(),
+		GasPrice: gasPrice,
+		Gas:      tx.Gas(),
+		To:       tx.To(),
+		Value:    tx.Value(),
+		Data:     tx.Data(),
+	}, nil
+}
+
+// Polls receipts of tx and its replacements until one of them is mined, nil
+// on shutdown. A tx not mined within replaceAfter blocks is replaced and
+// logged payments are moved to the latest tx, or to the one that got mined.
+func (u *PayoutsProcessor) waitTx(txHash string, payments []*storage.PendingPayment) (string, *rpc.TxReceipt) {
+	hashes := []string{txHash}
+	logged := txHash
+	defer func() {
+		u.sender.forget(hashes)
+	}()
+	var sentAt int64
+	if u.config.Fees.ReplaceAfter > 0 {
+		sentAt = u.currentHeight()
+	}
+
+	for {
+		log.Printf("Waiting for tx confirmation: %v", hashes[len(hashes)-1])
+		select {
+		case <-time.After(txCheckInterval):
+		case <-u.quit:
+			log.Printf("Stopped waiting for tx confirmation: %v", hashes[len(hashes)-1])
+			return "", nil
+		}
+
+		for _, hash := range hashes {
+			receipt, err := u.rpc.GetTxReceipt(hash)
+			if err != nil {
+				log.Printf("Failed to get tx receipt for %v: %v", hash, err)
+				continue
+			}
+			if receipt != nil && receipt.Confirmed() {
+				if hash != logged {
+					u.movePayments(logged, hash, payments)
+				}
+				return hash, receipt
+			}
+		}
+
+		if u.config.Fees.ReplaceAfter <= 0 {
+			continue
+		}
+		height := u.currentHeight()
+		if sentAt == 0 {
+			sentAt = height
+		}
+		if height == 0 || height-sentAt < u.config.Fees.ReplaceAfter {
+			continue
+		}
+		// Next attempt after another replaceAfter blocks, whatever the outcome
+		sentAt = height
+		stuck := hashes[len(hashes)-1]
+		newHash, err := u.sender.replace(stuck)
+		if err != nil {
+			log.Printf("Failed to replace tx %v not mined within %v blocks: %v", stuck, u.config.Fees.ReplaceAfter, err)
+			continue
+		}
+		log.Printf("Replaced tx %v not mined within %v blocks with %v", stuck, u.config.Fees.ReplaceAfter, newHash)
+		payoutsReplacedTx.With(u.coin).Inc()
+		hashes = append(hashes, newHash)
+		u.recordNonce(newHash)
+		if u.movePayments(logged, newHash, payments) {
+			logged = newHash
+		}
+	}
+}
+
+func (u *PayoutsProcessor) movePayments(oldTxHash, newTxHash string, payments []*storage.PendingPayment) bool {
+	if err := u.backend.ReplacePayment(oldTxHash, newTxHash, payments); err != nil {
+		log.Printf("Failed to move payments of tx %v to %v: %v", oldTxHash, newTxHash, err)
+		return false
+	}
+	log.Printf("Moved payments of tx %v to %v", oldTxHash, newTxHash)
+	return true
+}
+
+// Reconciliation tells a dropped tx from a pending one by its nonce
+func (u *PayoutsProcessor) recordNonce(txHash string) {
+	nonce, err := u.sender.nonceOf(txHash)
+	if err == nil {
+		err = u.backend.WritePaymentNonce(txHash, nonce)
+	}
+	if err != nil {
+		log.Printf("Failed to record nonce of payout tx %v, reconciliation takes it from node: %v", txHash, err)
+	}
+}
+
+// Height of pending block, 0 if node is unreachable
+func (u *PayoutsProcessor) currentHeight() int64 {
+	return pendingHeight(u.rpc)
+}
+
+func pendingHeight(client *rpc.RPCClient) int64 {
+	block, err := client.GetPendingBlock()
+	if err != nil || block == nil {
+		log.Printf("Failed to get current height: %v", err)
+		return 0
+	}
+	height, err := hexutil.DecodeUint64(block.Number)
+	if err != nil {
+		return 0
+	}
+	return int64(height)
+}
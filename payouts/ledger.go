@@ -0,0 +1,81 @@
+package payouts
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+// Periodically compares SQL ledger with balance counters in Redis
+type LedgerChecker struct {
+	coin     string
+	backend  storage.BalanceBackend
+	interval time.Duration
+	mu       sync.Mutex
+	quit     chan struct{}
+}
+
+func NewLedgerChecker(interval time.Duration, backend storage.BalanceBackend, coin string) *LedgerChecker {
+	return &LedgerChecker{coin: coin, backend: backend, interval: interval, quit: make(chan struct{})}
+}
+
+func (c *LedgerChecker) Start() {
+	log.Println("Starting ledger consistency checker")
+	timer := time.NewTimer(c.interval)
+	log.Printf("Set ledger check interval to %v", c.interval)
+
+	c.check()
+	timer.Reset(c.interval)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				c.check()
+				timer.Reset(c.interval)
+			case <-c.quit:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (c *LedgerChecker) Stop() {
+	log.Println("Stopping ledger consistency checker")
+	close(c.quit)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log.Println("Ledger consistency checker stopped")
+}
+
+func (c *LedgerChecker) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	result, err := c.backend.CheckLedger()
+	if err != nil {
+		log.Println("Failed to check ledger:", err)
+		return
+	}
+	ledgerMismatches.With(c.coin).Set(float64(len(result.Mismatches)))
+	if result.Consistent {
+		log.Println("Ledger is consistent with Redis")
+		return
+	}
+	for _, v := range result.Mismatches {
+		login := v.Login
+		if len(login) == 0 {
+			login = "finances"
+		}
+		log.Printf("WARNING: Ledger mismatch of %v %v, Redis has %v Shannon, ledger has %v Shannon", login, v.Field, v.Redis, v.Ledger)
+	}
+}
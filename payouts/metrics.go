@@ -0,0 +1,25 @@
+package payouts
+
+import (
+	"github.com/yuriy0803/open-etc-pool-friends/metrics"
+)
+
+var (
+	unlockerCandidates = metrics.NewGauge("pool_unlocker_candidates", "Block candidates waiting for unlock.", "coin")
+	unlockerImmature   = metrics.NewGauge("pool_unlocker_immature", "Immature blocks waiting for crediting.", "coin")
+	unlockerOrphans    = metrics.NewCounter("pool_unlocker_orphans_total", "Orphaned blocks.", "coin")
+	unlockerHalt       = metrics.NewGauge("pool_unlocker_halt", "Unlocker suspended due to a critical error.", "coin")
+
+	payoutsPaid       = metrics.NewCounter("pool_payouts_paid_shannon_total", "Amount paid to miners in Shannon.", "coin")
+	payoutsCount      = metrics.NewCounter("pool_payouts_total", "Payout transactions sent.", "coin")
+	payoutsPendingTx  = metrics.NewGauge("pool_payouts_pending_tx", "Payout transactions waiting for confirmation.", "coin")
+	payoutsReplacedTx = metrics.NewCounter("pool_payouts_replaced_tx_total", "Stuck payout transactions replaced with bumped fees.", "coin")
+	payoutsLocked     = metrics.NewGauge("pool_payouts_locked", "Payouts are locked in backend.", "coin")
+	payoutsHalt       = metrics.NewGauge("pool_payouts_halt", "Payouts suspended due to a critical error.", "coin")
+
+	reconcileReverted = metrics.NewCounter("pool_reconcile_reverted_total", "Payments of failed or dropped txs credited back.", "coin")
+	reconcileDrift    = metrics.NewGauge("pool_reconcile_drift_shannon", "Pool wallet balance minus balances owed to miners.", "coin")
+	reconcileAlert    = metrics.NewGauge("pool_reconcile_alert", "Pool wallet drifted from balances beyond configured bounds.", "coin")
+
+	ledgerMismatches = metrics.NewGauge("pool_ledger_mismatches", "Balance counters in Redis differing from SQL ledger.", "coin")
+)
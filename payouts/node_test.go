@@ -0,0 +1,145 @@
+package payouts
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+)
+
+// Simulated node shared by payouts tests. Raw txs are accepted and known by hash
+// until test mines or drops them, estimate and send handlers of unlocked account
+// reply with result or JSON-RPC error.
+type testNode struct {
+	mu      sync.Mutex
+	balance string
+	// Pending and mined nonce of pool address
+	nonce  uint64
+	latest uint64
+	height uint64
+
+	estimate func(params map[string]string) (interface{}, string)
+	send     func(params map[string]string) (interface{}, string)
+	// Params of last eth_sendTransaction
+	call map[string]string
+	// Raw txs in order received
+	sent []*types.Transaction
+	// Pending or mined txs by hash, receipts of mined ones
+	txs      map[string]*rpc.Tx
+	receipts map[string]*rpc.TxReceipt
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	var params map[string]string
+	var param string
+	if len(req.Params) > 0 {
+		json.Unmarshal(req.Params[0], &params)
+		json.Unmarshal(req.Params[0], &param)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var result interface{}
+	var rpcErr string
+	switch req.Method {
+	case "eth_getBalance":
+		result = n.balance
+	case "eth_getTransactionCount":
+		var block string
+		json.Unmarshal(req.Params[1], &block)
+		if block == "latest" {
+			result = hexutil.EncodeUint64(n.latest)
+		} else {
+			result = hexutil.EncodeUint64(n.nonce)
+		}
+	case "eth_gasPrice":
+		result = "0x3b9aca00"
+	case "eth_feeHistory":
+		result = map[string]interface{}{
+			"oldestBlock":   "0x1",
+			"baseFeePerGas": []string{"0x77359400", "0x77359400", "0x77359400", "0x77359400"},
+			"reward":        [][]string{{"0x3b9aca00"}, {"0x77359400"}, {"0xb2d05e00"}},
+		}
+	case "eth_getBlockByNumber":
+		result = map[string]string{"number": hexutil.EncodeUint64(n.height), "baseFeePerGas": "0x77359400"}
+	case "eth_estimateGas":
+		result, rpcErr = n.estimate(params)
+	case "eth_sendTransaction":
+		n.call = params
+		result, rpcErr = n.send(params)
+	case "eth_sendRawTransaction":
+		tx := new(types.Transaction)
+		tx.UnmarshalBinary(hexutil.MustDecode(param))
+		n.sent = append(n.sent, tx)
+		n.nonce++
+		n.addTx(tx.Hash().Hex(), tx.Nonce())
+		result = tx.Hash().Hex()
+	case "eth_getTransactionByHash":
+		if tx, ok := n.txs[param]; ok {
+			result = tx
+		}
+	case "eth_getTransactionReceipt":
+		if receipt, ok := n.receipts[param]; ok {
+			result = receipt
+		}
+	default:
+		rpcErr = "unexpected method " + req.Method
+	}
+	reply := map[string]interface{}{"jsonrpc": "2.0", "id": 0, "result": result}
+	if len(rpcErr) > 0 {
+		reply = map[string]interface{}{"jsonrpc": "2.0", "id": 0, "error": map[string]interface{}{"code": -32000, "message": rpcErr}}
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+// Tx of pool address is pending
+func (n *testNode) addTx(hash string, nonce uint64) {
+	if n.txs == nil {
+		n.txs = make(map[string]*rpc.Tx)
+	}
+	n.txs[hash] = &rpc.Tx{Hash: hash, Nonce: hexutil.EncodeUint64(nonce), Gas: "0x5208", GasPrice: "0x3b9aca00"}
+}
+
+// Tx sent by node from unlocked account is pending
+func (n *testNode) pend(hash string, nonce uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.addTx(hash, nonce)
+}
+
+// Mines pending tx at height, so nonce of pool address is past it
+func (n *testNode) mine(hash string, height uint64, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.receipts == nil {
+		n.receipts = make(map[string]*rpc.TxReceipt)
+	}
+	status := "0x1"
+	if !ok {
+		status = "0x0"
+	}
+	n.receipts[hash] = &rpc.TxReceipt{TxHash: hash, BlockHash: hash, BlockNumber: hexutil.EncodeUint64(height), Status: status}
+	n.latest++
+}
+
+// Forgets pending tx, as nodes do on tx pool overflow or restart
+func (n *testNode) drop(hash string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.txs, hash)
+}
+
+func (n *testNode) setNonce(pending, latest uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nonce, n.latest = pending, latest
+}
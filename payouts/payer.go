@@ -6,8 +6,9 @@ import (
 	"math/big"
 	"os"
 	"os/exec"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -29,10 +30,20 @@ type PayoutsConfig struct {
 	Gas          string `json:"gas"`
 	GasPrice     string `json:"gasPrice"`
 	AutoGas      bool   `json:"autoGas"`
+	// Tip in Wei, locally signed txs are sent as EIP-1559 if set
+	MaxPriorityFee string `json:"maxPriorityFee"`
 	// In Shannon
 	Threshold    int64 `json:"threshold"`
 	BgSave       bool  `json:"bgsave"`
 	ConcurrentTx int   `json:"concurrentTx"`
+	// Pay many miners with a single multisend contract call
+	Batch BatchConfig `json:"batch"`
+	// Sign txs in-process instead of using unlocked account of node
+	Signer SignerConfig `json:"signer"`
+	// Fee estimation and replacement of stuck txs, locally signed txs only
+	Fees FeeConfig `json:"fees"`
+	// Re-checks logged payouts, runs without payouts module too
+	Reconcile ReconcileConfig `json:"reconcile"`
 }
 
 func (self PayoutsConfig) GasHex() string {
@@ -45,51 +56,70 @@ func (self PayoutsConfig) GasPriceHex() string {
 	return hexutil.EncodeBig(x)
 }
 
+// Storage used by unlocker, payouts and reconciliation
+type Backend interface {
+	storage.BlockBackend
+	storage.BalanceBackend
+	storage.AdminBackend
+}
+
 type PayoutsProcessor struct {
+	// Accessed atomically, keep 64-bit aligned
+	threshold int64
+
+	coin     string
 	config   *PayoutsConfig
-	backend  *storage.RedisClient
+	backend  Backend
 	rpc      *rpc.RPCClient
+	sender   *txSender
+	batch    *batchPayer
 	halt     bool
 	lastFail error
+	// Held while paying, so shutdown waits for payment in flight to be logged
+	mu   sync.Mutex
+	quit chan struct{}
 }
 
-func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg, backend: backend}
+func NewPayoutsProcessor(cfg *PayoutsConfig, backend Backend, coin string) *PayoutsProcessor {
+	u := &PayoutsProcessor{coin: coin, config: cfg, backend: backend, quit: make(chan struct{}), threshold: cfg.Threshold}
 	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+	u.rpc.Coin = coin
+	u.sender = &txSender{config: cfg, rpc: u.rpc}
+	if cfg.Signer.Enabled {
+		signer, err := newTxSigner(&cfg.Signer, u.rpc)
+		if err != nil {
+			log.Fatalln("Failed to start payouts signer:", err)
+		}
+		if !strings.EqualFold(signer.address.Hex(), cfg.Address) {
+			log.Fatalf("Signer key is for %v, but payouts address is %v", signer.address.Hex(), cfg.Address)
+		}
+		u.sender.signer = signer
+	} else if cfg.Fees.Dynamic || cfg.Fees.ReplaceAfter > 0 {
+		log.Fatalln("Dynamic fees and replacement of stuck txs require payouts signer")
+	}
+	if cfg.Fees.Dynamic && (cfg.Fees.HistoryBlocks <= 0 || cfg.Fees.TipPercentile < 0 || cfg.Fees.TipPercentile > 100) {
+		log.Fatalln("Dynamic fees require positive historyBlocks and tipPercentile within 0-100")
+	}
+	if cfg.Batch.Enabled {
+		if !util.IsValidHexAddress(cfg.Batch.Contract) {
+			log.Fatalln("Invalid batch payouts contract", cfg.Batch.Contract)
+		}
+		if cfg.Batch.MaxPayees <= 0 {
+			log.Fatalln("Batch payouts maxPayees must be positive")
+		}
+		u.batch = &batchPayer{config: cfg, ledger: backend, rpc: u.rpc, sender: u.sender}
+		log.Printf("Paying up to %v miners per tx with contract %v", cfg.Batch.MaxPayees, cfg.Batch.Contract)
+	}
 	return u
 }
 
 func (u *PayoutsProcessor) Start() {
 	log.Println("Starting payouts")
 
-	if u.mustResolvePayout() {
-		log.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
-		u.resolvePayouts()
-		log.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
-		return
-	}
-
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Printf("Set payouts interval to %v", intv)
 
-	payments := u.backend.GetPendingPayments()
-	if len(payments) > 0 {
-		log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
-			formatPendingPayments(payments))
-		return
-	}
-
-	locked, err := u.backend.IsPayoutsLocked()
-	if err != nil {
-		log.Println("Unable to start payouts:", err)
-		return
-	}
-	if locked {
-		log.Println("Unable to start payouts because they are locked")
-		return
-	}
-
 	// Immediately process payouts after start
 	u.process()
 	timer.Reset(intv)
@@ -100,17 +130,77 @@ func (u *PayoutsProcessor) Start() {
 			case <-timer.C:
 				u.process()
 				timer.Reset(intv)
+			case <-u.quit:
+				timer.Stop()
+				return
 			}
 		}
 	}()
 }
 
+// Lets payment in flight finish and stops further payouts
+func (u *PayoutsProcessor) Stop() {
+	log.Println("Stopping payouts")
+	close(u.quit)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	log.Println("Payouts stopped")
+}
+
+// Default threshold for miners without own one, changed by config reload
+func (u *PayoutsProcessor) SetThreshold(threshold int64) {
+	atomic.StoreInt64(&u.threshold, threshold)
+	log.Printf("Set payout threshold to %v Shannon", threshold)
+}
+
+func (u *PayoutsProcessor) stopping() bool {
+	select {
+	case <-u.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (u *PayoutsProcessor) process() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer func() {
+		payoutsHalt.With(u.coin).SetBool(u.halt)
+	}()
+
 	if u.halt {
-		log.Println("Payments suspended due to last critical error:", u.lastFail)
-		os.Exit(1)
+		// Resumes once locked payouts were resolved via admin API
+		if ok, err := u.backend.PopUnhaltRequest("payouts"); err != nil {
+			log.Println("Failed to check un-halt request:", err)
+		} else if ok {
+			log.Println("Payouts resumed by admin request, last error was:", u.lastFail)
+			u.halt = false
+			u.lastFail = nil
+		}
+	}
+	if u.halt {
+		log.Println("Payments suspended due to last critical error, resolve it via admin API:", u.lastFail)
+		return
+	}
+
+	payments := u.backend.GetPendingPayments()
+	if len(payments) > 0 {
+		log.Printf("Previous payout failed, you have to resolve it via admin API. List of failed payments:\n %v",
+			formatPendingPayments(payments))
+		return
+	}
+	locked, err := u.backend.IsPayoutsLocked()
+	if err != nil {
+		log.Println("Unable to check payouts lock:", err)
+		return
+	}
+	payoutsLocked.With(u.coin).SetBool(locked)
+	if locked {
+		log.Println("Payouts are locked, you have to resolve it via admin API")
 		return
 	}
+
 	mustPay := 0
 	minersPaid := 0
 	totalAmount := big.NewInt(0)
@@ -122,13 +212,18 @@ func (u *PayoutsProcessor) process() {
 
 	waitingCount := 0
 	var wg sync.WaitGroup
+	var batch []*storage.PendingPayment
 
 	for _, login := range payees {
+		if u.stopping() {
+			log.Println("Payouts interrupted by shutdown")
+			break
+		}
 		amount, _ := u.backend.GetBalance(login)
 		amountInShannon := big.NewInt(amount)
 		ptresh, _ := u.backend.GetTreshold(login)
 		if ptresh <= 10 {
-			ptresh = u.config.Threshold
+			ptresh = atomic.LoadInt64(&u.threshold)
 		}
 
 		// Shannon^2 = Wei
@@ -139,6 +234,11 @@ func (u *PayoutsProcessor) process() {
 		}
 		mustPay++
 
+		if u.batch != nil {
+			batch = append(batch, &storage.PendingPayment{Address: login, Amount: amount})
+			continue
+		}
+
 		// Require active peers before processing
 		if !u.checkPeers() {
 			break
@@ -172,6 +272,7 @@ func (u *PayoutsProcessor) process() {
 			break
 		}
 		log.Printf("Locked payment for %s, %v Shannon", login, amount)
+		payoutsLocked.With(u.coin).Set(1)
 
 		// Debit miner's balance and update stats
 		err = u.backend.UpdateBalance(login, amount)
@@ -183,7 +284,7 @@ func (u *PayoutsProcessor) process() {
 		}
 
 		value := hexutil.EncodeBig(amountInWei)
-		txHash, err := u.rpc.SendTransaction(u.config.Address, login, u.config.GasHex(), u.config.GasPriceHex(), value, u.config.AutoGas)
+		txHash, err := u.sender.send(login, "", amountInWei, nil)
 		if err != nil {
 			log.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
 				login, amount, err, login)
@@ -211,34 +312,35 @@ func (u *PayoutsProcessor) process() {
 			break
 		}
 
+		u.recordNonce(txHash)
+
+		payoutsLocked.With(u.coin).Set(0)
+		payoutsPaid.With(u.coin).Add(float64(amount))
+		payoutsCount.With(u.coin).Inc()
+
 		minersPaid++
 		totalAmount.Add(totalAmount, big.NewInt(amount))
 		log.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
 
 		wg.Add(1)
 		waitingCount++
-		go func(txHash string, login string, wg *sync.WaitGroup) {
+		payoutsPendingTx.With(u.coin).Inc()
+		go func(txHash string, login string, amount int64, wg *sync.WaitGroup) {
+			defer wg.Done()
+			defer payoutsPendingTx.With(u.coin).Dec()
+
 			// Wait for TX confirmation before further payouts
-			for {
-				log.Printf("Waiting for tx confirmation: %v", txHash)
-				time.Sleep(txCheckInterval)
-				receipt, err := u.rpc.GetTxReceipt(txHash)
-				if err != nil {
-					log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
-					continue
-				}
-				// Tx has been mined
-				if receipt != nil && receipt.Confirmed() {
-					if receipt.Successful() {
-						log.Printf("Payout tx successful for %s: %s", login, txHash)
-					} else {
-						log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx.", login, txHash)
-					}
-					break
-				}
+			txHash, receipt := u.waitTx(txHash, []*storage.PendingPayment{{Address: login, Amount: amount}})
+			if receipt == nil {
+				// Payment is already logged, confirmation is only informational
+				return
+			}
+			if receipt.Successful() {
+				log.Printf("Payout tx successful for %s: %s", login, txHash)
+			} else {
+				log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx, payment is credited back by reconciliation if enabled.", login, txHash)
 			}
-			wg.Done()
-		}(txHash, login, &wg)
+		}(txHash, login, amount, &wg)
 
 		if waitingCount > u.config.ConcurrentTx {
 			wg.Wait()
@@ -249,6 +351,10 @@ func (u *PayoutsProcessor) process() {
 	wg.Wait()
 	waitingCount = 0
 
+	if len(batch) > 0 && u.checkPeers() && u.isUnlockedAccount() {
+		minersPaid, totalAmount = u.payBatches(batch)
+	}
+
 	if mustPay > 0 {
 		log.Printf("Paid total %v Shannon to %v of %v payees", totalAmount, minersPaid, mustPay)
 	} else {
@@ -261,7 +367,11 @@ func (u *PayoutsProcessor) process() {
 	}
 }
 
-func (self PayoutsProcessor) isUnlockedAccount() bool {
+func (self *PayoutsProcessor) isUnlockedAccount() bool {
+	// Key is held by payouts, not by node
+	if self.sender.signer != nil {
+		return true
+	}
 	_, err := self.rpc.Sign(self.config.Address, "0x0")
 	if err != nil {
 		log.Println("Unable to process payouts:", err)
@@ -270,7 +380,7 @@ func (self PayoutsProcessor) isUnlockedAccount() bool {
 	return true
 }
 
-func (self PayoutsProcessor) checkPeers() bool {
+func (self *PayoutsProcessor) checkPeers() bool {
 	n, err := self.rpc.GetPeerCount()
 	if err != nil {
 		log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
@@ -283,7 +393,7 @@ func (self PayoutsProcessor) checkPeers() bool {
 	return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int, threshold int64) bool {
+func (self *PayoutsProcessor) reachedThreshold(amount *big.Int, threshold int64) bool {
 	return big.NewInt(threshold).Cmp(amount) < 0
 }
 
@@ -295,7 +405,7 @@ func formatPendingPayments(list []*storage.PendingPayment) string {
 	return s
 }
 
-func (self PayoutsProcessor) bgSave() {
+func (self *PayoutsProcessor) bgSave() {
 	result, err := self.backend.BgSave()
 	if err != nil {
 		log.Println("Failed to perform BGSAVE on backend:", err)
@@ -303,37 +413,3 @@ func (self PayoutsProcessor) bgSave() {
 	}
 	log.Println("Saving backend state to disk:", result)
 }
-
-func (self PayoutsProcessor) resolvePayouts() {
-	payments := self.backend.GetPendingPayments()
-
-	if len(payments) > 0 {
-		log.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
-
-		for _, v := range payments {
-			err := self.backend.RollbackBalance(v.Address, v.Amount)
-			if err != nil {
-				log.Printf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
-				return
-			}
-			log.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
-		}
-		err := self.backend.UnlockPayouts()
-		if err != nil {
-			log.Println("Failed to unlock payouts:", err)
-			return
-		}
-	} else {
-		log.Println("No pending payments to resolve")
-	}
-
-	if self.config.BgSave {
-		self.bgSave()
-	}
-	log.Println("Payouts unlocked")
-}
-
-func (self PayoutsProcessor) mustResolvePayout() bool {
-	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
-	return v
-}
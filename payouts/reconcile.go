@@ -0,0 +1,263 @@
+package payouts
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type ReconcileConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// Payments logged within this period are re-checked
+	Window string `json:"window"`
+	// Confirmations of payout tx before its result is final
+	Depth int64 `json:"depth"`
+	// Payout tx unknown to node this long after payment is considered dropped
+	DropAfter string `json:"dropAfter"`
+	// Alert if pool wallet holds less than owed to miners by more than this, in Shannon
+	MaxDeficit int64 `json:"maxDeficit"`
+	// Alert if pool wallet holds more than owed by more than this, 0 disables
+	MaxSurplus int64 `json:"maxSurplus"`
+}
+
+// Re-checks logged payouts, credits back failed and dropped ones and compares
+// what is owed to miners with pool wallet balance
+type Reconciler struct {
+	coin    string
+	config  *PayoutsConfig
+	backend Backend
+	rpc     *rpc.RPCClient
+	mu      sync.Mutex
+	quit    chan struct{}
+}
+
+func NewReconciler(cfg *PayoutsConfig, backend Backend, coin string) *Reconciler {
+	if cfg.Reconcile.Depth < minDepth {
+		log.Fatalf("Reconcile depth can't be < %v, your depth is %v", minDepth, cfg.Reconcile.Depth)
+	}
+	if util.MustParseDuration(cfg.Reconcile.DropAfter) <= txCheckInterval {
+		log.Fatalln("Reconcile dropAfter is too short, payout txs would be credited back while pending")
+	}
+	r := &Reconciler{coin: coin, config: cfg, backend: backend, quit: make(chan struct{})}
+	r.rpc = rpc.NewRPCClient("Reconciler", cfg.Daemon, cfg.Timeout)
+	r.rpc.Coin = coin
+	return r
+}
+
+func (r *Reconciler) Start() {
+	log.Println("Starting payouts reconciliation")
+	intv := util.MustParseDuration(r.config.Reconcile.Interval)
+	timer := time.NewTimer(intv)
+	log.Printf("Set reconcile interval to %v", intv)
+
+	r.reconcile()
+	timer.Reset(intv)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				r.reconcile()
+				timer.Reset(intv)
+			case <-r.quit:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (r *Reconciler) Stop() {
+	log.Println("Stopping payouts reconciliation")
+	close(r.quit)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Println("Payouts reconciliation stopped")
+}
+
+func (r *Reconciler) reconcile() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.quit:
+		return
+	default:
+	}
+
+	height := pendingHeight(r.rpc)
+	if height == 0 {
+		log.Println("Skipping reconciliation, node is unreachable")
+		return
+	}
+	window := util.MustParseDuration(r.config.Reconcile.Window)
+	since := time.Now().Add(-window).Unix()
+	txs, err := r.backend.GetUnreconciledPayments(since)
+	if err != nil {
+		log.Println("Failed to get payments for reconciliation:", err)
+		return
+	}
+
+	reverted := int64(0)
+	for txHash, payments := range txs {
+		status, err := r.checkTx(txHash, payments, height)
+		if err != nil {
+			log.Printf("Failed to check payout tx %v: %v", txHash, err)
+			continue
+		}
+		switch status {
+		case storage.PaymentConfirmed:
+			if err := r.backend.MarkPaymentConfirmed(txHash); err != nil {
+				log.Printf("Failed to mark payout tx %v as confirmed: %v", txHash, err)
+			}
+		case storage.PaymentFailed, storage.PaymentDropped:
+			ok, err := r.backend.RevertPayment(txHash, status, payments)
+			if err != nil {
+				log.Printf("Failed to credit back payments of %v tx %v: %v", status, txHash, err)
+				continue
+			}
+			if ok {
+				reverted += int64(len(payments))
+				r.auditRevert(txHash, status, payments)
+			}
+		}
+	}
+	if reverted > 0 {
+		reconcileReverted.With(r.coin).Add(float64(reverted))
+	}
+	r.checkDrift(reverted)
+}
+
+// Empty status while tx result is not final yet
+func (r *Reconciler) checkTx(txHash string, payments []*storage.LoggedPayment, height int64) (string, error) {
+	receipt, err := r.rpc.GetTxReceipt(txHash)
+	if err != nil {
+		return "", err
+	}
+	if receipt != nil && receipt.Confirmed() {
+		mined, err := hexutil.DecodeUint64(receipt.BlockNumber)
+		if err != nil || height-int64(mined) < r.config.Reconcile.Depth {
+			return "", nil
+		}
+		if receipt.Successful() {
+			return storage.PaymentConfirmed, nil
+		}
+		return storage.PaymentFailed, nil
+	}
+
+	dropAfter := util.MustParseDuration(r.config.Reconcile.DropAfter)
+	if time.Since(time.Unix(payments[0].Timestamp, 0)) < dropAfter {
+		return "", nil
+	}
+	tx, err := r.rpc.GetTransactionByHash(txHash)
+	if err != nil {
+		return "", err
+	}
+	nonce, known, err := r.backend.GetPaymentNonce(txHash)
+	if err != nil {
+		return "", err
+	}
+	// Still waiting in tx pool
+	if tx != nil {
+		if !known {
+			if nonce, err := hexutil.DecodeUint64(tx.Nonce); err == nil {
+				r.backend.WritePaymentNonce(txHash, nonce)
+			}
+		}
+		return "", nil
+	}
+	if !known {
+		log.Printf("Payout tx %v is unknown to node and its nonce was not recorded, check it in block explorer", txHash)
+		return "", nil
+	}
+
+	// Unknown tx may still be broadcast again and mined until another one takes its nonce
+	latest, err := r.rpc.GetTransactionCount(r.config.Address, "latest")
+	if err != nil || latest <= nonce {
+		return "", err
+	}
+	// Mined since receipt was checked
+	receipt, err = r.rpc.GetTxReceipt(txHash)
+	if err != nil || (receipt != nil && receipt.Confirmed()) {
+		return "", err
+	}
+	// Nonce may be taken by tx this one replaced, payments go back to it
+	replaced, err := r.backend.GetReplacedTxs(txHash)
+	if err != nil {
+		return "", err
+	}
+	for _, old := range replaced {
+		receipt, err := r.rpc.GetTxReceipt(old)
+		if err != nil {
+			return "", err
+		}
+		if receipt != nil && receipt.Confirmed() {
+			log.Printf("Replaced payout tx %v was mined instead of %v, moving payments back to it", old, txHash)
+			return "", r.backend.ReplacePayment(txHash, old, pendingPayments(payments))
+		}
+	}
+	return storage.PaymentDropped, nil
+}
+
+func pendingPayments(payments []*storage.LoggedPayment) []*storage.PendingPayment {
+	result := make([]*storage.PendingPayment, len(payments))
+	for i, v := range payments {
+		result[i] = &storage.PendingPayment{Address: v.Address, Amount: v.Amount, Timestamp: v.Timestamp}
+	}
+	return result
+}
+
+func (r *Reconciler) auditRevert(txHash, status string, payments []*storage.LoggedPayment) {
+	for _, v := range payments {
+		log.Printf("WARNING: Payout tx %v %v, credited back %v Shannon to %v", txHash, status, v.Amount, v.Address)
+		entry := &storage.AuditEntry{
+			Actor:   "reconciler",
+			Action:  "revertPayment",
+			Target:  v.Address,
+			Amount:  v.Amount,
+			Details: fmt.Sprintf("%v tx %v", status, txHash),
+		}
+		if err := r.backend.WriteAudit(entry); err != nil {
+			log.Println("Failed to write audit entry:", err)
+		}
+	}
+}
+
+// Pool wallet must hold what is owed to miners, pool fees and gas spent make it drift
+func (r *Reconciler) checkDrift(reverted int64) {
+	balance, err := r.rpc.GetBalance(r.config.Address)
+	if err != nil {
+		log.Println("Failed to get pool balance for reconciliation:", err)
+		return
+	}
+	owed, err := r.backend.GetOwedBalance()
+	if err != nil {
+		log.Println("Failed to get owed balance for reconciliation:", err)
+		return
+	}
+	onChain := new(big.Int).Div(balance, util.Shannon).Int64()
+	state := &storage.ReconcileState{OnChain: onChain, Owed: owed, Drift: onChain - owed, Reverted: reverted}
+	cfg := &r.config.Reconcile
+	state.Alert = state.Drift < -cfg.MaxDeficit || (cfg.MaxSurplus > 0 && state.Drift > cfg.MaxSurplus)
+
+	reconcileDrift.With(r.coin).Set(float64(state.Drift))
+	reconcileAlert.With(r.coin).SetBool(state.Alert)
+	if state.Alert {
+		log.Printf("WARNING: Pool wallet drifted from balances, wallet has %v Shannon, owed to miners %v Shannon, drift %v Shannon",
+			onChain, owed, state.Drift)
+	} else {
+		log.Printf("Reconciled payouts, wallet has %v Shannon, owed to miners %v Shannon", onChain, owed)
+	}
+	if err := r.backend.WriteReconcileState(state); err != nil {
+		log.Println("Failed to write reconcile state:", err)
+	}
+}
@@ -0,0 +1,174 @@
+package payouts
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+const testReplacedTxHash = "0x7a2b0e2fdd83e1b8f8b1f6a5a5a3ad2d1b9b1b6a4b1c2d3e4f5a6b7c8d9e0f22"
+
+// Pool at height 100 has batch payout tx logged, depth of 10 makes it final
+func newTestReconciler(t *testing.T, node *testNode, dropAfter string) (*Reconciler, *storage.MemoryBackend) {
+	server := httptest.NewServer(node)
+	t.Cleanup(server.Close)
+	node.balance = "0x0"
+	node.height = 100
+
+	backend := storage.NewMemoryBackend(100)
+	for _, v := range testPayments {
+		backend.AdjustBalance(v.Address, v.Amount)
+	}
+	backend.LockPayouts("batch", 3500000000)
+	backend.UpdateBalances(testPayments)
+	backend.WriteBatchPayment(testTxHash, testPayments)
+
+	cfg := &PayoutsConfig{Address: testPool}
+	cfg.Reconcile = ReconcileConfig{Window: "1h", Depth: 10, DropAfter: dropAfter}
+	r := &Reconciler{config: cfg, backend: backend, quit: make(chan struct{})}
+	r.rpc = rpc.NewRPCClient("Reconciler", server.URL, "5s")
+	return r, backend
+}
+
+// Payments of tx are still logged and not credited back
+func expectUnreconciled(t *testing.T, name string, backend *storage.MemoryBackend, txHash string) {
+	t.Helper()
+	txs, _ := backend.GetUnreconciledPayments(0)
+	if len(txs) != 1 || len(txs[txHash]) != len(testPayments) {
+		t.Errorf("%v: expected payments of %v to be unreconciled, got %v", name, txHash, txs)
+	}
+	if balance, _ := backend.GetBalance(testPayments[0].Address); balance != 0 {
+		t.Errorf("%v: expected nothing credited back, got balance %v", name, balance)
+	}
+}
+
+// Payments of tx are credited back once with status
+func expectReverted(t *testing.T, name string, backend *storage.MemoryBackend, status string) {
+	t.Helper()
+	for _, v := range testPayments {
+		if balance, _ := backend.GetBalance(v.Address); balance != v.Amount {
+			t.Errorf("%v: expected %v credited back to %v, got %v", name, v.Amount, v.Address, balance)
+		}
+	}
+	if failed, _ := backend.GetFailedPayments(10); len(failed) != len(testPayments) || failed[0].Status != status {
+		t.Errorf("%v: expected payments %v, got %v", name, status, failed)
+	}
+}
+
+func TestReconcileConfirmed(t *testing.T) {
+	node := &testNode{}
+	r, backend := newTestReconciler(t, node, "0s")
+	node.mine(testTxHash, 95, true)
+	r.reconcile()
+	expectUnreconciled(t, "shallow", backend, testTxHash)
+
+	node.mine(testTxHash, 90, true)
+	r.reconcile()
+	if txs, _ := backend.GetUnreconciledPayments(0); len(txs) != 0 {
+		t.Errorf("Expected tx to be confirmed, got unreconciled %v", txs)
+	}
+	if balance, _ := backend.GetBalance(testPayments[0].Address); balance != 0 {
+		t.Errorf("Expected confirmed payment to stay paid, got balance %v", balance)
+	}
+}
+
+func TestReconcileFailed(t *testing.T) {
+	node := &testNode{}
+	r, backend := newTestReconciler(t, node, "1h")
+	node.mine(testTxHash, 90, false)
+	r.reconcile()
+	expectReverted(t, "failed", backend, storage.PaymentFailed)
+}
+
+func TestReconcileDropped(t *testing.T) {
+	node := &testNode{nonce: 6, latest: 6}
+	r, backend := newTestReconciler(t, node, "0s")
+	backend.WritePaymentNonce(testTxHash, 5)
+	r.reconcile()
+	expectReverted(t, "dropped", backend, storage.PaymentDropped)
+}
+
+func TestReconcileStillPending(t *testing.T) {
+	// Logged recently
+	node := &testNode{nonce: 6, latest: 6}
+	r, backend := newTestReconciler(t, node, "1h")
+	backend.WritePaymentNonce(testTxHash, 5)
+	r.reconcile()
+	expectUnreconciled(t, "recent", backend, testTxHash)
+
+	// Known to node, nonce is taken from it
+	node = &testNode{nonce: 6, latest: 5}
+	r, backend = newTestReconciler(t, node, "0s")
+	node.pend(testTxHash, 5)
+	r.reconcile()
+	expectUnreconciled(t, "in tx pool", backend, testTxHash)
+	if nonce, ok, _ := backend.GetPaymentNonce(testTxHash); !ok || nonce != 5 {
+		t.Errorf("Expected nonce of pending tx to be recorded, got %v %v", nonce, ok)
+	}
+
+	// Unknown to node, but may be broadcast again while its nonce is free
+	node = &testNode{nonce: 5, latest: 5}
+	r, backend = newTestReconciler(t, node, "0s")
+	backend.WritePaymentNonce(testTxHash, 5)
+	r.reconcile()
+	expectUnreconciled(t, "nonce not taken", backend, testTxHash)
+
+	// Nonce was never recorded
+	node = &testNode{nonce: 6, latest: 6}
+	r, backend = newTestReconciler(t, node, "0s")
+	r.reconcile()
+	expectUnreconciled(t, "nonce unknown", backend, testTxHash)
+
+	// Node is unreachable
+	r, backend = newTestReconciler(t, &testNode{}, "0s")
+	backend.WritePaymentNonce(testTxHash, 5)
+	r.rpc = rpc.NewRPCClient("Reconciler", "http://127.0.0.1:1", "1s")
+	r.reconcile()
+	expectUnreconciled(t, "node down", backend, testTxHash)
+}
+
+func TestReconcileReplacedMined(t *testing.T) {
+	node := &testNode{nonce: 6, latest: 5}
+	r, backend := newTestReconciler(t, node, "0s")
+	// Fee bump of logged tx lost the race to it
+	backend.ReplacePayment(testTxHash, testReplacedTxHash, testPayments)
+	backend.WritePaymentNonce(testReplacedTxHash, 5)
+	node.mine(testTxHash, 90, true)
+	r.reconcile()
+	expectUnreconciled(t, "replaced", backend, testTxHash)
+
+	r.reconcile()
+	if txs, _ := backend.GetUnreconciledPayments(0); len(txs) != 0 {
+		t.Errorf("Expected mined original to be confirmed, got unreconciled %v", txs)
+	}
+	if failed, _ := backend.GetFailedPayments(10); len(failed) != 0 {
+		t.Errorf("Expected nothing credited back, got %v", failed)
+	}
+}
+
+func TestReconcileAlreadyReconciled(t *testing.T) {
+	node := &testNode{nonce: 6, latest: 6}
+	r, backend := newTestReconciler(t, node, "0s")
+	backend.WritePaymentNonce(testTxHash, 5)
+	r.reconcile()
+	r.reconcile()
+	expectReverted(t, "dropped twice", backend, storage.PaymentDropped)
+
+	// Confirmed tx is not re-checked after node forgets it
+	node = &testNode{}
+	r, backend = newTestReconciler(t, node, "0s")
+	node.mine(testTxHash, 90, true)
+	r.reconcile()
+	node.drop(testTxHash)
+	node.setNonce(7, 7)
+	backend.WritePaymentNonce(testTxHash, 5)
+	r.reconcile()
+	if failed, _ := backend.GetFailedPayments(10); len(failed) != 0 {
+		t.Errorf("Expected confirmed payment to stay paid, got %v", failed)
+	}
+	if ok, _ := backend.RevertPayment(testTxHash, storage.PaymentDropped, nil); ok {
+		t.Error("Expected revert of confirmed tx to be refused")
+	}
+}
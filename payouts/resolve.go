@@ -0,0 +1,52 @@
+package payouts
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+// Resolves payments left pending by a failed payout. Given a login and the
+// hash of its tx found on chain, that payment is recorded as paid. Otherwise
+// payments of login, or all of them if login is empty, are credited back.
+// Payouts are unlocked and resumed once nothing is pending.
+func ResolvePayouts(backend Backend, login, txHash string) ([]*storage.PendingPayment, error) {
+	var resolved []*storage.PendingPayment
+	for _, v := range backend.GetPendingPayments() {
+		if len(login) > 0 && v.Address != login {
+			continue
+		}
+		if len(txHash) > 0 {
+			if err := backend.WritePayment(v.Address, txHash, v.Amount); err != nil {
+				return resolved, fmt.Errorf("Failed to log payment of %v Shannon to %s, tx: %s: %v", v.Amount, v.Address, txHash, err)
+			}
+			log.Printf("Logged payment of %v Shannon to %s, tx: %s", v.Amount, v.Address, txHash)
+		} else {
+			if err := backend.RollbackBalance(v.Address, v.Amount); err != nil {
+				return resolved, fmt.Errorf("Failed to credit %v Shannon back to %s: %v", v.Amount, v.Address, err)
+			}
+			log.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
+		}
+		resolved = append(resolved, v)
+		// Tx hash belongs to a single payment
+		if len(txHash) > 0 {
+			break
+		}
+	}
+	if len(login) > 0 && len(resolved) == 0 {
+		return nil, fmt.Errorf("No pending payment to %s", login)
+	}
+
+	if len(backend.GetPendingPayments()) > 0 {
+		return resolved, nil
+	}
+	if err := backend.UnlockPayouts(); err != nil {
+		return resolved, fmt.Errorf("Failed to unlock payouts: %v", err)
+	}
+	if err := backend.RequestUnhalt("payouts"); err != nil {
+		return resolved, fmt.Errorf("Failed to resume payouts: %v", err)
+	}
+	log.Println("Payouts unlocked")
+	return resolved, nil
+}
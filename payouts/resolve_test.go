@@ -0,0 +1,62 @@
+package payouts
+
+import (
+	"testing"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+func newPendingBackend(t *testing.T, payments map[string]int64) *storage.MemoryBackend {
+	backend := storage.NewMemoryBackend(100)
+	if err := backend.LockPayouts("0x0", 0); err != nil {
+		t.Fatal(err)
+	}
+	for login, amount := range payments {
+		backend.AdjustBalance(login, amount)
+		backend.UpdateBalance(login, amount)
+	}
+	return backend
+}
+
+func TestResolvePayoutsWithTx(t *testing.T) {
+	backend := newPendingBackend(t, map[string]int64{"0x1": 100, "0x2": 200})
+
+	resolved, err := ResolvePayouts(backend, "0x1", "0xtx")
+	if err != nil || len(resolved) != 1 {
+		t.Fatalf("Expected payment of 0x1 to be resolved, got %v, %v", resolved, err)
+	}
+	if pending := backend.GetPendingPayments(); len(pending) != 1 || pending[0].Address != "0x2" {
+		t.Errorf("Expected payment of 0x2 to stay pending, got %v", pending)
+	}
+	if ok, _ := backend.PopUnhaltRequest("payouts"); ok {
+		t.Error("Payouts must not resume while a payment is pending")
+	}
+	txs, _ := backend.GetUnreconciledPayments(0)
+	if len(txs["0xtx"]) != 1 || txs["0xtx"][0].Address != "0x1" {
+		t.Errorf("Expected payment of 0x1 to be logged with tx, got %v", txs)
+	}
+
+	if _, err := ResolvePayouts(backend, "", ""); err != nil {
+		t.Fatalf("Failed to credit back remaining payments: %v", err)
+	}
+	if balance, _ := backend.GetBalance("0x2"); balance != 200 {
+		t.Errorf("Expected 200 credited back to 0x2, got %v", balance)
+	}
+	if locked, _ := backend.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked once nothing is pending")
+	}
+	if ok, _ := backend.PopUnhaltRequest("payouts"); !ok {
+		t.Error("Payouts must be resumed once nothing is pending")
+	}
+}
+
+func TestResolvePayoutsUnknownLogin(t *testing.T) {
+	backend := newPendingBackend(t, map[string]int64{"0x1": 100})
+
+	if _, err := ResolvePayouts(backend, "0x9", ""); err == nil {
+		t.Error("Expected error for login without pending payment")
+	}
+	if len(backend.GetPendingPayments()) != 1 {
+		t.Error("Pending payment of other login must be kept")
+	}
+}
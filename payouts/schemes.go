@@ -0,0 +1,170 @@
+package payouts
+
+import (
+	"log"
+	"math"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type SchemeConfig struct {
+	// prop, pplns, pplnsTime, pps, pps+, fpps or solo
+	Type string `json:"type"`
+	// Window length for pplnsTime
+	Window string `json:"window"`
+}
+
+type RewardScheme interface {
+	Name() string
+	// Shares snapshotted into the round when a block is found
+	ShareWindow() (storage.ShareWindow, time.Duration)
+	// Splits miners profit of a block, returns Shannon and percent per login.
+	// Profit and tx fees are in Wei after pool fee, profit includes tx fees.
+	BlockRewards(block *storage.BlockData, shares map[string]int64, profit, txFees *big.Rat) (map[string]int64, map[string]*big.Rat)
+	// Shannon credited at share time against the current block reward, 0 if paid per block
+	ShareReward(diff int64, netDiff *big.Int, height int64, txFees *big.Int) int64
+	// Pool fee changed by config reload, used by schemes charging it at share time
+	SetPoolFee(fee float64)
+}
+
+// Fee percentage changeable by config reload
+type poolFee uint64
+
+func (f *poolFee) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64((*uint64)(f)))
+}
+
+func (f *poolFee) set(fee float64) {
+	atomic.StoreUint64((*uint64)(f), math.Float64bits(fee))
+}
+
+func NewRewardScheme(cfg *SchemeConfig, unlocker *UnlockerConfig, network string) RewardScheme {
+	switch cfg.Type {
+	case "prop":
+		return &roundScheme{name: "prop", window: storage.WindowRound}
+	case "", "pplns":
+		return &roundScheme{name: "pplns", window: storage.WindowLastShares}
+	case "pplnsTime":
+		if len(cfg.Window) == 0 {
+			log.Fatal("Reward scheme pplnsTime requires window")
+		}
+		return &roundScheme{name: "pplnsTime", window: storage.WindowTime, windowTime: util.MustParseDuration(cfg.Window)}
+	case "solo":
+		return &soloScheme{}
+	case "pps", "pps+", "fpps":
+		// Own copy, network params are needed for block reward at share time
+		ucfg := *unlocker
+		configureNetwork(&ucfg, network)
+		s := &ppsScheme{name: cfg.Type, config: &ucfg}
+		s.fee.set(ucfg.PoolFee)
+		return s
+	}
+	log.Fatalln("Invalid reward scheme", cfg.Type)
+	return nil
+}
+
+// PROP and PPLNS split the whole block among shares of a round, they differ only in round window
+type roundScheme struct {
+	name       string
+	window     storage.ShareWindow
+	windowTime time.Duration
+}
+
+func (s *roundScheme) Name() string {
+	return s.name
+}
+
+func (s *roundScheme) ShareWindow() (storage.ShareWindow, time.Duration) {
+	return s.window, s.windowTime
+}
+
+func (s *roundScheme) BlockRewards(block *storage.BlockData, shares map[string]int64, profit, txFees *big.Rat) (map[string]int64, map[string]*big.Rat) {
+	return splitRewards(shares, profit)
+}
+
+func (s *roundScheme) ShareReward(diff int64, netDiff *big.Int, height int64, txFees *big.Int) int64 {
+	return 0
+}
+
+func (s *roundScheme) SetPoolFee(fee float64) {}
+
+// Whole block goes to the finder
+type soloScheme struct{}
+
+func (s *soloScheme) Name() string {
+	return "solo"
+}
+
+func (s *soloScheme) ShareWindow() (storage.ShareWindow, time.Duration) {
+	return storage.WindowFinder, 0
+}
+
+func (s *soloScheme) BlockRewards(block *storage.BlockData, shares map[string]int64, profit, txFees *big.Rat) (map[string]int64, map[string]*big.Rat) {
+	return splitRewards(map[string]int64{block.Finder: 1}, profit)
+}
+
+func (s *soloScheme) ShareReward(diff int64, netDiff *big.Int, height int64, txFees *big.Int) int64 {
+	return 0
+}
+
+func (s *soloScheme) SetPoolFee(fee float64) {}
+
+// PPS pays block reward per share, PPS+ additionally splits tx fees of found
+// blocks PPLNS way, FPPS pays expected tx fees per share as well.
+// Block revenue reimburses the pool for share payments, miners profit not split
+// is booked as shareRewardsRepaid of finances and stays in pool wallet.
+type ppsScheme struct {
+	fee    poolFee
+	name   string
+	config *UnlockerConfig
+}
+
+func (s *ppsScheme) Name() string {
+	return s.name
+}
+
+func (s *ppsScheme) ShareWindow() (storage.ShareWindow, time.Duration) {
+	if s.name == "pps+" {
+		return storage.WindowLastShares, 0
+	}
+	return storage.WindowFinder, 0
+}
+
+func (s *ppsScheme) BlockRewards(block *storage.BlockData, shares map[string]int64, profit, txFees *big.Rat) (map[string]int64, map[string]*big.Rat) {
+	if s.name == "pps+" {
+		return splitRewards(shares, txFees)
+	}
+	return make(map[string]int64), make(map[string]*big.Rat)
+}
+
+func (s *ppsScheme) ShareReward(diff int64, netDiff *big.Int, height int64, txFees *big.Int) int64 {
+	if netDiff == nil || netDiff.Sign() <= 0 {
+		return 0
+	}
+	reward := getBlockReward(height, s.config)
+	if s.name == "fpps" && txFees != nil {
+		reward.Add(reward, txFees)
+	}
+	value := new(big.Rat).SetFrac(new(big.Int).Mul(reward, big.NewInt(diff)), netDiff)
+	value, _ = chargeFee(value, s.fee.get())
+	return weiToShannonInt64(value)
+}
+
+func (s *ppsScheme) SetPoolFee(fee float64) {
+	s.fee.set(fee)
+}
+
+func splitRewards(shares map[string]int64, reward *big.Rat) (map[string]int64, map[string]*big.Rat) {
+	total := int64(0)
+	for _, n := range shares {
+		total += n
+	}
+	if total == 0 {
+		return make(map[string]int64), make(map[string]*big.Rat)
+	}
+	return calculateRewardsForShares(shares, total, reward)
+}
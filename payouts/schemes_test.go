@@ -0,0 +1,153 @@
+package payouts
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+var schemeShares = map[string]int64{"0x0": 1000000, "0x1": 20000, "0x2": 5000, "0x3": 10, "0x4": 1}
+var schemeRewards = map[string]int64{"0x0": 4877996431, "0x1": 97559929, "0x2": 24389982, "0x3": 48780, "0x4": 4878}
+
+func checkRewards(t *testing.T, name string, rewards, expected map[string]int64) {
+	if len(rewards) != len(expected) {
+		t.Errorf("%v: must credit %v logins, credited %v", name, len(expected), len(rewards))
+	}
+	for login, amount := range expected {
+		if rewards[login] != amount {
+			t.Errorf("%v: amount for %v must be equal to %v vs %v", name, login, amount, rewards[login])
+		}
+	}
+}
+
+func TestRoundSchemes(t *testing.T) {
+	profit, _ := new(big.Rat).SetString("5000000000000000000")
+	txFees, _ := new(big.Rat).SetString("100000000000000000")
+	block := &storage.BlockData{Finder: "0x0"}
+
+	tests := []struct {
+		cfg        SchemeConfig
+		window     storage.ShareWindow
+		windowTime time.Duration
+	}{
+		{SchemeConfig{Type: "prop"}, storage.WindowRound, 0},
+		{SchemeConfig{Type: "pplns"}, storage.WindowLastShares, 0},
+		{SchemeConfig{Type: ""}, storage.WindowLastShares, 0},
+		{SchemeConfig{Type: "pplnsTime", Window: "2h"}, storage.WindowTime, 2 * time.Hour},
+	}
+	for _, test := range tests {
+		scheme := NewRewardScheme(&test.cfg, &UnlockerConfig{}, "classic")
+		window, windowTime := scheme.ShareWindow()
+		if window != test.window || windowTime != test.windowTime {
+			t.Errorf("%v: wrong share window %v %v", scheme.Name(), window, windowTime)
+		}
+		rewards, _ := scheme.BlockRewards(block, schemeShares, profit, txFees)
+		checkRewards(t, scheme.Name(), rewards, schemeRewards)
+		if scheme.ShareReward(4000000000, big.NewInt(4000000000000), 100, nil) != 0 {
+			t.Errorf("%v: must not pay at share time", scheme.Name())
+		}
+	}
+}
+
+func TestSoloScheme(t *testing.T) {
+	profit, _ := new(big.Rat).SetString("5000000000000000000")
+	block := &storage.BlockData{Finder: "0x3"}
+	scheme := NewRewardScheme(&SchemeConfig{Type: "solo"}, &UnlockerConfig{}, "classic")
+
+	rewards, percents := scheme.BlockRewards(block, schemeShares, profit, new(big.Rat))
+	checkRewards(t, "solo", rewards, map[string]int64{"0x3": 5000000000})
+	if percents["0x3"].Cmp(big.NewRat(1, 1)) != 0 {
+		t.Errorf("Finder must get 100%%, got %v", percents["0x3"])
+	}
+	if scheme.ShareReward(4000000000, big.NewInt(4000000000000), 100, nil) != 0 {
+		t.Error("Solo must not pay at share time")
+	}
+}
+
+func TestPPSSchemes(t *testing.T) {
+	profit, _ := new(big.Rat).SetString("5000000000000000000")
+	txFees, _ := new(big.Rat).SetString("100000000000000000")
+	feesWei := big.NewInt(1e18)
+	block := &storage.BlockData{Finder: "0x0"}
+	netDiff := big.NewInt(4000000000000)
+
+	tests := []struct {
+		name        string
+		shareReward int64
+		rewards     map[string]int64
+	}{
+		// 5 ETC * 4e9 / 4e12 - 1%
+		{"pps", 4950000, map[string]int64{}},
+		// Same per share, tx fees are split at block time
+		{"pps+", 4950000, map[string]int64{"0x0": 97559929, "0x1": 1951199, "0x2": 487800, "0x3": 976, "0x4": 98}},
+		// (5 ETC + 1 ETC expected fees) * 4e9 / 4e12 - 1%
+		{"fpps", 5940000, map[string]int64{}},
+	}
+	for _, test := range tests {
+		scheme := NewRewardScheme(&SchemeConfig{Type: test.name}, &UnlockerConfig{PoolFee: 1.0}, "classic")
+		if scheme.Name() != test.name {
+			t.Errorf("Wrong scheme name %v vs %v", scheme.Name(), test.name)
+		}
+		reward := scheme.ShareReward(4000000000, netDiff, 100, feesWei)
+		if reward != test.shareReward {
+			t.Errorf("%v: share reward must be equal to %v vs %v", test.name, test.shareReward, reward)
+		}
+		rewards, _ := scheme.BlockRewards(block, schemeShares, profit, txFees)
+		checkRewards(t, test.name, rewards, test.rewards)
+		if scheme.ShareReward(4000000000, big.NewInt(0), 100, feesWei) != 0 {
+			t.Errorf("%v: must not pay without network difficulty", test.name)
+		}
+	}
+}
+
+// Round of schemeShares for every block
+type schemeBackend struct {
+	*storage.MemoryBackend
+}
+
+func (b *schemeBackend) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	return schemeShares, nil
+}
+
+func TestPPSBlockRepaysPool(t *testing.T) {
+	reward, _ := new(big.Int).SetString("5100000000000000000", 10)
+	txFees, _ := new(big.Int).SetString("100000000000000000", 10)
+
+	tests := []struct {
+		name string
+		solo bool
+		// Shannon split among miners and kept by pool
+		split  int64
+		repaid int64
+	}{
+		// 5.1 ETC - 1%
+		{"pps", false, 0, 5049000000},
+		{"fpps", false, 0, 5049000000},
+		// 0.1 ETC tx fees - 1% are split, rounded per miner
+		{"pps+", false, 99000001, 4949999999},
+		// Solo finder takes the whole block without solo fee
+		{"pps", true, 5100000000, 0},
+	}
+	for _, test := range tests {
+		cfg := &UnlockerConfig{PoolFee: 1.0}
+		u := &BlockUnlocker{config: cfg, backend: &schemeBackend{storage.NewMemoryBackend(100)}, scheme: NewRewardScheme(&SchemeConfig{Type: test.name}, cfg, "classic")}
+		u.poolFee.set(cfg.PoolFee)
+		block := &storage.BlockData{Finder: "0x0", Reward: reward, TxFees: txFees, Solo: test.solo}
+		_, _, _, rewards, _, err := u.calculateRewards(block)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		split := int64(0)
+		for login, amount := range rewards {
+			if login != strings.ToLower(donationAccount) {
+				split += amount
+			}
+		}
+		if split != test.split || block.ShareRewardsRepaid != test.repaid {
+			t.Errorf("%v solo %v: expected %v Shannon split and %v repaid, got %v and %v", test.name, test.solo, test.split, test.repaid, split, block.ShareRewardsRepaid)
+		}
+	}
+}
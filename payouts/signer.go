@@ -0,0 +1,303 @@
+package payouts
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type SignerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Encrypted keystore file, password is read from passwordFile or PAYOUTS_KEY_PASSWORD env
+	Keystore     string `json:"keystore"`
+	PasswordFile string `json:"passwordFile"`
+	// File with hex private key, PAYOUTS_PRIVATE_KEY env is used if there is no keystore or key file
+	KeyFile string `json:"keyFile"`
+	// Fetched from node if 0
+	ChainId int64 `json:"chainId"`
+}
+
+// Signs payout txs in-process, so the account is never unlocked on node
+type txSigner struct {
+	sync.Mutex
+	key     *ecdsa.PrivateKey
+	address common.Address
+	signer  types.Signer
+	// Nonce of last sent tx + 1
+	nonce uint64
+	// Hash of last sent tx, or of its replacement
+	last string
+	// Txs waiting for confirmation, kept for replacement
+	sent map[string]types.TxData
+}
+
+func newTxSigner(cfg *SignerConfig, client *rpc.RPCClient) (*txSigner, error) {
+	key, err := loadSignerKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	chainId := cfg.ChainId
+	if chainId == 0 {
+		chainId, err = client.GetChainId()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get chain id: %v", err)
+		}
+	}
+	s := &txSigner{
+		key:     key,
+		address: crypto.PubkeyToAddress(key.PublicKey),
+		signer:  types.LatestSignerForChainID(big.NewInt(chainId)),
+		sent:    make(map[string]types.TxData),
+	}
+	log.Printf("Signing payouts locally for %v on chain %v", s.address.Hex(), chainId)
+	return s, nil
+}
+
+func loadSignerKey(cfg *SignerConfig) (*ecdsa.PrivateKey, error) {
+	if len(cfg.Keystore) > 0 {
+		keyJson, err := os.ReadFile(cfg.Keystore)
+		if err != nil {
+			return nil, err
+		}
+		password := os.Getenv("PAYOUTS_KEY_PASSWORD")
+		if len(cfg.PasswordFile) > 0 {
+			data, err := os.ReadFile(cfg.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimRight(string(data), "\r\n")
+		}
+		key, err := keystore.DecryptKey(keyJson, password)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt keystore: %v", err)
+		}
+		return key.PrivateKey, nil
+	}
+
+	hexKey := os.Getenv("PAYOUTS_PRIVATE_KEY")
+	if len(cfg.KeyFile) > 0 {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		hexKey = string(data)
+	}
+	if len(hexKey) == 0 {
+		return nil, errors.New("No keystore, key file or PAYOUTS_PRIVATE_KEY env for payouts signer")
+	}
+	return crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(hexKey), "0x"))
+}
+
+// Picks nonce of next tx. Local counter is used unless node is ahead of it,
+// node's pending nonce may lag behind txs it hasn't seen yet. If node doesn't
+// know our last tx at all, it was dropped and the gap is filled from node's
+// nonce, as later txs would be stuck behind it.
+func (s *txSigner) nextNonce(client *rpc.RPCClient) (uint64, error) {
+	pending, err := client.GetTransactionCount(s.address.Hex(), "pending")
+	if err != nil {
+		return 0, err
+	}
+	if pending >= s.nonce || len(s.last) == 0 {
+		s.nonce = pending
+		return s.nonce, nil
+	}
+	tx, err := client.GetTransactionByHash(s.last)
+	if err != nil {
+		return 0, err
+	}
+	if tx != nil {
+		return s.nonce, nil
+	}
+	latest, err := client.GetTransactionCount(s.address.Hex(), "latest")
+	if err != nil {
+		return 0, err
+	}
+	if latest < pending {
+		latest = pending
+	}
+	log.Printf("Nonce gap detected, last sent tx %v with nonce %v is unknown to node, reusing nonce %v", s.last, s.nonce-1, latest)
+	s.nonce = latest
+	s.last = ""
+	return s.nonce, nil
+}
+
+func (s *txSigner) sign(tx types.TxData) (string, error) {
+	signed, err := types.SignNewTx(s.key, s.signer, tx)
+	if err != nil {
+		return "", err
+	}
+	raw, err := signed.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return hexutil.Encode(raw), nil
+}
+
+// Sends txs from pool address, through node's unlocked account or signed locally
+type txSender struct {
+	config *PayoutsConfig
+	rpc    *rpc.RPCClient
+	signer *txSigner
+}
+
+// Gas is hex, config or node estimate is used if it's empty
+func (s *txSender) send(to, gas string, value *big.Int, data []byte) (string, error) {
+	if s.signer == nil {
+		if len(data) == 0 {
+			return s.rpc.SendTransaction(s.config.Address, to, s.config.GasHex(), s.config.GasPriceHex(), hexutil.EncodeBig(value), s.config.AutoGas)
+		}
+		gasPrice := ""
+		if !s.config.AutoGas {
+			gasPrice = s.config.GasPriceHex()
+		}
+		return s.rpc.SendContractTransaction(s.config.Address, to, gas, gasPrice, hexutil.EncodeBig(value), hexutil.Encode(data))
+	}
+
+	s.signer.Lock()
+	defer s.signer.Unlock()
+
+	gasLimit, err := s.gasLimit(to, gas, value, data)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := s.signer.nextNonce(s.rpc)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get nonce: %v", err)
+	}
+	tx, err := s.buildTx(nonce, to, gasLimit, value, data)
+	if err != nil {
+		return "", err
+	}
+	raw, err := s.signer.sign(tx)
+	if err != nil {
+		return "", fmt.Errorf("Failed to sign tx: %v", err)
+	}
+	txHash, err := s.rpc.SendRawTransaction(raw)
+	if err != nil {
+		return "", err
+	}
+	s.signer.nonce = nonce + 1
+	s.signer.last = txHash
+	s.signer.sent[txHash] = tx
+	return txHash, nil
+}
+
+// Sends tx again with same nonce and bumped fees, so it's mined instead of a stuck one
+func (s *txSender) replace(txHash string) (string, error) {
+	if s.signer == nil {
+		return "", errors.New("Only locally signed txs can be replaced")
+	}
+	s.signer.Lock()
+	defer s.signer.Unlock()
+
+	prev, ok := s.signer.sent[txHash]
+	if !ok {
+		return "", fmt.Errorf("Tx %v was not sent by this process", txHash)
+	}
+	tx, err := s.bumpFees(prev)
+	if err != nil {
+		return "", err
+	}
+	raw, err := s.signer.sign(tx)
+	if err != nil {
+		return "", fmt.Errorf("Failed to sign tx: %v", err)
+	}
+	newHash, err := s.rpc.SendRawTransaction(raw)
+	if err != nil {
+		return "", err
+	}
+	s.signer.sent[newHash] = tx
+	if s.signer.last == txHash {
+		s.signer.last = newHash
+	}
+	return newHash, nil
+}
+
+// Nonce of sent tx, known to signer if signed locally and asked from node otherwise
+func (s *txSender) nonceOf(txHash string) (uint64, error) {
+	if s.signer != nil {
+		s.signer.Lock()
+		tx, ok := s.signer.sent[txHash]
+		s.signer.Unlock()
+		if ok {
+			return types.NewTx(tx).Nonce(), nil
+		}
+	}
+	tx, err := s.rpc.GetTransactionByHash(txHash)
+	if err != nil {
+		return 0, err
+	}
+	if tx == nil {
+		return 0, fmt.Errorf("Tx %v is unknown to node", txHash)
+	}
+	return hexutil.DecodeUint64(tx.Nonce)
+}
+
+// Drops txs kept for replacement once one of them is mined
+func (s *txSender) forget(hashes []string) {
+	if s.signer == nil {
+		return
+	}
+	s.signer.Lock()
+	defer s.signer.Unlock()
+	for _, v := range hashes {
+		delete(s.signer.sent, v)
+	}
+}
+
+func (s *txSender) gasLimit(to, gas string, value *big.Int, data []byte) (uint64, error) {
+	if len(gas) > 0 {
+		return hexutil.DecodeUint64(gas)
+	}
+	if !s.config.AutoGas {
+		return util.String2Big(s.config.Gas).Uint64(), nil
+	}
+	estimate, err := s.rpc.EstimateGas(s.config.Address, to, hexutil.EncodeBig(value), hexutil.Encode(data))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to estimate gas: %v", err)
+	}
+	return uint64(estimate), nil
+}
+
+// EIP-1559 tx with dynamic fees or maxPriorityFee, EIP-155 legacy tx otherwise
+func (s *txSender) buildTx(nonce uint64, to string, gas uint64, value *big.Int, data []byte) (types.TxData, error) {
+	recipient := common.HexToAddress(to)
+	fees, err := s.suggestFees()
+	if err != nil {
+		return nil, err
+	}
+	if fees.gasPrice == nil {
+		return &types.DynamicFeeTx{
+			ChainID:   s.signer.signer.ChainID(),
+			Nonce:     nonce,
+			GasTipCap: fees.tipCap,
+			GasFeeCap: fees.feeCap,
+			Gas:       gas,
+			To:        &recipient,
+			Value:     value,
+			Data:      data,
+		}, nil
+	}
+	return &types.LegacyTx{
+		Nonce:    nonce,
+		GasPrice: fees.gasPrice,
+		Gas:      gas,
+		To:       &recipient,
+		Value:    value,
+		Data:     data,
+	}, nil
+}
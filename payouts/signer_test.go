@@ -0,0 +1,188 @@
+package payouts
+
+import (
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+)
+
+const testKey = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+
+func newTestSender(t *testing.T, node *testNode, cfg *PayoutsConfig) (*txSender, func()) {
+	server := httptest.NewServer(node)
+	client := rpc.NewRPCClient("test", server.URL, "5s")
+	t.Setenv("PAYOUTS_PRIVATE_KEY", testKey)
+	signer, err := newTxSigner(&SignerConfig{Enabled: true, ChainId: 61}, client)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return &txSender{config: cfg, rpc: client, signer: signer}, server.Close
+}
+
+func TestSignLegacyTx(t *testing.T) {
+	node := &testNode{nonce: 7}
+	cfg := &PayoutsConfig{Gas: "21000", GasPrice: "50000000000"}
+	sender, stop := newTestSender(t, node, cfg)
+	defer stop()
+
+	to := "0x00000000000000000000000000000000000000aa"
+	txHash, err := sender.send(to, "", big.NewInt(1000), nil)
+	if err != nil {
+		t.Fatalf("Failed to send tx: %v", err)
+	}
+	tx := node.sent[0]
+	if tx.Hash().Hex() != txHash {
+		t.Errorf("Wrong tx hash %v", txHash)
+	}
+	if tx.Type() != types.LegacyTxType || tx.ChainId().Int64() != 61 || !tx.Protected() {
+		t.Errorf("Must be EIP-155 legacy tx on chain 61, got type %v chain %v", tx.Type(), tx.ChainId())
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(big.NewInt(61)), tx)
+	key, _ := crypto.HexToECDSA(testKey)
+	if err != nil || from != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Errorf("Wrong sender %v: %v", from.Hex(), err)
+	}
+	if tx.Nonce() != 7 || tx.Gas() != 21000 || tx.GasPrice().Int64() != 50000000000 {
+		t.Errorf("Wrong nonce %v, gas %v or gas price %v", tx.Nonce(), tx.Gas(), tx.GasPrice())
+	}
+	if *tx.To() != common.HexToAddress(to) || tx.Value().Int64() != 1000 {
+		t.Errorf("Wrong recipient %v or value %v", tx.To().Hex(), tx.Value())
+	}
+}
+
+func TestSignDynamicFeeTx(t *testing.T) {
+	node := &testNode{}
+	cfg := &PayoutsConfig{Gas: "21000", MaxPriorityFee: "1000000000"}
+	sender, stop := newTestSender(t, node, cfg)
+	defer stop()
+
+	if _, err := sender.send("0x00000000000000000000000000000000000000aa", "", big.NewInt(1000), nil); err != nil {
+		t.Fatalf("Failed to send tx: %v", err)
+	}
+	tx := node.sent[0]
+	if tx.Type() != types.DynamicFeeTxType || tx.ChainId().Int64() != 61 {
+		t.Fatalf("Must be EIP-1559 tx on chain 61, got type %v chain %v", tx.Type(), tx.ChainId())
+	}
+	// Twice base fee of 2 Gwei plus tip
+	if tx.GasTipCap().Int64() != 1000000000 || tx.GasFeeCap().Int64() != 5000000000 {
+		t.Errorf("Wrong tip %v or fee cap %v", tx.GasTipCap(), tx.GasFeeCap())
+	}
+}
+
+func TestSignerNonceAheadOfLaggingNode(t *testing.T) {
+	node := &testNode{nonce: 3, latest: 3}
+	cfg := &PayoutsConfig{Gas: "21000", GasPrice: "50000000000"}
+	sender, stop := newTestSender(t, node, cfg)
+	defer stop()
+
+	to := "0x00000000000000000000000000000000000000aa"
+	for i := 0; i < 3; i++ {
+		if _, err := sender.send(to, "", big.NewInt(1000), nil); err != nil {
+			t.Fatalf("Failed to send tx: %v", err)
+		}
+		// Node doesn't count sent txs into pending nonce yet
+		node.setNonce(3, 3)
+	}
+	nonces := []uint64{node.sent[0].Nonce(), node.sent[1].Nonce(), node.sent[2].Nonce()}
+	if nonces[0] != 3 || nonces[1] != 4 || nonces[2] != 5 {
+		t.Errorf("Nonce must not be reused while node lags, got %v", nonces)
+	}
+
+	// Node ahead of local counter, e.g. tx sent by another wallet
+	node.setNonce(9, 9)
+	if _, err := sender.send(to, "", big.NewInt(1000), nil); err != nil {
+		t.Fatalf("Failed to send tx: %v", err)
+	}
+	if nonce := node.sent[3].Nonce(); nonce != 9 {
+		t.Errorf("Nonce must follow node ahead of local counter, got %v", nonce)
+	}
+}
+
+func TestSignerReusesDroppedNonce(t *testing.T) {
+	node := &testNode{nonce: 3, latest: 3}
+	cfg := &PayoutsConfig{Gas: "21000", GasPrice: "50000000000"}
+	sender, stop := newTestSender(t, node, cfg)
+	defer stop()
+
+	to := "0x00000000000000000000000000000000000000aa"
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		txHash, err := sender.send(to, "", big.NewInt(1000), nil)
+		if err != nil {
+			t.Fatalf("Failed to send tx: %v", err)
+		}
+		hashes = append(hashes, txHash)
+	}
+	// First tx mined, last one dropped from node's pool
+	node.mine(hashes[0], 1, true)
+	node.drop(hashes[1])
+	node.setNonce(4, 4)
+	if _, err := sender.send(to, "", big.NewInt(1000), nil); err != nil {
+		t.Fatalf("Failed to send tx: %v", err)
+	}
+	nonces := []uint64{node.sent[0].Nonce(), node.sent[1].Nonce(), node.sent[2].Nonce()}
+	if nonces[0] != 3 || nonces[1] != 4 || nonces[2] != 4 {
+		t.Errorf("Dropped nonce must be reused, got %v", nonces)
+	}
+	if sender.signer.nonce != 5 {
+		t.Errorf("Next nonce must be 5, got %v", sender.signer.nonce)
+	}
+}
+
+func TestDynamicFees(t *testing.T) {
+	node := &testNode{}
+	cfg := &PayoutsConfig{Gas: "21000", Fees: FeeConfig{Dynamic: true, HistoryBlocks: 3, TipPercentile: 50, MaxFee: "5500000000"}}
+	sender, stop := newTestSender(t, node, cfg)
+	defer stop()
+
+	if _, err := sender.send("0x00000000000000000000000000000000000000aa", "", big.NewInt(1000), nil); err != nil {
+		t.Fatalf("Failed to send tx: %v", err)
+	}
+	tx := node.sent[0]
+	// Median tip of history, fee cap of 6 Gwei limited by maxFee
+	if tx.Type() != types.DynamicFeeTxType || tx.GasTipCap().Int64() != 2000000000 || tx.GasFeeCap().Int64() != 5500000000 {
+		t.Errorf("Wrong type %v, tip %v or fee cap %v", tx.Type(), tx.GasTipCap(), tx.GasFeeCap())
+	}
+}
+
+func TestReplaceStuckTx(t *testing.T) {
+	node := &testNode{nonce: 9}
+	cfg := &PayoutsConfig{Gas: "21000", MaxPriorityFee: "1000000000", Fees: FeeConfig{Bump: 12, MaxFee: "6000000000"}}
+	sender, stop := newTestSender(t, node, cfg)
+	defer stop()
+
+	txHash, err := sender.send("0x00000000000000000000000000000000000000aa", "", big.NewInt(1000), nil)
+	if err != nil {
+		t.Fatalf("Failed to send tx: %v", err)
+	}
+	newHash, err := sender.replace(txHash)
+	if err != nil {
+		t.Fatalf("Failed to replace tx: %v", err)
+	}
+	prev, tx := node.sent[0], node.sent[1]
+	if newHash == txHash || tx.Hash().Hex() != newHash {
+		t.Errorf("Replacement must be a new tx, got %v", newHash)
+	}
+	if tx.Nonce() != prev.Nonce() || *tx.To() != *prev.To() || tx.Value().Cmp(prev.Value()) != 0 {
+		t.Error("Replacement must be the same payment with same nonce")
+	}
+	// Tip bumped by 12%, fee cap of 5 Gwei too
+	if tx.GasTipCap().Int64() != 1120000000 || tx.GasFeeCap().Int64() != 5600000000 {
+		t.Errorf("Wrong bumped tip %v or fee cap %v", tx.GasTipCap(), tx.GasFeeCap())
+	}
+
+	// Another bump would exceed maxFee
+	if _, err := sender.replace(newHash); err != errMaxFeeReached {
+		t.Errorf("Replacement above maxFee must fail, got %v", err)
+	}
+	sender.forget([]string{txHash, newHash})
+	if _, err := sender.replace(newHash); err == nil {
+		t.Error("Forgotten tx must not be replaced")
+	}
+}
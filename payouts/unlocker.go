@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"log"
 	"math/big"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/math"
@@ -19,6 +19,7 @@ import (
 type UnlockerConfig struct {
 	Enabled              bool     `json:"enabled"`
 	PoolFee              float64  `json:"poolFee"`
+	SoloFee              float64  `json:"soloFee"`
 	PoolFeeAddress       string   `json:"poolFeeAddress"`
 	Depth                int64    `json:"depth"`
 	ImmatureDepth        int64    `json:"immatureDepth"`
@@ -72,14 +73,40 @@ const donationFee = 1.0
 const donationAccount = "0xFc9B271B1b03B60e5aD68CB89Bb1016b9eAc2baC"
 
 type BlockUnlocker struct {
+	coin     string
+	poolFee  poolFee
 	config   *UnlockerConfig
-	backend  *storage.RedisClient
+	backend  Backend
 	rpc      *rpc.RPCClient
+	scheme   RewardScheme
 	halt     bool
 	lastFail error
+	// Held while unlocking, so shutdown doesn't interrupt crediting
+	mu   sync.Mutex
+	quit chan struct{}
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient, network string) *BlockUnlocker {
+func NewBlockUnlocker(cfg *UnlockerConfig, backend Backend, network string, scheme RewardScheme, coin string) *BlockUnlocker {
+	configureNetwork(cfg, network)
+
+	if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
+		log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
+	}
+	if cfg.Depth < minDepth*2 {
+		log.Fatalf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
+	}
+	if cfg.ImmatureDepth < minDepth {
+		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
+	}
+	u := &BlockUnlocker{coin: coin, config: cfg, backend: backend, scheme: scheme, quit: make(chan struct{})}
+	u.poolFee.set(cfg.PoolFee)
+	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
+	u.rpc.Coin = coin
+	log.Printf("Using %v reward scheme", scheme.Name())
+	return u
+}
+
+func configureNetwork(cfg *UnlockerConfig, network string) {
 	// determine which monetary policy to use based on network
 	// configure any reward params if needed.
 	if network == "classic" {
@@ -116,19 +143,6 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient, network
 	}
 
 	cfg.Network = network
-
-	if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
-		log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
-	}
-	if cfg.Depth < minDepth*2 {
-		log.Fatalf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
-	}
-	if cfg.ImmatureDepth < minDepth {
-		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
-	}
-	u := &BlockUnlocker{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
-	return u
 }
 
 func (u *BlockUnlocker) Start() {
@@ -138,22 +152,70 @@ func (u *BlockUnlocker) Start() {
 	log.Printf("Set block unlock interval to %v", intv)
 
 	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
+	u.unlock()
 	timer.Reset(intv)
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.unlockPendingBlocks()
-				u.unlockAndCreditMiners()
+				u.unlock()
 				timer.Reset(intv)
+			case <-u.quit:
+				timer.Stop()
+				return
 			}
 		}
 	}()
 }
 
+func (u *BlockUnlocker) unlock() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	select {
+	case <-u.quit:
+		return
+	default:
+	}
+	halted := u.halt
+	if halted {
+		// Resumes once operator fixed the error and un-halted via admin API
+		if ok, err := u.backend.PopUnhaltRequest("unlocker"); err != nil {
+			log.Printf("Failed to check un-halt request: %v", err)
+		} else if ok {
+			log.Println("Block unlocker resumed by admin request, last error was:", u.lastFail)
+			u.halt = false
+			u.lastFail = nil
+			halted = false
+		}
+	}
+	u.unlockPendingBlocks()
+	u.unlockAndCreditMiners()
+	if u.halt && !halted {
+		log.Println("Block unlocker halted due to critical error, fix it and un-halt via admin API or restart:", u.lastFail)
+	}
+	unlockerHalt.With(u.coin).SetBool(u.halt)
+	if err := u.backend.WriteUnlockerState(u.halt, u.lastFail); err != nil {
+		log.Printf("Failed to write unlocker state to backend: %v", err)
+	}
+}
+
+// Applied on config reload to blocks credited from now on
+func (u *BlockUnlocker) SetPoolFee(fee float64) {
+	u.poolFee.set(fee)
+	log.Printf("Set pool fee to %v%%", fee)
+}
+
+// Waits for unlocking in progress and stops further runs
+func (u *BlockUnlocker) Stop() {
+	log.Println("Stopping block unlocker")
+	close(u.quit)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	log.Println("Block unlocker stopped")
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -285,71 +347,11 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 		return err
 	}
 	candidate.Height = correctHeight
-	var reward *big.Int = big.NewInt(0)
-	if u.config.Network == "classic" || u.config.Network == "mordor" {
-		era := GetBlockEra(big.NewInt(candidate.Height), u.config.Ecip1017EraRounds)
-		reward = getConstReward(era)
-		// Add reward for including uncles
-		uncleReward := getRewardForUncle(reward)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-
-	} else if u.config.Network == "ubiq" {
-		reward = getConstRewardUbiq(candidate.Height)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-
-	} else if u.config.Network == "expanse" {
-		reward = getConstRewardExpanse(candidate.Height)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-
-	} else if u.config.Network == "etica" {
-		reward = getConstRewardetica(candidate.Height)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-
-	} else if u.config.Network == "callisto" {
-		reward = getConstRewardcallisto(candidate.Height)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-
-	} else if u.config.Network == "ethereumPow" {
-		reward = getConstRewardEthereumpow(candidate.Height)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-
-	} else if u.config.Network == "ethereum" || u.config.Network == "ropsten" || u.config.Network == "ethereumFair" {
-		reward = getConstRewardEthereum(candidate.Height, u.config)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-	} else if u.config.Network == "octaspace" {
-		reward = getConstRewardOctaspace(candidate.Height)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-	} else if u.config.Network == "universal" {
-		reward = getConstRewardUniversal(candidate.Height)
-		// Add reward for including uncles
-		uncleReward := new(big.Int).Div(reward, big32)
-		rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-		reward.Add(reward, rewardForUncles)
-	} else {
-		log.Fatalln("Invalid network set", u.config.Network)
-	}
+	reward := getBlockReward(candidate.Height, u.config)
+	// Add reward for including uncles
+	uncleReward := getRewardForUncle(reward)
+	rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
+	reward.Add(reward, rewardForUncles)
 
 	// Add TX fees
 	extraTxReward, err := u.getExtraRewardForTx(block)
@@ -379,12 +381,44 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 	log.Println("BurntFees: ", burntFees)
 	reward.Sub(reward, burntFees)
 
+	// Fees that actually went to the pool
+	candidate.TxFees = new(big.Int).Sub(extraTxReward, burntFees)
+	if candidate.TxFees.Sign() < 0 {
+		candidate.TxFees.SetInt64(0)
+	}
+
 	candidate.Orphan = false
 	candidate.Hash = block.Hash
 	candidate.Reward = reward
 	return nil
 }
 
+// Static block reward without uncle inclusion rewards and tx fees
+func getBlockReward(height int64, cfg *UnlockerConfig) *big.Int {
+	switch cfg.Network {
+	case "classic", "mordor":
+		return getConstReward(GetBlockEra(big.NewInt(height), cfg.Ecip1017EraRounds))
+	case "ubiq":
+		return getConstRewardUbiq(height)
+	case "expanse":
+		return getConstRewardExpanse(height)
+	case "etica":
+		return getConstRewardetica(height)
+	case "callisto":
+		return getConstRewardcallisto(height)
+	case "ethereumPow":
+		return getConstRewardEthereumpow(height)
+	case "ethereum", "ropsten", "ethereumFair":
+		return getConstRewardEthereum(height, cfg)
+	case "octaspace":
+		return getConstRewardOctaspace(height)
+	case "universal":
+		return getConstRewardUniversal(height)
+	}
+	log.Fatalln("Invalid network set", cfg.Network)
+	return nil
+}
+
 func handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.BlockData, cfg *UnlockerConfig) error {
 	uncleHeight, err := strconv.ParseInt(strings.Replace(uncle.Number, "0x", "", -1), 16, 64)
 	if err != nil {
@@ -423,7 +457,6 @@ func handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.Bloc
 func (u *BlockUnlocker) unlockPendingBlocks() {
 	if u.halt {
 		log.Println("Unlocking suspended due to last critical error:", u.lastFail)
-		os.Exit(1)
 		return
 	}
 
@@ -450,6 +483,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		return
 	}
 
+	unlockerCandidates.With(u.coin).Set(float64(len(candidates)))
 	if len(candidates) == 0 {
 		log.Println("No block candidates to unlock")
 		return
@@ -472,6 +506,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		return
 	} else {
 		log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
+		unlockerOrphans.With(u.coin).Add(float64(result.orphans))
 	}
 
 	totalRevenue := new(big.Rat)
@@ -505,6 +540,9 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 			util.FormatRatReward(poolProfit),
 		)
 		entries := []string{logEntry}
+		if block.ShareRewardsRepaid > 0 {
+			entries = append(entries, fmt.Sprintf("\tREPAID %v: %v Shannon of share rewards", block.RoundKey(), block.ShareRewardsRepaid))
+		}
 		for login, reward := range roundRewards {
 			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
 			per := new(big.Rat)
@@ -553,6 +591,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		return
 	}
 
+	unlockerImmature.With(u.coin).Set(float64(len(immature)))
 	if len(immature) == 0 {
 		log.Println("No immature blocks to credit miners")
 		return
@@ -575,6 +614,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 			log.Printf("Failed to insert orphaned block into backend: %v", err)
 			return
 		}
+		unlockerOrphans.With(u.coin).Inc()
 	}
 	log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
 
@@ -597,6 +637,12 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 			log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
+		// FPPS pays expected tx fees per share
+		if block.TxFees != nil {
+			if err := u.backend.UpdateAvgTxFees(new(big.Int).Div(block.TxFees, util.Shannon).Int64()); err != nil {
+				log.Printf("Failed to update average tx fees: %v", err)
+			}
+		}
 		totalRevenue.Add(totalRevenue, revenue)
 		totalMinersProfit.Add(totalMinersProfit, minersProfit)
 		totalPoolProfit.Add(totalPoolProfit, poolProfit)
@@ -609,6 +655,9 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 			util.FormatRatReward(poolProfit),
 		)
 		entries := []string{logEntry}
+		if block.ShareRewardsRepaid > 0 {
+			entries = append(entries, fmt.Sprintf("\tREPAID %v: %v Shannon of share rewards", block.RoundKey(), block.ShareRewardsRepaid))
+		}
 		for login, reward := range roundRewards {
 			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
 			per := new(big.Rat)
@@ -630,20 +679,40 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, map[string]*big.Rat, error) {
 	revenue := new(big.Rat).SetInt(block.Reward)
-	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
+	fee := u.poolFee.get()
+	if block.Solo {
+		fee = u.config.SoloFee
+	}
+	minersProfit, poolProfit := chargeFee(revenue, fee)
+
+	// Tx fees are part of block reward unless the pool keeps them
+	txFees := new(big.Rat)
+	if block.TxFees != nil && !u.config.KeepTxFees {
+		txFees.SetInt(block.TxFees)
+	}
+	minersTxFees, _ := chargeFee(txFees, fee)
 
 	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
 	if err != nil {
 		return nil, nil, nil, nil, nil, err
 	}
 
-	totalShares := int64(0)
-	for _, val := range shares {
-		totalShares += val
+	var rewards map[string]int64
+	var percents map[string]*big.Rat
+	if block.Solo {
+		// Whole reward goes to the finder whatever the pool scheme is
+		rewards, percents = splitRewards(map[string]int64{block.Finder: 1}, minersProfit)
+	} else {
+		rewards, percents = u.scheme.BlockRewards(block, shares, minersProfit, minersTxFees)
+		// Miners were paid at share time, what isn't split repays the pool
+		if _, ok := u.scheme.(*ppsScheme); ok {
+			block.ShareRewardsRepaid = weiToShannonInt64(minersProfit)
+			for _, amount := range rewards {
+				block.ShareRewardsRepaid -= amount
+			}
+		}
 	}
 
-	rewards, percents := calculateRewardsForShares(shares, totalShares, minersProfit)
-
 	if block.ExtraReward != nil {
 		extraReward := new(big.Rat).SetInt(block.ExtraReward)
 		poolProfit.Add(poolProfit, extraReward)
@@ -77,7 +77,7 @@ func TestGetUncleReward(t *testing.T) {
 		6: "1250000000000000000",
 	}
 	for i := int64(1); i < 7; i++ {
-		rewards[i] = getUncleReward(1, i+1, true).String()
+		rewards[i] = getUncleReward(big.NewInt(1), big.NewInt(i+1), big.NewInt(0), homesteadReward).String()
 	}
 	for i, reward := range rewards {
 		if expectedRewards[i] != rewards[i] {
@@ -98,7 +98,7 @@ func TestGetByzantiumUncleReward(t *testing.T) {
 		7: "375000000000000000",
 	}
 	for i := int64(1); i < 8; i++ {
-		rewards[i] = getUncleReward(byzantiumHardForkHeight, byzantiumHardForkHeight+i, true).String()
+		rewards[i] = getUncleRewardEthereum(big.NewInt(byzantiumHardForkHeight), big.NewInt(byzantiumHardForkHeight+i), byzantiumBlockReward).String()
 	}
 	for i, reward := range rewards {
 		if expectedRewards[i] != rewards[i] {
@@ -108,7 +108,7 @@ func TestGetByzantiumUncleReward(t *testing.T) {
 }
 
 func TestGetRewardForUncle(t *testing.T) {
-	reward := getRewardForUncle(1).String()
+	reward := getRewardForUncle(homesteadReward).String()
 	expectedReward := "156250000000000000"
 	if expectedReward != reward {
 		t.Errorf("Incorrect uncle bonus for height %v, expected %v vs %v", 1, expectedReward, reward)
@@ -116,18 +116,18 @@ func TestGetRewardForUncle(t *testing.T) {
 }
 
 func TestGetByzantiumRewardForUncle(t *testing.T) {
-	reward := getRewardForUncle(byzantiumHardForkHeight).String()
+	reward := getRewardForUncle(byzantiumBlockReward).String()
 	expectedReward := "93750000000000000"
 	if expectedReward != reward {
-		t.Errorf("Incorrect uncle bonus for height %v, expected %v vs %v", byzantiumHardForkHeight, expectedReward, reward)
+		t.Errorf("Incorrect uncle bonus for reward %v, expected %v vs %v", byzantiumBlockReward, expectedReward, reward)
 	}
 }
 
 func TestGetConstantinopleRewardForUncle(t *testing.T) {
-	reward := getRewardForUncle(constantinopleHardForkHeight).String()
+	reward := getRewardForUncle(constantinopleBlockReward).String()
 	expectedReward := "62500000000000000"
 	if expectedReward != reward {
-		t.Errorf("Incorrect uncle bonus for height %v, expected %v vs %v", constantinopleHardForkHeight, expectedReward, reward)
+		t.Errorf("Incorrect uncle bonus for reward %v, expected %v vs %v", constantinopleBlockReward, expectedReward, reward)
 	}
 }
 
@@ -156,3 +156,37 @@ func TestMatchCandidate(t *testing.T) {
 		t.Error("Must match with hash")
 	}
 }
+
+func TestCalculateSoloRewards(t *testing.T) {
+	reward, _ := new(big.Int).SetString("5000000000000000000", 10)
+	poolFeeAddress := "0x00000000000000000000000000000000000000ff"
+
+	tests := []struct {
+		name    string
+		solo    bool
+		rewards map[string]int64
+	}{
+		// 0.5% solo fee, finder takes the rest whatever shares the round has
+		{"solo", true, map[string]int64{"0x3": 4975000000, poolFeeAddress: 24750000}},
+		// 1% pool fee, round is split among shares
+		{"pool", false, map[string]int64{"0x0": 4829216467, "0x3": 48292, poolFeeAddress: 49500000}},
+	}
+	for _, test := range tests {
+		cfg := &UnlockerConfig{PoolFee: 1.0, SoloFee: 0.5, PoolFeeAddress: poolFeeAddress}
+		u := &BlockUnlocker{config: cfg, backend: &schemeBackend{storage.NewMemoryBackend(100)}, scheme: NewRewardScheme(&SchemeConfig{Type: "pplns"}, cfg, "classic")}
+		u.poolFee.set(cfg.PoolFee)
+		block := &storage.BlockData{Finder: "0x3", Reward: reward, Solo: test.solo}
+		_, _, _, rewards, percents, err := u.calculateRewards(block)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		for login, amount := range test.rewards {
+			if rewards[login] != amount {
+				t.Errorf("%v: expected %v Shannon for %v, got %v", test.name, amount, login, rewards[login])
+			}
+		}
+		if test.solo && (len(rewards) != 3 || percents["0x3"].Cmp(big.NewRat(1, 1)) != 0) {
+			t.Errorf("%v: expected whole block for finder only, got %v %v", test.name, rewards, percents)
+		}
+	}
+}
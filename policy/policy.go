@@ -12,10 +12,13 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/yuriy0803/open-etc-pool-friends/metrics"
 	"github.com/yuriy0803/open-etc-pool-friends/storage"
 	"github.com/yuriy0803/open-etc-pool-friends/util"
 )
 
+var bansCounter = metrics.NewCounter("pool_policy_bans_total", "Banned peers by reason.", "coin", "reason")
+
 type Config struct {
 	Workers         int     `json:"workers"`
 	Banning         Banning `json:"banning"`
@@ -56,8 +59,9 @@ type Stats struct {
 
 type PolicyServer struct {
 	sync.RWMutex
+	coin            string
 	statsMu         sync.Mutex
-	config          *Config
+	config          atomic.Value
 	stats           map[string]*Stats
 	banChannel      chan string
 	startedAt       int64
@@ -65,27 +69,30 @@ type PolicyServer struct {
 	timeout         int64
 	blacklist       []string
 	whitelist       []string
-	storage         *storage.RedisClient
+	storage         storage.PolicyBackend
 	walletblacklist []string
+	bans            map[string]*storage.Ban
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
-	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
+func Start(cfg *Config, backend storage.PolicyBackend, coin string) *PolicyServer {
+	s := &PolicyServer{coin: coin, startedAt: util.MakeTimestamp()}
+	s.config.Store(cfg)
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
 	s.banChannel = make(chan string, 64)
 	s.stats = make(map[string]*Stats)
-	s.storage = storage
+	s.bans = make(map[string]*storage.Ban)
+	s.storage = backend
 	s.refreshState()
 
-	timeout := util.MustParseDuration(s.config.ResetInterval)
+	timeout := util.MustParseDuration(cfg.ResetInterval)
 	s.timeout = int64(timeout / time.Millisecond)
 
-	resetIntv := util.MustParseDuration(s.config.ResetInterval)
+	resetIntv := util.MustParseDuration(cfg.ResetInterval)
 	resetTimer := time.NewTimer(resetIntv)
 	log.Printf("Set policy stats reset every %v", resetIntv)
 
-	refreshIntv := util.MustParseDuration(s.config.RefreshInterval)
+	refreshIntv := util.MustParseDuration(cfg.RefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	log.Printf("Set policy state refresh every %v", refreshIntv)
 
@@ -102,13 +109,25 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
 		}
 	}()
 
-	for i := 0; i < s.config.Workers; i++ {
+	for i := 0; i < cfg.Workers; i++ {
 		s.startPolicyWorker()
 	}
-	log.Printf("Running with %v policy workers", s.config.Workers)
+	log.Printf("Running with %v policy workers", cfg.Workers)
 	return s
 }
 
+func (s *PolicyServer) getConfig() *Config {
+	return s.config.Load().(*Config)
+}
+
+// Applies reloaded limits, banning and blacklist file, workers and intervals are fixed at start
+func (s *PolicyServer) ApplyConfig(cfg *Config) {
+	grace := util.MustParseDuration(cfg.Limits.Grace)
+	atomic.StoreInt64(&s.grace, int64(grace/time.Millisecond))
+	s.config.Store(cfg)
+	log.Println("Applied new policy config")
+}
+
 func (s *PolicyServer) startPolicyWorker() {
 	go func() {
 		for {
@@ -122,7 +141,7 @@ func (s *PolicyServer) startPolicyWorker() {
 
 func (s *PolicyServer) resetStats() {
 	now := util.MakeTimestamp()
-	banningTimeout := s.config.Banning.Timeout * 1000
+	banningTimeout := s.getConfig().Banning.Timeout * 1000
 	total := 0
 	s.statsMu.Lock()
 	defer s.statsMu.Unlock()
@@ -149,7 +168,11 @@ func (s *PolicyServer) resetStats() {
 
 // loads up blacklist of wallets if file is present
 func (s *PolicyServer) GetWalletBlacklist() ([]string, error) {
-	blacklistFileName := s.config.Walletblacklist
+	return ReadWalletBlacklist(s.getConfig().Walletblacklist)
+}
+
+// Wallets listed in blacklist_file, a JSON array of logins
+func ReadWalletBlacklist(blacklistFileName string) ([]string, error) {
 	blacklistFileName, _ = filepath.Abs(blacklistFileName)
 	log.Printf("Loading wallet blacklist: %v", blacklistFileName)
 	blacklistFile, err := os.Open(blacklistFileName)
@@ -184,12 +207,45 @@ func (s *PolicyServer) refreshState() {
 	if err != nil {
 		log.Printf("Failed to get wallet/login blacklist from json file backend: %v", err)
 	}
+	wallets, err := s.storage.GetWalletBlacklist()
+	if err != nil {
+		log.Printf("Failed to get wallet blacklist from backend: %v", err)
+	}
+	s.walletblacklist = append(s.walletblacklist, wallets...)
+
+	bans, err := s.storage.GetBans()
+	if err != nil {
+		log.Printf("Failed to get bans from backend: %v", err)
+	} else {
+		s.bans = bans
+		s.dropRemovedBans()
+	}
 	log.Println("Policy state refresh complete")
 }
 
+// Lifts bans removed from backend by admin before their timeout
+func (s *PolicyServer) dropRemovedBans() {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	for ip, x := range s.stats {
+		if _, ok := s.bans[ip]; ok || atomic.LoadInt32(&x.Banned) == 0 {
+			continue
+		}
+		atomic.StoreInt64(&x.BannedAt, 0)
+		if atomic.CompareAndSwapInt32(&x.Banned, 1, 0) {
+			log.Printf("Ban lifted for %v", ip)
+			delete(s.stats, ip)
+			if len(s.getConfig().Banning.IPSet) > 0 {
+				go s.doUnban(ip)
+			}
+		}
+	}
+}
+
 func (s *PolicyServer) NewStats() *Stats {
 	x := &Stats{
-		ConnLimit: s.config.Limits.Limit,
+		ConnLimit: s.getConfig().Limits.Limit,
 	}
 	x.heartbeat()
 	return x
@@ -211,20 +267,26 @@ func (s *PolicyServer) Get(ip string) *Stats {
 
 func (s *PolicyServer) BanClient(ip string) {
 	x := s.Get(ip)
-	s.forceBan(x, ip)
+	s.forceBan(x, ip, "manual")
 }
 
 func (s *PolicyServer) IsBanned(ip string) bool {
 	x := s.Get(ip)
-	return atomic.LoadInt32(&x.Banned) > 0
+	if atomic.LoadInt32(&x.Banned) > 0 {
+		return true
+	}
+	s.RLock()
+	defer s.RUnlock()
+	ban, ok := s.bans[ip]
+	return ok && ban.Active(util.MakeTimestamp())
 }
 
 func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
-	if !s.config.Limits.Enabled {
+	if !s.getConfig().Limits.Enabled {
 		return true
 	}
 	now := util.MakeTimestamp()
-	if now-s.startedAt > s.grace {
+	if now-s.startedAt > atomic.LoadInt64(&s.grace) {
 		return s.Get(ip).decrLimit() > 0
 	}
 	return true
@@ -240,7 +302,7 @@ func (s *PolicyServer) ApplyLoginWalletPolicy(login string) bool {
 func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
 	if s.InBlackList(addy) {
 		x := s.Get(ip)
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, "blacklist")
 		return false
 	}
 	return true
@@ -255,8 +317,8 @@ func (s *PolicyServer) InWalletBlackList(addy string) bool {
 func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 	x := s.Get(ip)
 	n := x.incrMalformed()
-	if n >= s.config.Banning.MalformedLimit {
-		s.forceBan(x, ip)
+	if n >= s.getConfig().Banning.MalformedLimit {
+		s.forceBan(x, ip, "malformed")
 		return false
 	}
 	return true
@@ -268,15 +330,15 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 
 	if validShare {
 		x.ValidShares++
-		if s.config.Limits.Enabled {
-			x.incrLimit(s.config.Limits.LimitJump)
+		if s.getConfig().Limits.Enabled {
+			x.incrLimit(s.getConfig().Limits.LimitJump)
 		}
 	} else {
 		x.InvalidShares++
 	}
 
 	totalShares := x.ValidShares + x.InvalidShares
-	if totalShares < s.config.Banning.CheckThreshold {
+	if totalShares < s.getConfig().Banning.CheckThreshold {
 		x.Unlock()
 		return true
 	}
@@ -287,8 +349,8 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 
 	ratio := invalidShares / validShares
 
-	if ratio >= s.config.Banning.InvalidPercent/100.0 {
-		s.forceBan(x, ip)
+	if ratio >= s.getConfig().Banning.InvalidPercent/100.0 {
+		s.forceBan(x, ip, "invalidShares")
 		return false
 	}
 	return true
@@ -299,14 +361,24 @@ func (x *Stats) resetShares() {
 	x.InvalidShares = 0
 }
 
-func (s *PolicyServer) forceBan(x *Stats, ip string) {
-	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
+func (s *PolicyServer) forceBan(x *Stats, ip, reason string) {
+	if !s.getConfig().Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
-	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
+	now := util.MakeTimestamp()
+	atomic.StoreInt64(&x.BannedAt, now)
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
-		if len(s.config.Banning.IPSet) > 0 {
+		bansCounter.With(s.coin, reason).Inc()
+		until := now + s.getConfig().Banning.Timeout*1000
+		if err := s.storage.WriteBan(ip, until, reason); err != nil {
+			log.Printf("Failed to write ban of %v to backend: %v", ip, err)
+		} else {
+			s.Lock()
+			s.bans[ip] = &storage.Ban{IP: ip, Until: until, Reason: reason}
+			s.Unlock()
+		}
+		if len(s.getConfig().Banning.IPSet) > 0 {
 			s.banChannel <- ip
 		} else {
 			log.Println("Banned peer", ip)
@@ -339,7 +411,7 @@ func (s *PolicyServer) InWhiteList(ip string) bool {
 }
 
 func (s *PolicyServer) doBan(ip string) {
-	set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
+	set, timeout := s.getConfig().Banning.IPSet, s.getConfig().Banning.Timeout
 	cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
 	args := strings.Fields(cmd)
 	head := args[0]
@@ -353,6 +425,19 @@ func (s *PolicyServer) doBan(ip string) {
 	}
 }
 
+func (s *PolicyServer) doUnban(ip string) {
+	set := s.getConfig().Banning.IPSet
+	cmd := fmt.Sprintf("sudo ipset del %s %s -!", set, ip)
+	args := strings.Fields(cmd)
+
+	log.Printf("Unbanned %v on ipset %s", ip, set)
+
+	_, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		log.Printf("CMD Error: %s", err)
+	}
+}
+
 func (x *Stats) heartbeat() {
 	now := util.MakeTimestamp()
 	atomic.StoreInt64(&x.LastBeat, now)
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+type ShareBatchConfig struct {
+	// Shares are buffered for this interval and written in one batch, empty writes every share at once
+	FlushInterval string `json:"flushInterval"`
+	// Flush early when this many shares are buffered
+	MaxShares int `json:"maxShares"`
+}
+
+// Found block waits this long at most for buffered shares of its round to be written
+var blockFlushRetries = []time.Duration{50 * time.Millisecond, 200 * time.Millisecond}
+
+// Buffers valid shares and writes them to backend in batches
+type shareBatcher struct {
+	coin      string
+	backend   storage.ShareBackend
+	interval  time.Duration
+	maxShares int
+
+	mu      sync.Mutex
+	pending []*storage.Share
+	// PoW of recent shares by height, duplicates are rejected before reaching backend
+	pow map[string]uint64
+
+	// One flush at a time, so shares reach backend in order
+	flushMu sync.Mutex
+	full    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func newShareBatcher(cfg *ShareBatchConfig, interval time.Duration, backend storage.ShareBackend, coin string) *shareBatcher {
+	maxShares := cfg.MaxShares
+	if maxShares <= 0 {
+		maxShares = 10000
+	}
+	b := &shareBatcher{
+		coin:      coin,
+		backend:   backend,
+		interval:  interval,
+		maxShares: maxShares,
+		pow:       make(map[string]uint64),
+		full:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	log.Printf("Writing shares in batches every %v or %v shares", interval, maxShares)
+	return b
+}
+
+func (b *shareBatcher) start() {
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.flush()
+			case <-b.full:
+				b.flush()
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Buffers share, true if share with the same PoW was already submitted
+func (b *shareBatcher) add(share *storage.Share) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := strings.Join(share.Params, ":")
+	if _, ok := b.pow[key]; ok {
+		return true
+	}
+	b.pow[key] = share.Height
+	b.pending = append(b.pending, share)
+	bufferedShares.With(b.coin).Set(float64(len(b.pending)))
+
+	// Only on reaching the limit, so a failing backend isn't retried on every share
+	if len(b.pending) == b.maxShares {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return false
+}
+
+// Writes buffered shares, they are kept for the next flush if backend fails
+func (b *shareBatcher) flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var maxHeight uint64
+	for _, v := range batch {
+		if v.Height > maxHeight {
+			maxHeight = v.Height
+		}
+	}
+	duplicates, err := b.backend.WriteShares(batch)
+	if err != nil {
+		log.Printf("Failed to write %v shares to backend: %v", len(batch), err)
+		shareFlushes.With(b.coin, "error").Inc()
+		b.mu.Lock()
+		b.pending = append(batch, b.pending...)
+		bufferedShares.With(b.coin).Set(float64(len(b.pending)))
+		b.mu.Unlock()
+		return err
+	}
+	shareFlushes.With(b.coin, "ok").Inc()
+
+	for i, v := range batch {
+		if duplicates[i] {
+			// Submitted to another proxy too, miner was already told it's accepted
+			log.Printf("Dropped duplicate share of %v.%v", v.Login, v.Id)
+			sharesCounter.With(b.coin, "duplicate").Inc()
+		}
+	}
+
+	b.mu.Lock()
+	// Sweep PoW backlog for previous blocks, as backend does
+	for k, h := range b.pow {
+		if maxHeight >= 8 && h < maxHeight-8 {
+			delete(b.pow, k)
+		}
+	}
+	bufferedShares.With(b.coin).Set(float64(len(b.pending)))
+	b.mu.Unlock()
+	return nil
+}
+
+// Round snapshot of a found block must include buffered shares, a failing write is
+// retried briefly so the block isn't held back for long
+func (b *shareBatcher) flushBlock() error {
+	err := b.flush()
+	for _, delay := range blockFlushRetries {
+		if err == nil {
+			return nil
+		}
+		time.Sleep(delay)
+		err = b.flush()
+	}
+	if err != nil {
+		blockFlushFailures.With(b.coin).Inc()
+	}
+	return err
+}
+
+// Stops periodic flushes and writes what is left, retrying until context is done
+func (b *shareBatcher) stop(ctx context.Context) {
+	close(b.quit)
+	<-b.done
+	for {
+		if err := b.flush(); err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			log.Printf("Gave up writing %v buffered shares", len(b.pending))
+			b.mu.Unlock()
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
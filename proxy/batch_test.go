@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+type flakyShareBackend struct {
+	*storage.MemoryBackend
+	fail bool
+}
+
+func (b *flakyShareBackend) WriteShares(shares []*storage.Share) ([]bool, error) {
+	if b.fail {
+		return nil, errors.New("backend down")
+	}
+	return b.MemoryBackend.WriteShares(shares)
+}
+
+func testShare(login, nonce string) *storage.Share {
+	return &storage.Share{Login: login, Id: "rig", Params: []string{nonce, "0xh", "0xm"}, Diff: 1000, Height: 100, Expire: time.Minute, Reward: 10}
+}
+
+func balanceOf(backend storage.BalanceBackend, login string) int64 {
+	balance, _ := backend.GetBalance(login)
+	return balance
+}
+
+func TestShareBatcherFlush(t *testing.T) {
+	backend := storage.NewMemoryBackend(100)
+	b := newShareBatcher(&ShareBatchConfig{}, time.Hour, backend, "")
+
+	b.add(testShare("0xa", "0x1"))
+	b.add(testShare("0xb", "0x2"))
+	if !b.add(testShare("0xa", "0x1")) {
+		t.Error("Expected buffered duplicate to be rejected")
+	}
+	if balanceOf(backend, "0xa") != 0 {
+		t.Error("Shares must be credited when they are written")
+	}
+	if err := b.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if balanceOf(backend, "0xa") != 10 || balanceOf(backend, "0xb") != 10 || len(b.pending) != 0 {
+		t.Errorf("Expected 2 shares written and credited, got balances %v and %v, %v pending", balanceOf(backend, "0xa"), balanceOf(backend, "0xb"), len(b.pending))
+	}
+	if exist, _ := backend.WriteShare("0xa", "rig", []string{"0x1", "0xh", "0xm"}, 1000, 1000, 100, time.Minute, "", 1000, false, 0); !exist {
+		t.Error("Expected flushed share to reach backend")
+	}
+}
+
+func TestShareBatcherDropsBackendDuplicates(t *testing.T) {
+	backend := storage.NewMemoryBackend(100)
+	// Same share submitted through another proxy
+	backend.WriteShare("0xa", "rig", []string{"0x1", "0xh", "0xm"}, 1000, 1000, 100, time.Minute, "", 1000, false, 0)
+	b := newShareBatcher(&ShareBatchConfig{}, time.Hour, backend, "")
+	b.add(testShare("0xa", "0x1"))
+	b.flush()
+	if balanceOf(backend, "0xa") != 0 {
+		t.Error("Duplicate found by backend must not be credited")
+	}
+}
+
+func TestShareBatcherKeepsSharesOnFailure(t *testing.T) {
+	backend := &flakyShareBackend{MemoryBackend: storage.NewMemoryBackend(100), fail: true}
+	b := newShareBatcher(&ShareBatchConfig{}, time.Hour, backend, "")
+	b.start()
+	b.add(testShare("0xa", "0x1"))
+
+	if err := b.flush(); err == nil {
+		t.Fatal("Expected flush to fail")
+	}
+	if len(b.pending) != 1 || balanceOf(backend, "0xa") != 0 {
+		t.Fatalf("Expected share to stay buffered, got %v pending", len(b.pending))
+	}
+
+	backend.fail = false
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b.stop(ctx)
+	if len(b.pending) != 0 || balanceOf(backend, "0xa") != 10 {
+		t.Errorf("Expected shutdown flush to write the share, got %v pending", len(b.pending))
+	}
+}
+
+func TestShareBatcherFlushesWhenFull(t *testing.T) {
+	backend := storage.NewMemoryBackend(100)
+	b := newShareBatcher(&ShareBatchConfig{MaxShares: 2}, time.Hour, backend, "")
+	b.start()
+	defer b.stop(context.Background())
+	b.add(testShare("0xa", "0x1"))
+	b.add(testShare("0xa", "0x2"))
+	deadline := time.Now().Add(5 * time.Second)
+	for balanceOf(backend, "0xa") != 20 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected full buffer to be flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShareBatcherFlushBlock(t *testing.T) {
+	defer func(retries []time.Duration) { blockFlushRetries = retries }(blockFlushRetries)
+	blockFlushRetries = []time.Duration{time.Millisecond, time.Millisecond}
+	backend := &flakyShareBackend{MemoryBackend: storage.NewMemoryBackend(100), fail: true}
+	b := newShareBatcher(&ShareBatchConfig{}, time.Hour, backend, "")
+	b.add(testShare("0xa", "0x1"))
+
+	if err := b.flushBlock(); err == nil {
+		t.Fatal("Expected block flush to fail with backend down")
+	}
+	if len(b.pending) != 1 || balanceOf(backend, "0xa") != 0 {
+		t.Fatalf("Expected share to stay buffered, got %v pending", len(b.pending))
+	}
+
+	// Backend is back before retries are over
+	blockFlushRetries = []time.Duration{50 * time.Millisecond}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.flushMu.Lock()
+		backend.fail = false
+		b.flushMu.Unlock()
+	}()
+	if err := b.flushBlock(); err != nil {
+		t.Fatalf("Expected retried block flush to succeed, got %v", err)
+	}
+	if len(b.pending) != 0 || balanceOf(backend, "0xa") != 10 {
+		t.Errorf("Expected share written before block, got %v pending", len(b.pending))
+	}
+}
@@ -3,8 +3,6 @@ package proxy
 import (
 	"log"
 	"math/big"
-	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/ubiq/go-ubiq/v7/common"
@@ -17,6 +15,10 @@ const maxBacklog = 3
 type heightDiffPair struct {
 	diff   *big.Int
 	height uint64
+	// Upstream which issued the job, or confirmed height of pushed one
+	upstream string
+	// Job id of upstream pool in NiceHash edge mode
+	job string
 }
 
 type BlockTemplate struct {
@@ -29,6 +31,7 @@ type BlockTemplate struct {
 	GetPendingBlockCache *rpc.GetBlockReplyPart
 	nonces               map[string]bool
 	headers              map[string]heightDiffPair
+	upstream             string
 }
 
 type Block struct {
@@ -46,18 +49,12 @@ func (b Block) MixDigest() common.Hash   { return b.mixDigest }
 func (b Block) NumberU64() uint64        { return b.number }
 
 func (s *ProxyServer) fetchBlockTemplate() {
-	rpc := s.rpc()
 	t := s.currentBlockTemplate()
-	pendingReply, height, diff, err := s.fetchPendingBlock()
-	if err != nil {
-		log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
-		return
-	}
-	reply, err := rpc.GetWork()
-	if err != nil {
-		log.Printf("Error while refreshing block template on %s: %s", rpc.Name, err)
+	w := s.fetchBestWork(t)
+	if w == nil {
 		return
 	}
+	reply, height, pendingReply := w.reply, w.height, w.pending
 	// No need to update, we have fresh job
 	if t != nil && t.Header == reply[0] {
 		return
@@ -70,14 +67,16 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		Seed:                 reply[1],
 		Target:               reply[2],
 		Height:               height,
-		Difficulty:           big.NewInt(diff),
+		Difficulty:           big.NewInt(w.diff),
 		GetPendingBlockCache: pendingReply,
 		headers:              make(map[string]heightDiffPair),
+		upstream:             w.upstream.Name,
 	}
 	// Copy job backlog and add current one
 	newTemplate.headers[reply[0]] = heightDiffPair{
-		diff:   util.TargetHexToDiff(reply[2]),
-		height: height,
+		diff:     util.TargetHexToDiff(reply[2]),
+		height:   height,
+		upstream: w.upstream.Name,
 	}
 	if t != nil {
 		for k, v := range t.headers {
@@ -87,30 +86,11 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		}
 	}
 	s.blockTemplate.Store(&newTemplate)
-	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
+	log.Printf("New block to mine on %s at height %d / %s", w.upstream.Name, height, reply[0][0:10])
+	s.verifier.prepareEpoch(height)
 
 	// Stratum
-	if s.config.Proxy.Stratum.Enabled {
+	if s.config.Proxy.StratumEnabled() {
 		go s.broadcastNewJobs()
 	}
 }
-
-func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReplyPart, uint64, int64, error) {
-	rpc := s.rpc()
-	reply, err := rpc.GetPendingBlock()
-	if err != nil {
-		log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
-		return nil, 0, 0, err
-	}
-	blockNumber, err := strconv.ParseUint(strings.Replace(reply.Number, "0x", "", -1), 16, 64)
-	if err != nil {
-		log.Println("Can't parse pending block number")
-		return nil, 0, 0, err
-	}
-	blockDiff, err := strconv.ParseInt(strings.Replace(reply.Difficulty, "0x", "", -1), 16, 64)
-	if err != nil {
-		log.Println("Can't parse pending block difficulty")
-		return nil, 0, 0, err
-	}
-	return reply, blockNumber, blockDiff, nil
-}
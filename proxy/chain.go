@@ -0,0 +1,567 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ubiq/go-ubiq/v7/common"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+const (
+	// Delay before reconnecting to upstream pool
+	poolReconnectInterval = 5 * time.Second
+	// Idle connection is kept up with a request, pool is lost when silent twice as long
+	poolKeepAliveInterval = 30 * time.Second
+	// Hex chars of extranonce the edge appends to pool's one for each session, at least
+	// min for 256 sessions and at most max for 65536, as many as pool extranonce leaves
+	minSessionExtranonceSize = 2
+	maxSessionExtranonceSize = 4
+	// Longest extranonce miners take, the rest of 8 byte nonce is searched by them
+	maxExtranonceSize = 14
+	poolAgent         = "open-etc-pool-friends"
+	// Seeds of jobs without height are looked up among this many epochs
+	maxSeedEpochs = 2048
+)
+
+var errPoolOffline = errors.New("Upstream pool is not connected")
+
+// Stratum client of the main pool, shares of all local sessions go over one connection
+type poolUpstream struct {
+	name     string
+	coin     string
+	cfg      *UpstreamPool
+	nicehash bool
+	timeout  time.Duration
+	quit     chan struct{}
+
+	mu    sync.Mutex
+	conn  net.Conn
+	enc   *json.Encoder
+	seq   int64
+	calls map[int64]poolCall
+	// NiceHash only, set by pool with mining.set_difficulty and mining.set_extranonce
+	diff       int64
+	extranonce string
+	// Last job, it's installed again when difficulty changes
+	job *poolJob
+}
+
+// Request waiting for reply
+type poolCall struct {
+	method string
+	worker string
+}
+
+type poolJob struct {
+	id     string
+	header string
+	seed   string
+	target string
+	height uint64
+	diff   *big.Int
+}
+
+type poolRequest struct {
+	Id     int64       `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+	Worker string      `json:"worker,omitempty"`
+}
+
+// Notifications have method, replies and EthProxy jobs pushed with id 0 have result
+type poolMessage struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+	Height json.RawMessage `json:"height"`
+}
+
+func newPoolUpstream(cfg *UpstreamPool, coin string) *poolUpstream {
+	p := &poolUpstream{name: cfg.Name, coin: coin, cfg: cfg, quit: make(chan struct{})}
+	if len(p.name) == 0 {
+		p.name = cfg.Url
+	}
+	switch cfg.Mode {
+	case "nicehash":
+		p.nicehash = true
+	case "", "ethproxy":
+	default:
+		log.Fatalf("Unknown upstream pool mode %v, use ethproxy or nicehash", cfg.Mode)
+	}
+	if len(cfg.Url) == 0 || len(cfg.Login) == 0 {
+		log.Fatal("Upstream pool needs url and login")
+	}
+	p.timeout = util.MustParseDuration(cfg.Timeout)
+	return p
+}
+
+func (p *poolUpstream) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	var conn net.Conn
+	var err error
+	if p.cfg.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.cfg.Url, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", p.cfg.Url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn = conn
+	p.enc = json.NewEncoder(conn)
+	p.calls = make(map[int64]poolCall)
+	// Pool difficulty is 1 until told otherwise
+	p.diff = util.DiffFloatToInt(1)
+	return conn, nil
+}
+
+func (p *poolUpstream) disconnect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.enc, p.calls = nil, nil, nil
+}
+
+func (p *poolUpstream) close() {
+	close(p.quit)
+	p.disconnect()
+}
+
+func (p *poolUpstream) call(method string, params interface{}, worker string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.enc == nil {
+		return errPoolOffline
+	}
+	p.seq++
+	p.calls[p.seq] = poolCall{method: method, worker: worker}
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	return p.enc.Encode(&poolRequest{Id: p.seq, Method: method, Params: params, Worker: worker})
+}
+
+// Takes request the reply is for, false for messages nobody asked for
+func (p *poolUpstream) reply(id json.RawMessage) (poolCall, bool) {
+	n, err := strconv.ParseInt(strings.Trim(string(id), `"`), 10, 64)
+	if err != nil || n == 0 {
+		return poolCall{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.calls[n]
+	delete(p.calls, n)
+	return c, ok
+}
+
+func (p *poolUpstream) login() error {
+	if p.nicehash {
+		if err := p.call("mining.subscribe", []string{poolAgent, "EthereumStratum/1.0.0"}, ""); err != nil {
+			return err
+		}
+		if err := p.call("mining.extranonce.subscribe", []string{}, ""); err != nil {
+			return err
+		}
+		return p.call("mining.authorize", []string{p.cfg.Login, p.cfg.Password}, "")
+	}
+	if err := p.call("eth_submitLogin", []string{p.cfg.Login, p.cfg.Password}, ""); err != nil {
+		return err
+	}
+	return p.call("eth_getWork", []string{}, "")
+}
+
+// Asks for something the pool answers, so neither side drops an idle connection
+func (p *poolUpstream) keepAlive(done chan struct{}) {
+	ticker := time.NewTicker(poolKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			var err error
+			if p.nicehash {
+				err = p.call("mining.extranonce.subscribe", []string{}, "")
+			} else {
+				err = p.call("eth_getWork", []string{}, "")
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (p *poolUpstream) getExtranonce() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.extranonce
+}
+
+// Forwards share to pool under worker name of the local miner
+func (p *poolUpstream) submit(worker string, params []string, job string) {
+	var err error
+	if p.nicehash {
+		nonce := strings.TrimPrefix(params[0], "0x")
+		extranonce := p.getExtranonce()
+		if !strings.HasPrefix(nonce, extranonce) {
+			log.Printf("Share of %v is out of %v extranonce %v, not forwarded", worker, p.name, extranonce)
+			poolShares.With(p.coin, "foreign").Inc()
+			return
+		}
+		err = p.call("mining.submit", []string{p.cfg.Login + "." + worker, job, nonce[len(extranonce):]}, worker)
+	} else {
+		err = p.call("eth_submitWork", params, worker)
+	}
+	if err != nil {
+		log.Printf("Failed to forward share of %v to %v: %v", worker, p.name, err)
+		poolShares.With(p.coin, "lost").Inc()
+	}
+}
+
+// Keeps connection to upstream pool, local miners get its jobs
+func (s *ProxyServer) runPool() {
+	p := s.pool
+	for {
+		log.Printf("Connecting to upstream pool %v at %v", p.name, p.cfg.Url)
+		err := s.servePool(p)
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+		log.Printf("Lost upstream pool %v: %v", p.name, err)
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(poolReconnectInterval):
+		}
+	}
+}
+
+// Logs in and handles pool messages until connection is lost
+func (s *ProxyServer) servePool(p *poolUpstream) error {
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer p.disconnect()
+	if err := p.login(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go p.keepAlive(done)
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * poolKeepAliveInterval))
+		data, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return err
+		}
+		if isPrefix {
+			return errors.New("Message too long")
+		}
+		if len(data) == 0 {
+			continue
+		}
+		var msg poolMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("Malformed message: %v", err)
+		}
+		if err := s.handlePoolMessage(p, &msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *ProxyServer) handlePoolMessage(p *poolUpstream, msg *poolMessage) error {
+	if len(msg.Method) > 0 {
+		return s.handlePoolNotification(p, msg)
+	}
+	c, ok := p.reply(msg.Id)
+	if !ok {
+		// EthProxy job push
+		if !p.nicehash && isJSONArray(msg.Result) {
+			return s.handleEthProxyJob(p, msg.Result)
+		}
+		return nil
+	}
+
+	failed := isJSONError(msg.Error) || string(msg.Result) == "false"
+	switch c.method {
+	case "mining.subscribe":
+		// Standard reply is [[subscriptions...], extranonce]
+		var result []json.RawMessage
+		var extranonce string
+		if json.Unmarshal(msg.Result, &result) == nil && len(result) > 1 && isJSONArray(result[0]) &&
+			json.Unmarshal(result[1], &extranonce) == nil {
+			return s.setPoolExtranonce(p, extranonce)
+		}
+	case "mining.authorize", "eth_submitLogin":
+		if failed {
+			return fmt.Errorf("Login rejected: %s", msg.Error)
+		}
+		log.Printf("Logged in to upstream pool %v as %v", p.name, p.cfg.Login)
+	case "eth_getWork":
+		if !failed {
+			return s.handleEthProxyJob(p, msg.Result)
+		}
+	case "mining.submit", "eth_submitWork":
+		if failed {
+			log.Printf("Share of %v rejected by %v: %s", c.worker, p.name, msg.Error)
+			poolShares.With(p.coin, "rejected").Inc()
+		} else {
+			poolShares.With(p.coin, "accepted").Inc()
+		}
+	}
+	return nil
+}
+
+func (s *ProxyServer) handlePoolNotification(p *poolUpstream, msg *poolMessage) error {
+	switch msg.Method {
+	case "mining.notify":
+		var params []interface{}
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) < 3 {
+			return fmt.Errorf("Malformed job: %s", msg.Params)
+		}
+		id, _ := params[0].(string)
+		seed, _ := params[1].(string)
+		header, _ := params[2].(string)
+		seed, header = "0x"+strings.TrimPrefix(strings.ToLower(seed), "0x"), "0x"+strings.TrimPrefix(strings.ToLower(header), "0x")
+		if len(id) == 0 || !hashPattern.MatchString(seed) || !hashPattern.MatchString(header) {
+			return fmt.Errorf("Malformed job: %s", msg.Params)
+		}
+		var clean bool
+		if len(params) > 3 {
+			clean, _ = params[3].(bool)
+		}
+		p.mu.Lock()
+		diff := big.NewInt(p.diff)
+		prev := p.job
+		p.mu.Unlock()
+		// Shares can't be verified without epoch. This pool sends block number in non-standard
+		// height field, without it the number is estimated from seed of the job.
+		height, ok := parsePoolHeight(msg.Height)
+		if !ok {
+			if height, ok = estimatePoolHeight(seed, clean, prev); !ok {
+				log.Printf("Job %v from %v has neither block height nor known seed, skipped", id, p.name)
+				return nil
+			}
+		}
+		s.setPoolJob(p, &poolJob{id: id, header: header, seed: seed, target: util.GetTargetHex(diff.Int64()), height: height, diff: diff})
+
+	case "mining.set_difficulty":
+		var params []float64
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) < 1 || params[0] <= 0 {
+			return fmt.Errorf("Malformed difficulty: %s", msg.Params)
+		}
+		diff := big.NewInt(util.DiffFloatToInt(params[0]))
+		p.mu.Lock()
+		p.diff = diff.Int64()
+		job := p.job
+		p.mu.Unlock()
+		// Shares of current job are forwarded at new difficulty from now on
+		if job != nil {
+			s.setPoolJob(p, &poolJob{id: job.id, header: job.header, seed: job.seed, target: util.GetTargetHex(diff.Int64()), height: job.height, diff: diff})
+		}
+
+	case "mining.set_extranonce":
+		var params []interface{}
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) < 1 {
+			return fmt.Errorf("Malformed extranonce: %s", msg.Params)
+		}
+		extranonce, _ := params[0].(string)
+		return s.setPoolExtranonce(p, extranonce)
+
+	case "client.reconnect":
+		return errors.New("Pool asked to reconnect")
+	}
+	return nil
+}
+
+func (s *ProxyServer) handleEthProxyJob(p *poolUpstream, result json.RawMessage) error {
+	reply, height, ok := parseNotifiedWork(result)
+	if !ok {
+		return fmt.Errorf("Malformed job: %s", result)
+	}
+	s.setPoolJob(p, &poolJob{header: reply[0], seed: reply[1], target: reply[2], height: height, diff: util.TargetHexToDiff(reply[2])})
+	return nil
+}
+
+// Short pool extranonce leaves room for more sessions under it
+func sessionExtranonceSize(poolExtranonce string) int {
+	size := maxExtranonceSize - len(poolExtranonce)
+	if size > maxSessionExtranonceSize {
+		size = maxSessionExtranonceSize
+	}
+	return size
+}
+
+// Sessions extranonces are made under this one, so nonces of their shares are good for the pool
+func (s *ProxyServer) setPoolExtranonce(p *poolUpstream, extranonce string) error {
+	extranonce = strings.ToLower(extranonce)
+	if _, err := strconv.ParseUint("0"+extranonce, 16, 64); err != nil || len(extranonce)%2 != 0 || len(extranonce)+minSessionExtranonceSize > maxExtranonceSize {
+		return fmt.Errorf("Unusable extranonce %q", extranonce)
+	}
+	p.mu.Lock()
+	changed := p.extranonce != extranonce
+	p.extranonce = extranonce
+	p.mu.Unlock()
+	if changed {
+		log.Printf("Extranonce of %v is %v", p.name, extranonce)
+		s.reconnectForeignSessions(extranonce)
+	}
+	return nil
+}
+
+// Job of upstream pool replaces current one, previous jobs stay valid for the backlog
+func (s *ProxyServer) setPoolJob(p *poolUpstream, job *poolJob) {
+	p.mu.Lock()
+	p.job = job
+	p.mu.Unlock()
+
+	t := s.currentBlockTemplate()
+	newTemplate := BlockTemplate{
+		Header:     job.header,
+		Seed:       job.seed,
+		Target:     job.target,
+		Height:     job.height,
+		Difficulty: job.diff,
+		GetPendingBlockCache: &rpc.GetBlockReplyPart{
+			Number:     util.ToHex(int64(job.height)),
+			Difficulty: util.ToHex(s.config.Proxy.Difficulty),
+		},
+		headers:  make(map[string]heightDiffPair),
+		upstream: p.name,
+	}
+	if t != nil {
+		for k, v := range t.headers {
+			if v.height > job.height-maxBacklog {
+				newTemplate.headers[k] = v
+			}
+		}
+	}
+	newTemplate.headers[job.header] = heightDiffPair{
+		diff:     job.diff,
+		height:   job.height,
+		upstream: p.name,
+		job:      job.id,
+	}
+	s.blockTemplate.Store(&newTemplate)
+	if t != nil && t.Header == job.header {
+		return
+	}
+	log.Printf("New job from %s at height %d / %s / %d", p.name, job.height, job.header[0:10], job.diff)
+	s.verifier.prepareEpoch(job.height)
+
+	// Stratum
+	if s.config.Proxy.StratumEnabled() {
+		go s.broadcastNewJobs()
+	}
+}
+
+// Sessions mining under previous extranonce of the pool can't get shares forwarded,
+// their miners reconnect for a new one
+func (s *ProxyServer) reconnectForeignSessions(extranonce string) {
+	s.sessionsMu.RLock()
+	var foreign []*Session
+	for cs := range s.sessions {
+		if cs.stratumMode() == NiceHash && !strings.HasPrefix(cs.Extranonce, extranonce) {
+			foreign = append(foreign, cs)
+		}
+	}
+	s.sessionsMu.RUnlock()
+
+	if len(foreign) > 0 {
+		log.Printf("Reconnecting %v stratum miners for new extranonce", len(foreign))
+	}
+	for _, cs := range foreign {
+		s.reconnectSession(cs)
+	}
+}
+
+// Name of where jobs come from
+func (s *ProxyServer) jobSource() string {
+	if s.pool != nil {
+		return s.pool.name
+	}
+	return s.rpc().Name
+}
+
+// Block number sent along mining.notify, as number, hex or decimal string
+func parsePoolHeight(raw json.RawMessage) (uint64, bool) {
+	var v interface{}
+	if len(raw) == 0 || json.Unmarshal(raw, &v) != nil {
+		return 0, false
+	}
+	switch h := v.(type) {
+	case float64:
+		return uint64(h), h > 0
+	case string:
+		var n uint64
+		var err error
+		if strings.HasPrefix(h, "0x") {
+			n, err = strconv.ParseUint(h[2:], 16, 64)
+		} else {
+			n, err = strconv.ParseUint(h, 10, 64)
+		}
+		return n, err == nil && n > 0
+	}
+	return 0, false
+}
+
+// Without height from the pool block number starts at epoch of the seed and grows by one
+// with every job clearing previous ones, as a new block does. It's never above the real
+// one and stays within the epoch, so shares are verified with the right one.
+func estimatePoolHeight(seed string, clean bool, prev *poolJob) (uint64, bool) {
+	if prev != nil && prev.seed == seed {
+		height := prev.height
+		if clean && (height+1)%epochLength != 0 {
+			height++
+		}
+		return height, true
+	}
+	epoch, ok := seedEpoch(seed)
+	return epoch * epochLength, ok
+}
+
+// Seed of epoch 0 is zeros, every next one is Keccak-256 of the previous
+func seedEpoch(seed string) (uint64, bool) {
+	want := common.HexToHash(seed)
+	var h common.Hash
+	for epoch := uint64(0); epoch < maxSeedEpochs; epoch++ {
+		if h == want {
+			return epoch, true
+		}
+		copy(h[:], crypto.Keccak256(h[:]))
+	}
+	return 0, false
+}
+
+func isJSONArray(raw json.RawMessage) bool {
+	return len(raw) > 0 && raw[0] == '['
+}
+
+func isJSONError(raw json.RawMessage) bool {
+	return len(raw) > 0 && string(raw) != "null"
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+type testPoolRequest struct {
+	Id     int64    `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	Worker string   `json:"worker"`
+}
+
+// Main pool with one edge connected, answers requests by method and passes them to test
+type testPool struct {
+	net.Listener
+	requests chan testPoolRequest
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newTestPool(t *testing.T, replies map[string]string) *testPool {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := &testPool{Listener: l, requests: make(chan testPoolRequest, 16)}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		p.mu.Lock()
+		p.conn = conn
+		p.mu.Unlock()
+		dec := json.NewDecoder(conn)
+		for {
+			var req testPoolRequest
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			if reply, ok := replies[req.Method]; ok {
+				p.send(fmt.Sprintf(`{"id":%d,"result":%s,"error":null}`, req.Id, reply))
+			}
+			p.requests <- req
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return p
+}
+
+func (p *testPool) send(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(p.conn, line)
+}
+
+func (p *testPool) expect(t *testing.T, method string) testPoolRequest {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case req := <-p.requests:
+			if req.Method == method {
+				return req
+			}
+		case <-timeout:
+			t.Fatalf("Expected %v request from edge", method)
+		}
+	}
+}
+
+func newEdgeProxy(t *testing.T, cfg *UpstreamPool) *ProxyServer {
+	s := &ProxyServer{
+		config:      &Config{Proxy: Proxy{Difficulty: 1000}},
+		verifier:    &verifier{},
+		sessions:    make(map[*Session]struct{}),
+		Extranonces: make(map[string]bool),
+		pool:        newPoolUpstream(cfg, ""),
+	}
+	go s.runPool()
+	t.Cleanup(s.pool.close)
+	return s
+}
+
+func waitTemplate(t *testing.T, s *ProxyServer, height uint64) *BlockTemplate {
+	for i := 0; i < 200; i++ {
+		if tpl := s.currentBlockTemplate(); tpl != nil && tpl.Height == height {
+			return tpl
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected job at height %v from upstream pool", height)
+	return nil
+}
+
+func TestPoolNiceHashJobs(t *testing.T) {
+	pool := newTestPool(t, map[string]string{
+		"mining.subscribe":            `[["mining.notify","ae6812eb4cd7735a302a8a9dd95cf71f","EthereumStratum/1.0.0"],"ab12"]`,
+		"mining.extranonce.subscribe": `true`,
+		"mining.authorize":            `true`,
+		"mining.submit":               `true`,
+	})
+	s := newEdgeProxy(t, &UpstreamPool{Url: pool.Addr().String(), Mode: "nicehash", Login: "0xabc", Timeout: "1s"})
+
+	if req := pool.expect(t, "mining.authorize"); req.Params[0] != "0xabc" {
+		t.Errorf("Expected edge to log in with its account, got %v", req.Params)
+	}
+	header, seed := fmt.Sprintf("%064x", 100), fmt.Sprintf("%064x", 1)
+	pool.send(`{"id":null,"method":"mining.set_difficulty","params":[2]}`)
+	pool.send(fmt.Sprintf(`{"id":null,"method":"mining.notify","params":["job1","%v","%v",true],"height":"100"}`, seed, header))
+
+	tpl := waitTemplate(t, s, 100)
+	h, ok := tpl.headers["0x"+header]
+	if !ok || h.job != "job1" || h.diff.Int64() != util.DiffFloatToInt(2) {
+		t.Fatalf("Expected pool job at pool difficulty, got %+v", h)
+	}
+	if extranonce, ok := s.uniqExtranonce(); !ok || len(extranonce) != 8 || !strings.HasPrefix(extranonce, "ab12") {
+		t.Errorf("Expected session extranonce under pool one, got %v", extranonce)
+	}
+
+	// Nonce out of pool extranonce can't be submitted there
+	s.pool.submit("rig0", []string{"0xff12001122334455", "0x" + header, "0x" + seed}, "job1")
+	s.pool.submit("rig1", []string{"0xab12001122334455", "0x" + header, "0x" + seed}, "job1")
+	req := pool.expect(t, "mining.submit")
+	if !reflect.DeepEqual(req.Params, []string{"0xabc.rig1", "job1", "001122334455"}) {
+		t.Errorf("Expected share with worker name and nonce after extranonce, got %v", req.Params)
+	}
+}
+
+func TestPoolEthProxyJobs(t *testing.T) {
+	work := func(height uint64) string {
+		return fmt.Sprintf(`["0x%064x","0x%064x","%v","0x%x"]`, height, 1, util.GetTargetHex(1<<32), height)
+	}
+	pool := newTestPool(t, map[string]string{
+		"eth_submitLogin": `true`,
+		"eth_getWork":     work(100),
+		"eth_submitWork":  `true`,
+	})
+	s := newEdgeProxy(t, &UpstreamPool{Url: pool.Addr().String(), Login: "0xabc", Password: "x", Timeout: "1s"})
+
+	if req := pool.expect(t, "eth_submitLogin"); !reflect.DeepEqual(req.Params, []string{"0xabc", "x"}) {
+		t.Errorf("Expected edge to log in with its account, got %v", req.Params)
+	}
+	waitTemplate(t, s, 100)
+	pool.send(`{"id":0,"jsonrpc":"2.0","result":` + work(101) + `}`)
+	tpl := waitTemplate(t, s, 101)
+	if tpl.Difficulty.Int64() != 1<<32 {
+		t.Errorf("Expected pushed job at target difficulty, got %v", tpl.Difficulty)
+	}
+
+	params := []string{"0x0011223344556677", tpl.Header, tpl.Seed}
+	s.pool.submit("rig1", params, "")
+	req := pool.expect(t, "eth_submitWork")
+	if req.Worker != "rig1" || !reflect.DeepEqual(req.Params, params) {
+		t.Errorf("Expected share with worker name, got %v %v", req.Worker, req.Params)
+	}
+}
+
+func TestSessionExtranonceSize(t *testing.T) {
+	tests := []struct {
+		pool string
+		size int
+	}{
+		{"", 4},
+		{"ab12", 4},
+		{"ab12cd34ef", 4},
+		{"ab12cd34ef56", 2},
+	}
+	for _, tt := range tests {
+		if size := sessionExtranonceSize(tt.pool); size != tt.size {
+			t.Errorf("%q: expected session extranonce of %v hex chars, got %v", tt.pool, tt.size, size)
+		}
+	}
+	s := &ProxyServer{}
+	if err := s.setPoolExtranonce(&poolUpstream{}, "ab12cd34ef5678"); err == nil {
+		t.Error("Expected pool extranonce leaving no room for sessions to be refused")
+	}
+}
+
+func TestEstimatePoolHeight(t *testing.T) {
+	const (
+		seed0 = "0x0000000000000000000000000000000000000000000000000000000000000000"
+		seed1 = "0x290decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e563"
+		seed2 = "0x510e4e770828ddbf7f7b00ab00a9f6adaf81c0dc9cc85f1f8249c256942d61d9"
+	)
+	tests := []struct {
+		name   string
+		seed   string
+		clean  bool
+		prev   *poolJob
+		height uint64
+		ok     bool
+	}{
+		{"first epoch", seed0, true, nil, 0, true},
+		{"start of seed epoch", seed2, true, nil, 2 * epochLength, true},
+		{"new block", seed1, true, &poolJob{seed: seed1, height: epochLength + 10}, epochLength + 11, true},
+		{"same block", seed1, false, &poolJob{seed: seed1, height: epochLength + 10}, epochLength + 10, true},
+		{"kept within epoch", seed1, true, &poolJob{seed: seed1, height: 2*epochLength - 1}, 2*epochLength - 1, true},
+		{"next epoch", seed2, false, &poolJob{seed: seed1, height: epochLength + 10}, 2 * epochLength, true},
+		{"unknown seed", "0x" + strings.Repeat("ab", 32), true, nil, 0, false},
+	}
+	for _, tt := range tests {
+		height, ok := estimatePoolHeight(tt.seed, tt.clean, tt.prev)
+		if height != tt.height || ok != tt.ok {
+			t.Errorf("%v: expected height %v %v, got %v %v", tt.name, tt.height, tt.ok, height, ok)
+		}
+	}
+}
@@ -1,19 +1,25 @@
 package proxy
 
 import (
+	"encoding/json"
+
 	"github.com/yuriy0803/open-etc-pool-friends/api"
 	"github.com/yuriy0803/open-etc-pool-friends/exchange"
+	"github.com/yuriy0803/open-etc-pool-friends/ledger"
+	"github.com/yuriy0803/open-etc-pool-friends/metrics"
 	"github.com/yuriy0803/open-etc-pool-friends/payouts"
 	"github.com/yuriy0803/open-etc-pool-friends/policy"
 	"github.com/yuriy0803/open-etc-pool-friends/storage"
 )
 
 type Config struct {
-	Name                  string        `json:"name"`
-	Proxy                 Proxy         `json:"proxy"`
-	Api                   api.ApiConfig `json:"api"`
-	Upstream              []Upstream    `json:"upstream"`
-	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
+	Name                  string         `json:"name"`
+	Proxy                 Proxy          `json:"proxy"`
+	Api                   api.ApiConfig  `json:"api"`
+	Upstream              []Upstream     `json:"upstream"`
+	UpstreamCheckInterval string         `json:"upstreamCheckInterval"`
+	UpstreamHealth        UpstreamHealth `json:"upstreamHealth"`
+	UpstreamPool          UpstreamPool   `json:"upstreamPool"`
 
 	Threads int `json:"threads"`
 
@@ -24,15 +30,24 @@ type Config struct {
 	Redis    storage.Config `json:"redis"`
 	CoinName string         `json:"coin-name"`
 
+	RewardScheme  payouts.SchemeConfig   `json:"rewardScheme"`
 	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
 
+	Ledger ledger.Config `json:"ledger"`
+
 	Exchange exchange.ExchangeConfig `json:"exchange"`
 
+	Metrics metrics.Config `json:"metrics"`
+
 	NewrelicName    string `json:"newrelicName"`
 	NewrelicKey     string `json:"newrelicKey"`
 	NewrelicVerbose bool   `json:"newrelicVerbose"`
 	NewrelicEnabled bool   `json:"newrelicEnabled"`
+
+	// Coins served by this process, every entry overrides fields of this config.
+	// Config is a single coin if empty.
+	Coins []json.RawMessage `json:"coins"`
 }
 
 type Proxy struct {
@@ -42,10 +57,12 @@ type Proxy struct {
 	LimitBodySize        int64  `json:"limitBodySize"`
 	BehindReverseProxy   bool   `json:"behindReverseProxy"`
 	BlockRefreshInterval string `json:"blockRefreshInterval"`
-	Difficulty           int64  `json:"difficulty"`
-	StateUpdateInterval  string `json:"stateUpdateInterval"`
-	HashrateExpiration   string `json:"hashrateExpiration"`
-	StratumHostname      string `json:"stratumHostname"`
+	// New transactions of subscribed nodes refresh job at most this often, empty is 1s
+	TxRefreshInterval   string `json:"txRefreshInterval"`
+	Difficulty          int64  `json:"difficulty"`
+	StateUpdateInterval string `json:"stateUpdateInterval"`
+	HashrateExpiration  string `json:"hashrateExpiration"`
+	StratumHostname     string `json:"stratumHostname"`
 
 	Policy policy.Config `json:"policy"`
 
@@ -53,7 +70,24 @@ type Proxy struct {
 	HealthCheck bool  `json:"healthCheck"`
 	Debug       bool  `json:"debug"`
 
-	Stratum Stratum `json:"stratum"`
+	Stratum []Stratum `json:"stratum"`
+
+	Verifier VerifierConfig `json:"verifier"`
+
+	ShareBatch ShareBatchConfig `json:"shareBatch"`
+
+	// Work pushed by node to /etc
+	Notify WorkNotify `json:"notify"`
+}
+
+// Any stratum port enabled
+func (p *Proxy) StratumEnabled() bool {
+	for _, v := range p.Stratum {
+		if v.Enabled {
+			return true
+		}
+	}
+	return false
 }
 
 type Stratum struct {
@@ -61,13 +95,61 @@ type Stratum struct {
 	Listen   string `json:"listen"`
 	Timeout  string `json:"timeout"`
 	MaxConn  int    `json:"maxConn"`
-	TLS      bool   `json:"tls`
-	CertFile string `json:"certFile`
-	KeyFile  string `json:"keyFile`
+	TLS      bool   `json:"tls"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// Share difficulty of this port, pool difficulty is used if not set
+	Difficulty int64   `json:"difficulty"`
+	VarDiff    VarDiff `json:"varDiff"`
+	// All miners on this port mine solo
+	Solo bool `json:"solo"`
+	// Port of edge proxies, a worker named along a share is taken instead of the one of login
+	Edge bool `json:"edge"`
+}
+
+type VarDiff struct {
+	Enabled bool `json:"enabled"`
+	// Difficulty bounds for retargeting
+	MinDiff int64 `json:"minDiff"`
+	MaxDiff int64 `json:"maxDiff"`
+	// Number of shares per minute every session should submit
+	SharesPerMinute float64 `json:"sharesPerMinute"`
+	// Allowed deviation from the shares per minute goal before retargeting
+	VariancePercent float64 `json:"variancePercent"`
+	// Minimal time between two retargets of a session
+	RetargetInterval string `json:"retargetInterval"`
 }
 
 type Upstream struct {
 	Name    string `json:"name"`
 	Url     string `json:"url"`
 	Timeout string `json:"timeout"`
+	// WebSocket url or IPC socket path for new heads and transactions, jobs are polled if not set
+	Subscribe string `json:"subscribe"`
+}
+
+type UpstreamHealth struct {
+	// Upstream is unhealthy when this many blocks behind the best one, 3 if not set
+	MaxLag uint64 `json:"maxLag"`
+	// Upstream is unhealthy with fewer peers, peers are not checked if not set
+	MinPeers int64 `json:"minPeers"`
+	// Upstream is unhealthy when its average RPC latency is higher, 2s if not set
+	MaxLatency string `json:"maxLatency"`
+	// Upstream is unhealthy when this share of recent RPC requests failed, 0.5 if not set
+	MaxErrorRate float64 `json:"maxErrorRate"`
+}
+
+// Main pool an edge proxy mines for, jobs come from there instead of nodes
+type UpstreamPool struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`
+	// Stratum host:port of the main pool
+	Url string `json:"url"`
+	TLS bool   `json:"tls"`
+	// "ethproxy" or "nicehash", ethproxy if not set
+	Mode string `json:"mode"`
+	// Account credited by the main pool for shares of all local miners
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Timeout  string `json:"timeout"`
 }
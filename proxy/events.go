@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Delay before reconnecting a lost subscription
+const resubscribeInterval = 5 * time.Second
+
+// Busy tx pool would otherwise refresh job on every tick
+const defaultTxRefreshInterval = time.Second
+
+// Subscribes to events of every upstream with subscribe url, subscriptions of previous config are closed
+func (s *ProxyServer) startSubscriptions(cfg []Upstream) {
+	s.stopSubscriptions()
+	quit := make(chan struct{})
+	s.subscriptionsMu.Lock()
+	s.subscriptionsQuit = quit
+	s.subscriptionsMu.Unlock()
+
+	for _, v := range cfg {
+		if len(v.Subscribe) > 0 {
+			go s.subscribe(v, quit)
+		}
+	}
+}
+
+func (s *ProxyServer) stopSubscriptions() {
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+	if s.subscriptionsQuit != nil {
+		close(s.subscriptionsQuit)
+		s.subscriptionsQuit = nil
+	}
+}
+
+func (s *ProxyServer) subscribe(cfg Upstream, quit chan struct{}) {
+	timeout := util.MustParseDuration(cfg.Timeout)
+	for {
+		sub, err := rpc.Subscribe(cfg.Name, cfg.Subscribe, timeout, rpc.NewHeads, rpc.NewPendingTransactions)
+		if err != nil {
+			log.Printf("Failed to subscribe to %v events: %v", cfg.Name, err)
+		} else {
+			log.Printf("Subscribed to %v events at %v", cfg.Name, cfg.Subscribe)
+			s.handleEvents(sub, quit)
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(resubscribeInterval):
+		}
+	}
+}
+
+func (s *ProxyServer) handleEvents(sub *rpc.Subscription, quit chan struct{}) {
+	liveSubscriptions.With(s.coin).Set(float64(atomic.AddInt32(&s.subscriptions, 1)))
+	defer func() {
+		liveSubscriptions.With(s.coin).Set(float64(atomic.AddInt32(&s.subscriptions, -1)))
+	}()
+
+	for {
+		select {
+		case <-quit:
+			sub.Close()
+			return
+		case e, ok := <-sub.Events():
+			if !ok {
+				log.Printf("Lost %v subscription: %v", sub.Name, sub.Err())
+				return
+			}
+			if e.Kind == rpc.NewHeads {
+				s.requestRefresh()
+			} else {
+				atomic.StoreInt32(&s.pendingTxs, 1)
+			}
+		}
+	}
+}
+
+func (s *ProxyServer) requestRefresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// New heads refresh job at once, new transactions on a tick at most once per txInterval.
+// Ticks poll upstreams while no subscription is up.
+func (s *ProxyServer) refreshBlockTemplates(interval, txInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastRefresh time.Time
+	for {
+		select {
+		case <-s.refresh:
+			s.fetchBlockTemplate()
+			lastRefresh = time.Now()
+		case now := <-ticker.C:
+			if atomic.LoadInt32(&s.subscriptions) == 0 || s.txRefreshDue(now, lastRefresh, txInterval) {
+				s.fetchBlockTemplate()
+				lastRefresh = now
+			}
+		}
+	}
+}
+
+// Transactions seen since the last refresh are picked up once txInterval has passed
+func (s *ProxyServer) txRefreshDue(now, lastRefresh time.Time, txInterval time.Duration) bool {
+	if now.Sub(lastRefresh) < txInterval {
+		return false
+	}
+	return atomic.SwapInt32(&s.pendingTxs, 0) > 0
+}
+
+// Subscribed node may get stuck without dropping connection, health checks catch that
+func (s *ProxyServer) refreshIfBehind() {
+	t := s.currentBlockTemplate()
+	if t != nil && s.bestHeight() > t.Height {
+		s.requestRefresh()
+	}
+}
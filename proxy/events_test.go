@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTxRefreshDue(t *testing.T) {
+	s := &ProxyServer{}
+	last := time.Now()
+	if s.txRefreshDue(last.Add(500*time.Millisecond), last, time.Second) {
+		t.Error("Expected no refresh without new transactions")
+	}
+	s.pendingTxs = 1
+	if s.txRefreshDue(last.Add(500*time.Millisecond), last, time.Second) {
+		t.Error("Expected new transactions to wait for tx refresh interval")
+	}
+	if s.pendingTxs != 1 {
+		t.Error("Expected new transactions to be kept for later refresh")
+	}
+	if !s.txRefreshDue(last.Add(time.Second), last, time.Second) {
+		t.Error("Expected refresh once tx refresh interval passed")
+	}
+	if s.txRefreshDue(last.Add(2*time.Second), last, time.Second) {
+		t.Error("Expected transactions to be refreshed once")
+	}
+}
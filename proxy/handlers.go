@@ -53,11 +53,26 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
 	// Update session information and register the session
 	cs.login = login
 	cs.worker = id
+	cs.solo = (cs.port != nil && cs.port.config.Solo) || (len(params) > 1 && isSoloPassword(params[1]))
 	s.registerSession(cs)
-	log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	if cs.solo {
+		log.Printf("Stratum solo miner connected %v@%v", login, cs.ip)
+	} else {
+		log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	}
 	return true, nil
 }
 
+// Password "solo", optionally among comma separated flags like "x,solo", opts into solo mining
+func isSoloPassword(pass string) bool {
+	for _, flag := range strings.Split(pass, ",") {
+		if strings.TrimSpace(flag) == "solo" {
+			return true
+		}
+	}
+	return false
+}
+
 // handleGetWorkRPC handles the 'getwork' RPC request from a Stratum miner.
 func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
 	// Get the current block template.
@@ -66,8 +81,8 @@ func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	// Return a slice of strings with the header, seed, target difficulty, and height of the current block template.
-	return []string{t.Header, t.Seed, s.diff, util.ToHex(int64(t.Height))}, nil
+	// Return a slice of strings with the header, seed, session target, and height of the current block template.
+	return []string{t.Header, t.Seed, cs.targetHex(), util.ToHex(int64(t.Height))}, nil
 }
 
 // Stratum
@@ -81,8 +96,13 @@ func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string
 		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
 	}
 
-	// Call the handleSubmitRPC function with the session's login and worker IDs
-	return s.handleSubmitRPC(cs, cs.login, cs.worker, params)
+	// Edge proxies submit for many workers, a worker named along the share overrides the one of login.
+	// Only on edge ports, other miners can't spread shares over workers they never logged in.
+	worker := cs.worker
+	if cs.isEdge() && workerPattern.MatchString(id) {
+		worker = id
+	}
+	return s.handleSubmitRPC(cs, cs.login, worker, params)
 }
 
 func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
@@ -93,9 +113,9 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
-	// Add "0x" prefix to params if the stratum mode is NiceHash
+	// Add "0x" prefix to params for NiceHash and EthereumStratum/2.0.0 modes
 	stratumMode := cs.stratumMode()
-	if stratumMode == NiceHash {
+	if stratumMode != EthProxy {
 		for i := 0; i < len(params); i++ {
 			if !strings.HasPrefix(params[i], "0x") {
 				params[i] = "0x" + params[i]
@@ -110,13 +130,21 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
 
+	// Don't queue more shares than workers can verify
+	if !s.verifier.admit() {
+		log.Printf("Verification queue is full, rejected share from %s@%s", login, cs.ip)
+		return false, errServerBusy
+	}
+
 	// Process the share in a separate goroutine
 	go func(s *ProxyServer, cs *Session, login, id string, params []string) {
+		defer s.verifier.done()
+
 		// Get the current block template
 		t := s.currentBlockTemplate()
 
 		// Check if the share already exists and if it's valid
-		exist, validShare := s.processShare(login, id, cs.ip, t, params, stratumMode != EthProxy)
+		exist, validShare := s.processShare(cs, login, id, t, params, stratumMode != EthProxy)
 
 		// Apply the share policy to determine if the share should be accepted
 		ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
@@ -147,6 +175,7 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 		if s.config.Proxy.Debug {
 			log.Printf("Valid share from %s@%s", login, cs.ip)
 		}
+		s.retargetSession(cs)
 
 		// Apply the policy to determine if the session should be disconnected
 		if !ok {
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/yuriy0803/open-etc-pool-friends/metrics"
+)
+
+var (
+	sessionsGauge      = metrics.NewGauge("pool_proxy_sessions", "Connected stratum sessions.", "coin", "mode")
+	sharesCounter      = metrics.NewCounter("pool_proxy_shares_total", "Submitted shares by result.", "coin", "result")
+	blocksCounter      = metrics.NewCounter("pool_proxy_blocks_total", "Blocks submitted to the node by result.", "coin", "result")
+	upstreamSwitches   = metrics.NewCounter("pool_proxy_upstream_switches_total", "Switches of the active upstream.", "coin", "upstream")
+	liveSubscriptions  = metrics.NewGauge("pool_proxy_upstream_subscriptions", "Live upstream event subscriptions.", "coin")
+	notifyCounter      = metrics.NewCounter("pool_proxy_work_notifications_total", "Work pushed to /etc by result.", "coin", "result")
+	upstreamScores     = metrics.NewGauge("pool_proxy_upstream_score", "Health score of each upstream, 1 is a perfect node.", "coin", "upstream")
+	broadcastDuration  = metrics.NewHistogram("pool_proxy_broadcast_duration_seconds", "Time to dispatch a new job to all sessions.", nil, "coin")
+	bufferedShares     = metrics.NewGauge("pool_proxy_buffered_shares", "Valid shares waiting for a batch write.", "coin")
+	shareFlushes       = metrics.NewCounter("pool_proxy_share_flushes_total", "Batch writes of shares by result.", "coin", "result")
+	blockFlushFailures = metrics.NewCounter("pool_proxy_block_flush_failures_total", "Blocks written without buffered shares of their round.", "coin")
+	poolShares         = metrics.NewCounter("pool_proxy_pool_shares_total", "Shares forwarded to upstream pool by result.", "coin", "result")
+	verifyQueue        = metrics.NewGauge("pool_proxy_verify_queue", "Shares waiting for a free verification worker.", "coin")
+	verifyPending      = metrics.NewGauge("pool_proxy_verify_pending", "Admitted shares not processed yet.", "coin")
+	verifyRejected     = metrics.NewCounter("pool_proxy_verify_rejected_total", "Shares refused with server busy on a full verification queue.", "coin")
+	verifyDuration     = metrics.NewHistogram("pool_proxy_verify_duration_seconds", "Time a share waits for and takes PoW verification.", nil, "coin")
+)
+
+var stratumModeNames = map[int]string{
+	EthProxy:         "ethproxy",
+	NiceHash:         "nicehash",
+	EthereumStratum2: "stratum2",
+}
+
+func (s *ProxyServer) collectMetrics() {
+	counts := make(map[int]int)
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		counts[cs.stratumMode()]++
+	}
+	s.sessionsMu.RUnlock()
+	for mode, name := range stratumModeNames {
+		sessionsGauge.With(s.coin, name).Set(float64(counts[mode]))
+	}
+	if s.verifier != nil {
+		verifyQueue.With(s.coin).Set(float64(len(s.verifier.jobs)))
+		verifyPending.With(s.coin).Set(float64(atomic.LoadInt64(&s.verifier.pending)))
+	}
+}
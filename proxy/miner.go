@@ -5,42 +5,43 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/ubiq/go-ubiq/v7/common"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
 	"github.com/yuriy0803/open-etc-pool-friends/util"
-	"github.com/yuriy0803/ubqhash"
 )
 
 var (
 	maxUint256 = new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
 )
 
-var hasher = ubqhash.New()
-
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string, stratum bool) (bool, bool) {
+func (s *ProxyServer) processShare(cs *Session, login, id string, t *BlockTemplate, params []string, stratum bool) (bool, bool) {
+	ip := cs.ip
 
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	mixDigest := params[2]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Difficulty
+	shareDiff := cs.difficulty()
 	stratumHostname := s.config.Proxy.StratumHostname
 
 	var result common.Hash
 	if stratum {
 		hashNoNonceTmp := common.HexToHash(params[2])
 
-		_, mixDigestTmp, hashTmp := hasher.Compute(t.Height, hashNoNonceTmp, nonce)
+		mixDigestTmp, hashTmp := s.verifier.compute(t.Height, hashNoNonceTmp, nonce)
 		params[1] = hashNoNonceTmp.Hex()
 		params[2] = mixDigestTmp.Hex()
 		hashNoNonce = params[1]
 		result = hashTmp
 	} else {
 		hashNoNonceTmp := common.HexToHash(hashNoNonce)
-		_, mixDigestTmp, hashTmp := hasher.Compute(t.Height, hashNoNonceTmp, nonce)
+		mixDigestTmp, hashTmp := s.verifier.compute(t.Height, hashNoNonceTmp, nonce)
 
 		// check mixDigest
 		if mixDigestTmp.Hex() != mixDigest {
+			sharesCounter.With(s.coin, "invalid").Inc()
 			return false, false
 		}
 		result = hashTmp
@@ -51,6 +52,7 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 	if !s.policy.ApplyLoginWalletPolicy(login) {
 		// check to see if this wallet login is blocked
 		log.Printf("Blacklisted wallet share, skipped from %v", login)
+		sharesCounter.With(s.coin, "invalid").Inc()
 		return false, false
 		//return codes need work here, a lot of it.
 	}
@@ -63,6 +65,7 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 	if shareDiffFloat < 0.0001 {
 		log.Printf("share difficulty too low, %f < %d, from %v@%v", shareDiffFloat, t.Difficulty, login, ip)
 		s.backend.WriteWorkerShareStatus(login, id, false, true, false)
+		sharesCounter.With(s.coin, "invalid").Inc()
 		return false, false
 	}
 
@@ -83,28 +86,45 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
 		log.Printf("Stale share from %v@%v", login, ip)
+		sharesCounter.With(s.coin, "stale").Inc()
 		return false, false
 	}
 
 	// check share difficulty
-	shareTarget := new(big.Int).Div(maxUint256, big.NewInt(shareDiff))
-	if result.Big().Cmp(shareTarget) > 0 {
+	shareDiff, ok = cs.shareDifficulty(result.Big())
+	if !ok {
 		s.backend.WriteWorkerShareStatus(login, id, false, false, true)
+		sharesCounter.With(s.coin, "invalid").Inc()
 		return false, false
 	}
+	reward := s.shareReward(cs, shareDiff, t)
 	// check target difficulty
 	target := new(big.Int).Div(maxUint256, big.NewInt(h.diff.Int64()))
-	if result.Big().Cmp(target) <= 0 {
-		ok, err := s.rpc().SubmitBlock(params)
+	// Edge proxy forwards shares good enough for upstream pool, blocks are found there
+	if s.pool != nil && result.Big().Cmp(target) <= 0 {
+		s.pool.submit(id, params, h.job)
+	}
+	if s.pool == nil && result.Big().Cmp(target) <= 0 {
+		ok, err := s.submitBlock(params, h.upstream)
 		if err != nil {
 			log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
+			blocksCounter.With(s.coin, "error").Inc()
 		} else if !ok {
 			log.Printf("Block rejected at height %v for %v", h.height, t.Header)
+			blocksCounter.With(s.coin, "rejected").Inc()
+			sharesCounter.With(s.coin, "invalid").Inc()
 			return false, false
 		} else {
+			blocksCounter.With(s.coin, "accepted").Inc()
 			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, shareDiffCalc, h.diff.Int64(), h.height, s.hashrateExpiration, stratumHostname)
+			if s.shares != nil {
+				if err := s.shares.flushBlock(); err != nil {
+					log.Printf("Writing block %v without buffered shares of its round, they are credited to the next one: %v", h.height, err)
+				}
+			}
+			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, shareDiffCalc, h.diff.Int64(), h.height, s.hashrateExpiration, stratumHostname, cs.portDiff(s), cs.solo, reward)
 			if exist {
+				sharesCounter.With(s.coin, "duplicate").Inc()
 				return true, false
 			}
 			if err != nil {
@@ -114,9 +134,28 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 			}
 			log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
 		}
+	} else if s.shares != nil {
+		share := &storage.Share{
+			Login:         login,
+			Id:            id,
+			Params:        params,
+			Diff:          shareDiff,
+			ShareDiffCalc: shareDiffCalc,
+			Height:        h.height,
+			Expire:        s.hashrateExpiration,
+			Hostname:      stratumHostname,
+			PortDiff:      cs.portDiff(s),
+			Solo:          cs.solo,
+			Reward:        reward,
+		}
+		if s.shares.add(share) {
+			sharesCounter.With(s.coin, "duplicate").Inc()
+			return true, false
+		}
 	} else {
-		exist, err := s.backend.WriteShare(login, id, params, shareDiff, shareDiffCalc, h.height, s.hashrateExpiration, stratumHostname)
+		exist, err := s.backend.WriteShare(login, id, params, shareDiff, shareDiffCalc, h.height, s.hashrateExpiration, stratumHostname, cs.portDiff(s), cs.solo, reward)
 		if exist {
+			sharesCounter.With(s.coin, "duplicate").Inc()
 			return true, false
 		}
 		if err != nil {
@@ -124,9 +163,19 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 		}
 	}
 	s.backend.WriteWorkerShareStatus(login, id, true, false, false)
+	sharesCounter.With(s.coin, "valid").Inc()
 	return false, true
 }
 
+// Shannon credited with the share by PPS family schemes, solo miners are paid by their blocks only
+func (s *ProxyServer) shareReward(cs *Session, diff int64, t *BlockTemplate) int64 {
+	if cs.solo {
+		return 0
+	}
+	txFees := new(big.Int).Mul(big.NewInt(atomic.LoadInt64(&s.txFees)), util.Shannon)
+	return s.scheme.ShareReward(diff, t.Difficulty, int64(t.Height), txFees)
+}
+
 func formatHashrate(shareDiffCalc int64) string {
 	units := []string{"H/s", "KH/s", "MH/s", "GH/s", "TH/s", "PH/s"}
 	var i int
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Work notification is 4 hashes and a number, anything bigger is not a notification
+const maxNotifyBodySize = 4096
+
+var heightPattern = regexp.MustCompile("^0x[0-9a-f]{1,16}$")
+
+type WorkNotify struct {
+	// Sent as "Authorization: Bearer <secret>" or used as HMAC-SHA256 key of body,
+	// hex encoded in X-Notify-Signature. Not checked if not set.
+	Secret string `json:"secret"`
+	// Addresses or CIDR ranges allowed to notify, localhost only if not set
+	AllowedIPs []string `json:"allowedIPs"`
+	// Reverse proxies whose X-Forwarded-For is trusted, no header is trusted if not set
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+func parseAllowedIPs(list []string) []*net.IPNet {
+	if len(list) == 0 {
+		list = []string{"127.0.0.1", "::1"}
+	}
+	return parseIPNets(list)
+}
+
+func parseIPNets(list []string) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Fatalf("Invalid notify allowed IP %v: %v", v, err)
+		}
+		result = append(result, ipNet)
+	}
+	return result
+}
+
+func containsIP(nets []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, v := range nets {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Peer address, or the client a trusted reverse proxy appended to X-Forwarded-For.
+// Anyone can send the header, so it is ignored from other peers.
+func (s *ProxyServer) notifyAddr(r *http.Request) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !containsIP(s.notifyProxies, ip) {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if client := strings.TrimSpace(forwarded[len(forwarded)-1]); net.ParseIP(client) != nil {
+		return client
+	}
+	return ip
+}
+
+func (s *ProxyServer) notifyAllowed(ip string) bool {
+	return containsIP(s.notifyIPs, ip)
+}
+
+func (s *ProxyServer) notifyAuthorized(r *http.Request, body []byte) bool {
+	secret := s.config.Proxy.Notify.Secret
+	if len(secret) == 0 {
+		return true
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); len(token) > 0 {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get("X-Notify-Signature"), "0x"))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// Checks shape of eth_getWork reply: header, seed, target and block number
+func parseNotifiedWork(body []byte) ([]string, uint64, bool) {
+	var reply []string
+	if err := json.Unmarshal(body, &reply); err != nil || len(reply) < 4 {
+		return nil, 0, false
+	}
+	for _, v := range reply[:3] {
+		if !hashPattern.MatchString(v) {
+			return nil, 0, false
+		}
+	}
+	if !heightPattern.MatchString(reply[3]) {
+		return nil, 0, false
+	}
+	height, err := strconv.ParseUint(reply[3][2:], 16, 64)
+	if err != nil || util.TargetHexToDiff(reply[2]).Sign() == 0 {
+		return nil, 0, false
+	}
+	return reply, height, true
+}
+
+// Work pushed by node, e.g. geth --miner.notify. Source is authorized and
+// notified height must match active upstream before the job reaches miners.
+func (s *ProxyServer) MiningNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "405 method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := s.notifyAddr(r)
+	if !s.notifyAllowed(ip) {
+		log.Printf("Work notification from unauthorized address %v", ip)
+		notifyCounter.With(s.coin, "unauthorized").Inc()
+		http.Error(w, "403 forbidden.", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNotifyBodySize))
+	if err != nil {
+		notifyCounter.With(s.coin, "invalid").Inc()
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.notifyAuthorized(r, body) {
+		log.Printf("Work notification with bad signature from %v", ip)
+		notifyCounter.With(s.coin, "unauthorized").Inc()
+		http.Error(w, "403 forbidden.", http.StatusForbidden)
+		return
+	}
+	reply, height, ok := parseNotifiedWork(body)
+	if !ok {
+		notifyCounter.With(s.coin, "invalid").Inc()
+		http.Error(w, "400 malformed work.", http.StatusBadRequest)
+		return
+	}
+
+	t := s.currentBlockTemplate()
+	// No need to update, we have fresh job
+	if t != nil {
+		if t.Header == reply[0] {
+			return
+		}
+		if _, ok := t.headers[reply[0]]; ok {
+			return
+		}
+	}
+
+	// Node may notify before its pending block is visible over RPC, one block ahead is fine
+	node := s.rpc()
+	_, nodeHeight, _, err := fetchPendingBlock(node)
+	if err != nil {
+		log.Printf("Can't check notified work at height %d on %v: %v", height, node.Name, err)
+		notifyCounter.With(s.coin, "error").Inc()
+		http.Error(w, "503 upstream unavailable.", http.StatusServiceUnavailable)
+		return
+	}
+	if height < nodeHeight || height > nodeHeight+1 {
+		log.Printf("Notified height %d doesn't match %d on %v", height, nodeHeight, node.Name)
+		notifyCounter.With(s.coin, "mismatch").Inc()
+		http.Error(w, "409 height mismatch.", http.StatusConflict)
+		return
+	}
+
+	diff := util.TargetHexToDiff(reply[2])
+	pendingReply := &rpc.GetBlockReplyPart{
+		Difficulty: util.ToHex(s.config.Proxy.Difficulty),
+		Number:     reply[3],
+	}
+
+	newTemplate := BlockTemplate{
+		Header:               reply[0],
+		Seed:                 reply[1],
+		Target:               reply[2],
+		Height:               height,
+		Difficulty:           diff,
+		GetPendingBlockCache: pendingReply,
+		headers:              make(map[string]heightDiffPair),
+		upstream:             node.Name,
+	}
+	// Copy job backlog and add current one
+	newTemplate.headers[reply[0]] = heightDiffPair{
+		diff:     diff,
+		height:   height,
+		upstream: node.Name,
+	}
+	if t != nil {
+		for k, v := range t.headers {
+			if v.height > height-maxBacklog {
+				newTemplate.headers[k] = v
+			}
+		}
+	}
+	s.blockTemplate.Store(&newTemplate)
+	notifyCounter.With(s.coin, "accepted").Inc()
+
+	log.Printf("New block notified at height %d / %s / %d", height, reply[0][0:10], diff)
+
+	// Stratum
+	if s.config.Proxy.StratumEnabled() {
+		go s.broadcastNewJobs()
+	}
+}
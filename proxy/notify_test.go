@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newNotifyProxy(t *testing.T, cfg WorkNotify) *ProxyServer {
+	node := newTestNode(100, true)
+	t.Cleanup(node.Close)
+	s := newUpstreamsProxy(node)
+	s.config = &Config{Proxy: Proxy{Difficulty: 1000, Notify: cfg}}
+	s.notifyIPs = parseAllowedIPs(cfg.AllowedIPs)
+	s.notifyProxies = parseIPNets(cfg.TrustedProxies)
+	return s
+}
+
+func notifiedWork(height uint64) string {
+	return fmt.Sprintf(`["0x%064x","0x%064x","0x%064x","0x%x"]`, height, 1, 1<<32, height)
+}
+
+func notify(s *ProxyServer, body string, header ...string) int {
+	r := httptest.NewRequest("POST", "/etc", strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:5000"
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.MiningNotify(w, r)
+	return w.Code
+}
+
+func TestMiningNotifyValidatesWork(t *testing.T) {
+	s := newNotifyProxy(t, WorkNotify{})
+	invalid := []string{
+		`["0x01","0x02","0x03"]`,
+		`{"header":"0x01"}`,
+		strings.Replace(notifiedWork(100), "0x0", "0xz", 1),
+		fmt.Sprintf(`["0x%064x","0x%064x","0x%064x","100"]`, 1, 1, 1),
+		strings.Repeat(" ", maxNotifyBodySize) + notifiedWork(100),
+	}
+	for _, body := range invalid {
+		if code := notify(s, body); code == http.StatusOK {
+			t.Errorf("Expected %.40q to be rejected", body)
+		}
+	}
+	if code := notify(s, notifiedWork(90)); code != http.StatusConflict {
+		t.Errorf("Expected stale height to be rejected, got %v", code)
+	}
+	if s.currentBlockTemplate() != nil {
+		t.Fatal("Rejected work must not reach miners")
+	}
+
+	if code := notify(s, notifiedWork(101)); code != http.StatusOK {
+		t.Fatalf("Expected work one block ahead of upstream to be accepted, got %v", code)
+	}
+	tpl := s.currentBlockTemplate()
+	if tpl == nil || tpl.Height != 101 {
+		t.Fatalf("Expected notified template at height 101, got %+v", tpl)
+	}
+	// Block found on pushed job is submitted to the node that confirmed its height
+	if tpl.upstream != "node0" || tpl.headers[tpl.Header].upstream != "node0" {
+		t.Errorf("Expected notified job of node0, got %q", tpl.headers[tpl.Header].upstream)
+	}
+}
+
+func TestMiningNotifyAuthorization(t *testing.T) {
+	s := newNotifyProxy(t, WorkNotify{Secret: "secret"})
+	body := notifiedWork(100)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if code := notify(s, body); code != http.StatusForbidden {
+		t.Errorf("Expected unsigned work to be rejected, got %v", code)
+	}
+	if code := notify(s, body, "Authorization", "Bearer wrong"); code != http.StatusForbidden {
+		t.Errorf("Expected wrong secret to be rejected, got %v", code)
+	}
+	if code := notify(s, body, "X-Notify-Signature", strings.Repeat("0", len(signature))); code != http.StatusForbidden {
+		t.Errorf("Expected wrong signature to be rejected, got %v", code)
+	}
+	if code := notify(s, body, "X-Notify-Signature", signature); code != http.StatusOK {
+		t.Errorf("Expected signed work to be accepted, got %v", code)
+	}
+	if code := notify(s, notifiedWork(101), "Authorization", "Bearer secret"); code != http.StatusOK {
+		t.Errorf("Expected work with secret to be accepted, got %v", code)
+	}
+
+	remote := newNotifyProxy(t, WorkNotify{AllowedIPs: []string{"10.0.0.0/8"}})
+	if code := notify(remote, body); code != http.StatusForbidden {
+		t.Errorf("Expected address out of allowlist to be rejected, got %v", code)
+	}
+}
+
+func TestMiningNotifyForwardedAddress(t *testing.T) {
+	body := notifiedWork(100)
+	// Header is set by anyone, allowlist checks the peer
+	s := newNotifyProxy(t, WorkNotify{AllowedIPs: []string{"10.0.0.1"}})
+	s.config.Proxy.BehindReverseProxy = true
+	if code := notify(s, body, "X-Forwarded-For", "10.0.0.1"); code != http.StatusForbidden {
+		t.Errorf("Expected forwarded address of untrusted peer to be ignored, got %v", code)
+	}
+
+	s = newNotifyProxy(t, WorkNotify{AllowedIPs: []string{"10.0.0.1"}, TrustedProxies: []string{"127.0.0.1"}})
+	if code := notify(s, body, "X-Forwarded-For", "10.0.0.1, 10.0.0.2"); code != http.StatusForbidden {
+		t.Errorf("Expected address appended by proxy to be checked, got %v", code)
+	}
+	if code := notify(s, body, "X-Forwarded-For", "10.0.0.2, 10.0.0.1"); code != http.StatusOK {
+		t.Errorf("Expected address forwarded by trusted proxy to be allowed, got %v", code)
+	}
+	if code := notify(s, notifiedWork(101)); code != http.StatusForbidden {
+		t.Errorf("Expected trusted proxy itself to be checked against allowlist, got %v", code)
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"log"
@@ -14,27 +15,62 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/yuriy0803/open-etc-pool-friends/metrics"
+	"github.com/yuriy0803/open-etc-pool-friends/payouts"
 	"github.com/yuriy0803/open-etc-pool-friends/policy"
-	"github.com/yuriy0803/open-etc-pool-friends/rpc"
 	"github.com/yuriy0803/open-etc-pool-friends/storage"
 	"github.com/yuriy0803/open-etc-pool-friends/util"
 )
 
+// Storage used by proxy, policy shares it
+type Backend interface {
+	storage.ShareBackend
+	storage.NodeBackend
+	storage.PolicyBackend
+}
+
 type ProxyServer struct {
 	config             *Config
+	coin               string
 	blockTemplate      atomic.Value
 	upstream           int32
-	upstreams          []*rpc.RPCClient
-	backend            *storage.RedisClient
-	diff               string
+	upstreamsMu        sync.RWMutex
+	upstreams          []*upstream
+	upstreamLimits     *upstreamLimits
+	notifyIPs          []*net.IPNet
+	notifyProxies      []*net.IPNet
+	backend            Backend
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
+	scheme             payouts.RewardScheme
+	verifier           *verifier
+	// Nil when every share is written at once
+	shares *shareBatcher
+	// Average tx fees per block in Shannon, for FPPS
+	txFees int64
+	// Set once shutdown begins
+	stopping int32
+
+	// Number of live upstream subscriptions, polling for jobs stops while any is up
+	subscriptions     int32
+	subscriptionsMu   sync.Mutex
+	subscriptionsQuit chan struct{}
+	// Set by new transaction events, job is refreshed on the next tick
+	pendingTxs int32
+	refresh    chan struct{}
+
+	// Main pool jobs come from in edge mode, nil when mining on nodes
+	pool *poolUpstream
+
+	// Getwork server and stratum listeners, closed on shutdown
+	listenersMu sync.Mutex
+	httpServer  *http.Server
+	listeners   []net.Listener
 
 	// Stratum
 	sessionsMu sync.RWMutex
 	sessions   map[*Session]struct{}
-	timeout    time.Duration
 	// Extranonce
 	Extranonces map[string]bool
 }
@@ -45,8 +81,13 @@ type staleJob struct {
 }
 
 type Session struct {
-	ip  string
-	enc *json.Encoder
+	// Accessed atomically, keep 64-bit aligned
+	diff     int64
+	prevDiff int64
+
+	ip          string
+	enc         *json.Encoder
+	connectedAt int64
 
 	// Stratum
 	sync.Mutex
@@ -61,6 +102,14 @@ type Session struct {
 	JobDetails     jobDetails
 	staleJobs      map[string]staleJob
 	staleJobIDs    []string
+	varDiff        *varDiff
+	port           *stratumPort
+	solo           bool
+
+	// Last values sent with EthereumStratum/2.0.0 mining.set
+	stratum2Set    bool
+	stratum2Epoch  int64
+	stratum2Target string
 }
 
 type jobDetails struct {
@@ -71,66 +120,68 @@ type jobDetails struct {
 	Epoch      int64
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend Backend, scheme payouts.RewardScheme) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		log.Fatal("You must set instance name")
 	}
-	policy := policy.Start(&cfg.Proxy.Policy, backend)
+	policy := policy.Start(&cfg.Proxy.Policy, backend, cfg.Coin)
 
-	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
-	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
-
-	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
-	for i, v := range cfg.Upstream {
-		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
-		log.Printf("Upstream: %s => %s", v.Name, v.Url)
+	proxy := &ProxyServer{config: cfg, coin: cfg.Coin, backend: backend, policy: policy, scheme: scheme, refresh: make(chan struct{}, 1)}
+	proxy.verifier = newVerifier(&cfg.Proxy.Verifier, cfg.Coin)
+	if len(cfg.Proxy.ShareBatch.FlushInterval) > 0 {
+		proxy.shares = newShareBatcher(&cfg.Proxy.ShareBatch, util.MustParseDuration(cfg.Proxy.ShareBatch.FlushInterval), backend, cfg.Coin)
+		proxy.shares.start()
+	}
+	metrics.OnCollect(proxy.collectMetrics)
+
+	proxy.upstreams = newUpstreams(cfg.Upstream, cfg.Coin)
+	proxy.upstreamLimits = newUpstreamLimits(&cfg.UpstreamHealth)
+	proxy.notifyIPs = parseAllowedIPs(cfg.Proxy.Notify.AllowedIPs)
+	proxy.notifyProxies = parseIPNets(cfg.Proxy.Notify.TrustedProxies)
+	if cfg.UpstreamPool.Enabled {
+		proxy.pool = newPoolUpstream(&cfg.UpstreamPool, cfg.Coin)
+		log.Printf("Upstream pool: %s => %s", proxy.pool.name, cfg.UpstreamPool.Url)
+	} else {
+		log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 	}
-	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
-	if cfg.Proxy.Stratum.Enabled {
+	if cfg.Proxy.StratumEnabled() {
 		proxy.sessions = make(map[*Session]struct{})
 		proxy.Extranonces = make(map[string]bool)
-		go proxy.ListenTCP()
+		for i := range cfg.Proxy.Stratum {
+			if cfg.Proxy.Stratum[i].Enabled {
+				go proxy.ListenTCP(proxy.newStratumPort(&cfg.Proxy.Stratum[i]))
+			}
+		}
 	}
 
-	proxy.fetchBlockTemplate()
-
 	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
 
-	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
-	refreshTimer := time.NewTimer(refreshIntv)
-	log.Printf("Set block refresh every %v", refreshIntv)
-
-	checkIntv := util.MustParseDuration(cfg.UpstreamCheckInterval)
-	checkTimer := time.NewTimer(checkIntv)
-
 	stateUpdateIntv := util.MustParseDuration(cfg.Proxy.StateUpdateInterval)
 	stateUpdateTimer := time.NewTimer(stateUpdateIntv)
 
-	go func() {
-		for {
-			select {
-			case <-refreshTimer.C:
-				proxy.fetchBlockTemplate()
-				refreshTimer.Reset(refreshIntv)
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-checkTimer.C:
-				proxy.checkUpstreams()
-				checkTimer.Reset(checkIntv)
-			}
-		}
-	}()
+	if proxy.pool != nil {
+		go proxy.runPool()
+	} else {
+		proxy.startUpstreams()
+	}
 
 	go func() {
 		for {
 			select {
 			case <-stateUpdateTimer.C:
+				if fees, err := backend.GetAvgTxFees(); err == nil {
+					atomic.StoreInt64(&proxy.txFees, fees)
+				}
+				proxy.writeVerifierStats()
+				proxy.writeSessions(stateUpdateIntv)
+				proxy.kickSessions()
+				// Edge proxy knows neither nodes nor network difficulty
+				if proxy.pool != nil {
+					stateUpdateTimer.Reset(stateUpdateIntv)
+					continue
+				}
+				proxy.writeUpstreamStates()
 				t := proxy.currentBlockTemplate()
 				if t != nil {
 					rpc := proxy.rpc()
@@ -170,49 +221,96 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	return proxy
 }
 
+// Jobs come from nodes, polled or refreshed by their events
+func (s *ProxyServer) startUpstreams() {
+	s.checkUpstreams()
+	s.fetchBlockTemplate()
+
+	refreshIntv := util.MustParseDuration(s.config.Proxy.BlockRefreshInterval)
+	log.Printf("Set block refresh every %v", refreshIntv)
+	txRefreshIntv := defaultTxRefreshInterval
+	if len(s.config.Proxy.TxRefreshInterval) > 0 {
+		txRefreshIntv = util.MustParseDuration(s.config.Proxy.TxRefreshInterval)
+	}
+
+	checkIntv := util.MustParseDuration(s.config.UpstreamCheckInterval)
+	checkTimer := time.NewTimer(checkIntv)
+
+	go s.refreshBlockTemplates(refreshIntv, txRefreshIntv)
+	s.startSubscriptions(s.config.Upstream)
+
+	go func() {
+		for {
+			select {
+			case <-checkTimer.C:
+				s.checkUpstreams()
+				s.refreshIfBehind()
+				checkTimer.Reset(checkIntv)
+			}
+		}
+	}()
+}
+
 func (s *ProxyServer) Start() {
 	log.Printf("Starting proxy on %v", s.config.Proxy.Listen)
 	r := mux.NewRouter()
 	r.Handle("/{login:0x[0-9a-fA-F]{40}}/{id:[0-9a-zA-Z-_]{1,200}}", s)
 	r.Handle("/{login:0x[0-9a-fA-F]{40}}", s)
-	r.HandleFunc("/etc", s.MiningNotify)
+	if s.pool == nil {
+		r.HandleFunc("/etc", s.MiningNotify)
+	}
 	srv := &http.Server{
 		Addr:           s.config.Proxy.Listen,
 		Handler:        r,
 		MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
 	}
+	s.listenersMu.Lock()
+	s.httpServer = srv
+	s.listenersMu.Unlock()
+	if s.isStopping() {
+		return
+	}
 	err := srv.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start proxy: %v", err)
 	}
 }
 
-func (s *ProxyServer) rpc() *rpc.RPCClient {
-	i := atomic.LoadInt32(&s.upstream)
-	return s.upstreams[i]
-}
+// Stops accepting miners, says goodbye to connected sessions and waits for shares in flight
+func (s *ProxyServer) Stop(ctx context.Context) {
+	atomic.StoreInt32(&s.stopping, 1)
+	log.Println("Stopping proxy")
 
-func (s *ProxyServer) checkUpstreams() {
-	idx := atomic.LoadInt32(&s.upstream)
-	current := s.upstreams[idx]
-	if current.Check() {
-		return
+	s.listenersMu.Lock()
+	for _, l := range s.listeners {
+		l.Close()
 	}
+	srv := s.httpServer
+	s.listenersMu.Unlock()
 
-	candidate := int32(0)
-	backup := false
-
-	for i, v := range s.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shutdown proxy HTTP server: %v", err)
 		}
 	}
-
-	if s.upstream != candidate {
-		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-		atomic.StoreInt32(&s.upstream, candidate)
+	s.stopSubscriptions()
+	if s.pool != nil {
+		s.pool.close()
+	}
+	s.drainSessions()
+	s.verifier.wait(ctx)
+	if s.shares != nil {
+		s.shares.stop(ctx)
 	}
+	log.Println("Proxy stopped")
+}
+
+func (s *ProxyServer) isStopping() bool {
+	return atomic.LoadInt32(&s.stopping) > 0
+}
+
+func (s *ProxyServer) ApplyPolicy(cfg *policy.Config) {
+	s.policy.ApplyConfig(cfg)
 }
 
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -247,7 +345,7 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
 	r.Body = http.MaxBytesReader(w, r.Body, s.config.Proxy.LimitBodySize)
 	defer r.Body.Close()
 
-	cs := &Session{ip: ip, enc: json.NewEncoder(w)}
+	cs := &Session{ip: ip, enc: json.NewEncoder(w), diff: s.config.Proxy.Difficulty}
 	dec := json.NewDecoder(r.Body)
 	for {
 		var req JSONRpcReq
@@ -362,73 +460,3 @@ func (s *ProxyServer) isSick() bool {
 func (s *ProxyServer) markOk() {
 	atomic.StoreInt64(&s.failsCount, 0)
 }
-
-func (s *ProxyServer) MiningNotify(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "405 method not allowed.", http.StatusMethodNotAllowed)
-		return
-	}
-
-	body := make([]byte, r.ContentLength)
-	r.Body.Read(body)
-
-	var reply []string
-	err := json.Unmarshal(body, &reply)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-
-	t := s.currentBlockTemplate()
-	// No need to update, we have fresh job
-	if t != nil {
-		if t.Header == reply[0] {
-			return
-		}
-		if _, ok := t.headers[reply[0]]; ok {
-			return
-		}
-	}
-	diff := util.TargetHexToDiff(reply[2])
-	height, err := strconv.ParseUint(strings.Replace(reply[3], "0x", "", -1), 16, 64)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	pendingReply := &rpc.GetBlockReplyPart{
-		Difficulty: util.ToHex(s.config.Proxy.Difficulty),
-		Number:     reply[3],
-	}
-
-	newTemplate := BlockTemplate{
-		Header:               reply[0],
-		Seed:                 reply[1],
-		Target:               reply[2],
-		Height:               height,
-		Difficulty:           diff,
-		GetPendingBlockCache: pendingReply,
-		headers:              make(map[string]heightDiffPair),
-	}
-	// Copy job backlog and add current one
-	newTemplate.headers[reply[0]] = heightDiffPair{
-		diff:   diff,
-		height: height,
-	}
-	if t != nil {
-		for k, v := range t.headers {
-			if v.height > height-maxBacklog {
-				newTemplate.headers[k] = v
-			}
-		}
-	}
-	s.blockTemplate.Store(&newTemplate)
-
-	log.Printf("New block notified at height %d / %s / %d", height, reply[0][0:10], diff)
-
-	// Stratum
-	if s.config.Proxy.Stratum.Enabled {
-		go s.broadcastNewJobs()
-	}
-}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Session snapshot published for admin API, keyed by extranonce
+type sessionInfo struct {
+	Login       string `json:"login"`
+	Worker      string `json:"worker"`
+	IP          string `json:"ip"`
+	Mode        string `json:"mode"`
+	Port        string `json:"port"`
+	Difficulty  int64  `json:"difficulty"`
+	Solo        bool   `json:"solo"`
+	ConnectedAt int64  `json:"connectedAt"`
+}
+
+func (s *ProxyServer) writeSessions(interval time.Duration) {
+	if s.sessions == nil {
+		return
+	}
+	snapshot := make(map[string]string)
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		info := sessionInfo{
+			Login:       cs.login,
+			Worker:      cs.worker,
+			IP:          cs.ip,
+			Mode:        stratumModeNames[cs.stratumMode()],
+			Port:        cs.port.config.Listen,
+			Difficulty:  cs.difficulty(),
+			Solo:        cs.solo,
+			ConnectedAt: cs.connectedAt / 1000,
+		}
+		data, _ := json.Marshal(info)
+		snapshot[cs.Extranonce] = string(data)
+	}
+	s.sessionsMu.RUnlock()
+
+	// Outlives a few missed updates, then proxy is considered gone
+	err := s.backend.WriteSessions(s.config.Name, snapshot, interval*3)
+	if err != nil {
+		log.Printf("Failed to write sessions to backend: %v", err)
+	}
+}
+
+// Disconnects sessions requested via admin API
+func (s *ProxyServer) kickSessions() {
+	if s.sessions == nil {
+		return
+	}
+	ids, err := s.backend.PopKickedSessions(s.config.Name)
+	if err != nil {
+		log.Printf("Failed to get kicked sessions from backend: %v", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	kicked := make(map[string]bool)
+	for _, id := range ids {
+		kicked[id] = true
+	}
+
+	var sessions []*Session
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		if kicked[cs.Extranonce] {
+			sessions = append(sessions, cs)
+		}
+	}
+	s.sessionsMu.RUnlock()
+
+	for _, cs := range sessions {
+		log.Printf("Disconnecting %v@%v by admin request", cs.login, cs.ip)
+		cs.disconnect()
+		s.removeSession(cs)
+	}
+}
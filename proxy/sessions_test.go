@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+func newSessionsProxy(backend Backend, sessions ...*Session) *ProxyServer {
+	s := &ProxyServer{
+		config:      &Config{Name: "proxy1"},
+		backend:     backend,
+		sessions:    make(map[*Session]struct{}),
+		Extranonces: make(map[string]bool),
+	}
+	for _, cs := range sessions {
+		s.sessions[cs] = struct{}{}
+		s.Extranonces[cs.Extranonce] = true
+	}
+	return s
+}
+
+func TestWriteSessions(t *testing.T) {
+	backend := storage.NewMemoryBackend(100)
+	port := &stratumPort{config: &Stratum{Listen: "0.0.0.0:8008"}}
+	cs := &Session{login: "0xa", worker: "rig", ip: "10.0.0.1", Extranonce: "aa", port: port, diff: 4000}
+	s := newSessionsProxy(backend, cs)
+
+	s.writeSessions(time.Minute)
+
+	sessions, _ := backend.GetSessions("proxy1")
+	var info sessionInfo
+	if err := json.Unmarshal([]byte(sessions["aa"]), &info); err != nil {
+		t.Fatalf("Expected session aa to be published, got %v", sessions)
+	}
+	if info.Login != "0xa" || info.Worker != "rig" || info.Difficulty != 4000 || info.Port != "0.0.0.0:8008" {
+		t.Errorf("Unexpected session info %+v", info)
+	}
+}
+
+func TestKickSessions(t *testing.T) {
+	backend := storage.NewMemoryBackend(100)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	kicked := &Session{login: "0xa", Extranonce: "aa", conn: conn}
+	other := &Session{login: "0xb", Extranonce: "bb"}
+	s := newSessionsProxy(backend, kicked, other)
+
+	backend.KickSession("proxy1", "aa")
+	s.kickSessions()
+
+	if _, ok := s.sessions[kicked]; ok {
+		t.Error("Kicked session must be removed")
+	}
+	if _, ok := s.sessions[other]; !ok {
+		t.Error("Other sessions must be kept")
+	}
+	if _, err := peer.Write([]byte{0}); err == nil {
+		t.Error("Kicked session must be disconnected")
+	}
+}
@@ -23,41 +23,89 @@ const (
 const (
 	EthProxy int = iota
 	NiceHash
+	EthereumStratum2
 )
 
-func (s *ProxyServer) ListenTCP() {
+type stratumPort struct {
+	config  *Stratum
+	diff    int64
+	timeout time.Duration
+}
+
+func (s *ProxyServer) newStratumPort(cfg *Stratum) *stratumPort {
+	port := &stratumPort{config: cfg, diff: cfg.Difficulty}
+	if port.diff == 0 {
+		port.diff = s.config.Proxy.Difficulty
+	}
 	// Parse timeout duration from configuration
-	s.timeout = util.MustParseDuration(s.config.Proxy.Stratum.Timeout)
+	port.timeout = util.MustParseDuration(cfg.Timeout)
+
+	if cfg.VarDiff.Enabled && cfg.VarDiff.SharesPerMinute <= 0 {
+		log.Fatalf("Vardiff shares per minute on %s must be > 0, your value is %v", cfg.Listen, cfg.VarDiff.SharesPerMinute)
+	}
+	return port
+}
+
+// Difficulty of the port session came in on, reported as worker's portDiff
+func (cs *Session) portDiff(s *ProxyServer) int64 {
+	if cs.port == nil {
+		return s.config.Proxy.Difficulty
+	}
+	return cs.port.diff
+}
+
+// Session came in on a port of edge proxies
+func (cs *Session) isEdge() bool {
+	return cs.port != nil && cs.port.config.Edge
+}
+
+func (s *ProxyServer) ListenTCP(port *stratumPort) {
+	cfg := port.config
 
 	var err error
 	var server net.Listener
 
 	// If TLS is enabled, load certificate and key file and create a TLS listener
-	if s.config.Proxy.Stratum.TLS {
+	if cfg.TLS {
 		var cert tls.Certificate
-		cert, err = tls.LoadX509KeyPair(s.config.Proxy.Stratum.CertFile, s.config.Proxy.Stratum.KeyFile)
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 		if err != nil {
 			log.Fatalln("Error loading certificate:", err)
 		}
 		tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
-		server, err = tls.Listen("tcp", s.config.Proxy.Stratum.Listen, tlsCfg)
+		server, err = tls.Listen("tcp", cfg.Listen, tlsCfg)
 	} else {
 		// Otherwise, create a regular TCP listener
-		server, err = net.Listen("tcp", s.config.Proxy.Stratum.Listen)
+		server, err = net.Listen("tcp", cfg.Listen)
 	}
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 	defer server.Close()
 
-	log.Printf("Stratum listening on %s", s.config.Proxy.Stratum.Listen)
-	var accept = make(chan int, s.config.Proxy.Stratum.MaxConn)
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, server)
+	s.listenersMu.Unlock()
+	if s.isStopping() {
+		return
+	}
+
+	if cfg.VarDiff.Enabled {
+		log.Printf("Stratum listening on %s, vardiff %v-%v from %v, %v shares per minute",
+			cfg.Listen, cfg.VarDiff.MinDiff, cfg.VarDiff.MaxDiff, port.diff, cfg.VarDiff.SharesPerMinute)
+	} else {
+		log.Printf("Stratum listening on %s, difficulty %v", cfg.Listen, port.diff)
+	}
+	var accept = make(chan int, cfg.MaxConn)
 	n := 0
 
 	for {
 		// Accept new incoming connections
 		conn, err := server.Accept()
 		if err != nil {
+			if s.isStopping() {
+				return
+			}
 			continue
 		}
 		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
@@ -67,12 +115,23 @@ func (s *ProxyServer) ListenTCP() {
 			conn.Close()
 			continue
 		}
-		n += 1
 		// Generate a unique extranonce value for this session
-		extranonce := s.uniqExtranonce()
-		cs := &Session{conn: conn, ip: ip, Extranonce: extranonce, ExtranonceSub: false, stratum: -1}
+		extranonce, ok := s.uniqExtranonce()
+		if !ok {
+			log.Printf("No free extranonce for %v, too many sessions", ip)
+			conn.Close()
+			continue
+		}
+		n += 1
+		cs := &Session{conn: conn, ip: ip, Extranonce: extranonce, ExtranonceSub: false, stratum: -1, port: port, connectedAt: util.MakeTimestamp()}
 		// Allocate a stale jobs cache for this session
 		cs.staleJobs = make(map[string]staleJob)
+		// Every session starts at port difficulty and is retargeted from there
+		cs.diff = port.diff
+		if cfg.VarDiff.Enabled {
+			cs.varDiff = newVarDiff(&cfg.VarDiff)
+			cs.diff = cs.varDiff.clamp(cs.diff)
+		}
 
 		accept <- n
 		// Start a new goroutine to handle the session
@@ -96,7 +155,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
 
 	// Set a deadline for the connection
-	s.setDeadline(cs.conn)
+	s.setDeadline(cs)
 
 	for {
 		// Read a line of data from the client
@@ -135,7 +194,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 			}
 
 			// Set a new deadline for the connection
-			s.setDeadline(cs.conn)
+			s.setDeadline(cs)
 
 			// Handle the incoming message from the client
 			err = cs.handleTCPMessage(s, &req)
@@ -167,15 +226,22 @@ func (cs *Session) setStratumMode(str string) error {
 
 // stratumMode returns the current stratum mode of the session.
 // The returned value is an integer representing the current stratum mode,
-// where 0 represents EthProxy and 1 represents NiceHash.
+// where 0 represents EthProxy, 1 represents NiceHash and 2 represents EthereumStratum/2.0.0.
 func (cs *Session) stratumMode() int {
 	// Returns the current stratum mode of the session.
 	return cs.stratum
 }
 
 func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
+	if cs.stratumMode() == EthereumStratum2 {
+		return cs.handleStratum2Message(s, req)
+	}
+
 	// Handle RPC/Stratum methods
 	switch req.Method {
+	// EthereumStratum/2.0.0
+	case "mining.hello":
+		return cs.handleStratum2Hello(s, req)
 	// claymore -esm 1
 	case "eth_login":
 		// Unmarshal request parameters
@@ -265,11 +331,7 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 				return err
 			}
 
-			paramsDiff := []float64{
-				util.DiffIntToFloat(s.config.Proxy.Difficulty),
-			}
-			respReq := JSONStratumReq{Method: "mining.set_difficulty", Params: paramsDiff}
-			if err := cs.sendTCPReq(respReq); err != nil {
+			if err := cs.sendDifficulty(); err != nil {
 				return err
 			}
 
@@ -481,6 +543,14 @@ func (cs *Session) pushNewJob(s *ProxyServer, result interface{}) error {
 	cs.Lock()
 	defer cs.Unlock()
 
+	if cs.stratumMode() == EthereumStratum2 {
+		t := s.currentBlockTemplate()
+		if t == nil {
+			return nil
+		}
+		return cs.writeStratum2Job(s, t, true)
+	}
+
 	if cs.stratumMode() == NiceHash {
 		cs.cacheStales(10, 3)
 
@@ -563,8 +633,8 @@ func (cs *Session) sendTCPReq(resp JSONStratumReq) error {
 	return cs.enc.Encode(&resp)
 }
 
-func (self *ProxyServer) setDeadline(conn net.Conn) {
-	conn.SetDeadline(time.Now().Add(self.timeout))
+func (self *ProxyServer) setDeadline(cs *Session) {
+	cs.conn.SetDeadline(time.Now().Add(cs.port.timeout))
 }
 
 func (s *ProxyServer) registerSession(cs *Session) {
@@ -629,8 +699,6 @@ func (s *ProxyServer) broadcastNewJobs() {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return
 	}
-	reply := []string{t.Header, t.Seed, s.diff, util.ToHex(int64(t.Height))}
-
 	s.sessionsMu.RLock()
 	defer s.sessionsMu.RUnlock()
 
@@ -646,33 +714,77 @@ func (s *ProxyServer) broadcastNewJobs() {
 		bcast <- n
 
 		go func(cs *Session) {
-			err := cs.pushNewJob(s, &reply)
+			// Old work is gone with the new block, so is previous difficulty
+			cs.clearPrevDifficulty()
+			var err error
+			if s.retargetIdleSession(cs) && cs.stratumMode() == NiceHash {
+				err = cs.sendDifficulty()
+			}
+			if err == nil {
+				reply := []string{t.Header, t.Seed, cs.targetHex(), util.ToHex(int64(t.Height))}
+				err = cs.pushNewJob(s, &reply)
+			}
 			<-bcast
 			if err != nil {
 				log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
 				s.removeSession(cs)
 			} else {
-				s.setDeadline(cs.conn)
+				s.setDeadline(cs)
 			}
 		}(m)
 	}
 	log.Printf("Jobs broadcast finished %s", time.Since(start))
+	broadcastDuration.With(s.coin).ObserveSince(start)
 }
 
-func (s *ProxyServer) uniqExtranonce() string {
+// Asks every miner to reconnect, they come back once the pool is up again
+func (s *ProxyServer) drainSessions() {
 	s.sessionsMu.RLock()
-	defer s.sessionsMu.RUnlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for cs := range s.sessions {
+		sessions = append(sessions, cs)
+	}
+	s.sessionsMu.RUnlock()
 
-	extranonce := randomHex(4)
+	log.Printf("Disconnecting %v stratum miners", len(sessions))
+	for _, cs := range sessions {
+		s.reconnectSession(cs)
+	}
+}
+
+func (s *ProxyServer) reconnectSession(cs *Session) {
+	err := cs.sendTCPReq(JSONStratumReq{Method: "client.reconnect", Params: []interface{}{}})
+	if err != nil {
+		log.Printf("Reconnect notice error to %v@%v: %v", cs.login, cs.ip, err)
+	}
+	cs.disconnect()
+	s.removeSession(cs)
+}
+
+// Extranonce not used by other sessions, false when all are taken. In NiceHash edge
+// mode it's upstream pool's extranonce with a short session part after it.
+func (s *ProxyServer) uniqExtranonce() (string, bool) {
+	prefix, size := "", 4
+	if s.pool != nil && s.pool.nicehash {
+		prefix = s.pool.getExtranonce()
+		size = sessionExtranonceSize(prefix)
+	}
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if len(s.Extranonces) >= 1<<(4*size) {
+		return "", false
+	}
+	extranonce := prefix + randomHex(size)
 	for {
 		if _, ok := s.Extranonces[extranonce]; ok {
-			extranonce = randomHex(4)
+			extranonce = prefix + randomHex(size)
 		} else {
 			break
 		}
 	}
 	s.Extranonces[extranonce] = true
-	return extranonce
+	return extranonce, true
 }
 
 func randomHex(strlen int) string {
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EthereumStratum/2.0.0, https://eips.ethereum.org/EIPS/eip-1571
+
+const stratum2Proto = "EthereumStratum/2.0.0"
+
+// Blocks per ethash/ubqhash epoch
+const epochLength = 30000
+
+// EIP-1571 error codes
+const (
+	stratum2BadRequest         = 400
+	stratum2Unauthorized       = 401
+	stratum2JobNotFound        = 404
+	stratum2MethodNotAllowed   = 405
+	stratum2BadNonce           = 406
+	stratum2ServiceUnavailable = 503
+)
+
+var errStratum2Bye = errors.New("mining.bye")
+
+var hexPattern = regexp.MustCompile("^[0-9a-f]+$")
+
+type stratum2Hello struct {
+	Agent string `json:"agent"`
+	Host  string `json:"host"`
+	Port  string `json:"port"`
+	Proto string `json:"proto"`
+}
+
+func (cs *Session) handleStratum2Hello(s *ProxyServer, req *StratumReq) error {
+	var params stratum2Hello
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		log.Println("Malformed mining.hello params from", cs.ip, err)
+		return err
+	}
+	if params.Proto != stratum2Proto {
+		log.Printf("Unsupported stratum version %v from %v", params.Proto, cs.ip)
+		return cs.sendStratum2Error(req.Id, stratum2BadRequest, "Unsupported protocol version")
+	}
+	cs.stratum = EthereumStratum2
+	log.Printf("EthereumStratum/2.0.0 hello from %v: %v", cs.ip, params.Agent)
+
+	result := map[string]string{
+		"proto":     stratum2Proto,
+		"encoding":  "plain",
+		"resume":    "0",
+		"timeout":   strconv.FormatInt(int64(cs.port.timeout.Seconds()), 16),
+		"maxerrors": strconv.FormatInt(int64(s.config.Proxy.Policy.Banning.MalformedLimit), 16),
+		"node":      s.jobSource(),
+	}
+	return cs.sendStratumResult(req.Id, result)
+}
+
+func (cs *Session) handleStratum2Message(s *ProxyServer, req *StratumReq) error {
+	switch req.Method {
+	case "mining.subscribe":
+		if len(cs.subscriptionID) > 0 {
+			return cs.sendStratum2Error(req.Id, stratum2MethodNotAllowed, "Already subscribed")
+		}
+		// Session resume is not supported, always start a new one
+		cs.subscriptionID = randomHex(16)
+		return cs.sendStratumResult(req.Id, cs.subscriptionID)
+
+	case "mining.authorize":
+		if len(cs.subscriptionID) == 0 {
+			return cs.sendStratum2Error(req.Id, stratum2MethodNotAllowed, "Not subscribed")
+		}
+		var params []string
+		if err := json.Unmarshal(req.Params, &params); err != nil || len(params) < 1 {
+			log.Println("Malformed mining.authorize params from", cs.ip, err)
+			return cs.sendStratum2Error(req.Id, stratum2BadRequest, "Invalid params")
+		}
+		_, errReply := s.handleLoginRPC(cs, params, req.Worker)
+		if errReply != nil {
+			return cs.sendStratum2Error(req.Id, stratum2Unauthorized, errReply.Message)
+		}
+		// Worker name is unique within connection, use it as worker id
+		if err := cs.sendStratumResult(req.Id, cs.worker); err != nil {
+			return err
+		}
+		t := s.currentBlockTemplate()
+		if t == nil || len(t.Header) == 0 || s.isSick() {
+			return nil
+		}
+		cs.Lock()
+		defer cs.Unlock()
+		return cs.writeStratum2Job(s, t, true)
+
+	case "mining.submit":
+		var params []string
+		if err := json.Unmarshal(req.Params, &params); err != nil || len(params) < 3 {
+			log.Println("Malformed mining.submit params from", cs.ip, err)
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			return cs.sendStratum2Error(req.Id, stratum2BadRequest, "Invalid params")
+		}
+		// params[0] = Job ID, params[1] = nonce without extranonce, params[2] = worker id
+		if params[2] != cs.worker {
+			return cs.sendStratum2Error(req.Id, stratum2Unauthorized, "Unknown worker")
+		}
+		nonce := cs.Extranonce + params[1]
+		if len(nonce) != 16 || !hexPattern.MatchString(nonce) {
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			return cs.sendStratum2Error(req.Id, stratum2BadNonce, "Bad nonce")
+		}
+
+		var headerHash, seedHash string
+		if cs.JobDetails.JobID == params[0] {
+			headerHash, seedHash = cs.JobDetails.HeaderHash, cs.JobDetails.SeedHash
+		} else if stale, ok := cs.staleJobs[params[0]]; ok {
+			headerHash, seedHash = stale.HeaderHash, stale.SeedHash
+		} else {
+			log.Printf("Stale share (mining.submit JobID received %s != current %s)", params[0], cs.JobDetails.JobID)
+			return cs.sendStratum2Error(req.Id, stratum2JobNotFound, "Job not found")
+		}
+
+		reply, errReply := s.handleTCPSubmitRPC(cs, cs.worker, []string{nonce, seedHash, headerHash})
+		if errReply != nil {
+			code := stratum2BadRequest
+			if errReply.Code == 25 {
+				code = stratum2Unauthorized
+			} else if errReply == errServerBusy {
+				code = stratum2ServiceUnavailable
+			}
+			return cs.sendStratum2Error(req.Id, code, errReply.Message)
+		}
+		return cs.sendStratumResult(req.Id, reply)
+
+	case "mining.hashrate":
+		var params []string
+		if err := json.Unmarshal(req.Params, &params); err != nil || len(params) < 1 {
+			return cs.sendStratum2Error(req.Id, stratum2BadRequest, "Invalid params")
+		}
+		hashrate, err := strconv.ParseInt(strings.TrimPrefix(params[0], "0x"), 16, 64)
+		if err != nil {
+			return cs.sendStratum2Error(req.Id, stratum2BadRequest, "Invalid hashrate")
+		}
+		log.Printf("Hashrate reported by %v@%v (%v): %s", cs.worker, cs.ip, cs.login, formatEthHashrate(hashrate))
+		return cs.sendStratumResult(req.Id, true)
+
+	case "mining.noop":
+		return cs.sendStratumResult(req.Id, true)
+
+	case "mining.bye":
+		log.Printf("Client %s said bye", cs.ip)
+		return errStratum2Bye
+
+	default:
+		errReply := s.handleUnknownRPC(cs, req.Method)
+		return cs.sendStratum2Error(req.Id, stratum2JobNotFound, errReply.Message)
+	}
+}
+
+// Sends mining.set with changed fields only, then compact mining.notify.
+// Caller must hold session lock.
+func (cs *Session) writeStratum2Job(s *ProxyServer, t *BlockTemplate, clean bool) error {
+	cs.cacheStales(10, 3)
+	cs.JobDetails = jobDetails{
+		JobID:      randomHex(8),
+		SeedHash:   strings.TrimPrefix(t.Seed, "0x"),
+		HeaderHash: strings.TrimPrefix(t.Header, "0x"),
+		Height:     strconv.FormatUint(t.Height, 16),
+		Epoch:      int64(t.Height / epochLength),
+	}
+
+	set := make(map[string]string)
+	if !cs.stratum2Set {
+		set["algo"] = s.config.Algo
+		set["extranonce"] = cs.Extranonce
+	}
+	if !cs.stratum2Set || cs.stratum2Epoch != cs.JobDetails.Epoch {
+		set["epoch"] = strconv.FormatInt(cs.JobDetails.Epoch, 16)
+	}
+	target := strings.TrimPrefix(cs.targetHex(), "0x")
+	if !cs.stratum2Set || cs.stratum2Target != target {
+		set["target"] = target
+	}
+	if len(set) > 0 {
+		if err := cs.enc.Encode(&JSONStratumReq{Method: "mining.set", Params: set}); err != nil {
+			return err
+		}
+		cs.stratum2Set = true
+		cs.stratum2Epoch = cs.JobDetails.Epoch
+		cs.stratum2Target = target
+	}
+
+	cleanFlag := "0"
+	if clean {
+		cleanFlag = "1"
+	}
+	resp := JSONStratumReq{
+		Method: "mining.notify",
+		Params: []string{cs.JobDetails.JobID, cs.JobDetails.Height, cs.JobDetails.HeaderHash, cleanFlag},
+	}
+	return cs.enc.Encode(&resp)
+}
+
+func (cs *Session) sendStratum2Error(id json.RawMessage, code int, message string) error {
+	return cs.sendStratumError(id, &ErrorReply{Code: code, Message: message})
+}
+
+// Stratum2 job for a retarget, work is still valid so miner keeps its queue
+func (s *ProxyServer) pushStratum2Job(cs *Session) error {
+	t := s.currentBlockTemplate()
+	if t == nil || len(t.Header) == 0 || s.isSick() {
+		return nil
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.writeStratum2Job(s, t, false)
+}
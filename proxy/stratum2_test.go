@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/policy"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+)
+
+const (
+	stratum2Header = "0x1111111111111111111111111111111111111111111111111111111111111111"
+	stratum2Seed   = "0x2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+// Message read by a stratum2 miner, reply or notification
+type stratum2Msg struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *ErrorReply     `json:"error"`
+}
+
+type stratum2Miner struct {
+	t   *testing.T
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+func (m *stratum2Miner) call(method string, params interface{}) *stratum2Msg {
+	m.t.Helper()
+	if err := m.enc.Encode(map[string]interface{}{"id": 1, "method": method, "params": params}); err != nil {
+		m.t.Fatalf("Can't send %v: %v", method, err)
+	}
+	return m.read()
+}
+
+func (m *stratum2Miner) read() *stratum2Msg {
+	m.t.Helper()
+	var msg stratum2Msg
+	if err := m.dec.Decode(&msg); err != nil {
+		m.t.Fatalf("Can't read reply: %v", err)
+	}
+	return &msg
+}
+
+func (m *stratum2Miner) expectError(msg *stratum2Msg, code int) {
+	m.t.Helper()
+	if msg.Error == nil || msg.Error.Code != code {
+		m.t.Errorf("Expected error %v, got %+v", code, msg.Error)
+	}
+}
+
+// Connects a miner to a proxy with a stored job, its share verifier is always busy
+func newStratum2Proxy(t *testing.T) (*stratum2Miner, chan error) {
+	n := newTestNode(30001, true)
+	t.Cleanup(n.Close)
+
+	backend := storage.NewMemoryBackend(100)
+	policyCfg := &policy.Config{
+		Limits:          policy.Limits{Grace: "1m"},
+		ResetInterval:   "1h",
+		RefreshInterval: "1h",
+		Banning:         policy.Banning{MalformedLimit: 5},
+	}
+	s := newUpstreamsProxy(n)
+	s.config = &Config{Name: "proxy1", Algo: "ubqhash"}
+	s.config.Proxy.Policy = *policyCfg
+	s.backend = backend
+	s.policy = policy.Start(policyCfg, backend, "")
+	s.sessions = make(map[*Session]struct{})
+	s.Extranonces = make(map[string]bool)
+	s.verifier = &verifier{}
+	s.blockTemplate.Store(&BlockTemplate{Header: stratum2Header, Seed: stratum2Seed, Height: 30001})
+
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	cs := &Session{
+		ip:         "10.0.0.1",
+		conn:       conn,
+		diff:       4000,
+		stratum:    -1,
+		Extranonce: "aabb",
+		staleJobs:  make(map[string]staleJob),
+		port:       &stratumPort{config: &Stratum{}, timeout: time.Minute},
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.handleTCPClient(cs) }()
+	return &stratum2Miner{t: t, enc: json.NewEncoder(peer), dec: json.NewDecoder(peer)}, done
+}
+
+func TestStratum2Hello(t *testing.T) {
+	m, _ := newStratum2Proxy(t)
+
+	m.expectError(m.call("mining.hello", map[string]string{"agent": "miner/1.0", "proto": "EthereumStratum/1.0.0"}), stratum2BadRequest)
+
+	reply := m.call("mining.hello", map[string]string{"agent": "miner/1.0", "proto": stratum2Proto})
+	var result map[string]string
+	if err := json.Unmarshal(reply.Result, &result); err != nil || reply.Error != nil {
+		t.Fatalf("Expected hello result, got %s %+v", reply.Result, reply.Error)
+	}
+	if result["proto"] != stratum2Proto || result["timeout"] != "3c" || result["maxerrors"] != "5" || result["node"] != "node0" {
+		t.Errorf("Unexpected hello result %v", result)
+	}
+}
+
+func TestStratum2Session(t *testing.T) {
+	m, done := newStratum2Proxy(t)
+	m.call("mining.hello", map[string]string{"agent": "miner/1.0", "proto": stratum2Proto})
+
+	m.expectError(m.call("mining.authorize", []string{"0x0000000000000000000000000000000000000001.rig"}), stratum2MethodNotAllowed)
+	if reply := m.call("mining.subscribe", []string{}); reply.Error != nil || len(reply.Result) < 3 {
+		t.Fatalf("Expected subscription id, got %s %+v", reply.Result, reply.Error)
+	}
+	m.expectError(m.call("mining.subscribe", []string{}), stratum2MethodNotAllowed)
+	m.expectError(m.call("mining.authorize", []string{"not-an-address"}), stratum2Unauthorized)
+
+	reply := m.call("mining.authorize", []string{"0x0000000000000000000000000000000000000001.rig"})
+	if string(reply.Result) != `"rig"` {
+		t.Fatalf("Expected worker id rig, got %s %+v", reply.Result, reply.Error)
+	}
+	set := m.read()
+	var setParams map[string]string
+	json.Unmarshal(set.Params, &setParams)
+	if set.Method != "mining.set" || setParams["algo"] != "ubqhash" || setParams["extranonce"] != "aabb" || setParams["epoch"] != "1" || len(setParams["target"]) == 0 {
+		t.Errorf("Unexpected mining.set %v %v", set.Method, setParams)
+	}
+	notify := m.read()
+	var job []string
+	json.Unmarshal(notify.Params, &job)
+	if notify.Method != "mining.notify" || len(job) != 4 || job[1] != "7531" || job[2] != stratum2Header[2:] || job[3] != "1" {
+		t.Fatalf("Unexpected mining.notify %v %v", notify.Method, job)
+	}
+
+	m.expectError(m.call("mining.submit", []string{job[0], "000000000001", "other"}), stratum2Unauthorized)
+	m.expectError(m.call("mining.submit", []string{job[0], "zz", "rig"}), stratum2BadNonce)
+	m.expectError(m.call("mining.submit", []string{"ffffffff", "000000000001", "rig"}), stratum2JobNotFound)
+	m.expectError(m.call("mining.submit", []string{job[0]}), stratum2BadRequest)
+	m.expectError(m.call("mining.submit", []string{job[0], "000000000001", "rig"}), stratum2ServiceUnavailable)
+
+	if reply := m.call("mining.hashrate", []string{"0x3b9aca00", "rig"}); string(reply.Result) != "true" {
+		t.Errorf("Expected hashrate to be accepted, got %s %+v", reply.Result, reply.Error)
+	}
+	m.expectError(m.call("mining.hashrate", []string{"fast"}), stratum2BadRequest)
+	m.expectError(m.call("eth_getWork", []string{}), stratum2JobNotFound)
+	if reply := m.call("mining.noop", nil); string(reply.Result) != "true" {
+		t.Errorf("Expected noop reply, got %s", reply.Result)
+	}
+
+	m.enc.Encode(map[string]interface{}{"id": 1, "method": "mining.bye"})
+	select {
+	case err := <-done:
+		if err != errStratum2Bye {
+			t.Errorf("Expected connection closed by bye, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not closed after bye")
+	}
+}
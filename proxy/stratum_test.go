@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ubiq/go-ubiq/v7/common"
+	"github.com/yuriy0803/open-etc-pool-friends/payouts"
+	"github.com/yuriy0803/open-etc-pool-friends/policy"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+const portsBlockDiff = 1000000000000
+
+// Records port difficulty shares and blocks are written with
+type portBackend struct {
+	*storage.MemoryBackend
+	mu      sync.Mutex
+	shares  []int64
+	blocks  []int64
+	workers []string
+}
+
+func (b *portBackend) WriteShare(login, id string, params []string, diff int64, shareDiffCalc int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error) {
+	b.mu.Lock()
+	b.shares = append(b.shares, portDiff)
+	b.workers = append(b.workers, id)
+	b.mu.Unlock()
+	return b.MemoryBackend.WriteShare(login, id, params, diff, shareDiffCalc, height, window, hostname, portDiff, solo, reward)
+}
+
+func (b *portBackend) WriteBlock(login, id string, params []string, diff, shareDiffCalc int64, roundDiff int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error) {
+	b.mu.Lock()
+	b.blocks = append(b.blocks, portDiff)
+	b.mu.Unlock()
+	return b.MemoryBackend.WriteBlock(login, id, params, diff, shareDiffCalc, roundDiff, height, window, hostname, portDiff, solo, reward)
+}
+
+// Starts proxy listening on given ports, returns their addresses in the same order
+func newPortsProxy(t *testing.T, ports []Stratum) (*ProxyServer, *portBackend, []string) {
+	n := newTestNode(30001, true)
+	t.Cleanup(n.Close)
+
+	backend := &portBackend{MemoryBackend: storage.NewMemoryBackend(100)}
+	policyCfg := &policy.Config{
+		Limits:          policy.Limits{Grace: "1m"},
+		ResetInterval:   "1h",
+		RefreshInterval: "1h",
+		Banning:         policy.Banning{MalformedLimit: 5},
+	}
+	s := newUpstreamsProxy(n)
+	s.config = &Config{Name: "proxy1", Algo: "ubqhash"}
+	s.config.Proxy.Difficulty = 2000000000
+	s.config.Proxy.Policy = *policyCfg
+	s.backend = backend
+	s.policy = policy.Start(policyCfg, backend, "")
+	s.scheme = payouts.NewRewardScheme(&payouts.SchemeConfig{Type: "prop"}, nil, "")
+	s.sessions = make(map[*Session]struct{})
+	s.Extranonces = make(map[string]bool)
+	s.verifier = newVerifier(&VerifierConfig{Workers: 1}, "")
+	s.blockTemplate.Store(newPortsTemplate())
+	t.Cleanup(func() {
+		atomic.StoreInt32(&s.stopping, 1)
+		s.listenersMu.Lock()
+		for _, l := range s.listeners {
+			l.Close()
+		}
+		s.listenersMu.Unlock()
+	})
+
+	var addrs []string
+	for i := range ports {
+		ports[i].Listen = "127.0.0.1:0"
+		ports[i].MaxConn = 8
+		go s.ListenTCP(s.newStratumPort(&ports[i]))
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.listenersMu.Lock()
+			started := len(s.listeners) > i
+			if started {
+				addrs = append(addrs, s.listeners[i].Addr().String())
+			}
+			s.listenersMu.Unlock()
+			if started {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Port %v didn't start listening", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return s, backend, addrs
+}
+
+// Found block makes proxy fetch job of test node, tests restore this one
+func newPortsTemplate() *BlockTemplate {
+	return &BlockTemplate{
+		Header:     stratum2Header,
+		Seed:       stratum2Seed,
+		Height:     30001,
+		Difficulty: big.NewInt(portsBlockDiff),
+		headers:    map[string]heightDiffPair{stratum2Header: {diff: big.NewInt(portsBlockDiff), height: 30001, upstream: "node0"}},
+	}
+}
+
+// Logs in through port at addr, returns target of issued work
+func loginPort(t *testing.T, addr, login string, pass ...string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Can't connect to %v: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	m := &stratum2Miner{t: t, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	if reply := m.call("eth_submitLogin", append([]string{login}, pass...)); string(reply.Result) != "true" {
+		t.Fatalf("Login of %v failed: %s %+v", login, reply.Result, reply.Error)
+	}
+	var work []string
+	if reply := m.call("eth_getWork", []string{}); json.Unmarshal(reply.Result, &work) != nil || len(work) != 4 {
+		t.Fatalf("Expected work, got %s %+v", reply.Result, reply.Error)
+	}
+	return conn, work[2]
+}
+
+func (s *ProxyServer) sessionOf(login string) *Session {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	for cs := range s.sessions {
+		if cs.login == login {
+			return cs
+		}
+	}
+	return nil
+}
+
+func TestNewStratumPort(t *testing.T) {
+	s := &ProxyServer{config: &Config{}}
+	s.config.Proxy.Difficulty = 2000
+
+	tests := []struct {
+		name    string
+		cfg     Stratum
+		diff    int64
+		timeout time.Duration
+	}{
+		{"inherits pool difficulty", Stratum{Timeout: "2m"}, 2000, 2 * time.Minute},
+		{"own difficulty", Stratum{Timeout: "30s", Difficulty: 8000}, 8000, 30 * time.Second},
+		{"vardiff", Stratum{Timeout: "1m", VarDiff: VarDiff{Enabled: true, SharesPerMinute: 10}}, 2000, time.Minute},
+	}
+	for _, tt := range tests {
+		port := s.newStratumPort(&tt.cfg)
+		if port.diff != tt.diff || port.timeout != tt.timeout || port.config != &tt.cfg {
+			t.Errorf("%v: expected difficulty %v and timeout %v, got %v and %v", tt.name, tt.diff, tt.timeout, port.diff, port.timeout)
+		}
+	}
+}
+
+func TestStratumPortDifficulty(t *testing.T) {
+	vardiff := VarDiff{Enabled: true, MinDiff: 1000000000, MaxDiff: 4000000000, SharesPerMinute: 10, VariancePercent: 30, RetargetInterval: "1m"}
+	tests := []struct {
+		name string
+		port Stratum
+		// Difficulty of work issued on the port and reported as portDiff
+		diff     int64
+		portDiff int64
+	}{
+		{"inherits pool difficulty", Stratum{Timeout: "1m"}, 2000000000, 2000000000},
+		{"own difficulty", Stratum{Timeout: "1m", Difficulty: 8000000000}, 8000000000, 8000000000},
+		{"vardiff within bounds", Stratum{Timeout: "1m", Difficulty: 3000000000, VarDiff: vardiff}, 3000000000, 3000000000},
+		{"vardiff clamped to min", Stratum{Timeout: "1m", Difficulty: 500000000, VarDiff: vardiff}, 1000000000, 500000000},
+		{"vardiff clamped to max", Stratum{Timeout: "1m", Difficulty: 50000000000, VarDiff: vardiff}, 4000000000, 50000000000},
+	}
+	ports := make([]Stratum, len(tests))
+	for i, tt := range tests {
+		ports[i] = tt.port
+	}
+	s, backend, addrs := newPortsProxy(t, ports)
+
+	for i, tt := range tests {
+		login := fmt.Sprintf("0x%040x", i+1)
+		_, target := loginPort(t, addrs[i], login)
+		if target != util.GetTargetHex(tt.diff) {
+			t.Errorf("%v: expected work at difficulty %v, got target %v", tt.name, tt.diff, target)
+		}
+		cs := s.sessionOf(login)
+		if cs == nil {
+			t.Fatalf("%v: no session registered for %v", tt.name, login)
+		}
+		if cs.portDiff(s) != tt.portDiff {
+			t.Errorf("%v: expected port difficulty %v, got %v", tt.name, tt.portDiff, cs.portDiff(s))
+		}
+
+		// Share just meeting session difficulty, then a block
+		mix := common.HexToHash("0x3333333333333333333333333333333333333333333333333333333333333333")
+		s.blockTemplate.Store(newPortsTemplate())
+		for j, diff := range []int64{tt.diff, portsBlockDiff} {
+			result := common.BigToHash(new(big.Int).Div(maxUint256, big.NewInt(diff)))
+			s.verifier.hash = func(uint64, common.Hash, uint64) (common.Hash, common.Hash) { return mix, result }
+			params := []string{fmt.Sprintf("0x%016x", i*2+j+1), stratum2Header, mix.Hex()}
+			if _, ok := s.processShare(cs, login, "rig", s.currentBlockTemplate(), params, false); !ok {
+				t.Fatalf("%v: share at difficulty %v rejected", tt.name, diff)
+			}
+		}
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if len(backend.shares) != len(tests) || len(backend.blocks) != len(tests) {
+		t.Fatalf("Expected %v shares and blocks, got %v and %v", len(tests), len(backend.shares), len(backend.blocks))
+	}
+	for i, tt := range tests {
+		if backend.shares[i] != tt.portDiff || backend.blocks[i] != tt.portDiff {
+			t.Errorf("%v: expected share and block written with port difficulty %v, got %v and %v", tt.name, tt.portDiff, backend.shares[i], backend.blocks[i])
+		}
+	}
+}
+
+func TestStratumEdgeWorker(t *testing.T) {
+	s, backend, addrs := newPortsProxy(t, []Stratum{{Timeout: "1m"}, {Timeout: "1m", Edge: true}})
+	mix := common.HexToHash("0x3333333333333333333333333333333333333333333333333333333333333333")
+	result := common.BigToHash(new(big.Int).Div(maxUint256, big.NewInt(s.config.Proxy.Difficulty)))
+	s.verifier.hash = func(uint64, common.Hash, uint64) (common.Hash, common.Hash) { return mix, result }
+
+	tests := []struct {
+		name   string
+		port   int
+		id     string
+		worker string
+	}{
+		{"miner naming other worker", 0, "rig2", "0"},
+		{"edge naming worker", 1, "rig2", "rig2"},
+		{"edge naming malformed worker", 1, "rig 2", "0"},
+		{"edge naming no worker", 1, "", "0"},
+	}
+	for i, tt := range tests {
+		login := fmt.Sprintf("0x%040x", i+1)
+		loginPort(t, addrs[tt.port], login)
+		cs := s.sessionOf(login)
+		if cs == nil {
+			t.Fatalf("%v: no session registered for %v", tt.name, login)
+		}
+		params := []string{fmt.Sprintf("0x%016x", i+1), stratum2Header, mix.Hex()}
+		if ok, errReply := s.handleTCPSubmitRPC(cs, tt.id, params); !ok || errReply != nil {
+			t.Fatalf("%v: share rejected, got %+v", tt.name, errReply)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s.verifier.wait(ctx)
+		cancel()
+
+		backend.mu.Lock()
+		if len(backend.workers) != i+1 || backend.workers[i] != tt.worker {
+			t.Errorf("%v: expected share of worker %v, got %v", tt.name, tt.worker, backend.workers)
+		}
+		backend.mu.Unlock()
+	}
+}
+
+func TestStratumPortTimeout(t *testing.T) {
+	_, _, addrs := newPortsProxy(t, []Stratum{{Timeout: "100ms"}, {Timeout: "1m"}})
+
+	short, _ := loginPort(t, addrs[0], "0x0000000000000000000000000000000000000001")
+	long, _ := loginPort(t, addrs[1], "0x0000000000000000000000000000000000000002")
+
+	time.Sleep(300 * time.Millisecond)
+	buf := make([]byte, 1)
+	short.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := short.Read(buf); err == nil || isTimeout(err) {
+		t.Errorf("Expected idle session on 100ms port to be closed, got %v", err)
+	}
+	long.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := long.Read(buf); !isTimeout(err) {
+		t.Errorf("Expected idle session on 1m port to stay open, got %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestStratumSoloLogin(t *testing.T) {
+	s, _, addrs := newPortsProxy(t, []Stratum{{Timeout: "1m"}, {Timeout: "1m", Solo: true}})
+
+	tests := []struct {
+		name string
+		port int
+		pass []string
+		solo bool
+	}{
+		{"no password", 0, nil, false},
+		{"other password", 0, []string{"x"}, false},
+		{"solo password", 0, []string{"solo"}, true},
+		{"solo among flags", 0, []string{"x, solo "}, true},
+		{"solo as part of flag", 0, []string{"x,solox"}, false},
+		{"solo port", 1, nil, true},
+		{"solo port with other password", 1, []string{"x"}, true},
+	}
+	for i, tt := range tests {
+		login := fmt.Sprintf("0x%040x", i+1)
+		loginPort(t, addrs[tt.port], login, tt.pass...)
+		cs := s.sessionOf(login)
+		if cs == nil {
+			t.Fatalf("%v: no session registered for %v", tt.name, login)
+		}
+		if cs.solo != tt.solo {
+			t.Errorf("%v: expected solo %v, got %v", tt.name, tt.solo, cs.solo)
+		}
+	}
+}
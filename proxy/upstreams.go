@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+	"github.com/yuriy0803/open-etc-pool-friends/storage"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Weights of health criteria in upstream score, a node at best height
+// with enough peers, no errors and instant replies scores 1
+const (
+	lagWeight     = 0.4
+	peersWeight   = 0.2
+	latencyWeight = 0.2
+	errorsWeight  = 0.2
+)
+
+type upstreamLimits struct {
+	maxLag       uint64
+	minPeers     int64
+	maxLatency   time.Duration
+	maxErrorRate float64
+}
+
+func newUpstreamLimits(cfg *UpstreamHealth) *upstreamLimits {
+	l := &upstreamLimits{
+		maxLag:       cfg.MaxLag,
+		minPeers:     cfg.MinPeers,
+		maxLatency:   2 * time.Second,
+		maxErrorRate: cfg.MaxErrorRate,
+	}
+	if l.maxLag == 0 {
+		l.maxLag = 3
+	}
+	if len(cfg.MaxLatency) > 0 {
+		l.maxLatency = util.MustParseDuration(cfg.MaxLatency)
+	}
+	if l.maxErrorRate <= 0 {
+		l.maxErrorRate = 0.5
+	}
+	return l
+}
+
+// Node with results of its last health check, latency and errors are tracked by every request
+type upstream struct {
+	*rpc.RPCClient
+
+	mu sync.RWMutex
+	// Last check reached the node
+	alive   bool
+	height  uint64
+	peers   int64
+	lag     uint64
+	healthy bool
+	score   float64
+}
+
+func newUpstreams(cfg []Upstream, coin string) []*upstream {
+	upstreams := make([]*upstream, len(cfg))
+	for i, v := range cfg {
+		upstreams[i] = &upstream{RPCClient: rpc.NewRPCClient(v.Name, v.Url, v.Timeout)}
+		upstreams[i].Coin = coin
+		log.Printf("Upstream: %s => %s", v.Name, v.Url)
+	}
+	return upstreams
+}
+
+func (u *upstream) check(minPeers int64) {
+	_, height, _, err := fetchPendingBlock(u.RPCClient)
+	var peers int64
+	if err == nil && minPeers > 0 {
+		peers, err = u.GetPeerCount()
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.alive = err == nil
+	if err != nil {
+		log.Printf("Upstream %v check failed: %v", u.Name, err)
+		return
+	}
+	u.height = height
+	u.peers = peers
+}
+
+// Scores upstream against the best height among all upstreams
+func (u *upstream) rate(best uint64, l *upstreamLimits) {
+	latency, errorRate := u.Health()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.alive {
+		u.lag, u.score, u.healthy = 0, 0, false
+		return
+	}
+	u.lag = best - u.height
+	score := 1 - lagWeight*ratio(float64(u.lag), float64(l.maxLag+1))
+	enoughPeers := l.minPeers == 0 || u.peers >= l.minPeers
+	if !enoughPeers {
+		score -= peersWeight * ratio(float64(l.minPeers-u.peers), float64(l.minPeers))
+	}
+	score -= latencyWeight * ratio(float64(latency), float64(l.maxLatency))
+	score -= errorsWeight * ratio(errorRate, l.maxErrorRate)
+	u.score = score
+	u.healthy = u.lag <= l.maxLag && enoughPeers && latency <= l.maxLatency && errorRate < l.maxErrorRate
+}
+
+func ratio(value, limit float64) float64 {
+	if value >= limit {
+		return 1
+	}
+	return value / limit
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.healthy
+}
+
+func (u *upstream) getScore() float64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.score
+}
+
+func (u *upstream) state(active bool) *storage.UpstreamState {
+	latency, errorRate := u.Health()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return &storage.UpstreamState{
+		Name:      u.Name,
+		Active:    active,
+		Healthy:   u.healthy,
+		Score:     u.score,
+		Height:    u.height,
+		Lag:       u.lag,
+		Peers:     u.peers,
+		LatencyMs: latency.Milliseconds(),
+		ErrorRate: errorRate,
+	}
+}
+
+func (s *ProxyServer) rpc() *rpc.RPCClient {
+	return s.activeUpstream().RPCClient
+}
+
+func (s *ProxyServer) activeUpstream() *upstream {
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+	i := atomic.LoadInt32(&s.upstream)
+	return s.upstreams[i]
+}
+
+func (s *ProxyServer) getUpstreams() []*upstream {
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+	return s.upstreams
+}
+
+// Upstreams with index of the active one, read together so a reload can't come in between
+func (s *ProxyServer) upstreamsState() ([]*upstream, int32) {
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+	return s.upstreams, atomic.LoadInt32(&s.upstream)
+}
+
+// Whether both slices are the same list of upstreams, not just equal ones
+func sameUpstreams(a, b []*upstream) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
+
+// Healthy upstreams by score, the active one alone if none is healthy
+func (s *ProxyServer) healthyUpstreams() []*upstream {
+	var result []*upstream
+	for _, u := range s.getUpstreams() {
+		if u.isHealthy() {
+			result = append(result, u)
+		}
+	}
+	if len(result) == 0 {
+		return []*upstream{s.activeUpstream()}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].getScore() > result[j].getScore()
+	})
+	return result
+}
+
+// Checks all upstreams at once. Active upstream is kept while healthy, so jobs
+// don't jump between nodes, otherwise the best scored healthy one takes over.
+func (s *ProxyServer) checkUpstreams() {
+	upstreams, idx := s.upstreamsState()
+	if len(upstreams) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			u.check(s.upstreamLimits.minPeers)
+		}(u)
+	}
+	wg.Wait()
+
+	best := s.bestHeight()
+	for _, u := range upstreams {
+		u.rate(best, s.upstreamLimits)
+		upstreamScores.With(s.coin, u.Name).Set(u.getScore())
+	}
+
+	if upstreams[idx].isHealthy() {
+		return
+	}
+	candidate := idx
+	for i, u := range upstreams {
+		if u.isHealthy() && (!upstreams[candidate].isHealthy() || u.getScore() > upstreams[candidate].getScore()) {
+			candidate = int32(i)
+		}
+	}
+
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+	// Upstreams were replaced by config reload while checking
+	if !sameUpstreams(s.upstreams, upstreams) {
+		return
+	}
+	if s.upstream != candidate {
+		log.Printf("Switching to %v upstream", upstreams[candidate].Name)
+		atomic.StoreInt32(&s.upstream, candidate)
+		upstreamSwitches.With(s.coin, upstreams[candidate].Name).Inc()
+	}
+}
+
+// Highest pending block among reachable upstreams at last check
+func (s *ProxyServer) bestHeight() uint64 {
+	var best uint64
+	for _, u := range s.getUpstreams() {
+		u.mu.RLock()
+		if u.alive && u.height > best {
+			best = u.height
+		}
+		u.mu.RUnlock()
+	}
+	return best
+}
+
+// Replaces upstreams on config reload, the first one becomes active
+func (s *ProxyServer) SetUpstreams(cfg []Upstream) {
+	upstreams := newUpstreams(cfg, s.coin)
+	s.upstreamsMu.Lock()
+	s.upstreams = upstreams
+	atomic.StoreInt32(&s.upstream, 0)
+	s.upstreamsMu.Unlock()
+	log.Printf("Default upstream: %s => %s", upstreams[0].Name, upstreams[0].Url)
+	s.checkUpstreams()
+	s.startSubscriptions(cfg)
+}
+
+func (s *ProxyServer) writeUpstreamStates() {
+	active := s.activeUpstream()
+	upstreams := s.getUpstreams()
+	states := make([]*storage.UpstreamState, len(upstreams))
+	for i, u := range upstreams {
+		states[i] = u.state(u == active)
+	}
+	if err := s.backend.WriteNodeUpstreams(s.config.Name, states); err != nil {
+		log.Printf("Failed to write upstream states to backend: %v", err)
+	}
+}
+
+// Job offered by an upstream
+type work struct {
+	upstream *upstream
+	reply    []string
+	pending  *rpc.GetBlockReplyPart
+	height   uint64
+	diff     int64
+}
+
+func fetchWork(u *upstream) (*work, error) {
+	pending, height, diff, err := fetchPendingBlock(u.RPCClient)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := u.GetWork()
+	if err != nil {
+		return nil, err
+	}
+	return &work{upstream: u, reply: reply, pending: pending, height: height, diff: diff}, nil
+}
+
+// Asks healthy upstreams for work at once and takes the highest block. On equal height
+// upstream of the current job wins, other nodes would only reshuffle transactions.
+func (s *ProxyServer) fetchBestWork(t *BlockTemplate) *work {
+	upstreams := s.healthyUpstreams()
+	results := make([]*work, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func(i int, u *upstream) {
+			defer wg.Done()
+			w, err := fetchWork(u)
+			if err != nil {
+				log.Printf("Error while refreshing block template on %s: %s", u.Name, err)
+				return
+			}
+			results[i] = w
+		}(i, u)
+	}
+	wg.Wait()
+
+	var best *work
+	for _, w := range results {
+		if w == nil {
+			continue
+		}
+		if best == nil || w.height > best.height || (w.height == best.height && t != nil && w.upstream.Name == t.upstream) {
+			best = w
+		}
+	}
+	return best
+}
+
+// Submits solution to every healthy upstream and the one the job came from at once,
+// block is accepted once any of them takes it
+func (s *ProxyServer) submitBlock(params []string, source string) (bool, error) {
+	upstreams := s.healthyUpstreams()
+	found := false
+	for _, u := range upstreams {
+		found = found || u.Name == source
+	}
+	if !found {
+		for _, u := range s.getUpstreams() {
+			if u.Name == source {
+				upstreams = append(upstreams, u)
+			}
+		}
+	}
+
+	accepted := make([]bool, len(upstreams))
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func(i int, u *upstream) {
+			defer wg.Done()
+			accepted[i], errs[i] = u.SubmitBlock(params)
+		}(i, u)
+	}
+	wg.Wait()
+
+	var err error
+	ok := false
+	for i, u := range upstreams {
+		if errs[i] != nil {
+			log.Printf("Block submission to %v failed: %v", u.Name, errs[i])
+			err = errs[i]
+		} else if accepted[i] {
+			log.Printf("Block accepted by %v", u.Name)
+			ok = true
+		}
+	}
+	if ok {
+		return true, nil
+	}
+	return false, err
+}
+
+func fetchPendingBlock(node *rpc.RPCClient) (*rpc.GetBlockReplyPart, uint64, int64, error) {
+	reply, err := node.GetPendingBlock()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if reply == nil {
+		return nil, 0, 0, errors.New("No pending block")
+	}
+	blockNumber, err := strconv.ParseUint(strings.Replace(reply.Number, "0x", "", -1), 16, 64)
+	if err != nil {
+		log.Println("Can't parse pending block number")
+		return nil, 0, 0, err
+	}
+	blockDiff, err := strconv.ParseInt(strings.Replace(reply.Difficulty, "0x", "", -1), 16, 64)
+	if err != nil {
+		log.Println("Can't parse pending block difficulty")
+		return nil, 0, 0, err
+	}
+	return reply, blockNumber, blockDiff, nil
+}
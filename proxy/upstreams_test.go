@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yuriy0803/open-etc-pool-friends/rpc"
+)
+
+// Node serving a fixed pending block and counting submitted solutions
+type testNode struct {
+	*httptest.Server
+	// Accessed atomically
+	height  uint64
+	accept  bool
+	submits int32
+}
+
+func newTestNode(height uint64, accept bool) *testNode {
+	n := &testNode{height: height, accept: accept}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var result interface{}
+		switch req.Method {
+		case "eth_getBlockByNumber":
+			result = map[string]string{"number": fmt.Sprintf("0x%x", atomic.LoadUint64(&n.height)), "difficulty": "0x1000"}
+		case "eth_getWork":
+			result = []string{fmt.Sprintf("0x%064x", atomic.LoadUint64(&n.height)), "0xseed", "0x" + fmt.Sprintf("%064x", 1<<32)}
+		case "eth_submitWork":
+			atomic.AddInt32(&n.submits, 1)
+			result = n.accept
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": result})
+	}))
+	return n
+}
+
+func newUpstreamsProxy(nodes ...*testNode) *ProxyServer {
+	s := &ProxyServer{upstreamLimits: newUpstreamLimits(&UpstreamHealth{})}
+	for i, n := range nodes {
+		s.upstreams = append(s.upstreams, &upstream{RPCClient: rpc.NewRPCClient(fmt.Sprint("node", i), n.URL, "1s")})
+	}
+	return s
+}
+
+func TestUpstreamScoring(t *testing.T) {
+	l := newUpstreamLimits(&UpstreamHealth{MinPeers: 4})
+	fresh := &upstream{RPCClient: rpc.NewRPCClient("fresh", "http://127.0.0.1:0", "1s"), alive: true, height: 100, peers: 10}
+	lagging := &upstream{RPCClient: rpc.NewRPCClient("lagging", "http://127.0.0.1:0", "1s"), alive: true, height: 95, peers: 10}
+	lonely := &upstream{RPCClient: rpc.NewRPCClient("lonely", "http://127.0.0.1:0", "1s"), alive: true, height: 100, peers: 1}
+	dead := &upstream{RPCClient: rpc.NewRPCClient("dead", "http://127.0.0.1:0", "1s"), height: 100, peers: 10}
+	for _, u := range []*upstream{fresh, lagging, lonely, dead} {
+		u.rate(100, l)
+	}
+
+	if !fresh.healthy || fresh.score != 1 {
+		t.Errorf("Expected perfect score, got %v", fresh.score)
+	}
+	if lagging.healthy || lagging.lag != 5 {
+		t.Errorf("Expected node 5 blocks behind to be unhealthy, got lag %v", lagging.lag)
+	}
+	if lonely.healthy || lonely.score >= fresh.score {
+		t.Errorf("Expected node without peers to be unhealthy and scored lower, got %v", lonely.score)
+	}
+	if dead.healthy || dead.score != 0 {
+		t.Errorf("Expected unreachable node to score 0, got %v", dead.score)
+	}
+}
+
+func TestCheckUpstreamsSwitchesToBestNode(t *testing.T) {
+	behind, ahead := newTestNode(90, true), newTestNode(100, true)
+	defer behind.Close()
+	defer ahead.Close()
+	s := newUpstreamsProxy(behind, ahead)
+
+	s.checkUpstreams()
+	if s.activeUpstream().Name != "node1" {
+		t.Errorf("Expected lagging active upstream to be replaced, got %v", s.activeUpstream().Name)
+	}
+	if states := s.activeUpstream().state(true); !states.Healthy || states.Height != 100 {
+		t.Errorf("Unexpected upstream state %+v", states)
+	}
+}
+
+func TestFetchBestWork(t *testing.T) {
+	a, b := newTestNode(100, true), newTestNode(101, true)
+	defer a.Close()
+	defer b.Close()
+	s := newUpstreamsProxy(a, b)
+	s.upstreamLimits.maxLag = 5
+	s.checkUpstreams()
+
+	w := s.fetchBestWork(nil)
+	if w == nil || w.height != 101 || w.upstream.Name != "node1" {
+		t.Fatalf("Expected work of the highest node, got %+v", w)
+	}
+
+	// Equal height keeps the node of current job
+	atomic.StoreUint64(&a.height, 101)
+	w = s.fetchBestWork(&BlockTemplate{upstream: "node0"})
+	if w == nil || w.upstream.Name != "node0" {
+		t.Errorf("Expected work of the current job node, got %+v", w)
+	}
+}
+
+func TestSubmitBlockToAllUpstreams(t *testing.T) {
+	rejecting, accepting := newTestNode(100, false), newTestNode(100, true)
+	defer rejecting.Close()
+	defer accepting.Close()
+	s := newUpstreamsProxy(rejecting, accepting)
+	s.checkUpstreams()
+
+	ok, err := s.submitBlock([]string{"0x1", "0x2", "0x3"}, "node0")
+	if !ok || err != nil {
+		t.Errorf("Expected block to be accepted by any upstream, got %v: %v", ok, err)
+	}
+	if atomic.LoadInt32(&rejecting.submits) != 1 || atomic.LoadInt32(&accepting.submits) != 1 {
+		t.Error("Expected solution to reach every healthy upstream")
+	}
+}
+
+func TestSameUpstreams(t *testing.T) {
+	node := newTestNode(100, true)
+	defer node.Close()
+	s := newUpstreamsProxy(node, node)
+	reloaded := append([]*upstream(nil), s.upstreams...)
+
+	tests := []struct {
+		name string
+		a, b []*upstream
+		same bool
+	}{
+		{"same list", s.upstreams, s.getUpstreams(), true},
+		{"reloaded with equal upstreams", s.upstreams, reloaded, false},
+		{"shrunk", s.upstreams, s.upstreams[:1], false},
+		{"both empty", nil, []*upstream{}, true},
+		{"one empty", s.upstreams, nil, false},
+	}
+	for _, tt := range tests {
+		if same := sameUpstreams(tt.a, tt.b); same != tt.same {
+			t.Errorf("%v: expected %v, got %v", tt.name, tt.same, same)
+		}
+	}
+
+	// Nothing to check, nothing to switch
+	empty := newUpstreamsProxy()
+	empty.checkUpstreams()
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"log"
+	"math"
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+const (
+	// Number of recent share timestamps used to estimate the share rate
+	varDiffBufferSize = 32
+	// Never move difficulty by more than this factor in one retarget
+	varDiffMaxJump = 4.0
+)
+
+type varDiff struct {
+	sync.Mutex
+	config       *VarDiff
+	retargetIntv int64
+	shareTimes   []int64
+	windowStart  int64
+	lastRetarget int64
+}
+
+func newVarDiff(cfg *VarDiff) *varDiff {
+	now := util.MakeTimestamp()
+	intv := util.MustParseDuration(cfg.RetargetInterval)
+	return &varDiff{
+		config:       cfg,
+		retargetIntv: intv.Milliseconds(),
+		shareTimes:   make([]int64, 0, varDiffBufferSize),
+		windowStart:  now,
+		lastRetarget: now,
+	}
+}
+
+// Clamp difficulty to configured vardiff bounds
+func (v *varDiff) clamp(diff int64) int64 {
+	if v.config.MinDiff > 0 && diff < v.config.MinDiff {
+		return v.config.MinDiff
+	}
+	if v.config.MaxDiff > 0 && diff > v.config.MaxDiff {
+		return v.config.MaxDiff
+	}
+	return diff
+}
+
+// Records a share submitted at ts (ms). Returns the new difficulty or 0 if it must stay as is.
+func (v *varDiff) submit(ts, current int64) int64 {
+	v.Lock()
+	defer v.Unlock()
+
+	if len(v.shareTimes) == varDiffBufferSize {
+		v.windowStart = v.shareTimes[0]
+		v.shareTimes = append(v.shareTimes[:0], v.shareTimes[1:]...)
+	}
+	v.shareTimes = append(v.shareTimes, ts)
+	return v.retarget(ts, current)
+}
+
+// Checked on every job broadcast, so a session that stopped finding shares is eased down.
+func (v *varDiff) idle(ts, current int64) int64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.retarget(ts, current)
+}
+
+func (v *varDiff) retarget(now, current int64) int64 {
+	if now-v.lastRetarget < v.retargetIntv {
+		return 0
+	}
+	v.lastRetarget = now
+
+	elapsed := float64(now-v.windowStart) / 60000
+	if elapsed <= 0 {
+		return 0
+	}
+	rate := float64(len(v.shareTimes)) / elapsed
+	goal := v.config.SharesPerMinute
+	if math.Abs(rate-goal) <= goal*v.config.VariancePercent/100 {
+		return 0
+	}
+
+	factor := math.Max(1/varDiffMaxJump, math.Min(varDiffMaxJump, rate/goal))
+	next := v.clamp(int64(float64(current) * factor))
+	if next == current {
+		return 0
+	}
+	// Share rate measured at old difficulty is meaningless now
+	v.shareTimes = v.shareTimes[:0]
+	v.windowStart = now
+	return next
+}
+
+func (cs *Session) difficulty() int64 {
+	return atomic.LoadInt64(&cs.diff)
+}
+
+// Previous difficulty is still accepted for work issued before the last retarget
+func (cs *Session) prevDifficulty() int64 {
+	return atomic.LoadInt64(&cs.prevDiff)
+}
+
+// Difficulty share of given hash is credited at, work issued before the last
+// retarget is credited at previous difficulty. False if hash meets neither.
+func (cs *Session) shareDifficulty(hash *big.Int) (int64, bool) {
+	diff := cs.difficulty()
+	if hash.Cmp(new(big.Int).Div(maxUint256, big.NewInt(diff))) <= 0 {
+		return diff, true
+	}
+	prev := cs.prevDifficulty()
+	if prev == 0 || hash.Cmp(new(big.Int).Div(maxUint256, big.NewInt(prev))) > 0 {
+		return 0, false
+	}
+	return prev, true
+}
+
+func (cs *Session) setDifficulty(diff int64) {
+	atomic.StoreInt64(&cs.prevDiff, atomic.SwapInt64(&cs.diff, diff))
+}
+
+func (cs *Session) clearPrevDifficulty() {
+	atomic.StoreInt64(&cs.prevDiff, 0)
+}
+
+func (cs *Session) targetHex() string {
+	return util.GetTargetHex(cs.difficulty())
+}
+
+// Retarget session after a valid share and push new difficulty to the miner
+func (s *ProxyServer) retargetSession(cs *Session) {
+	if cs.varDiff == nil {
+		return
+	}
+	current := cs.difficulty()
+	next := cs.varDiff.submit(util.MakeTimestamp(), current)
+	if next == 0 {
+		return
+	}
+	cs.setDifficulty(next)
+	if s.config.Proxy.Debug {
+		log.Printf("Retarget %v@%v difficulty %v => %v", cs.login, cs.ip, current, next)
+	}
+	if err := s.pushDifficulty(cs); err != nil {
+		log.Printf("Difficulty transmit error to %v@%v: %v", cs.login, cs.ip, err)
+		s.removeSession(cs)
+	}
+}
+
+// Lower difficulty of a session that doesn't submit shares, new job will carry it
+func (s *ProxyServer) retargetIdleSession(cs *Session) bool {
+	if cs.varDiff == nil {
+		return false
+	}
+	current := cs.difficulty()
+	next := cs.varDiff.idle(util.MakeTimestamp(), current)
+	if next == 0 {
+		return false
+	}
+	cs.setDifficulty(next)
+	if s.config.Proxy.Debug {
+		log.Printf("Retarget idle %v@%v difficulty %v => %v", cs.login, cs.ip, current, next)
+	}
+	return true
+}
+
+func (s *ProxyServer) pushDifficulty(cs *Session) error {
+	if cs.stratumMode() == EthereumStratum2 {
+		// New target goes out with mining.set
+		return s.pushStratum2Job(cs)
+	}
+	if cs.stratumMode() == NiceHash {
+		if err := cs.sendDifficulty(); err != nil {
+			return err
+		}
+		// Keep current job acceptable, shares are in flight already
+		cs.Lock()
+		cs.cacheStales(10, 3)
+		cs.Unlock()
+		return cs.sendJob(s, nil, true)
+	}
+	reply, errReply := s.handleGetWorkRPC(cs)
+	if errReply != nil {
+		return nil
+	}
+	return cs.pushNewJob(s, &reply)
+}
+
+func (cs *Session) sendDifficulty() error {
+	req := JSONStratumReq{
+		Method: "mining.set_difficulty",
+		Params: []float64{util.DiffIntToFloat(cs.difficulty())},
+	}
+	return cs.sendTCPReq(req)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Starts at time 0, so tests control share timestamps
+func newTestVarDiff(retargetInterval string) *varDiff {
+	v := newVarDiff(&VarDiff{
+		MinDiff:          1000,
+		MaxDiff:          1000000,
+		SharesPerMinute:  10,
+		VariancePercent:  30,
+		RetargetInterval: retargetInterval,
+	})
+	v.windowStart = 0
+	v.lastRetarget = 0
+	return v
+}
+
+func TestVarDiffRetarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		shares  int
+		current int64
+		next    int64
+	}{
+		{"on goal", 10, 4000, 0},
+		{"within variance", 12, 4000, 0},
+		{"fast", 20, 4000, 8000},
+		{"slow", 5, 4000, 2000},
+		{"jump up limited", 100, 4000, 16000},
+		{"jump down limited", 1, 4000, 1000},
+		{"max diff", 40, 500000, 1000000},
+		{"min diff", 5, 1500, 1000},
+		{"at min diff", 2, 1000, 0},
+	}
+	for _, tt := range tests {
+		v := newTestVarDiff("1m")
+		// Shares spread over one minute, the last one is due for retarget
+		var next int64
+		for i := 1; i <= tt.shares; i++ {
+			next = v.submit(int64(i)*60000/int64(tt.shares), tt.current)
+			if i < tt.shares && next != 0 {
+				t.Fatalf("%v: retarget before interval passed, got %v", tt.name, next)
+			}
+		}
+		if next != tt.next {
+			t.Errorf("%v: expected difficulty %v, got %v", tt.name, tt.next, next)
+		}
+		if next != 0 && (len(v.shareTimes) != 0 || v.windowStart != 60000) {
+			t.Errorf("%v: share rate must be measured anew after retarget", tt.name)
+		}
+	}
+}
+
+func TestVarDiffBufferRollOver(t *testing.T) {
+	v := newTestVarDiff("2m")
+	for i := int64(1); i <= 40; i++ {
+		if next := v.submit(i*1000, 1000); next != 0 {
+			t.Fatalf("Retarget before interval passed, got %v", next)
+		}
+	}
+	// Oldest shares are dropped, window starts at the last dropped one
+	if len(v.shareTimes) != varDiffBufferSize || v.shareTimes[0] != 9000 || v.windowStart != 8000 {
+		t.Fatalf("Expected 32 latest shares from 8s, got %v from %v", len(v.shareTimes), v.windowStart)
+	}
+	// 32 shares within two minutes of window start
+	if next := v.idle(128000, 1000); next != 1600 {
+		t.Errorf("Expected share rate of 16 per minute to raise difficulty to 1600, got %v", next)
+	}
+}
+
+func TestVarDiffIdle(t *testing.T) {
+	v := newTestVarDiff("30s")
+	if next := v.idle(10000, 8000); next != 0 {
+		t.Errorf("Expected no retarget before interval, got %v", next)
+	}
+	if next := v.idle(30000, 8000); next != 2000 {
+		t.Errorf("Expected idle session eased down by 4x, got %v", next)
+	}
+	if next := v.idle(40000, 2000); next != 0 {
+		t.Errorf("Expected no retarget within interval of the last one, got %v", next)
+	}
+	if next := v.idle(60000, 2000); next != 1000 {
+		t.Errorf("Expected idle session eased down to min diff, got %v", next)
+	}
+	if next := v.idle(90000, 1000); next != 0 {
+		t.Errorf("Expected no retarget below min diff, got %v", next)
+	}
+}
+
+func TestShareDifficultyAfterRetarget(t *testing.T) {
+	target := func(diff int64) *big.Int {
+		return new(big.Int).Div(maxUint256, big.NewInt(diff))
+	}
+	cs := &Session{diff: 1000}
+	cs.setDifficulty(4000)
+
+	if diff, ok := cs.shareDifficulty(target(4000)); !ok || diff != 4000 {
+		t.Errorf("Expected share at new difficulty to be credited at 4000, got %v %v", diff, ok)
+	}
+	if diff, ok := cs.shareDifficulty(target(2000)); !ok || diff != 1000 {
+		t.Errorf("Expected share of work issued before retarget to be credited at 1000, got %v %v", diff, ok)
+	}
+	if _, ok := cs.shareDifficulty(target(500)); ok {
+		t.Error("Expected share below previous difficulty to be rejected")
+	}
+
+	cs.clearPrevDifficulty()
+	if _, ok := cs.shareDifficulty(target(2000)); ok {
+		t.Error("Expected share at previous difficulty to be rejected with a new block")
+	}
+}
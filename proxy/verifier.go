@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/ubiq/go-ubiq/v7/common"
+	"github.com/yuriy0803/ubqhash"
+)
+
+// Start generating cache of the next epoch this many blocks before the boundary
+const epochWarmupBlocks = 50
+
+var errServerBusy = &ErrorReply{Code: -1, Message: "Server busy"}
+
+type VerifierConfig struct {
+	// Number of PoW verification workers, defaults to number of CPUs
+	Workers int `json:"workers"`
+	// Max shares waiting for verification, miners get "Server busy" above it
+	QueueSize int `json:"queueSize"`
+}
+
+type verifyJob struct {
+	height      uint64
+	hashNoNonce common.Hash
+	nonce       uint64
+	mixDigest   common.Hash
+	result      common.Hash
+	done        chan struct{}
+}
+
+// Bounded pool of ubqhash workers shared by all sessions
+type verifier struct {
+	// Accessed atomically, keep 64-bit aligned
+	pending      int64
+	rejected     int64
+	verified     int64
+	latencyTotal int64
+	latencyMax   int64
+	warmEpoch    uint64
+
+	coin       string
+	hasher     *ubqhash.Ubqhash
+	jobs       chan *verifyJob
+	workers    int
+	maxPending int64
+	// Mix digest and PoW result of a share, replaced by tests
+	hash func(height uint64, hashNoNonce common.Hash, nonce uint64) (common.Hash, common.Hash)
+	// Generates cache of an epoch ahead of its first share, replaced by tests
+	warm func(epoch uint64)
+}
+
+type verifierStats struct {
+	Queue     int64
+	Pending   int64
+	Workers   int64
+	Verified  int64
+	Rejected  int64
+	LatencyUs int64
+	MaxUs     int64
+}
+
+func newVerifier(cfg *VerifierConfig, coin string) *verifier {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = workers * 64
+	}
+	v := &verifier{
+		coin:       coin,
+		hasher:     ubqhash.New(),
+		jobs:       make(chan *verifyJob, queueSize),
+		workers:    workers,
+		maxPending: int64(queueSize),
+	}
+	v.hash = v.computePoW
+	v.warm = v.generateCache
+	for i := 0; i < workers; i++ {
+		go v.work()
+	}
+	log.Printf("Started %v share verification workers, queue size %v", workers, queueSize)
+	return v
+}
+
+func (v *verifier) work() {
+	for job := range v.jobs {
+		job.mixDigest, job.result = v.hash(job.height, job.hashNoNonce, job.nonce)
+		close(job.done)
+	}
+}
+
+func (v *verifier) computePoW(height uint64, hashNoNonce common.Hash, nonce uint64) (common.Hash, common.Hash) {
+	_, mixDigest, result := v.hasher.Compute(height, hashNoNonce, nonce)
+	return mixDigest, result
+}
+
+// Reserves a queue slot for a submitted share, false if the queue is full.
+// Every admitted share must be released with done.
+func (v *verifier) admit() bool {
+	if atomic.AddInt64(&v.pending, 1) > v.maxPending {
+		atomic.AddInt64(&v.pending, -1)
+		atomic.AddInt64(&v.rejected, 1)
+		verifyRejected.With(v.coin).Inc()
+		return false
+	}
+	return true
+}
+
+func (v *verifier) done() {
+	atomic.AddInt64(&v.pending, -1)
+}
+
+// Returns mix digest and PoW result, blocks until a worker is free
+func (v *verifier) compute(height uint64, hashNoNonce common.Hash, nonce uint64) (common.Hash, common.Hash) {
+	start := time.Now()
+	job := &verifyJob{height: height, hashNoNonce: hashNoNonce, nonce: nonce, done: make(chan struct{})}
+	v.jobs <- job
+	<-job.done
+
+	verifyDuration.With(v.coin).ObserveSince(start)
+	latency := time.Since(start).Microseconds()
+	atomic.AddInt64(&v.verified, 1)
+	atomic.AddInt64(&v.latencyTotal, latency)
+	for {
+		max := atomic.LoadInt64(&v.latencyMax)
+		if latency <= max || atomic.CompareAndSwapInt64(&v.latencyMax, max, latency) {
+			break
+		}
+	}
+	return job.mixDigest, job.result
+}
+
+// Waits until all admitted shares are processed
+func (v *verifier) wait(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&v.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("Gave up waiting for %v shares in flight", atomic.LoadInt64(&v.pending))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Generates cache of the next epoch in background, so the first shares after the boundary don't stall workers
+func (v *verifier) prepareEpoch(height uint64) {
+	if height%epochLength < epochLength-epochWarmupBlocks {
+		return
+	}
+	next := height/epochLength + 1
+	if atomic.SwapUint64(&v.warmEpoch, next) == next {
+		return
+	}
+	go v.warm(next)
+}
+
+func (v *verifier) generateCache(epoch uint64) {
+	start := time.Now()
+	v.hasher.Compute(epoch*epochLength, common.Hash{}, 0)
+	log.Printf("Generated verification cache for epoch %v in %v", epoch, time.Since(start))
+}
+
+// Snapshot of metrics, counters are totals since start and aren't reset by reading
+func (v *verifier) stats() verifierStats {
+	verified := atomic.LoadInt64(&v.verified)
+	total := atomic.LoadInt64(&v.latencyTotal)
+	stats := verifierStats{
+		Queue:    int64(len(v.jobs)),
+		Pending:  atomic.LoadInt64(&v.pending),
+		Workers:  int64(v.workers),
+		Verified: verified,
+		Rejected: atomic.LoadInt64(&v.rejected),
+		MaxUs:    atomic.LoadInt64(&v.latencyMax),
+	}
+	if verified > 0 {
+		stats.LatencyUs = total / verified
+	}
+	return stats
+}
+
+func (s *ProxyServer) writeVerifierStats() {
+	stats := s.verifier.stats()
+	err := s.backend.WriteNodeMetrics(s.config.Name, map[string]int64{
+		"verifyQueue":        stats.Queue,
+		"verifyPending":      stats.Pending,
+		"verifyWorkers":      stats.Workers,
+		"verified":           stats.Verified,
+		"verifyRejected":     stats.Rejected,
+		"verifyLatencyUs":    stats.LatencyUs,
+		"verifyMaxLatencyUs": stats.MaxUs,
+	})
+	if err != nil {
+		log.Printf("Failed to write verifier stats to backend: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ubiq/go-ubiq/v7/common"
+)
+
+func TestVerifierQueueFull(t *testing.T) {
+	s, _, addrs := newPortsProxy(t, []Stratum{{Timeout: "1m"}})
+	login := "0x0000000000000000000000000000000000000001"
+	loginPort(t, addrs[0], login)
+	cs := s.sessionOf(login)
+	if cs == nil {
+		t.Fatalf("No session registered for %v", login)
+	}
+
+	// One share in the worker and one queued fill the queue
+	s.verifier = newVerifier(&VerifierConfig{Workers: 1, QueueSize: 2}, s.coin)
+	release := make(chan struct{})
+	mix := common.HexToHash("0x3333333333333333333333333333333333333333333333333333333333333333")
+	s.verifier.hash = func(uint64, common.Hash, uint64) (common.Hash, common.Hash) {
+		<-release
+		return mix, common.HexToHash("0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+	}
+	submit := func(nonce int) (bool, *ErrorReply) {
+		return s.handleSubmitRPC(cs, login, "rig", []string{fmt.Sprintf("0x%016x", nonce), stratum2Header, mix.Hex()})
+	}
+	rejected := verifyRejected.With(s.coin).Get()
+	for i := 1; i <= 2; i++ {
+		if ok, errReply := submit(i); !ok || errReply != nil {
+			t.Fatalf("Expected share %v to be queued, got %v %+v", i, ok, errReply)
+		}
+	}
+	if ok, errReply := submit(3); ok || errReply != errServerBusy {
+		t.Fatalf("Expected server busy on full queue, got %v %+v", ok, errReply)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.verifier.jobs) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected one share waiting for the worker, got %v", len(s.verifier.jobs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.collectMetrics()
+	if queue, pending := verifyQueue.With(s.coin).Get(), verifyPending.With(s.coin).Get(); queue != 1 || pending != 2 {
+		t.Errorf("Expected queue 1 and pending 2 in metrics, got %v and %v", queue, pending)
+	}
+	if delta := verifyRejected.With(s.coin).Get() - rejected; delta != 1 {
+		t.Errorf("Expected 1 more rejected share in metrics, got %v", delta)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.verifier.wait(ctx)
+	// Stats are read by node state and tests alike, reading must not reset them
+	for i := 0; i < 2; i++ {
+		stats := s.verifier.stats()
+		if stats.Pending != 0 || stats.Verified != 2 || stats.Rejected != 1 {
+			t.Errorf("Read %v: expected 0 pending, 2 verified and 1 rejected, got %+v", i, stats)
+		}
+	}
+	s.collectMetrics()
+	if pending := verifyPending.With(s.coin).Get(); pending != 0 {
+		t.Errorf("Expected no pending shares in metrics, got %v", pending)
+	}
+}
+
+func TestVerifierConcurrency(t *testing.T) {
+	v := newVerifier(&VerifierConfig{Workers: 3}, "")
+	var running, max int32
+	v.hash = func(uint64, common.Hash, uint64) (common.Hash, common.Hash) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return common.Hash{}, common.Hash{}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(nonce uint64) {
+			defer wg.Done()
+			v.compute(1, common.Hash{}, nonce)
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	if max != 3 {
+		t.Errorf("Expected at most 3 concurrent verifications with 3 workers, got %v", max)
+	}
+	if stats := v.stats(); stats.Verified != 12 || stats.Workers != 3 {
+		t.Errorf("Expected 12 shares verified by 3 workers, got %+v", stats)
+	}
+}
+
+func TestVerifierPrepareEpoch(t *testing.T) {
+	warmed := make(chan uint64, 8)
+	v := &verifier{warm: func(epoch uint64) { warmed <- epoch }}
+
+	tests := []struct {
+		height uint64
+		// Epoch expected to be generated, 0 for none
+		epoch uint64
+	}{
+		{epochLength - epochWarmupBlocks - 1, 0},
+		{epochLength - epochWarmupBlocks, 1},
+		{epochLength - 1, 0},
+		{epochLength, 0},
+		{2*epochLength - epochWarmupBlocks + 10, 2},
+		{2*epochLength - 1, 0},
+	}
+	for _, tt := range tests {
+		v.prepareEpoch(tt.height)
+		select {
+		case epoch := <-warmed:
+			if epoch != tt.epoch {
+				t.Errorf("Height %v: expected epoch %v to be generated, got %v", tt.height, tt.epoch, epoch)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if tt.epoch != 0 {
+				t.Errorf("Height %v: expected epoch %v to be generated", tt.height, tt.epoch)
+			}
+		}
+	}
+}
@@ -0,0 +1,331 @@
+//go:build go1.9
+// +build go1.9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/api"
+	"github.com/yuriy0803/open-etc-pool-friends/proxy"
+)
+
+// Config fields applied without restart, by json path
+var liveConfigFields = []string{
+	"upstream",
+	"proxy.policy",
+	"payouts.threshold",
+	"unlocker.poolFee",
+	"api.hashrateWindow",
+	"api.hashrateLargeWindow",
+	"api.luckWindow",
+}
+
+// Policy fields used only when it starts
+var restartPolicyFields = []string{
+	"proxy.policy.workers",
+	"proxy.policy.resetInterval",
+	"proxy.policy.refreshInterval",
+}
+
+var reloadMu sync.Mutex
+
+// Re-reads config file and applies fields that can change live,
+// so miners keep their connections. Changes of other fields are only reported.
+func reloadConfig() (*api.ReloadReport, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	log.Printf("Reloading config: %v", configFileName)
+	var file proxy.Config
+	coins, err := loadCoinConfigs(configFileName, &file)
+	if err == nil {
+		err = validateCoins(coins)
+	}
+	if err != nil {
+		log.Printf("Config reload failed: %v", err)
+		return nil, err
+	}
+
+	// Paths are prefixed by coin when process serves several
+	prefix := func(p *coinPool, path string) string {
+		if len(cfg.Coins) == 0 {
+			return path
+		}
+		return p.cfg.Coin + ":" + path
+	}
+	report := &api.ReloadReport{Applied: []string{}, Restart: []string{}}
+	matched := make(map[*proxy.Config]bool)
+	for _, p := range pools {
+		next := nextConfig(coins, p.cfg.Coin)
+		if next == nil {
+			report.Restart = append(report.Restart, prefix(p, "coins"))
+			continue
+		}
+		matched[next] = true
+		var applied []string
+		for _, path := range diffConfig("", reflect.ValueOf(p.running), reflect.ValueOf(*next)) {
+			if isLiveField(path) {
+				applied = append(applied, path)
+				report.Applied = append(report.Applied, prefix(p, path))
+			} else {
+				report.Restart = append(report.Restart, prefix(p, path))
+			}
+		}
+		p.applyConfig(next, applied)
+	}
+	for i := range coins {
+		if !matched[&coins[i]] {
+			report.Restart = append(report.Restart, coins[i].Coin+":coins")
+		}
+	}
+
+	log.Printf("Config reloaded, applied: %v", report.Applied)
+	if len(report.Restart) > 0 {
+		log.Printf("Changed fields which need restart: %v", report.Restart)
+	}
+	return report, nil
+}
+
+// Reloaded config of the coin, the only one if process serves a single coin
+func nextConfig(coins []proxy.Config, coin string) *proxy.Config {
+	if len(cfg.Coins) == 0 && len(coins) == 1 {
+		return &coins[0]
+	}
+	for i := range coins {
+		if coins[i].Coin == coin {
+			return &coins[i]
+		}
+	}
+	return nil
+}
+
+// Nothing is applied or reported unless the whole config of every coin is valid
+// and live fields are valid for modules running now
+func validateCoins(coins []proxy.Config) error {
+	for i := range coins {
+		if err := validateConfig(&coins[i]); err != nil {
+			if len(cfg.Coins) > 0 {
+				return fmt.Errorf("%v: %v", coins[i].Coin, err)
+			}
+			return err
+		}
+	}
+	for _, p := range pools {
+		next := nextConfig(coins, p.cfg.Coin)
+		if next == nil {
+			continue
+		}
+		if err := p.validateLiveConfig(next); err != nil {
+			if len(cfg.Coins) > 0 {
+				return fmt.Errorf("%v: %v", p.cfg.Coin, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks fields modules enabled in config would refuse at start
+func validateConfig(c *proxy.Config) error {
+	var durations [][2]string
+	duration := func(path, v string) {
+		durations = append(durations, [2]string{path, v})
+	}
+	if c.Proxy.Enabled {
+		duration("proxy.blockRefreshInterval", c.Proxy.BlockRefreshInterval)
+		if len(c.Proxy.TxRefreshInterval) > 0 {
+			duration("proxy.txRefreshInterval", c.Proxy.TxRefreshInterval)
+		}
+		duration("proxy.stateUpdateInterval", c.Proxy.StateUpdateInterval)
+		duration("proxy.hashrateExpiration", c.Proxy.HashrateExpiration)
+		duration("upstreamCheckInterval", c.UpstreamCheckInterval)
+		duration("proxy.policy.limits.grace", c.Proxy.Policy.Limits.Grace)
+		duration("proxy.policy.resetInterval", c.Proxy.Policy.ResetInterval)
+		duration("proxy.policy.refreshInterval", c.Proxy.Policy.RefreshInterval)
+		if len(c.Proxy.ShareBatch.FlushInterval) > 0 {
+			duration("proxy.shareBatch.flushInterval", c.Proxy.ShareBatch.FlushInterval)
+		}
+		if len(c.UpstreamHealth.MaxLatency) > 0 {
+			duration("upstreamHealth.maxLatency", c.UpstreamHealth.MaxLatency)
+		}
+		if c.UpstreamPool.Enabled {
+			duration("upstreamPool.timeout", c.UpstreamPool.Timeout)
+		}
+		for i, v := range c.Proxy.Stratum {
+			if !v.Enabled {
+				continue
+			}
+			duration(fmt.Sprintf("proxy.stratum.%d.timeout", i), v.Timeout)
+			if v.VarDiff.Enabled {
+				duration(fmt.Sprintf("proxy.stratum.%d.varDiff.retargetInterval", i), v.VarDiff.RetargetInterval)
+			}
+		}
+	}
+	if c.Api.Enabled {
+		duration("api.hashrateWindow", c.Api.HashrateWindow)
+		duration("api.hashrateLargeWindow", c.Api.HashrateLargeWindow)
+		duration("api.statsCollectInterval", c.Api.StatsCollectInterval)
+		duration("api.purgeInterval", c.Api.PurgeInterval)
+		if c.Api.PayoutThreshold.Enabled {
+			duration("api.payoutThreshold.maxAge", c.Api.PayoutThreshold.MaxAge)
+		}
+	}
+	if c.BlockUnlocker.Enabled {
+		duration("unlocker.interval", c.BlockUnlocker.Interval)
+	}
+	if c.Payouts.Enabled {
+		duration("payouts.interval", c.Payouts.Interval)
+	}
+	if c.Payouts.Reconcile.Enabled {
+		duration("payouts.reconcile.interval", c.Payouts.Reconcile.Interval)
+		duration("payouts.reconcile.window", c.Payouts.Reconcile.Window)
+		duration("payouts.reconcile.dropAfter", c.Payouts.Reconcile.DropAfter)
+	}
+	if c.Ledger.Enabled && len(c.Ledger.CheckInterval) > 0 {
+		duration("ledger.checkInterval", c.Ledger.CheckInterval)
+	}
+	if c.RewardScheme.Type == "pplnsTime" {
+		duration("rewardScheme.window", c.RewardScheme.Window)
+	}
+	for _, v := range durations {
+		if _, err := time.ParseDuration(v[1]); err != nil {
+			return fmt.Errorf("Invalid %v: %v", v[0], err)
+		}
+	}
+	return nil
+}
+
+// Checks only live fields, the rest are not used until restart
+func (p *coinPool) validateLiveConfig(next *proxy.Config) error {
+	if len(next.Upstream) == 0 && !next.UpstreamPool.Enabled {
+		return errors.New("At least one upstream is required")
+	}
+	for _, v := range next.Upstream {
+		if len(v.Url) == 0 {
+			return fmt.Errorf("Upstream %v has no url", v.Name)
+		}
+		if _, err := time.ParseDuration(v.Timeout); err != nil {
+			return fmt.Errorf("Invalid timeout of upstream %v: %v", v.Name, err)
+		}
+	}
+	if p.proxyServer != nil {
+		if _, err := time.ParseDuration(next.Proxy.Policy.Limits.Grace); err != nil {
+			return fmt.Errorf("Invalid policy limits grace: %v", err)
+		}
+	}
+	if next.BlockUnlocker.PoolFee < 0 || next.BlockUnlocker.PoolFee >= 100 {
+		return fmt.Errorf("Invalid pool fee %v", next.BlockUnlocker.PoolFee)
+	}
+	if p.payer != nil && next.Payouts.Threshold <= 0 {
+		return fmt.Errorf("Invalid payout threshold %v", next.Payouts.Threshold)
+	}
+	if p.apiServer != nil {
+		if _, err := time.ParseDuration(next.Api.HashrateWindow); err != nil {
+			return fmt.Errorf("Invalid hashrate window: %v", err)
+		}
+		if _, err := time.ParseDuration(next.Api.HashrateLargeWindow); err != nil {
+			return fmt.Errorf("Invalid large hashrate window: %v", err)
+		}
+	}
+	return nil
+}
+
+func (p *coinPool) applyConfig(next *proxy.Config, applied []string) {
+	changed := func(prefix string) bool {
+		for _, path := range applied {
+			if path == prefix || strings.HasPrefix(path, prefix+".") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if changed("upstream") {
+		// Edge proxy doesn't mine on nodes
+		if p.proxyServer != nil && !p.running.UpstreamPool.Enabled {
+			p.proxyServer.SetUpstreams(next.Upstream)
+		}
+		p.running.Upstream = next.Upstream
+	}
+	if changed("proxy.policy") {
+		policy := next.Proxy.Policy
+		policy.Workers = p.running.Proxy.Policy.Workers
+		policy.ResetInterval = p.running.Proxy.Policy.ResetInterval
+		policy.RefreshInterval = p.running.Proxy.Policy.RefreshInterval
+		if p.proxyServer != nil {
+			p.proxyServer.ApplyPolicy(&policy)
+		}
+		if p.apiServer != nil {
+			p.apiServer.SetBlacklistFile(policy.Walletblacklist)
+		}
+		p.running.Proxy.Policy = policy
+	}
+	if changed("payouts.threshold") {
+		if p.payer != nil {
+			p.payer.SetThreshold(next.Payouts.Threshold)
+		}
+		p.running.Payouts.Threshold = next.Payouts.Threshold
+	}
+	if changed("unlocker.poolFee") {
+		if p.unlocker != nil {
+			p.unlocker.SetPoolFee(next.BlockUnlocker.PoolFee)
+		}
+		p.scheme.SetPoolFee(next.BlockUnlocker.PoolFee)
+		p.running.BlockUnlocker.PoolFee = next.BlockUnlocker.PoolFee
+	}
+	if changed("api.hashrateWindow") || changed("api.hashrateLargeWindow") || changed("api.luckWindow") {
+		p.running.Api.HashrateWindow = next.Api.HashrateWindow
+		p.running.Api.HashrateLargeWindow = next.Api.HashrateLargeWindow
+		p.running.Api.LuckWindow = next.Api.LuckWindow
+		if p.apiServer != nil {
+			p.apiServer.ApplyWindows(&p.running.Api)
+		}
+	}
+}
+
+func isLiveField(path string) bool {
+	for _, v := range restartPolicyFields {
+		if path == v {
+			return false
+		}
+	}
+	for _, v := range liveConfigFields {
+		if path == v || strings.HasPrefix(path, v+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Json paths of fields that differ, slices and maps are compared as a whole
+func diffConfig(path string, a, b reflect.Value) []string {
+	if a.Kind() != reflect.Struct {
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			return nil
+		}
+		return []string{path}
+	}
+	var changed []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if len(name) == 0 || name == "-" {
+			name = field.Name
+		}
+		if len(path) > 0 {
+			name = path + "." + name
+		}
+		changed = append(changed, diffConfig(name, a.Field(i), b.Field(i))...)
+	}
+	return changed
+}
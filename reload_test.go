@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yuriy0803/open-etc-pool-friends/proxy"
+)
+
+func TestIsLiveField(t *testing.T) {
+	tests := []struct {
+		path string
+		live bool
+	}{
+		{"upstream", true},
+		{"proxy.policy.banning.timeout", true},
+		{"proxy.policy.limits", true},
+		{"proxy.policy.workers", false},
+		{"proxy.policy.resetInterval", false},
+		{"proxy.policy.refreshInterval", false},
+		{"payouts.threshold", true},
+		{"payouts.thresholdMax", false},
+		{"unlocker.poolFee", true},
+		{"unlocker.poolFeeAddress", false},
+		{"api.hashrateWindow", true},
+		{"api.listen", false},
+		{"proxy.listen", false},
+		{"redis", false},
+	}
+	for _, tt := range tests {
+		if live := isLiveField(tt.path); live != tt.live {
+			t.Errorf("%v: expected live %v, got %v", tt.path, tt.live, live)
+		}
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	var a, b proxy.Config
+	a.Upstream = []proxy.Upstream{{Name: "main", Url: "http://127.0.0.1:8545", Timeout: "10s"}}
+	b.Upstream = []proxy.Upstream{{Name: "main", Url: "http://127.0.0.1:8545", Timeout: "10s"}}
+	if changed := diffConfig("", reflect.ValueOf(a), reflect.ValueOf(b)); len(changed) != 0 {
+		t.Fatalf("Expected equal configs, got %v", changed)
+	}
+
+	b.Upstream[0].Timeout = "5s"
+	b.Proxy.Policy.Banning.Timeout = 60
+	b.Proxy.Listen = "0.0.0.0:8888"
+	b.Api.Listen = "0.0.0.0:8080"
+	changed := diffConfig("", reflect.ValueOf(a), reflect.ValueOf(b))
+	expected := []string{"proxy.listen", "proxy.policy.banning.timeout", "api.listen", "upstream"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected changed %v, got %v", expected, changed)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	var c proxy.Config
+	if err := validateConfig(&c); err != nil {
+		t.Fatalf("Expected config without modules to be valid, got %v", err)
+	}
+
+	c.Payouts.Reconcile.Enabled = true
+	c.Payouts.Reconcile.Interval = "10m"
+	c.Payouts.Reconcile.Window = "24h"
+	c.Payouts.Reconcile.DropAfter = "1 hour"
+	if err := validateConfig(&c); err == nil {
+		t.Error("Expected invalid reconcile dropAfter to be refused")
+	}
+
+	c.Payouts.Reconcile.DropAfter = "1h"
+	c.Proxy.Enabled = true
+	c.Proxy.BlockRefreshInterval = "120ms"
+	c.Proxy.StateUpdateInterval = "3s"
+	c.Proxy.HashrateExpiration = "3h"
+	c.UpstreamCheckInterval = "5s"
+	c.Proxy.Policy.Limits.Grace = "5m"
+	c.Proxy.Policy.ResetInterval = "60m"
+	c.Proxy.Policy.RefreshInterval = "1m"
+	c.Proxy.Stratum = []proxy.Stratum{{Timeout: "bogus"}, {Enabled: true, Timeout: "120s"}}
+	if err := validateConfig(&c); err != nil {
+		t.Errorf("Expected timeout of disabled port to be ignored, got %v", err)
+	}
+
+	c.Proxy.Stratum[1].VarDiff = proxy.VarDiff{Enabled: true}
+	if err := validateConfig(&c); err == nil {
+		t.Error("Expected missing retarget interval to be refused")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	running := proxy.Config{Name: "main"}
+	running.Upstream = []proxy.Upstream{{Name: "main", Url: "http://127.0.0.1:8545", Timeout: "10s"}}
+	running.Api.Listen = "0.0.0.0:8080"
+	p := &coinPool{cfg: running, running: running}
+	pools = []*coinPool{p}
+	defer func() { pools = nil }()
+
+	configFileName = filepath.Join(t.TempDir(), "config.json")
+	write := func(data string) {
+		if err := os.WriteFile(configFileName, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Restart field is refused along with the rest of the file
+	write(`{"name": "main", "upstream": [{"name": "main", "url": "http://127.0.0.1:8546", "timeout": "10s"}],
+		"api": {"enabled": true, "listen": "0.0.0.0:8081", "hashrateWindow": "30m", "hashrateLargeWindow": "3h",
+		"statsCollectInterval": "5s", "purgeInterval": "never"}}`)
+	if _, err := reloadConfig(); err == nil {
+		t.Fatal("Expected config with invalid api purge interval to be refused")
+	}
+	if p.running.Upstream[0].Url != "http://127.0.0.1:8545" {
+		t.Fatal("Nothing must be applied from refused config")
+	}
+
+	write(`{"name": "main", "upstream": [{"name": "main", "url": "http://127.0.0.1:8546", "timeout": "10s"}],
+		"api": {"listen": "0.0.0.0:8081"}}`)
+	report, err := reloadConfig()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if !reflect.DeepEqual(report.Applied, []string{"upstream"}) || !reflect.DeepEqual(report.Restart, []string{"api.listen"}) {
+		t.Errorf("Unexpected reload report %+v", report)
+	}
+	if p.running.Upstream[0].Url != "http://127.0.0.1:8546" || p.running.Api.Listen != "0.0.0.0:8080" {
+		t.Errorf("Expected only live fields applied, got upstream %v and api on %v", p.running.Upstream[0].Url, p.running.Api.Listen)
+	}
+}
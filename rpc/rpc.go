@@ -11,11 +11,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/yuriy0803/open-etc-pool-friends/metrics"
 	"github.com/yuriy0803/open-etc-pool-friends/util"
 )
 
+var (
+	rpcDuration = metrics.NewHistogram("pool_rpc_request_duration_seconds", "Node RPC request latency.", nil, "coin", "upstream", "method")
+	rpcErrors   = metrics.NewCounter("pool_rpc_errors_total", "Failed node RPC requests.", "coin", "upstream", "method")
+)
+
 const (
 	// RPC method "eth_getWork"
 	RPCEthGetWork = "eth_getWork"
@@ -34,14 +41,19 @@ const (
 	RPCMethodQux = "qux"
 )
 
+// Weight of the latest request in smoothed latency and error rate
+const healthSmoothing = 0.1
+
 type RPCClient struct {
 	sync.RWMutex
-	Url         string
-	Name        string
-	sick        bool
-	sickRate    int
-	successRate int
-	client      *http.Client
+	Url  string
+	Name string
+	Coin string
+	// Smoothed over recent requests
+	latency   float64
+	errorRate float64
+	observed  bool
+	client    *http.Client
 }
 
 type GetBlockReply struct {
@@ -61,17 +73,19 @@ type GetBlockReply struct {
 }
 
 type GetBlockReplyPart struct {
-	Number     string `json:"number"`
-	Difficulty string `json:"difficulty"`
+	Number        string `json:"number"`
+	Difficulty    string `json:"difficulty"`
+	BaseFeePerGas string `json:"baseFeePerGas"`
 }
 
 const receiptStatusSuccessful = "0x1"
 
 type TxReceipt struct {
-	TxHash    string `json:"transactionHash"`
-	GasUsed   string `json:"gasUsed"`
-	BlockHash string `json:"blockHash"`
-	Status    string `json:"status"`
+	TxHash      string `json:"transactionHash"`
+	GasUsed     string `json:"gasUsed"`
+	BlockHash   string `json:"blockHash"`
+	BlockNumber string `json:"blockNumber"`
+	Status      string `json:"status"`
 }
 
 func (r *TxReceipt) Confirmed() bool {
@@ -90,6 +104,17 @@ type Tx struct {
 	Gas      string `json:"gas"`
 	GasPrice string `json:"gasPrice"`
 	Hash     string `json:"hash"`
+	Nonce    string `json:"nonce"`
+}
+
+// Error in node's reply, unlike transport errors the request was processed
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
 }
 
 type JSONRpcResp struct {
@@ -171,6 +196,20 @@ func (r *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
 	return nil, nil
 }
 
+// Nil if tx is unknown to node, neither mined nor pending
+func (r *RPCClient) GetTransactionByHash(hash string) (*Tx, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_getTransactionByHash", []string{hash})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result != nil {
+		var reply *Tx
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
+	}
+	return nil, nil
+}
+
 func (r *RPCClient) SubmitBlock(params []string) (bool, error) {
 	rpcResp, err := r.doPost(r.Url, "eth_submitWork", params)
 	if err != nil {
@@ -267,7 +306,136 @@ func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoG
 	return reply, err
 }
 
+func (r *RPCClient) EstimateGas(from, to, value, data string) (int64, error) {
+	params := map[string]string{
+		"from":  from,
+		"to":    to,
+		"value": value,
+		"data":  data,
+	}
+	rpcResp, err := r.doPost(r.Url, "eth_estimateGas", []interface{}{params})
+	if err != nil {
+		return 0, err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
+// Sends tx with call data, node picks gas price if it's empty
+func (r *RPCClient) SendContractTransaction(from, to, gas, gasPrice, value, data string) (string, error) {
+	params := map[string]string{
+		"from":  from,
+		"to":    to,
+		"gas":   gas,
+		"value": value,
+		"data":  data,
+	}
+	if len(gasPrice) > 0 {
+		params["gasPrice"] = gasPrice
+	}
+
+	rpcResp, err := r.doPost(r.Url, "eth_sendTransaction", []interface{}{params})
+	var reply string
+	if err != nil {
+		return reply, err
+	}
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return reply, err
+	}
+	if util.IsZeroHash(reply) {
+		err = errors.New("transaction is not yet available")
+	}
+	return reply, err
+}
+
+func (r *RPCClient) SendRawTransaction(raw string) (string, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_sendRawTransaction", []string{raw})
+	var reply string
+	if err != nil {
+		return reply, err
+	}
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Nonce of next tx of address, block is "latest" or "pending"
+func (r *RPCClient) GetTransactionCount(address, block string) (uint64, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_getTransactionCount", []string{address, block})
+	if err != nil {
+		return 0, err
+	}
+	var reply hexutil.Uint64
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return uint64(reply), err
+}
+
+func (r *RPCClient) GetChainId() (int64, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_chainId", nil)
+	if err != nil {
+		return 0, err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
+// Base fee of latest block in Wei, nil before London fork
+func (r *RPCClient) GetBaseFee() (*big.Int, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_getBlockByNumber", []interface{}{"latest", false})
+	if err != nil {
+		return nil, err
+	}
+	var reply *GetBlockReplyPart
+	if rpcResp.Result != nil {
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+	}
+	if err != nil || reply == nil || len(reply.BaseFeePerGas) == 0 {
+		return nil, err
+	}
+	return hexutil.DecodeBig(reply.BaseFeePerGas)
+}
+
+type FeeHistory struct {
+	OldestBlock string `json:"oldestBlock"`
+	// One more than blocks, last one is base fee of next block
+	BaseFeePerGas []string `json:"baseFeePerGas"`
+	// Tips paid in each block at requested percentiles
+	Reward [][]string `json:"reward"`
+}
+
+// Fee history of last blocks up to latest, percentiles of tips in 0-100
+func (r *RPCClient) GetFeeHistory(blocks int, percentiles []float64) (*FeeHistory, error) {
+	params := []interface{}{hexutil.EncodeUint64(uint64(blocks)), "latest", percentiles}
+	rpcResp, err := r.doPost(r.Url, "eth_feeHistory", params)
+	if err != nil {
+		return nil, err
+	}
+	var reply *FeeHistory
+	if rpcResp.Result != nil {
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+	}
+	if err == nil && reply == nil {
+		err = errors.New("empty fee history")
+	}
+	return reply, err
+}
+
 func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
+	start := time.Now()
+	defer rpcDuration.With(r.Coin, r.Name, method).ObserveSince(start)
+	failed := true
+	defer func() {
+		r.observe(time.Since(start), failed)
+	}()
+
 	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
 	data, _ := json.Marshal(jsonReq)
 
@@ -278,7 +446,7 @@ func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSON
 
 	resp, err := r.client.Do(req)
 	if err != nil {
-		r.markSick()
+		rpcErrors.With(r.Coin, r.Name, method).Inc()
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -286,48 +454,37 @@ func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSON
 	var rpcResp *JSONRpcResp
 	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
 	if err != nil {
-		r.markSick()
+		rpcErrors.With(r.Coin, r.Name, method).Inc()
 		return nil, err
 	}
 	if rpcResp.Error != nil {
-		r.markSick()
-		return nil, errors.New(rpcResp.Error["message"].(string))
+		rpcErrors.With(r.Coin, r.Name, method).Inc()
+		code, _ := rpcResp.Error["code"].(float64)
+		message, _ := rpcResp.Error["message"].(string)
+		return nil, &Error{Code: int(code), Message: message}
 	}
+	failed = false
 	return rpcResp, err
 }
 
-func (r *RPCClient) Check() bool {
-	_, err := r.GetWork()
-	if err != nil {
-		return false
-	}
-	r.markAlive()
-	return !r.Sick()
-}
-
-func (r *RPCClient) Sick() bool {
+// Smoothed request latency and share of failed requests
+func (r *RPCClient) Health() (time.Duration, float64) {
 	r.RLock()
 	defer r.RUnlock()
-	return r.sick
+	return time.Duration(r.latency), r.errorRate
 }
 
-func (r *RPCClient) markSick() {
-	r.Lock()
-	r.sickRate++
-	r.successRate = 0
-	if r.sickRate >= 5 {
-		r.sick = true
+func (r *RPCClient) observe(latency time.Duration, failed bool) {
+	var fail float64
+	if failed {
+		fail = 1
 	}
-	r.Unlock()
-}
-
-func (r *RPCClient) markAlive() {
 	r.Lock()
-	r.successRate++
-	if r.successRate >= 5 {
-		r.sick = false
-		r.sickRate = 0
-		r.successRate = 0
+	defer r.Unlock()
+	if !r.observed {
+		r.latency, r.errorRate, r.observed = float64(latency), fail, true
+		return
 	}
-	r.Unlock()
+	r.latency += healthSmoothing * (float64(latency) - r.latency)
+	r.errorRate += healthSmoothing * (fail - r.errorRate)
 }
@@ -0,0 +1,39 @@
+package rpc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthTracksFailures(t *testing.T) {
+	var fail int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) > 0 {
+			w.Write([]byte(`{"id":0,"error":{"code":-32000,"message":"no mining work available yet"}}`))
+			return
+		}
+		w.Write([]byte(`{"id":0,"result":"0x19"}`))
+	}))
+	defer srv.Close()
+	r := NewRPCClient("test", srv.URL, "1s")
+
+	if peers, err := r.GetPeerCount(); err != nil || peers != 25 {
+		t.Fatalf("Expected 25 peers, got %v: %v", peers, err)
+	}
+	if latency, errorRate := r.Health(); latency <= 0 || errorRate != 0 {
+		t.Errorf("Expected latency and no errors, got %v and %v", latency, errorRate)
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	for i := 0; i < 10; i++ {
+		if _, err := r.GetPeerCount(); err == nil {
+			t.Fatal("Expected node error")
+		}
+	}
+	_, errorRate := r.Health()
+	if errorRate < 0.6 || errorRate >= 1 {
+		t.Errorf("Expected error rate to grow smoothly, got %v", errorRate)
+	}
+}
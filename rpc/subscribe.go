@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// eth_subscribe event of every new chain head
+	NewHeads = "newHeads"
+	// eth_subscribe event of every transaction entering node pool
+	NewPendingTransactions = "newPendingTransactions"
+)
+
+var errSubscriptionClosed = errors.New("Subscription closed")
+
+// Notification of a node subscription
+type Event struct {
+	Kind   string
+	Result json.RawMessage
+}
+
+// Node events pushed over WebSocket or IPC connection
+type Subscription struct {
+	Name   string
+	client *gethrpc.Client
+	events chan *Event
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	once sync.Once
+	mu   sync.Mutex
+	err  error
+}
+
+// Connects to ws://, wss:// url or IPC socket path and subscribes to given events.
+// Events are delivered until connection fails or subscription is closed.
+func Subscribe(name, url string, timeout time.Duration, kinds ...string) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := gethrpc.DialContext(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{Name: name, client: client, events: make(chan *Event, 64), done: make(chan struct{})}
+	for _, kind := range kinds {
+		ch := make(chan json.RawMessage, 64)
+		sub, err := client.EthSubscribe(ctx, ch, kind)
+		if err != nil {
+			s.stop(err)
+			s.wg.Wait()
+			return nil, fmt.Errorf("Failed to subscribe to %v: %w", kind, err)
+		}
+		s.wg.Add(1)
+		go s.forward(kind, ch, sub)
+	}
+	go func() {
+		s.wg.Wait()
+		close(s.events)
+	}()
+	return s, nil
+}
+
+// Events are triggers for consumers, if they fall behind newer events are dropped
+func (s *Subscription) forward(kind string, ch <-chan json.RawMessage, sub *gethrpc.ClientSubscription) {
+	defer s.wg.Done()
+	for {
+		select {
+		case result := <-ch:
+			select {
+			case s.events <- &Event{Kind: kind, Result: result}:
+			default:
+			}
+		case err := <-sub.Err():
+			if err == nil {
+				err = fmt.Errorf("Node ended %v subscription", kind)
+			}
+			s.stop(err)
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// The first failure of any subscription ends all of them
+func (s *Subscription) stop(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+		s.client.Close()
+	})
+}
+
+// Closed once connection is lost
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Reason of lost connection
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) Close() error {
+	s.stop(errSubscriptionClosed)
+	return nil
+}
@@ -0,0 +1,111 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+// Pushes one event to every subscription made to it
+type testEthService struct{}
+
+func (s *testEthService) notifyOnce(ctx context.Context) (*gethrpc.Subscription, error) {
+	notifier, ok := gethrpc.NotifierFromContext(ctx)
+	if !ok {
+		return nil, gethrpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	// Buffered by notifier until subscription id is sent
+	notifier.Notify(sub.ID, map[string]string{"number": "0x64"})
+	return sub, nil
+}
+
+func (s *testEthService) NewHeads(ctx context.Context) (*gethrpc.Subscription, error) {
+	return s.notifyOnce(ctx)
+}
+
+func (s *testEthService) NewPendingTransactions(ctx context.Context) (*gethrpc.Subscription, error) {
+	return s.notifyOnce(ctx)
+}
+
+func newTestEthServer(t *testing.T) *gethrpc.Server {
+	srv := gethrpc.NewServer()
+	if err := srv.RegisterName("eth", new(testEthService)); err != nil {
+		t.Fatalf("Failed to register service: %v", err)
+	}
+	return srv
+}
+
+// Waits for events of both kinds, then ends subscription and expects its reason
+func checkEvents(t *testing.T, s *Subscription, end func()) {
+	kinds := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(kinds) < 2 {
+		select {
+		case e, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("Subscription ended early: %v", s.Err())
+			}
+			kinds[e.Kind] = true
+		case <-timeout:
+			t.Fatalf("Expected events of both subscriptions, got %v", kinds)
+		}
+	}
+	end()
+	for range s.Events() {
+	}
+	if s.Err() == nil {
+		t.Error("Expected ended subscription to report error")
+	}
+}
+
+func TestSubscribeWebSocket(t *testing.T) {
+	srv := newTestEthServer(t)
+	httpSrv := httptest.NewServer(srv.WebsocketHandler([]string{"*"}))
+	defer httpSrv.Close()
+
+	s, err := Subscribe("test", "ws"+strings.TrimPrefix(httpSrv.URL, "http"), time.Second, NewHeads, NewPendingTransactions)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	// Node goes away
+	checkEvents(t, s, srv.Stop)
+}
+
+func TestSubscribeIPC(t *testing.T) {
+	srv := newTestEthServer(t)
+	defer srv.Stop()
+	path := filepath.Join(t.TempDir(), "node.ipc")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	go srv.ServeListener(l)
+
+	s, err := Subscribe("test", path, time.Second, NewHeads, NewPendingTransactions)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	checkEvents(t, s, func() { s.Close() })
+}
+
+func TestSubscribeUnsupported(t *testing.T) {
+	srv := newTestEthServer(t)
+	defer srv.Stop()
+	httpSrv := httptest.NewServer(srv.WebsocketHandler([]string{"*"}))
+	defer httpSrv.Close()
+
+	if _, err := Subscribe("test", "ws"+strings.TrimPrefix(httpSrv.URL, "http"), time.Second, "logs"); err == nil {
+		t.Error("Expected subscription to unknown event to fail")
+	}
+	if _, err := Subscribe("test", httpSrv.URL, time.Second, NewHeads); err == nil {
+		t.Error("Expected subscription over HTTP to fail")
+	}
+}
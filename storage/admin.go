@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/yuriy0803/open-etc-pool-friends/ledger"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+const maxAuditEntries = 10000
+
+type Ban struct {
+	IP string `json:"ip"`
+	// Unix time in milliseconds, 0 is permanent
+	Until  int64  `json:"until"`
+	Reason string `json:"reason"`
+}
+
+func (b *Ban) Active(now int64) bool {
+	return b.Until == 0 || b.Until > now
+}
+
+type AuditEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Amount    int64  `json:"amount,omitempty"`
+	Details   string `json:"details,omitempty"`
+}
+
+type UnlockerState struct {
+	Halt      bool   `json:"halt"`
+	LastFail  string `json:"lastFail"`
+	UpdatedAt int64  `json:"updatedAt"`
+	// Un-halt requested via admin API and not yet picked up
+	UnhaltRequested bool `json:"unhaltRequested"`
+}
+
+// IP bans shared by all proxies, policy picks them up on state refresh
+func (r *RedisClient) WriteBan(ip string, until int64, reason string) error {
+	return r.client.HSet(r.formatKey("bans"), ip, join(until, reason)).Err()
+}
+
+func (r *RedisClient) DeleteBan(ip string) (bool, error) {
+	n, err := r.client.HDel(r.formatKey("bans"), ip).Result()
+	return n > 0, err
+}
+
+// Returns active bans, expired ones are removed
+func (r *RedisClient) GetBans() (map[string]*Ban, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("bans"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	now := util.MakeTimestamp()
+	bans := make(map[string]*Ban)
+	var expired []string
+	for ip, v := range cmd.Val() {
+		parts := strings.SplitN(v, ":", 2)
+		ban := &Ban{IP: ip}
+		ban.Until, _ = strconv.ParseInt(parts[0], 10, 64)
+		if len(parts) > 1 {
+			ban.Reason = parts[1]
+		}
+		if ban.Active(now) {
+			bans[ip] = ban
+		} else {
+			expired = append(expired, ip)
+		}
+	}
+	if len(expired) > 0 {
+		r.client.HDel(r.formatKey("bans"), expired...)
+	}
+	return bans, nil
+}
+
+// Wallets whose shares are skipped, in addition to policy blacklist file
+func (r *RedisClient) GetWalletBlacklist() ([]string, error) {
+	cmd := r.client.SMembers(r.formatKey("walletblacklist"))
+	if cmd.Err() != nil {
+		return []string{}, cmd.Err()
+	}
+	return cmd.Val(), nil
+}
+
+func (r *RedisClient) AddWalletBlacklist(login string) (bool, error) {
+	n, err := r.client.SAdd(r.formatKey("walletblacklist"), login).Result()
+	return n > 0, err
+}
+
+func (r *RedisClient) RemoveWalletBlacklist(login string) (bool, error) {
+	n, err := r.client.SRem(r.formatKey("walletblacklist"), login).Result()
+	return n > 0, err
+}
+
+// Replaces session snapshot of a proxy, it expires if proxy stops updating it
+func (r *RedisClient) WriteSessions(node string, sessions map[string]string, ttl time.Duration) error {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.Del(r.formatKey("sessions", node))
+		for id, v := range sessions {
+			tx.HSet(r.formatKey("sessions", node), id, v)
+		}
+		tx.Expire(r.formatKey("sessions", node), ttl)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetSessions(node string) (map[string]string, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("sessions", node))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return cmd.Val(), nil
+}
+
+func (r *RedisClient) KickSession(node, id string) error {
+	return r.client.SAdd(r.formatKey("sessions", node, "kick"), id).Err()
+}
+
+// Returns sessions admin asked to disconnect since last call
+func (r *RedisClient) PopKickedSessions(node string) ([]string, error) {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.SMembers(r.formatKey("sessions", node, "kick"))
+		tx.Del(r.formatKey("sessions", node, "kick"))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cmds[0].(*redis.StringSliceCmd).Val(), nil
+}
+
+func (r *RedisClient) WriteUnlockerState(halt bool, lastFail error) error {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	fail := ""
+	if lastFail != nil {
+		fail = lastFail.Error()
+	}
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.formatKey("unlocker"), "halt", strconv.FormatBool(halt))
+		tx.HSet(r.formatKey("unlocker"), "lastFail", fail)
+		tx.HSet(r.formatKey("unlocker"), "updatedAt", strconv.FormatInt(util.MakeTimestamp()/1000, 10))
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetUnlockerState() (*UnlockerState, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("unlocker"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	v := cmd.Val()
+	state := &UnlockerState{LastFail: v["lastFail"]}
+	state.Halt, _ = strconv.ParseBool(v["halt"])
+	state.UpdatedAt, _ = strconv.ParseInt(v["updatedAt"], 10, 64)
+	state.UnhaltRequested, _ = r.client.SIsMember(r.formatKey("unhalt"), "unlocker").Result()
+	return state, nil
+}
+
+// Asks halted module, "unlocker" or "payouts", to resume on its next run
+func (r *RedisClient) RequestUnhalt(module string) error {
+	return r.client.SAdd(r.formatKey("unhalt"), module).Err()
+}
+
+// True once per un-halt request
+func (r *RedisClient) PopUnhaltRequest(module string) (bool, error) {
+	n, err := r.client.SRem(r.formatKey("unhalt"), module).Result()
+	return n > 0, err
+}
+
+// Manual credit or debit of miner's balance, amount in Shannon
+// Debit exceeding balance is refused, balance is watched so it can't change
+// between the check and the write. Returns balance after adjustment, or current one if refused.
+func (r *RedisClient) AdjustBalance(login string, amount int64) (int64, bool, error) {
+	minerKey := r.formatKey("miners", login)
+	tx, err := r.client.Watch(minerKey)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Close()
+
+	balance, err := tx.HGet(minerKey, "balance").Int64()
+	if err != nil && err != redis.Nil {
+		return 0, false, err
+	}
+	if balance+amount < 0 {
+		return balance, false, nil
+	}
+	err = r.withLedger(ledger.KindAdjust, login, creditPostings(login, amount, ledger.PoolAdjustments), func() error {
+		_, err := tx.Exec(func() error {
+			tx.HIncrBy(minerKey, "balance", amount)
+			tx.HIncrBy(minerKey, "adjusted", amount)
+			tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+			tx.HIncrBy(r.formatKey("finances"), "adjusted", amount)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return balance, false, err
+	}
+	return balance + amount, true, nil
+}
+
+func (r *RedisClient) WriteAudit(entry *AuditEntry) error {
+	entry.Timestamp = util.MakeTimestamp() / 1000
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.LPush(r.formatKey("admin", "audit"), string(data))
+		tx.LTrim(r.formatKey("admin", "audit"), 0, maxAuditEntries-1)
+		return nil
+	})
+	return err
+}
+
+// Latest audit entries first
+func (r *RedisClient) GetAudit(max int64) ([]*AuditEntry, error) {
+	cmd := r.client.LRange(r.formatKey("admin", "audit"), 0, max-1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make([]*AuditEntry, 0, len(cmd.Val()))
+	for _, v := range cmd.Val() {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(v), &entry); err == nil {
+			result = append(result, &entry)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"math/big"
+	"time"
+)
+
+// Shares and block candidates submitted by miners
+type ShareBackend interface {
+	// True if share is a duplicate. Reward in Shannon is credited with the share (PPS family).
+	WriteShare(login, id string, params []string, diff int64, shareDiffCalc int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error)
+	WriteBlock(login, id string, params []string, diff, shareDiffCalc int64, roundDiff int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error)
+	// Duplicates are reported by position and not credited
+	WriteShares(shares []*Share) ([]bool, error)
+	WriteWorkerShareStatus(login string, id string, valid bool, stale bool, invalid bool)
+	GetAvgTxFees() (int64, error)
+}
+
+// Upstream node state and stratum sessions published by proxies
+type NodeBackend interface {
+	WriteNodeState(id string, height uint64, diff *big.Int, blocktime float64) error
+	WriteNodeMetrics(id string, metrics map[string]int64) error
+	WriteNodeUpstreams(id string, upstreams []*UpstreamState) error
+	GetNodeStates() ([]map[string]interface{}, error)
+	WriteSessions(node string, sessions map[string]string, ttl time.Duration) error
+	GetSessions(node string) (map[string]string, error)
+	KickSession(node, id string) error
+	PopKickedSessions(node string) ([]string, error)
+}
+
+// IP bans and access lists shared by all proxies
+type PolicyBackend interface {
+	GetBans() (map[string]*Ban, error)
+	WriteBan(ip string, until int64, reason string) error
+	DeleteBan(ip string) (bool, error)
+	GetBlacklist() ([]string, error)
+	GetWhitelist() ([]string, error)
+	GetWalletBlacklist() ([]string, error)
+	AddWalletBlacklist(login string) (bool, error)
+	RemoveWalletBlacklist(login string) (bool, error)
+}
+
+// Block candidates, their rounds and crediting of rewards by unlocker
+type BlockBackend interface {
+	GetCandidates(maxHeight int64) ([]*BlockData, error)
+	GetImmatureBlocks(maxHeight int64) ([]*BlockData, error)
+	GetRoundShares(height int64, nonce string) (map[string]int64, error)
+	WritePendingOrphans(blocks []*BlockData) error
+	WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error
+	WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error
+	WriteOrphan(block *BlockData) error
+	WriteReward(login string, amount int64, percent *big.Rat, immature bool, block *BlockData) error
+	UpdateAvgTxFees(fees int64) error
+	BgSave() (string, error)
+}
+
+// Miner balances, payouts and their reconciliation
+type BalanceBackend interface {
+	GetPayees() ([]string, error)
+	GetBalance(login string) (int64, error)
+	GetTreshold(login string) (int64, error)
+	// False if threshold was already changed at ts or later
+	SetTreshold(login string, threshold, ts int64) (bool, error)
+	GetTresholdHistory(login string) ([]*ThresholdChange, error)
+	LockPayouts(login string, amount int64) error
+	UnlockPayouts() error
+	IsPayoutsLocked() (bool, error)
+	GetPendingPayments() []*PendingPayment
+	UpdateBalance(login string, amount int64) error
+	UpdateBalances(payments []*PendingPayment) error
+	RollbackBalance(login string, amount int64) error
+	RollbackBalances(payments []*PendingPayment) error
+	WritePayment(login, txHash string, amount int64) error
+	WriteBatchPayment(txHash string, payments []*PendingPayment) error
+	ReplacePayment(oldTxHash, newTxHash string, payments []*PendingPayment) error
+	AdjustBalance(login string, amount int64) (int64, bool, error)
+	GetUnreconciledPayments(since int64) (map[string][]*LoggedPayment, error)
+	MarkPaymentConfirmed(txHash string) error
+	WritePaymentNonce(txHash string, nonce uint64) error
+	GetPaymentNonce(txHash string) (uint64, bool, error)
+	GetReplacedTxs(txHash string) ([]string, error)
+	RevertPayment(txHash, status string, payments []*LoggedPayment) (bool, error)
+	GetFailedPayments(max int64) ([]*LoggedPayment, error)
+	GetOwedBalance() (int64, error)
+	WriteReconcileState(state *ReconcileState) error
+	GetReconcileState() (*ReconcileState, error)
+	CheckLedger() (*LedgerCheck, error)
+}
+
+// Halt state of modules and audit trail of admin actions
+type AdminBackend interface {
+	WriteUnlockerState(halt bool, lastFail error) error
+	GetUnlockerState() (*UnlockerState, error)
+	RequestUnhalt(module string) error
+	PopUnhaltRequest(module string) (bool, error)
+	WriteAudit(entry *AuditEntry) error
+	GetAudit(max int64) ([]*AuditEntry, error)
+}
+
+// Stats and charts served by API
+type StatsBackend interface {
+	WritePoolCharts(time1 int64, time2 string, poolHash string) error
+	WriteDiffCharts(time1 int64, time2 string, netHash string) error
+	WriteMinerCharts(time1 int64, time2, k string, hash, largeHash, workerOnline int64) error
+	WriteShareCharts(time1 int64, time2, login string, valid, stale, workerOnline int64) error
+	GetPoolCharts(poolHashLen int64) ([]*PoolCharts, error)
+	GetNetCharts(netHashLen int64) ([]*NetCharts, error)
+	GetMinerCharts(hashNum int64, login string) ([]*MinerCharts, error)
+	GetShareCharts(shareNum int64, login string) ([]*ShareCharts, error)
+	GetPaymentCharts(login string) ([]*PaymentCharts, error)
+	GetAllMinerAccount() ([]string, error)
+	DeleteOldMinerData() error
+	DeleteOldShareData() error
+	IsMinerExists(login string) (bool, error)
+	GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error)
+	FlushStaleStats(staleDuration, largeWindow time.Duration) (int64, error)
+	CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error)
+	CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error)
+	CollectLuckStats(windows []int) (map[string]interface{}, error)
+	CollectLuckCharts(max int) ([]*LuckCharts, error)
+	StoreExchangeData(ExchangeData []map[string]interface{})
+}
+
+// Everything modules keep in storage
+type Backend interface {
+	ShareBackend
+	NodeBackend
+	PolicyBackend
+	BlockBackend
+	BalanceBackend
+	AdminBackend
+	StatsBackend
+	Check() (string, error)
+}
+
+var _ Backend = (*RedisClient)(nil)
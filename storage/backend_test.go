@@ -0,0 +1,580 @@
+package storage
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Backend implementations must behave the same for modules using them
+type conformanceBackend interface {
+	ShareBackend
+	NodeBackend
+	PolicyBackend
+	BlockBackend
+	BalanceBackend
+	AdminBackend
+	SetShareWindow(window ShareWindow, d time.Duration)
+}
+
+type backendFactory func(t *testing.T) conformanceBackend
+
+func backends(t *testing.T) map[string]backendFactory {
+	result := map[string]backendFactory{
+		"memory": func(t *testing.T) conformanceBackend {
+			return NewMemoryBackend(100)
+		},
+	}
+	// Embedded Redis unless a server is given, keys are removed after each test
+	result["redis"] = func(t *testing.T) conformanceBackend {
+		return newTestRedis(t, &Config{Endpoint: testRedisEndpoint(t), PoolSize: 2})
+	}
+	result["cluster"] = func(t *testing.T) conformanceBackend {
+		return newTestRedis(t, &Config{ClusterEnabled: true, ClusterAddrs: testClusterAddrs(t), PoolSize: 2})
+	}
+	return result
+}
+
+// Nodes of REDIS_CLUSTER_TEST_ADDRS or embedded server owning all slots
+func testClusterAddrs(t *testing.T) []string {
+	if addrs := os.Getenv("REDIS_CLUSTER_TEST_ADDRS"); len(addrs) > 0 {
+		return strings.Split(addrs, ",")
+	}
+	return []string{runTestCluster(t).Addr()}
+}
+
+// Server of REDIS_TEST_ENDPOINT or embedded one running Lua scripts like Redis does
+func testRedisEndpoint(t *testing.T) string {
+	if endpoint := os.Getenv("REDIS_TEST_ENDPOINT"); len(endpoint) > 0 {
+		return endpoint
+	}
+	return miniredis.RunT(t).Addr()
+}
+
+func newTestRedis(t *testing.T, cfg *Config) *RedisClient {
+	prefix := "conformance" + strconv.FormatInt(util.MakeTimestamp(), 10)
+	r := NewRedisClient(cfg, prefix, 100, "test")
+	if _, err := r.Check(); err != nil {
+		t.Fatalf("Redis is unreachable: %v", err)
+	}
+	cleanupRedis(t, r)
+	return r
+}
+
+func cleanupRedis(t *testing.T, r *RedisClient) {
+	t.Cleanup(func() {
+		if keys, err := r.client.Keys(r.formatKey("*")).Result(); err == nil && len(keys) > 0 {
+			r.client.Del(keys...)
+		}
+		r.client.Close()
+	})
+}
+
+func runConformance(t *testing.T, test func(t *testing.T, b conformanceBackend)) {
+	for name, factory := range backends(t) {
+		factory := factory
+		t.Run(name, func(t *testing.T) {
+			test(t, factory(t))
+		})
+	}
+}
+
+func TestBackendPayments(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		login := "0xa"
+		if _, _, err := b.AdjustBalance(login, 1000); err != nil {
+			t.Fatalf("Failed to credit balance: %v", err)
+		}
+		if err := b.LockPayouts(login, 600); err != nil {
+			t.Fatalf("Failed to lock payouts: %v", err)
+		}
+		if err := b.LockPayouts(login, 600); err == nil {
+			t.Error("Expected second lock to fail")
+		}
+		if err := b.UpdateBalance(login, 600); err != nil {
+			t.Fatalf("Failed to debit balance: %v", err)
+		}
+		pending := b.GetPendingPayments()
+		if len(pending) != 1 || pending[0].Address != login || pending[0].Amount != 600 {
+			t.Fatalf("Expected pending payment of 600 to %v, got %v", login, pending)
+		}
+		if owed, _ := b.GetOwedBalance(); owed != 1000 {
+			t.Errorf("Expected 1000 owed while payment is pending, got %v", owed)
+		}
+
+		if err := b.WritePayment(login, "0xtx", 600); err != nil {
+			t.Fatalf("Failed to log payment: %v", err)
+		}
+		if locked, _ := b.IsPayoutsLocked(); locked {
+			t.Error("Expected payouts to be unlocked after payment")
+		}
+		if len(b.GetPendingPayments()) != 0 {
+			t.Error("Expected no pending payments after payment")
+		}
+		if balance, _ := b.GetBalance(login); balance != 400 {
+			t.Errorf("Expected balance of 400, got %v", balance)
+		}
+
+		txs, err := b.GetUnreconciledPayments(0)
+		if err != nil || len(txs["0xtx"]) != 1 {
+			t.Fatalf("Expected logged payment to be unreconciled, got %v, %v", txs, err)
+		}
+		ok, err := b.RevertPayment("0xtx", PaymentFailed, txs["0xtx"])
+		if err != nil || !ok {
+			t.Fatalf("Failed to revert payment: %v", err)
+		}
+		if ok, _ := b.RevertPayment("0xtx", PaymentFailed, txs["0xtx"]); ok {
+			t.Error("Expected reverted payment to be credited back only once")
+		}
+		if balance, _ := b.GetBalance(login); balance != 1000 {
+			t.Errorf("Expected balance of 1000 after revert, got %v", balance)
+		}
+		failed, _ := b.GetFailedPayments(10)
+		if len(failed) != 1 || failed[0].Status != PaymentFailed {
+			t.Errorf("Expected failed payment, got %v", failed)
+		}
+		if txs, _ := b.GetUnreconciledPayments(0); len(txs) != 0 {
+			t.Errorf("Expected no unreconciled payments, got %v", txs)
+		}
+	})
+}
+
+func TestBackendPaymentNonces(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		if _, ok, err := b.GetPaymentNonce("0xtx"); err != nil || ok {
+			t.Fatalf("Expected no nonce of unknown tx, got %v %v", ok, err)
+		}
+		b.WritePaymentNonce("0xtx", 5)
+		if nonce, ok, _ := b.GetPaymentNonce("0xtx"); !ok || nonce != 5 {
+			t.Errorf("Expected nonce 5, got %v %v", nonce, ok)
+		}
+
+		payments := []*PendingPayment{{Address: "0xa", Amount: 600}}
+		b.ReplacePayment("0xtx", "0xtx2", payments)
+		b.ReplacePayment("0xtx2", "0xtx3", payments)
+		if replaced, _ := b.GetReplacedTxs("0xtx3"); len(replaced) != 1 || replaced[0] != "0xtx2" {
+			t.Errorf("Expected 0xtx3 to replace 0xtx2, got %v", replaced)
+		}
+		if replaced, _ := b.GetReplacedTxs("0xtx"); len(replaced) != 0 {
+			t.Errorf("Expected 0xtx to replace nothing, got %v", replaced)
+		}
+	})
+}
+
+func TestBackendAdjustBalance(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		if balance, ok, err := b.AdjustBalance("0xa", -1); err != nil || ok || balance != 0 {
+			t.Fatalf("Expected debit of empty balance to be refused, got %v %v %v", balance, ok, err)
+		}
+		if balance, ok, _ := b.AdjustBalance("0xa", 1000); !ok || balance != 1000 {
+			t.Fatalf("Expected balance of 1000 after credit, got %v", balance)
+		}
+
+		// Concurrent debits never take balance below zero
+		var wg sync.WaitGroup
+		var debited int64
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, ok, _ := b.AdjustBalance("0xa", -300); ok {
+					atomic.AddInt64(&debited, 300)
+				}
+			}()
+		}
+		wg.Wait()
+		balance, _ := b.GetBalance("0xa")
+		if balance < 0 || balance != 1000-debited {
+			t.Errorf("Expected balance of %v after debits, got %v", 1000-debited, balance)
+		}
+	})
+}
+
+func TestBackendThresholds(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		tests := []struct {
+			threshold, ts int64
+			ok            bool
+		}{
+			{500000000, 100, true},
+			{600000000, 100, false},
+			{700000000, 90, false},
+			{800000000, 110, true},
+		}
+		for _, tt := range tests {
+			if ok, err := b.SetTreshold("0xa", tt.threshold, tt.ts); err != nil || ok != tt.ok {
+				t.Errorf("Threshold %v at %v: expected %v, got %v %v", tt.threshold, tt.ts, tt.ok, ok, err)
+			}
+		}
+
+		// Concurrent uses of one signed change set it once
+		var wg sync.WaitGroup
+		var set int64
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, _ := b.SetTreshold("0xa", 900000000, 120); ok {
+					atomic.AddInt64(&set, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if set != 1 {
+			t.Errorf("Expected threshold to be set once, got %v", set)
+		}
+
+		if threshold, _ := b.GetTreshold("0xa"); threshold != 900000000 {
+			t.Errorf("Expected threshold 900000000, got %v", threshold)
+		}
+		history, _ := b.GetTresholdHistory("0xa")
+		if len(history) != 3 || history[0].Timestamp != 120 || history[1].Timestamp != 110 || history[2].Threshold != 500000000 {
+			t.Errorf("Expected three changes newest first, got %+v", history)
+		}
+	})
+}
+
+func TestBackendBatchRollback(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		b.AdjustBalance("0xa", 500)
+		b.AdjustBalance("0xb", 700)
+		payments := []*PendingPayment{{Address: "0xa", Amount: 500}, {Address: "0xb", Amount: 700}}
+
+		if err := b.LockPayouts("batch", 1200); err != nil {
+			t.Fatalf("Failed to lock payouts: %v", err)
+		}
+		if err := b.UpdateBalances(payments); err != nil {
+			t.Fatalf("Failed to debit balances: %v", err)
+		}
+		if len(b.GetPendingPayments()) != 2 {
+			t.Fatalf("Expected 2 pending payments, got %v", b.GetPendingPayments())
+		}
+		if err := b.RollbackBalances(payments); err != nil {
+			t.Fatalf("Failed to roll back balances: %v", err)
+		}
+		if locked, _ := b.IsPayoutsLocked(); locked {
+			t.Error("Expected payouts to be unlocked after rollback")
+		}
+		for _, v := range payments {
+			if balance, _ := b.GetBalance(v.Address); balance != v.Amount {
+				t.Errorf("Expected balance of %v to be %v, got %v", v.Address, v.Amount, balance)
+			}
+		}
+		if owed, _ := b.GetOwedBalance(); owed != 1200 {
+			t.Errorf("Expected 1200 owed, got %v", owed)
+		}
+	})
+}
+
+func TestBackendBlockLifecycle(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		b.SetShareWindow(WindowRound, 0)
+		height := uint64(100)
+
+		exist, err := b.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 3000, 3000, height, time.Minute, "", 3000, false, 0)
+		if err != nil || exist {
+			t.Fatalf("Failed to write share: %v, %v", exist, err)
+		}
+		exist, _ = b.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 3000, 3000, height, time.Minute, "", 3000, false, 0)
+		if !exist {
+			t.Error("Expected duplicate share to be detected")
+		}
+		b.WriteShare("0xb", "rig", []string{"0x2", "0xh2", "0xm2"}, 1000, 1000, height, time.Minute, "", 1000, false, 0)
+		exist, err = b.WriteBlock("0xb", "rig", []string{"0x3", "0xh3", "0xm3"}, 1000, 90000, 50000, height, time.Minute, "", 1000, false, 0)
+		if err != nil || exist {
+			t.Fatalf("Failed to write block: %v, %v", exist, err)
+		}
+
+		candidates, err := b.GetCandidates(int64(height))
+		if err != nil || len(candidates) != 1 {
+			t.Fatalf("Expected a candidate, got %v, %v", candidates, err)
+		}
+		block := candidates[0]
+		if block.Finder != "0xb" || block.Nonce != "0x3" || block.TotalShares != 5000 || block.Difficulty != 50000 {
+			t.Errorf("Unexpected candidate %+v", block)
+		}
+		shares, _ := b.GetRoundShares(block.RoundHeight, block.Nonce)
+		if shares["0xa"] != 3000 || shares["0xb"] != 2000 {
+			t.Errorf("Unexpected round shares %v", shares)
+		}
+
+		// Unlocker found block one height later
+		block.Height = block.RoundHeight + 1
+		block.Hash = "0xblock"
+		block.Reward = new(big.Int).Mul(big.NewInt(5000), util.Shannon)
+		rewards := map[string]int64{"0xa": 3000, "0xb": 2000}
+		if err := b.WriteImmatureBlock(block, rewards); err != nil {
+			t.Fatalf("Failed to write immature block: %v", err)
+		}
+		if candidates, _ := b.GetCandidates(int64(height) + 1); len(candidates) != 0 {
+			t.Errorf("Expected no candidates, got %v", candidates)
+		}
+		if shares, _ := b.GetRoundShares(block.Height, block.Nonce); shares["0xa"] != 3000 {
+			t.Errorf("Expected round to move to block height, got %v", shares)
+		}
+
+		immature, err := b.GetImmatureBlocks(int64(height) + 1)
+		if err != nil || len(immature) != 1 || immature[0].Hash != "0xblock" {
+			t.Fatalf("Expected an immature block, got %v, %v", immature, err)
+		}
+		block = immature[0]
+		block.Reward = new(big.Int).Mul(big.NewInt(5000), util.Shannon)
+		if err := b.WriteMaturedBlock(block, rewards); err != nil {
+			t.Fatalf("Failed to write matured block: %v", err)
+		}
+		if immature, _ := b.GetImmatureBlocks(int64(height) + 1); len(immature) != 0 {
+			t.Errorf("Expected no immature blocks, got %v", immature)
+		}
+		if shares, _ := b.GetRoundShares(block.Height, block.Nonce); len(shares) != 0 {
+			t.Errorf("Expected round to be removed, got %v", shares)
+		}
+		for login, amount := range rewards {
+			if balance, _ := b.GetBalance(login); balance != amount {
+				t.Errorf("Expected balance of %v to be %v, got %v", login, amount, balance)
+			}
+		}
+		if owed, _ := b.GetOwedBalance(); owed != 5000 {
+			t.Errorf("Expected 5000 owed, got %v", owed)
+		}
+	})
+}
+
+func TestBackendShareWindows(t *testing.T) {
+	// Multiples of PPLNS unit keep window entries deterministic
+	unit := int64(pplnsShareUnit)
+	windows := map[string]struct {
+		window ShareWindow
+		round  map[string]int64
+	}{
+		"lastShares": {WindowLastShares, map[string]int64{"0xa": 2, "0xb": 1}},
+		"time":       {WindowTime, map[string]int64{"0xa": 2 * unit, "0xb": unit}},
+		"finder":     {WindowFinder, map[string]int64{"0xb": 1}},
+	}
+	for name, w := range windows {
+		w := w
+		t.Run(name, func(t *testing.T) {
+			runConformance(t, func(t *testing.T, b conformanceBackend) {
+				b.SetShareWindow(w.window, time.Minute)
+				height := uint64(300)
+				b.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 2*unit, 2*unit, height, time.Minute, "", 2*unit, false, 0)
+				exist, err := b.WriteBlock("0xb", "rig", []string{"0x2", "0xh2", "0xm2"}, unit, 90000, 50000, height, time.Minute, "", unit, false, 0)
+				if err != nil || exist {
+					t.Fatalf("Failed to write block: %v, %v", exist, err)
+				}
+				if exist, _ := b.WriteBlock("0xb", "rig", []string{"0x2", "0xh2", "0xm2"}, unit, 90000, 50000, height, time.Minute, "", unit, false, 0); !exist {
+					t.Error("Expected duplicate block to be detected")
+				}
+
+				candidates, _ := b.GetCandidates(int64(height))
+				if len(candidates) != 1 {
+					t.Fatalf("Expected a candidate, got %v", candidates)
+				}
+				if block := candidates[0]; block.TotalShares != 3*unit || block.PersonalShares != unit || block.Worker != "rig" || block.ShareDiffCalc != 90000 {
+					t.Errorf("Unexpected candidate %+v", block)
+				}
+				shares, _ := b.GetRoundShares(int64(height), "0x2")
+				if len(shares) != len(w.round) {
+					t.Errorf("Expected round shares %v, got %v", w.round, shares)
+				}
+				for login, n := range w.round {
+					if shares[login] != n {
+						t.Errorf("Expected round shares %v, got %v", w.round, shares)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestBackendWriteShares(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		b.SetShareWindow(WindowRound, 0)
+		height := uint64(400)
+		b.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 3000, 3000, height, time.Minute, "", 3000, false, 0)
+
+		shares := []*Share{
+			{Login: "0xa", Id: "rig", Params: []string{"0x1", "0xh1", "0xm1"}, Diff: 3000, Height: height, Expire: time.Minute},
+			{Login: "0xa", Id: "rig", Params: []string{"0x2", "0xh2", "0xm2"}, Diff: 1000, Height: height, Expire: time.Minute},
+			{Login: "0xb", Id: "rig", Params: []string{"0x3", "0xh3", "0xm3"}, Diff: 2000, Height: height, Expire: time.Minute},
+			{Login: "0xa", Id: "rig2", Params: []string{"0x4", "0xh4", "0xm4"}, Diff: 500, Height: height, Expire: time.Minute},
+			{Login: "0xc", Id: "rig", Params: []string{"0x5", "0xh5", "0xm5"}, Diff: 4000, Height: height, Expire: time.Minute, Solo: true},
+		}
+		duplicates, err := b.WriteShares(shares)
+		if err != nil {
+			t.Fatalf("Failed to write shares: %v", err)
+		}
+		for i, dup := range duplicates {
+			if dup != (i == 0) {
+				t.Errorf("Unexpected duplicates %v", duplicates)
+				break
+			}
+		}
+
+		b.WriteBlock("0xb", "rig", []string{"0x6", "0xh6", "0xm6"}, 1000, 90000, 50000, height, time.Minute, "", 1000, false, 0)
+		candidates, _ := b.GetCandidates(int64(height))
+		if len(candidates) != 1 || candidates[0].TotalShares != 7500 || candidates[0].PersonalShares != 3000 {
+			t.Fatalf("Expected candidate with 7500 shares, got %v", candidates)
+		}
+		round, _ := b.GetRoundShares(int64(height), "0x6")
+		if len(round) != 2 || round["0xa"] != 4500 || round["0xb"] != 3000 {
+			t.Errorf("Expected batched shares in round, got %v", round)
+		}
+	})
+}
+
+func TestBackendShareRewards(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		height := uint64(500)
+		b.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 1000, 1000, height, time.Minute, "", 1000, false, 10)
+		if exist, _ := b.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 1000, 1000, height, time.Minute, "", 1000, false, 10); !exist {
+			t.Error("Expected duplicate share to be detected")
+		}
+		b.WriteBlock("0xb", "rig", []string{"0x2", "0xh2", "0xm2"}, 1000, 90000, 50000, height, time.Minute, "", 1000, false, 20)
+		duplicates, err := b.WriteShares([]*Share{
+			{Login: "0xa", Id: "rig", Params: []string{"0x1", "0xh1", "0xm1"}, Diff: 1000, Height: height, Expire: time.Minute, Reward: 10},
+			{Login: "0xa", Id: "rig", Params: []string{"0x3", "0xh3", "0xm3"}, Diff: 1000, Height: height, Expire: time.Minute, Reward: 5},
+			{Login: "0xb", Id: "rig", Params: []string{"0x4", "0xh4", "0xm4"}, Diff: 1000, Height: height, Expire: time.Minute, Reward: 7},
+		})
+		if err != nil || !duplicates[0] {
+			t.Fatalf("Expected first share of batch to be a duplicate, got %v, %v", duplicates, err)
+		}
+
+		// Duplicates aren't credited
+		for login, amount := range map[string]int64{"0xa": 15, "0xb": 27} {
+			if balance, _ := b.GetBalance(login); balance != amount {
+				t.Errorf("Expected balance of %v to be %v, got %v", login, amount, balance)
+			}
+		}
+		if owed, _ := b.GetOwedBalance(); owed != 42 {
+			t.Errorf("Expected 42 owed, got %v", owed)
+		}
+	})
+}
+
+func TestBackendSoloBlock(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		height := uint64(200)
+		b.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 4000, 4000, height, time.Minute, "", 4000, true, 0)
+		b.WriteShare("0xb", "rig", []string{"0x2", "0xh2", "0xm2"}, 1000, 1000, height, time.Minute, "", 1000, false, 0)
+		b.WriteBlock("0xa", "rig", []string{"0x3", "0xh3", "0xm3"}, 1000, 90000, 50000, height, time.Minute, "", 1000, true, 0)
+
+		candidates, _ := b.GetCandidates(int64(height))
+		if len(candidates) != 1 || !candidates[0].Solo || candidates[0].TotalShares != 5000 {
+			t.Fatalf("Expected solo candidate with 5000 shares, got %v", candidates)
+		}
+		shares, _ := b.GetRoundShares(int64(height), "0x3")
+		if len(shares) != 1 || shares["0xa"] != 5000 {
+			t.Errorf("Expected finder to take the whole round, got %v", shares)
+		}
+	})
+}
+
+func TestBackendPolicy(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		now := util.MakeTimestamp()
+		b.WriteBan("10.0.0.1", 0, "abuse")
+		b.WriteBan("10.0.0.2", now+60000, "flood")
+		b.WriteBan("10.0.0.3", now-1, "expired")
+
+		bans, err := b.GetBans()
+		if err != nil || len(bans) != 2 || bans["10.0.0.1"].Reason != "abuse" {
+			t.Fatalf("Expected 2 active bans, got %v, %v", bans, err)
+		}
+		if ok, _ := b.DeleteBan("10.0.0.2"); !ok {
+			t.Error("Expected ban to be removed")
+		}
+		if ok, _ := b.DeleteBan("10.0.0.3"); ok {
+			t.Error("Expected expired ban to be gone")
+		}
+
+		if ok, _ := b.AddWalletBlacklist("0xbad"); !ok {
+			t.Error("Expected wallet to be blacklisted")
+		}
+		if ok, _ := b.AddWalletBlacklist("0xbad"); ok {
+			t.Error("Expected wallet to be blacklisted once")
+		}
+		if list, _ := b.GetWalletBlacklist(); len(list) != 1 || list[0] != "0xbad" {
+			t.Errorf("Unexpected wallet blacklist %v", list)
+		}
+		if ok, _ := b.RemoveWalletBlacklist("0xbad"); !ok {
+			t.Error("Expected wallet to be removed from blacklist")
+		}
+	})
+}
+
+func TestBackendNodeStates(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		b.WriteNodeState("proxy1", 100, big.NewInt(2000), 13.5)
+		b.WriteNodeMetrics("proxy1", map[string]int64{"verified": 5})
+		b.WriteNodeUpstreams("proxy1", []*UpstreamState{
+			{Name: "main", Active: true, Healthy: true, Score: 0.9, Height: 100},
+			{Name: "backup", Score: 0.2, Height: 95, Lag: 5},
+		})
+		nodes, err := b.GetNodeStates()
+		if err != nil || len(nodes) != 1 {
+			t.Fatalf("Expected 1 node, got %v: %v", nodes, err)
+		}
+		node := nodes[0]
+		if node["height"] != "100" || node["verified"] != "5" {
+			t.Errorf("Unexpected node state %v", node)
+		}
+		upstreams, ok := node["upstreams"].([]*UpstreamState)
+		if !ok || len(upstreams) != 2 {
+			t.Fatalf("Expected 2 upstreams, got %v", node["upstreams"])
+		}
+		if !upstreams[0].Active || upstreams[1].Lag != 5 {
+			t.Errorf("Unexpected upstreams %+v %+v", upstreams[0], upstreams[1])
+		}
+	})
+}
+
+func TestBackendSessionsAndAdmin(t *testing.T) {
+	runConformance(t, func(t *testing.T, b conformanceBackend) {
+		b.WriteSessions("proxy1", map[string]string{"aa": "{}", "bb": "{}"}, time.Minute)
+		if sessions, _ := b.GetSessions("proxy1"); len(sessions) != 2 {
+			t.Errorf("Expected 2 sessions, got %v", sessions)
+		}
+		b.WriteSessions("proxy1", map[string]string{"cc": "{}"}, time.Minute)
+		if sessions, _ := b.GetSessions("proxy1"); len(sessions) != 1 {
+			t.Errorf("Expected sessions to be replaced, got %v", sessions)
+		}
+
+		b.KickSession("proxy1", "cc")
+		b.KickSession("proxy1", "cc")
+		if ids, _ := b.PopKickedSessions("proxy1"); len(ids) != 1 || ids[0] != "cc" {
+			t.Errorf("Expected kicked session cc, got %v", ids)
+		}
+		if ids, _ := b.PopKickedSessions("proxy1"); len(ids) != 0 {
+			t.Errorf("Expected kicked sessions to be popped once, got %v", ids)
+		}
+
+		b.WriteUnlockerState(true, errors.New("node down"))
+		b.RequestUnhalt("unlocker")
+		state, _ := b.GetUnlockerState()
+		if !state.Halt || state.LastFail != "node down" || !state.UnhaltRequested {
+			t.Errorf("Unexpected unlocker state %+v", state)
+		}
+		if ok, _ := b.PopUnhaltRequest("unlocker"); !ok {
+			t.Error("Expected un-halt request")
+		}
+		if ok, _ := b.PopUnhaltRequest("unlocker"); ok {
+			t.Error("Expected un-halt request to be popped once")
+		}
+
+		b.WriteAudit(&AuditEntry{Actor: "test", Action: "first"})
+		b.WriteAudit(&AuditEntry{Actor: "test", Action: "second"})
+		if audit, _ := b.GetAudit(1); len(audit) != 1 || audit[0].Action != "second" {
+			t.Errorf("Expected latest audit entry first, got %v", audit)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// Commands used by RedisClient, both single node and cluster clients implement them.
+// Keep it in sync when using new commands, it is the only place to touch on client upgrade.
+type redisClient interface {
+	Ping() *redis.StatusCmd
+	BgSave() (string, error)
+	Multi() (*redis.Multi, error)
+	Watch(keys ...string) (*redis.Multi, error)
+	Keys(pattern string) *redis.StringSliceCmd
+	Scan(cursor int64, match string, count int64) (int64, []string, error)
+	Del(keys ...string) *redis.IntCmd
+	Exists(key string) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	HGet(key, field string) *redis.StringCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HIncrBy(key, field string, incr int64) *redis.IntCmd
+	HMGet(key string, fields ...string) *redis.SliceCmd
+	LLen(key string) *redis.IntCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	SAdd(key string, members ...string) *redis.IntCmd
+	SIsMember(key string, member interface{}) *redis.BoolCmd
+	SMembers(key string) *redis.StringSliceCmd
+	SRem(key string, members ...string) *redis.IntCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZRangeByScoreWithScores(key string, opt redis.ZRangeByScore) *redis.ZSliceCmd
+	ZRemRangeByScore(key, min, max string) *redis.IntCmd
+	ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	ZScore(key, member string) *redis.FloatCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args []string) *redis.Cmd
+	ScriptExists(scripts ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+	Close() error
+}
+
+// In cluster mode every key of the pool carries {prefix} hash tag, so all of them
+// live in a single slot. Transactions keep spanning miners, finances, stats and
+// rounds like on a single node, cluster gives failover and room for more pools.
+// A pool never outgrows a single shard, its memory and load stay on one master.
+type clusterClient struct {
+	*redis.ClusterClient
+	// Never written, only used to find the node owning pool slot
+	slotKey string
+}
+
+// Single instance or sentinel client, transaction can't fail to start there
+type nodeClient struct {
+	*redis.Client
+}
+
+func (c *nodeClient) Multi() (*redis.Multi, error) {
+	return c.Client.Multi(), nil
+}
+
+func (c *nodeClient) Scan(cursor int64, match string, count int64) (int64, []string, error) {
+	return c.Client.Scan(cursor, match, count).Result()
+}
+
+func (c *nodeClient) BgSave() (string, error) {
+	return c.Client.BgSave().Result()
+}
+
+func newClusterClient(cfg *Config, prefix string) *clusterClient {
+	opts := &redis.ClusterOptions{
+		Addrs:    cfg.ClusterAddrs,
+		Password: cfg.Password,
+		PoolSize: cfg.PoolSize,
+	}
+	return &clusterClient{
+		ClusterClient: redis.NewClusterClient(opts),
+		slotKey:       join(clusterPrefix(prefix), "slot"),
+	}
+}
+
+func clusterPrefix(prefix string) string {
+	return "{" + prefix + "}"
+}
+
+// Cluster client has no Multi, transaction is bound to the node owning pool slot.
+// Watched key is never modified, so it never fails the transaction.
+// Fails if the owner is unreachable, no other node may take writes of the pool.
+func (c *clusterClient) Multi() (*redis.Multi, error) {
+	tx, err := c.ClusterClient.Watch(c.slotKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach owner of %v slot: %v", c.slotKey, err)
+	}
+	return tx, nil
+}
+
+// SCAN has no key and would go to a random node, run it on the pool node instead
+func (c *clusterClient) Scan(cursor int64, match string, count int64) (int64, []string, error) {
+	tx, err := c.Multi()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Close()
+	return tx.Scan(cursor, match, count).Result()
+}
+
+// Snapshot the node holding pool data
+func (c *clusterClient) BgSave() (string, error) {
+	tx, err := c.Multi()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Close()
+	return tx.BgSave().Result()
+}
+
+// Copies keys of a single instance or sentinel setup into the cluster with hash-tagged layout.
+// Source is left untouched, stop all pool processes before running it.
+func MigrateToCluster(cfg *Config, prefix string) (int, error) {
+	if len(cfg.ClusterAddrs) == 0 {
+		return 0, fmt.Errorf("No cluster addresses configured")
+	}
+	source := newNodeClient(cfg)
+	defer source.Close()
+	target := newClusterClient(cfg, prefix)
+	defer target.Close()
+
+	var cursor int64
+	var migrated int
+	for {
+		var keys []string
+		var err error
+		cursor, keys, err = source.Scan(cursor, join(prefix, "*"), 1000).Result()
+		if err != nil {
+			return migrated, err
+		}
+		for _, key := range keys {
+			if err := migrateKey(source, target, key, clusterPrefix(prefix)+key[len(prefix):]); err != nil {
+				return migrated, fmt.Errorf("Failed to migrate %v: %v", key, err)
+			}
+			migrated++
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	return migrated, nil
+}
+
+func migrateKey(source *redis.Client, target *clusterClient, key, newKey string) error {
+	data, err := source.Dump(key).Result()
+	if err == redis.Nil {
+		// Expired while scanning
+		return nil
+	} else if err != nil {
+		return err
+	}
+	ttl, err := source.PTTL(key).Result()
+	if err != nil {
+		return err
+	}
+	// Negative for keys without expiration, zero keeps key forever on restore
+	if ttl < 0 {
+		ttl = 0
+	}
+	return target.RestoreReplace(newKey, ttl, data).Err()
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Embedded server owning all slots, client checks cluster state before use
+func runTestCluster(t *testing.T) *miniredis.Miniredis {
+	m := miniredis.RunT(t)
+	m.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "CLUSTER" && len(args) == 1 && strings.ToUpper(args[0]) == "INFO" {
+			c.WriteBulk("cluster_state:ok\r\n")
+			return true
+		}
+		return false
+	})
+	return m
+}
+
+// Embedded servers have no DUMP and RESTORE, keys are serialized by the test instead of in Redis format
+type dumpedKey struct {
+	Type   string             `json:"type"`
+	String string             `json:"string,omitempty"`
+	Hash   map[string]string  `json:"hash,omitempty"`
+	Set    []string           `json:"set,omitempty"`
+	ZSet   map[string]float64 `json:"zset,omitempty"`
+	List   []string           `json:"list,omitempty"`
+}
+
+func registerDumpRestore(m *miniredis.Miniredis) {
+	m.Server().Register("DUMP", func(c *server.Peer, cmd string, args []string) {
+		key := args[0]
+		if !m.Exists(key) {
+			c.WriteNull()
+			return
+		}
+		d := dumpedKey{Type: m.Type(key)}
+		switch d.Type {
+		case "string":
+			d.String, _ = m.Get(key)
+		case "hash":
+			d.Hash = make(map[string]string)
+			fields, _ := m.HKeys(key)
+			for _, f := range fields {
+				d.Hash[f] = m.HGet(key, f)
+			}
+		case "set":
+			d.Set, _ = m.Members(key)
+		case "zset":
+			d.ZSet = make(map[string]float64)
+			members, _ := m.ZMembers(key)
+			for _, member := range members {
+				d.ZSet[member], _ = m.ZScore(key, member)
+			}
+		case "list":
+			d.List, _ = m.List(key)
+		}
+		data, _ := json.Marshal(d)
+		c.WriteBulk(string(data))
+	})
+	// RESTORE key ttl value REPLACE
+	m.Server().Register("RESTORE", func(c *server.Peer, cmd string, args []string) {
+		key := args[0]
+		var d dumpedKey
+		if err := json.Unmarshal([]byte(args[2]), &d); err != nil {
+			c.WriteError("ERR DUMP payload version or checksum are wrong")
+			return
+		}
+		m.Del(key)
+		switch d.Type {
+		case "string":
+			m.Set(key, d.String)
+		case "hash":
+			for f, v := range d.Hash {
+				m.HSet(key, f, v)
+			}
+		case "set":
+			m.SAdd(key, d.Set...)
+		case "zset":
+			for member, score := range d.ZSet {
+				m.ZAdd(key, score, member)
+			}
+		case "list":
+			m.Push(key, d.List...)
+		}
+		if ttl, _ := strconv.ParseInt(args[1], 10, 64); ttl > 0 {
+			m.SetTTL(key, time.Duration(ttl)*time.Millisecond)
+		}
+		c.WriteOK()
+	})
+}
+
+func TestMigrateToCluster(t *testing.T) {
+	endpoint, addrs := os.Getenv("REDIS_TEST_ENDPOINT"), os.Getenv("REDIS_CLUSTER_TEST_ADDRS")
+	var source, target *miniredis.Miniredis
+	if len(endpoint) == 0 || len(addrs) == 0 {
+		source, target = miniredis.RunT(t), runTestCluster(t)
+		registerDumpRestore(source)
+		registerDumpRestore(target)
+		endpoint, addrs = source.Addr(), target.Addr()
+	}
+	prefix := "migration" + strconv.FormatInt(util.MakeTimestamp(), 10)
+	cfg := &Config{Endpoint: endpoint, ClusterAddrs: strings.Split(addrs, ","), PoolSize: 2}
+
+	r := NewRedisClient(cfg, prefix, 100, "test")
+	cleanupRedis(t, r)
+	r.AdjustBalance("0xa", 1000)
+	r.LockPayouts("0xa", 600)
+	r.WriteSessions("proxy1", map[string]string{"1": "{}"}, time.Hour)
+	r.SetTreshold("0xa", 500000000, 100)
+	// Keys of other pools stay behind
+	other := NewRedisClient(cfg, prefix+"other", 100, "test")
+	cleanupRedis(t, other)
+	other.AdjustBalance("0xa", 1)
+
+	n, err := MigrateToCluster(cfg, prefix)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	sourceKeys, _ := r.client.Keys(r.formatKey("*")).Result()
+	if n == 0 || n != len(sourceKeys) {
+		t.Fatalf("Expected %v keys to be migrated, got %v", len(sourceKeys), n)
+	}
+
+	cfg.ClusterEnabled = true
+	migrated := NewRedisClient(cfg, prefix, 100, "test")
+	cleanupRedis(t, migrated)
+	if balance, _ := migrated.GetBalance("0xa"); balance != 1000 {
+		t.Errorf("Expected migrated balance of 1000, got %v", balance)
+	}
+	if locked, _ := migrated.IsPayoutsLocked(); !locked {
+		t.Error("Expected payouts lock to be migrated")
+	}
+	if sessions, _ := migrated.GetSessions("proxy1"); sessions["1"] != "{}" {
+		t.Errorf("Expected sessions to be migrated, got %v", sessions)
+	}
+	if history, _ := migrated.GetTresholdHistory("0xa"); len(history) != 1 || history[0].Threshold != 500000000 {
+		t.Errorf("Expected threshold history to be migrated, got %+v", history)
+	}
+	if target == nil {
+		return
+	}
+
+	// Every key gets hash tag of the pool, expiration is kept
+	for _, key := range sourceKeys {
+		newKey := "{" + prefix + "}" + strings.TrimPrefix(key, prefix)
+		if !target.Exists(newKey) {
+			t.Errorf("Expected %v to be migrated as %v", key, newKey)
+		}
+	}
+	if keys := target.Keys(); len(keys) != len(sourceKeys) {
+		t.Errorf("Expected only keys of the pool in cluster, got %v", keys)
+	}
+	if ttl := target.TTL(migrated.formatKey("sessions", "proxy1")); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Expected sessions to expire within an hour, got %v", ttl)
+	}
+	if ttl := target.TTL(migrated.formatKey("miners", "0xa")); ttl != 0 {
+		t.Errorf("Expected miner not to expire, got %v", ttl)
+	}
+}
+
+func TestClusterOwnerUnreachable(t *testing.T) {
+	m := runTestCluster(t)
+	r := NewRedisClient(&Config{ClusterAddrs: []string{m.Addr()}, ClusterEnabled: true, PoolSize: 1}, "unreachable", 100, "test")
+	tx, err := r.client.Multi()
+	if err != nil {
+		t.Fatalf("Expected transaction on reachable owner, got %v", err)
+	}
+	tx.Close()
+	m.Close()
+
+	// Writes of the pool must not go to any other node
+	if _, err := r.client.Multi(); err == nil {
+		t.Error("Expected transaction to fail with slot owner down")
+	}
+	if err := r.LockPayouts("0xa", 600); err == nil {
+		t.Error("Expected payouts lock to fail with slot owner down")
+	}
+	if _, err := r.BgSave(); err == nil {
+		t.Error("Expected snapshot to fail with slot owner down")
+	}
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/yuriy0803/open-etc-pool-friends/ledger"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+var ledgerFields = []string{ledger.AccountBalance, ledger.AccountPending, ledger.AccountPaid}
+
+type LedgerMismatch struct {
+	// Empty for pool totals in finances
+	Login  string `json:"login,omitempty"`
+	Field  string `json:"field"`
+	Redis  int64  `json:"redis"`
+	Ledger int64  `json:"ledger"`
+}
+
+type LedgerCheck struct {
+	CheckedAt  int64             `json:"checkedAt"`
+	Consistent bool              `json:"consistent"`
+	Mismatches []*LedgerMismatch `json:"mismatches"`
+}
+
+// Every balance change is recorded in SQL ledger too. Empty ledger starts with
+// current counters of all miners.
+func (r *RedisClient) SetLedger(l *ledger.Ledger) error {
+	r.ledger = l
+	ok, err := l.HasOpening()
+	if err != nil || ok {
+		return err
+	}
+	return r.writeOpeningBalances()
+}
+
+func (r *RedisClient) writeOpeningBalances() error {
+	logins, err := r.GetPayees()
+	if err != nil {
+		return err
+	}
+	var postings []ledger.Posting
+	total := int64(0)
+	for _, login := range logins {
+		counters, err := r.getMinerCounters(login)
+		if err != nil {
+			return err
+		}
+		for _, field := range ledgerFields {
+			total += counters[field]
+			postings = append(postings, ledger.Posting{Account: ledger.Account(field, login), Amount: counters[field]})
+		}
+	}
+	postings = append(postings, ledger.Posting{Account: ledger.PoolOpening, Amount: -total})
+	log.Printf("Writing opening balances of %v miners to ledger, %v Shannon", len(logins), total)
+	return r.ledger.Record(ledger.KindOpening, "redis", postings)
+}
+
+// Writes postings to ledger and runs Redis transaction as one operation.
+// Nothing reaches Redis if ledger fails, ledger is rolled back if Redis fails.
+func (r *RedisClient) withLedger(kind, reference string, postings []ledger.Posting, exec func() error) error {
+	if r.ledger == nil {
+		return exec()
+	}
+	tx, err := r.ledger.Begin(kind, reference, postings)
+	if err != nil {
+		return fmt.Errorf("Failed to write %v to ledger: %v", kind, err)
+	}
+	if err := exec(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		// Redis is already changed, ledger check reports the difference
+		log.Printf("CRITICAL: %v %v is written to Redis, but ledger commit failed: %v", kind, reference, err)
+	}
+	return nil
+}
+
+func creditPostings(login string, amount int64, source string) []ledger.Posting {
+	return []ledger.Posting{
+		{Account: ledger.Account(ledger.AccountBalance, login), Amount: amount},
+		{Account: source, Amount: -amount},
+	}
+}
+
+func debitPostings(login string, amount int64) []ledger.Posting {
+	return []ledger.Posting{
+		{Account: ledger.Account(ledger.AccountBalance, login), Amount: -amount},
+		{Account: ledger.Account(ledger.AccountPending, login), Amount: amount},
+	}
+}
+
+func creditBackPostings(login string, amount int64) []ledger.Posting {
+	return []ledger.Posting{
+		{Account: ledger.Account(ledger.AccountPending, login), Amount: -amount},
+		{Account: ledger.Account(ledger.AccountBalance, login), Amount: amount},
+	}
+}
+
+func paymentPostings(login string, amount int64) []ledger.Posting {
+	return []ledger.Posting{
+		{Account: ledger.Account(ledger.AccountPending, login), Amount: -amount},
+		{Account: ledger.Account(ledger.AccountPaid, login), Amount: amount},
+	}
+}
+
+func revertPostings(login string, amount int64) []ledger.Posting {
+	return []ledger.Posting{
+		{Account: ledger.Account(ledger.AccountPaid, login), Amount: -amount},
+		{Account: ledger.Account(ledger.AccountBalance, login), Amount: amount},
+	}
+}
+
+func (r *RedisClient) getMinerCounters(login string) (map[string]int64, error) {
+	return r.getCounters(r.formatKey("miners", login))
+}
+
+func (r *RedisClient) getCounters(key string) (map[string]int64, error) {
+	values, err := r.client.HMGet(key, ledgerFields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64)
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			result[ledgerFields[i]], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return result, nil
+}
+
+// Compares balance, pending and paid counters of every miner and finances with ledger
+func (r *RedisClient) CheckLedger() (*LedgerCheck, error) {
+	if r.ledger == nil {
+		return nil, fmt.Errorf("Ledger is not enabled")
+	}
+	accounts, err := r.ledger.Balances()
+	if err != nil {
+		return nil, err
+	}
+	logins, err := r.GetPayees()
+	if err != nil {
+		return nil, err
+	}
+	check := &LedgerCheck{Mismatches: []*LedgerMismatch{}}
+	totals := make(map[string]int64)
+	for _, login := range logins {
+		counters, err := r.getMinerCounters(login)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range ledgerFields {
+			account := ledger.Account(field, login)
+			totals[field] += accounts[account]
+			if counters[field] != accounts[account] {
+				check.Mismatches = append(check.Mismatches, &LedgerMismatch{Login: login, Field: field, Redis: counters[field], Ledger: accounts[account]})
+			}
+		}
+	}
+	finances, err := r.getCounters(r.formatKey("finances"))
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range ledgerFields {
+		if finances[field] != totals[field] {
+			check.Mismatches = append(check.Mismatches, &LedgerMismatch{Field: field, Redis: finances[field], Ledger: totals[field]})
+		}
+	}
+	check.CheckedAt = util.MakeTimestamp() / 1000
+	check.Consistent = len(check.Mismatches) == 0
+	return check, nil
+}
@@ -0,0 +1,1097 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+// Keeps shares, blocks, balances, payments and policy lists in memory, mirroring
+// what RedisClient does with them, for tests without a Redis server.
+// Stats and charts of API are not kept.
+type MemoryBackend struct {
+	mu         sync.Mutex
+	pplns      int64
+	window     ShareWindow
+	windowTime time.Duration
+
+	// Counters of miners:<login> and finances
+	miners   map[string]map[string]int64
+	finances map[string]int64
+	stats    map[string]int64
+
+	// PoW of recent shares by height, for duplicate check
+	pow          map[string]uint64
+	roundCurrent map[string]int64
+	// Latest first, as lastshares list
+	lastShares []string
+	timeShares []*memoryShare
+	soloShares map[string]int64
+	rounds     map[string]map[string]int64
+
+	candidates      map[string]*BlockData
+	immature        map[string]*BlockData
+	matured         map[string]*BlockData
+	immatureCredits map[string]map[string]int64
+
+	payoutsLock string
+	pending     map[string]*PendingPayment
+	payments    map[string]*LoggedPayment
+	failed      []*LoggedPayment
+	statuses    map[string]string
+	replaced    map[string]string
+	nonces      map[string]uint64
+	thresholds  map[string][]*ThresholdChange
+	reconcile   ReconcileState
+
+	nodes           map[string]map[string]string
+	sessions        map[string]map[string]string
+	sessionsExpire  map[string]int64
+	kicked          map[string]map[string]struct{}
+	bans            map[string]*Ban
+	walletBlacklist map[string]struct{}
+
+	unlocker UnlockerState
+	unhalt   map[string]struct{}
+	audit    []*AuditEntry
+}
+
+type memoryShare struct {
+	login string
+	diff  int64
+	ms    int64
+}
+
+var _ interface {
+	ShareBackend
+	NodeBackend
+	PolicyBackend
+	BlockBackend
+	BalanceBackend
+	AdminBackend
+} = (*MemoryBackend)(nil)
+
+func NewMemoryBackend(pplns int64) *MemoryBackend {
+	return &MemoryBackend{
+		pplns:           pplns,
+		miners:          make(map[string]map[string]int64),
+		finances:        make(map[string]int64),
+		stats:           make(map[string]int64),
+		pow:             make(map[string]uint64),
+		roundCurrent:    make(map[string]int64),
+		soloShares:      make(map[string]int64),
+		rounds:          make(map[string]map[string]int64),
+		candidates:      make(map[string]*BlockData),
+		immature:        make(map[string]*BlockData),
+		matured:         make(map[string]*BlockData),
+		immatureCredits: make(map[string]map[string]int64),
+		pending:         make(map[string]*PendingPayment),
+		payments:        make(map[string]*LoggedPayment),
+		statuses:        make(map[string]string),
+		replaced:        make(map[string]string),
+		nonces:          make(map[string]uint64),
+		thresholds:      make(map[string][]*ThresholdChange),
+		nodes:           make(map[string]map[string]string),
+		sessions:        make(map[string]map[string]string),
+		sessionsExpire:  make(map[string]int64),
+		kicked:          make(map[string]map[string]struct{}),
+		bans:            make(map[string]*Ban),
+		walletBlacklist: make(map[string]struct{}),
+		unhalt:          make(map[string]struct{}),
+	}
+}
+
+// Same as RedisClient.SetShareWindow
+func (m *MemoryBackend) SetShareWindow(window ShareWindow, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.window = window
+	m.windowTime = d
+}
+
+func (m *MemoryBackend) Check() (string, error) {
+	return "PONG", nil
+}
+
+func (m *MemoryBackend) BgSave() (string, error) {
+	return "OK", nil
+}
+
+func (m *MemoryBackend) miner(login string) map[string]int64 {
+	miner, ok := m.miners[login]
+	if !ok {
+		miner = make(map[string]int64)
+		m.miners[login] = miner
+	}
+	return miner
+}
+
+func (m *MemoryBackend) round(height int64, nonce string) map[string]int64 {
+	key := join(height, nonce)
+	round, ok := m.rounds[key]
+	if !ok {
+		round = make(map[string]int64)
+		m.rounds[key] = round
+	}
+	return round
+}
+
+func (m *MemoryBackend) powExists(height uint64, params []string) bool {
+	for k, v := range m.pow {
+		if height >= 8 && v < height-8 {
+			delete(m.pow, k)
+		}
+	}
+	key := strings.Join(params, ":")
+	if _, ok := m.pow[key]; ok {
+		return true
+	}
+	m.pow[key] = height
+	return false
+}
+
+func (m *MemoryBackend) WriteShare(login, id string, params []string, diff int64, shareDiffCalc int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.powExists(height, params) {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	if solo {
+		m.writeSoloShare(ms/1000, login, diff, shareDiffCalc)
+		return false, nil
+	}
+	m.writeShare(ms, login, diff, shareDiffCalc)
+	m.stats["roundShares"] += diff
+	m.creditShareReward(login, reward)
+	return false, nil
+}
+
+func (m *MemoryBackend) WriteShares(shares []*Share) ([]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ms := util.MakeTimestamp()
+	duplicates := make([]bool, len(shares))
+	for i, v := range shares {
+		if m.powExists(v.Height, v.Params) {
+			duplicates[i] = true
+			continue
+		}
+		if v.Solo {
+			m.writeSoloShare(ms/1000, v.Login, v.Diff, v.ShareDiffCalc)
+			continue
+		}
+		m.writeShare(ms, v.Login, v.Diff, v.ShareDiffCalc)
+		m.stats["roundShares"] += v.Diff
+		m.creditShareReward(v.Login, v.Reward)
+	}
+	return duplicates, nil
+}
+
+func (m *MemoryBackend) WriteBlock(login, id string, params []string, diff, shareDiffCalc int64, roundDiff int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.powExists(height, params) {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+	if solo {
+		m.writeSoloBlock(ts, login, id, params, diff, shareDiffCalc, roundDiff, height)
+		return false, nil
+	}
+	m.writeShare(ms, login, diff, shareDiffCalc)
+	m.creditShareReward(login, reward)
+	personalShares := m.roundCurrent[login]
+	m.stats["lastBlockFound"] = ts
+	delete(m.stats, "roundShares")
+	m.miner(login)["roundShares"] = 0
+	m.miner(login)["blocksFound"]++
+	sharesMap := m.roundCurrent
+	m.roundCurrent = make(map[string]int64)
+
+	round := m.round(int64(height), params[0])
+	switch m.window {
+	case WindowRound:
+		for k, v := range sharesMap {
+			round[k] += v
+		}
+	case WindowTime:
+		for _, v := range m.timeShares {
+			if v.ms >= ms-m.windowTime.Milliseconds() {
+				round[v.login] += v.diff
+			}
+		}
+	case WindowFinder:
+		round[login] += 1
+	default:
+		for _, v := range m.lastShares {
+			round[v] += 1
+		}
+	}
+
+	totalShares := int64(0)
+	for _, v := range sharesMap {
+		totalShares += v
+	}
+	key := join(strings.Join(params, ":"), ts, roundDiff, totalShares, login, shareDiffCalc, id, personalShares)
+	m.candidates[key] = &BlockData{
+		Height:         int64(height),
+		Nonce:          params[0],
+		PowHash:        params[1],
+		MixDigest:      params[2],
+		Timestamp:      ts,
+		Difficulty:     roundDiff,
+		TotalShares:    totalShares,
+		Finder:         login,
+		ShareDiffCalc:  shareDiffCalc,
+		Worker:         id,
+		PersonalShares: personalShares,
+	}
+	return false, nil
+}
+
+func (m *MemoryBackend) writeShare(ms int64, login string, diff, shareDiffCalc int64) {
+	for i := pplnsWeight(diff); i > 0; i-- {
+		m.lastShares = append([]string{login}, m.lastShares...)
+	}
+	if int64(len(m.lastShares)) > m.pplns+1 {
+		m.lastShares = m.lastShares[:m.pplns+1]
+	}
+	if m.window == WindowTime {
+		m.timeShares = append(m.timeShares, &memoryShare{login: login, diff: diff, ms: ms})
+		for len(m.timeShares) > 0 && m.timeShares[0].ms < ms-m.windowTime.Milliseconds() {
+			m.timeShares = m.timeShares[1:]
+		}
+	}
+	m.miner(login)["roundShares"] += diff
+	m.roundCurrent[login] += diff
+	m.miner(login)["lastShare"] = ms / 1000
+	m.miner(login)["lastShareDiff"] = shareDiffCalc
+}
+
+func (m *MemoryBackend) writeSoloShare(ts int64, login string, diff, shareDiffCalc int64) {
+	m.soloShares[login] += diff
+	m.miner(login)["lastShare"] = ts
+	m.miner(login)["lastShareDiff"] = shareDiffCalc
+}
+
+func (m *MemoryBackend) writeSoloBlock(ts int64, login, id string, params []string, diff, shareDiffCalc, roundDiff int64, height uint64) {
+	m.writeSoloShare(ts, login, diff, shareDiffCalc)
+	m.miner(login)["soloBlocksFound"]++
+	roundShares := m.soloShares[login]
+	delete(m.soloShares, login)
+
+	m.round(int64(height), params[0])[login] += roundShares
+	key := join(strings.Join(params, ":"), ts, roundDiff, roundShares, login, shareDiffCalc, id, roundShares, true)
+	m.candidates[key] = &BlockData{
+		Height:         int64(height),
+		Nonce:          params[0],
+		PowHash:        params[1],
+		MixDigest:      params[2],
+		Timestamp:      ts,
+		Difficulty:     roundDiff,
+		TotalShares:    roundShares,
+		Finder:         login,
+		ShareDiffCalc:  shareDiffCalc,
+		Worker:         id,
+		PersonalShares: roundShares,
+		Solo:           true,
+	}
+}
+
+func (m *MemoryBackend) creditShareReward(login string, amount int64) {
+	if amount <= 0 {
+		return
+	}
+	m.miner(login)["balance"] += amount
+	m.miner(login)["shareRewards"] += amount
+	m.finances["balance"] += amount
+	m.finances["shareRewards"] += amount
+}
+
+// Share status counters are stats, not kept
+func (m *MemoryBackend) WriteWorkerShareStatus(login string, id string, valid bool, stale bool, invalid bool) {
+}
+
+func (m *MemoryBackend) GetAvgTxFees() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.finances["avgTxFees"], nil
+}
+
+func (m *MemoryBackend) UpdateAvgTxFees(fees int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	avg := m.finances["avgTxFees"]
+	if avg == 0 {
+		avg = fees
+	} else {
+		avg += (fees - avg) / 10
+	}
+	m.finances["avgTxFees"] = avg
+	return nil
+}
+
+// Ordered by height like a sorted set
+func sortedBlocks(blocks map[string]*BlockData, maxHeight int64) []string {
+	var keys []string
+	for k, v := range blocks {
+		if v.Height >= 0 && v.Height <= maxHeight {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := blocks[keys[i]], blocks[keys[j]]
+		if a.Height != b.Height {
+			return a.Height < b.Height
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func (m *MemoryBackend) GetCandidates(maxHeight int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []*BlockData
+	for _, k := range sortedBlocks(m.candidates, maxHeight) {
+		v := m.candidates[k]
+		result = append(result, &BlockData{
+			Height:         v.Height,
+			RoundHeight:    v.Height,
+			Nonce:          v.Nonce,
+			PowHash:        v.PowHash,
+			MixDigest:      v.MixDigest,
+			Timestamp:      v.Timestamp,
+			Difficulty:     v.Difficulty,
+			TotalShares:    v.TotalShares,
+			Finder:         v.Finder,
+			ShareDiffCalc:  v.ShareDiffCalc,
+			Worker:         v.Worker,
+			PersonalShares: v.PersonalShares,
+			Solo:           v.Solo,
+			candidateKey:   k,
+		})
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []*BlockData
+	for _, k := range sortedBlocks(m.immature, maxHeight) {
+		v := m.immature[k]
+		reward := join(v.Reward)
+		result = append(result, &BlockData{
+			Height:         v.Height,
+			RoundHeight:    v.Height,
+			UncleHeight:    v.UncleHeight,
+			Uncle:          v.UncleHeight > 0,
+			Orphan:         v.Orphan,
+			Nonce:          v.Nonce,
+			Hash:           v.serializeHash(),
+			Timestamp:      v.Timestamp,
+			Difficulty:     v.Difficulty,
+			TotalShares:    v.TotalShares,
+			RewardString:   reward,
+			ImmatureReward: reward,
+			Finder:         v.Finder,
+			ShareDiffCalc:  v.ShareDiffCalc,
+			Worker:         v.Worker,
+			PersonalShares: v.PersonalShares,
+			Solo:           v.Solo,
+			immatureKey:    k,
+		})
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]int64)
+	for login, n := range m.rounds[join(height, nonce)] {
+		result[login] = n
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) writeImmatureBlock(block *BlockData) {
+	if block.Height != block.RoundHeight {
+		if round, ok := m.rounds[join(block.RoundHeight, block.Nonce)]; ok {
+			delete(m.rounds, join(block.RoundHeight, block.Nonce))
+			m.rounds[join(block.Height, block.Nonce)] = round
+		}
+	}
+	delete(m.candidates, block.candidateKey)
+	copied := *block
+	m.immature[block.key()] = &copied
+}
+
+func (m *MemoryBackend) writeMaturedBlock(block *BlockData) {
+	delete(m.rounds, join(block.RoundHeight, block.Nonce))
+	delete(m.immature, block.immatureKey)
+	copied := *block
+	m.matured[block.key()] = &copied
+}
+
+func (m *MemoryBackend) WritePendingOrphans(blocks []*BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, block := range blocks {
+		m.writeImmatureBlock(block)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writeImmatureBlock(block)
+	creditKey := join(block.Height, block.Hash)
+	credits, ok := m.immatureCredits[creditKey]
+	if !ok {
+		credits = make(map[string]int64)
+		m.immatureCredits[creditKey] = credits
+	}
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.miner(login)["immature"] += amount
+		if _, ok := credits[login]; !ok {
+			credits[login] = amount
+		}
+	}
+	m.finances["immature"] += total
+	return nil
+}
+
+func (m *MemoryBackend) decrementImmature(block *BlockData) {
+	creditKey := join(block.RoundHeight, block.Hash)
+	totalImmature := int64(0)
+	for login, amount := range m.immatureCredits[creditKey] {
+		totalImmature += amount
+		m.miner(login)["immature"] -= amount
+	}
+	delete(m.immatureCredits, creditKey)
+	m.finances["immature"] -= totalImmature
+}
+
+func (m *MemoryBackend) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writeMaturedBlock(block)
+	m.decrementImmature(block)
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.miner(login)["balance"] += amount
+	}
+	m.finances["balance"] += total
+	m.finances["shareRewardsRepaid"] += block.ShareRewardsRepaid
+	m.finances["lastCreditHeight"] = block.Height
+	m.finances["totalMined"] += block.RewardInShannon()
+	return nil
+}
+
+func (m *MemoryBackend) WriteOrphan(block *BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writeMaturedBlock(block)
+	m.decrementImmature(block)
+	return nil
+}
+
+// Rewards history is for stats, not kept
+func (m *MemoryBackend) WriteReward(login string, amount int64, percent *big.Rat, immature bool, block *BlockData) error {
+	return nil
+}
+
+func (m *MemoryBackend) GetPayees() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []string
+	for login := range m.miners {
+		result = append(result, login)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetBalance(login string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.miners[login]["balance"], nil
+}
+
+func (m *MemoryBackend) GetTreshold(login string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.miners[login]["payouttreshold"], nil
+}
+
+func (m *MemoryBackend) SetTreshold(login string, threshold, ts int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if last := m.thresholds[login]; len(last) > 0 && last[0].Timestamp >= ts {
+		return false, nil
+	}
+	m.miner(login)["payouttreshold"] = threshold
+	history := append([]*ThresholdChange{{Timestamp: ts, Threshold: threshold}}, m.thresholds[login]...)
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Timestamp > history[j].Timestamp })
+	if len(history) > 20 {
+		history = history[:20]
+	}
+	m.thresholds[login] = history
+	return true, nil
+}
+
+func (m *MemoryBackend) GetTresholdHistory(login string) ([]*ThresholdChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]*ThresholdChange, 0, len(m.thresholds[login]))
+	for _, v := range m.thresholds[login] {
+		change := *v
+		result = append(result, &change)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) LockPayouts(login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.payoutsLock) > 0 {
+		return fmt.Errorf("Unable to acquire lock '%s'", "payments:lock")
+	}
+	m.payoutsLock = join(login, amount)
+	return nil
+}
+
+func (m *MemoryBackend) UnlockPayouts() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.payoutsLock = ""
+	return nil
+}
+
+func (m *MemoryBackend) IsPayoutsLocked() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.payoutsLock) > 0, nil
+}
+
+func (m *MemoryBackend) GetPendingPayments() []*PendingPayment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for k := range m.pending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := m.pending[keys[i]], m.pending[keys[j]]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp > b.Timestamp
+		}
+		return keys[i] > keys[j]
+	})
+	var result []*PendingPayment
+	for _, k := range keys {
+		payment := *m.pending[k]
+		result = append(result, &payment)
+	}
+	return result
+}
+
+func (m *MemoryBackend) UpdateBalance(login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.debitBalance(login, amount, util.MakeTimestamp()/1000)
+	return nil
+}
+
+func (m *MemoryBackend) UpdateBalances(payments []*PendingPayment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+	for _, v := range payments {
+		m.debitBalance(v.Address, v.Amount, ts)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) debitBalance(login string, amount, ts int64) {
+	m.miner(login)["balance"] -= amount
+	m.miner(login)["pending"] += amount
+	m.finances["balance"] -= amount
+	m.finances["pending"] += amount
+	m.pending[join(login, amount)] = &PendingPayment{Timestamp: ts, Amount: amount, Address: login}
+}
+
+func (m *MemoryBackend) RollbackBalance(login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.creditBack(login, amount)
+	return nil
+}
+
+func (m *MemoryBackend) RollbackBalances(payments []*PendingPayment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range payments {
+		m.creditBack(v.Address, v.Amount)
+	}
+	m.payoutsLock = ""
+	return nil
+}
+
+func (m *MemoryBackend) creditBack(login string, amount int64) {
+	m.miner(login)["balance"] += amount
+	m.miner(login)["pending"] -= amount
+	m.finances["balance"] += amount
+	m.finances["pending"] -= amount
+	delete(m.pending, join(login, amount))
+}
+
+func (m *MemoryBackend) WritePayment(login, txHash string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.logPayment(login, txHash, amount, util.MakeTimestamp()/1000)
+	m.payoutsLock = ""
+	return nil
+}
+
+func (m *MemoryBackend) WriteBatchPayment(txHash string, payments []*PendingPayment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+	for _, v := range payments {
+		m.logPayment(v.Address, txHash, v.Amount, ts)
+	}
+	m.payoutsLock = ""
+	return nil
+}
+
+func (m *MemoryBackend) logPayment(login, txHash string, amount, ts int64) {
+	m.miner(login)["pending"] -= amount
+	m.miner(login)["paid"] += amount
+	m.finances["pending"] -= amount
+	m.finances["paid"] += amount
+	m.payments[join(txHash, login, amount)] = &LoggedPayment{TxHash: txHash, Address: login, Amount: amount, Timestamp: ts}
+	delete(m.pending, join(login, amount))
+}
+
+func (m *MemoryBackend) ReplacePayment(oldTxHash, newTxHash string, payments []*PendingPayment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range payments {
+		ts := util.MakeTimestamp() / 1000
+		if old, ok := m.payments[join(oldTxHash, v.Address, v.Amount)]; ok {
+			ts = old.Timestamp
+			delete(m.payments, join(oldTxHash, v.Address, v.Amount))
+		}
+		m.payments[join(newTxHash, v.Address, v.Amount)] = &LoggedPayment{TxHash: newTxHash, Address: v.Address, Amount: v.Amount, Timestamp: ts}
+	}
+	m.replaced[oldTxHash] = newTxHash
+	return nil
+}
+
+func (m *MemoryBackend) AdjustBalance(login string, amount int64) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	balance := m.miners[login]["balance"]
+	if balance+amount < 0 {
+		return balance, false, nil
+	}
+	m.miner(login)["balance"] += amount
+	m.miner(login)["adjusted"] += amount
+	m.finances["balance"] += amount
+	m.finances["adjusted"] += amount
+	return balance + amount, true, nil
+}
+
+func (m *MemoryBackend) GetUnreconciledPayments(since int64) (map[string][]*LoggedPayment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for k, v := range m.payments {
+		if _, ok := m.statuses[v.TxHash]; !ok && v.Timestamp >= since {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := m.payments[keys[i]], m.payments[keys[j]]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		return keys[i] < keys[j]
+	})
+	result := make(map[string][]*LoggedPayment)
+	for _, k := range keys {
+		payment := *m.payments[k]
+		result[payment.TxHash] = append(result[payment.TxHash], &payment)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) MarkPaymentConfirmed(txHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statuses[txHash] = PaymentConfirmed
+	return nil
+}
+
+func (m *MemoryBackend) WritePaymentNonce(txHash string, nonce uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nonces[txHash] = nonce
+	return nil
+}
+
+func (m *MemoryBackend) GetPaymentNonce(txHash string) (uint64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nonce, ok := m.nonces[txHash]
+	return nonce, ok, nil
+}
+
+func (m *MemoryBackend) GetReplacedTxs(txHash string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result []string
+	for old, v := range m.replaced {
+		if v == txHash {
+			result = append(result, old)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (m *MemoryBackend) RevertPayment(txHash, status string, payments []*LoggedPayment) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.statuses[txHash]; ok {
+		return false, nil
+	}
+	for _, v := range payments {
+		delete(m.payments, join(txHash, v.Address, v.Amount))
+		m.failed = append(m.failed, &LoggedPayment{TxHash: txHash, Address: v.Address, Amount: v.Amount, Timestamp: v.Timestamp, Status: status})
+		m.miner(v.Address)["balance"] += v.Amount
+		m.miner(v.Address)["paid"] -= v.Amount
+		m.finances["balance"] += v.Amount
+		m.finances["paid"] -= v.Amount
+	}
+	m.statuses[txHash] = status
+	return true, nil
+}
+
+func (m *MemoryBackend) GetFailedPayments(max int64) ([]*LoggedPayment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]*LoggedPayment, 0, len(m.failed))
+	for _, v := range m.failed {
+		payment := *v
+		result = append(result, &payment)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Timestamp > result[j].Timestamp })
+	if int64(len(result)) > max {
+		result = result[:max]
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetOwedBalance() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.finances["balance"] + m.finances["pending"], nil
+}
+
+func (m *MemoryBackend) WriteReconcileState(state *ReconcileState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state.CheckedAt = util.MakeTimestamp() / 1000
+	m.reconcile = *state
+	return nil
+}
+
+func (m *MemoryBackend) GetReconcileState() (*ReconcileState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := m.reconcile
+	return &state, nil
+}
+
+func (m *MemoryBackend) CheckLedger() (*LedgerCheck, error) {
+	return nil, fmt.Errorf("Ledger is not enabled")
+}
+
+func (m *MemoryBackend) WriteNodeState(id string, height uint64, diff *big.Int, blocktime float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node := m.node(id)
+	node["name"] = id
+	node["height"] = strconv.FormatUint(height, 10)
+	node["difficulty"] = diff.String()
+	node["lastBeat"] = strconv.FormatInt(util.MakeTimestamp()/1000, 10)
+	node["blocktime"] = strconv.FormatFloat(blocktime, 'f', 4, 64)
+	return nil
+}
+
+func (m *MemoryBackend) WriteNodeMetrics(id string, metrics map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node := m.node(id)
+	for key, value := range metrics {
+		node[key] = strconv.FormatInt(value, 10)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) WriteNodeUpstreams(id string, upstreams []*UpstreamState) error {
+	data, err := json.Marshal(upstreams)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.node(id)["upstreams"] = string(data)
+	return nil
+}
+
+func (m *MemoryBackend) node(id string) map[string]string {
+	node, ok := m.nodes[id]
+	if !ok {
+		node = make(map[string]string)
+		m.nodes[id] = node
+	}
+	return node
+}
+
+func (m *MemoryBackend) GetNodeStates() ([]map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]map[string]interface{}, 0, len(m.nodes))
+	for _, v := range m.nodes {
+		node := make(map[string]interface{})
+		for key, value := range v {
+			node[key] = nodeStateValue(key, value)
+		}
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) WriteSessions(node string, sessions map[string]string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]string)
+	for id, v := range sessions {
+		snapshot[id] = v
+	}
+	m.sessions[node] = snapshot
+	m.sessionsExpire[node] = util.MakeTimestamp() + ttl.Milliseconds()
+	return nil
+}
+
+func (m *MemoryBackend) GetSessions(node string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]string)
+	if m.sessionsExpire[node] < util.MakeTimestamp() {
+		return result, nil
+	}
+	for id, v := range m.sessions[node] {
+		result[id] = v
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) KickSession(node, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.kicked[node]; !ok {
+		m.kicked[node] = make(map[string]struct{})
+	}
+	m.kicked[node][id] = struct{}{}
+	return nil
+}
+
+func (m *MemoryBackend) PopKickedSessions(node string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := []string{}
+	for id := range m.kicked[node] {
+		result = append(result, id)
+	}
+	delete(m.kicked, node)
+	return result, nil
+}
+
+func (m *MemoryBackend) WriteBan(ip string, until int64, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans[ip] = &Ban{IP: ip, Until: until, Reason: reason}
+	return nil
+}
+
+func (m *MemoryBackend) DeleteBan(ip string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.bans[ip]
+	delete(m.bans, ip)
+	return ok, nil
+}
+
+func (m *MemoryBackend) GetBans() (map[string]*Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := util.MakeTimestamp()
+	bans := make(map[string]*Ban)
+	for ip, v := range m.bans {
+		if v.Active(now) {
+			ban := *v
+			bans[ip] = &ban
+		} else {
+			delete(m.bans, ip)
+		}
+	}
+	return bans, nil
+}
+
+// IP lists are maintained by hand in Redis, always empty here
+func (m *MemoryBackend) GetBlacklist() ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *MemoryBackend) GetWhitelist() ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *MemoryBackend) GetWalletBlacklist() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := []string{}
+	for login := range m.walletBlacklist {
+		result = append(result, login)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) AddWalletBlacklist(login string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.walletBlacklist[login]
+	m.walletBlacklist[login] = struct{}{}
+	return !ok, nil
+}
+
+func (m *MemoryBackend) RemoveWalletBlacklist(login string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.walletBlacklist[login]
+	delete(m.walletBlacklist, login)
+	return ok, nil
+}
+
+func (m *MemoryBackend) WriteUnlockerState(halt bool, lastFail error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.unlocker = UnlockerState{Halt: halt, UpdatedAt: util.MakeTimestamp() / 1000}
+	if lastFail != nil {
+		m.unlocker.LastFail = lastFail.Error()
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetUnlockerState() (*UnlockerState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.unlocker
+	_, state.UnhaltRequested = m.unhalt["unlocker"]
+	return &state, nil
+}
+
+func (m *MemoryBackend) RequestUnhalt(module string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unhalt[module] = struct{}{}
+	return nil
+}
+
+func (m *MemoryBackend) PopUnhaltRequest(module string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.unhalt[module]
+	delete(m.unhalt, module)
+	return ok, nil
+}
+
+func (m *MemoryBackend) WriteAudit(entry *AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.Timestamp = util.MakeTimestamp() / 1000
+	copied := *entry
+	m.audit = append([]*AuditEntry{&copied}, m.audit...)
+	if len(m.audit) > maxAuditEntries {
+		m.audit = m.audit[:maxAuditEntries]
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetAudit(max int64) ([]*AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]*AuditEntry, 0, len(m.audit))
+	for i, v := range m.audit {
+		if int64(i) >= max {
+			break
+		}
+		entry := *v
+		result = append(result, &entry)
+	}
+	return result, nil
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/yuriy0803/open-etc-pool-friends/ledger"
+	"github.com/yuriy0803/open-etc-pool-friends/util"
+)
+
+const (
+	PaymentConfirmed = "confirmed"
+	PaymentFailed    = "failed"
+	PaymentDropped   = "dropped"
+)
+
+// Entry of payments:all
+type LoggedPayment struct {
+	TxHash    string `json:"tx"`
+	Address   string `json:"address"`
+	Amount    int64  `json:"amount"`
+	Timestamp int64  `json:"timestamp"`
+	Status    string `json:"status,omitempty"`
+}
+
+type ReconcileState struct {
+	CheckedAt int64 `json:"checkedAt"`
+	// Pool wallet balance and what is owed to miners, in Shannon
+	OnChain int64 `json:"onChain"`
+	Owed    int64 `json:"owed"`
+	Drift   int64 `json:"drift"`
+	Alert   bool  `json:"alert"`
+	// Payments credited back during last run
+	Reverted int64 `json:"reverted"`
+}
+
+// Payments logged since given unix time, grouped by tx, except txs already reconciled
+func (r *RedisClient) GetUnreconciledPayments(since int64) (map[string][]*LoggedPayment, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(since, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("payments", "all"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	statuses, err := r.client.HGetAllMap(r.formatKey("payments", "status")).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]*LoggedPayment)
+	for _, v := range cmd.Val() {
+		// "txHash:address:amount"
+		fields := strings.Split(v.Member.(string), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if _, ok := statuses[fields[0]]; ok {
+			continue
+		}
+		payment := &LoggedPayment{TxHash: fields[0], Address: fields[1], Timestamp: int64(v.Score)}
+		payment.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+		result[payment.TxHash] = append(result[payment.TxHash], payment)
+	}
+	return result, nil
+}
+
+// Final tx is not checked again
+func (r *RedisClient) MarkPaymentConfirmed(txHash string) error {
+	return r.client.HSet(r.formatKey("payments", "status"), txHash, PaymentConfirmed).Err()
+}
+
+// Nonce of payout tx, reconciliation considers tx dropped only once pool address is past it
+func (r *RedisClient) WritePaymentNonce(txHash string, nonce uint64) error {
+	return r.client.HSet(r.formatKey("payments", "nonces"), txHash, strconv.FormatUint(nonce, 10)).Err()
+}
+
+// False if nonce of tx was not recorded
+func (r *RedisClient) GetPaymentNonce(txHash string) (uint64, bool, error) {
+	cmd := r.client.HGet(r.formatKey("payments", "nonces"), txHash)
+	if cmd.Err() == redis.Nil {
+		return 0, false, nil
+	} else if cmd.Err() != nil {
+		return 0, false, cmd.Err()
+	}
+	nonce, err := cmd.Uint64()
+	return nonce, err == nil, err
+}
+
+// Txs replaced by given one, any of them may be mined instead
+func (r *RedisClient) GetReplacedTxs(txHash string) ([]string, error) {
+	replaced, err := r.client.HGetAllMap(r.formatKey("payments", "replaced")).Result()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for old, v := range replaced {
+		if v == txHash {
+			result = append(result, old)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Moves payments of a failed or dropped tx from payment history to payments:failed
+// and credits them back to miners. Does nothing if tx was already reconciled.
+func (r *RedisClient) RevertPayment(txHash, status string, payments []*LoggedPayment) (bool, error) {
+	statusKey := r.formatKey("payments", "status")
+	tx, err := r.client.Watch(statusKey)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	done, err := tx.HExists(statusKey, txHash).Result()
+	if err != nil || done {
+		return false, err
+	}
+	var postings []ledger.Posting
+	for _, v := range payments {
+		postings = append(postings, revertPostings(v.Address, v.Amount)...)
+	}
+	err = r.withLedger(ledger.KindRevert, txHash, postings, func() error {
+		_, err := tx.Exec(func() error {
+			for _, v := range payments {
+				tx.ZRem(r.formatKey("payments", "all"), join(txHash, v.Address, v.Amount))
+				tx.ZRem(r.formatKey("payments", v.Address), join(txHash, v.Amount))
+				tx.ZAdd(r.formatKey("payments", "failed"), redis.Z{Score: float64(v.Timestamp), Member: join(txHash, v.Address, v.Amount, status)})
+				tx.ZRemRangeByRank(r.formatKey("payments", "failed"), 0, -10000)
+				tx.HIncrBy(r.formatKey("miners", v.Address), "balance", v.Amount)
+				tx.HIncrBy(r.formatKey("miners", v.Address), "paid", (v.Amount * -1))
+				tx.HIncrBy(r.formatKey("finances"), "balance", v.Amount)
+				tx.HIncrBy(r.formatKey("finances"), "paid", (v.Amount * -1))
+				tx.HIncrBy(r.formatKey("paymentsTotal"), "all", -1)
+				tx.HIncrBy(r.formatKey("paymentsTotal"), v.Address, -1)
+			}
+			tx.HSet(statusKey, txHash, status)
+			return nil
+		})
+		return err
+	})
+	return err == nil, err
+}
+
+// Latest failed and dropped payments first
+func (r *RedisClient) GetFailedPayments(max int64) ([]*LoggedPayment, error) {
+	cmd := r.client.ZRevRangeWithScores(r.formatKey("payments", "failed"), 0, max-1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make([]*LoggedPayment, 0, len(cmd.Val()))
+	for _, v := range cmd.Val() {
+		// "txHash:address:amount:status"
+		fields := strings.Split(v.Member.(string), ":")
+		if len(fields) < 4 {
+			continue
+		}
+		payment := &LoggedPayment{TxHash: fields[0], Address: fields[1], Status: fields[3], Timestamp: int64(v.Score)}
+		payment.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+		result = append(result, payment)
+	}
+	return result, nil
+}
+
+// Shannon owed to miners, credited balances and payments in flight
+func (r *RedisClient) GetOwedBalance() (int64, error) {
+	cmd := r.client.HMGet(r.formatKey("finances"), "balance", "pending")
+	if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	var owed int64
+	for _, v := range cmd.Val() {
+		if s, ok := v.(string); ok {
+			n, _ := strconv.ParseInt(s, 10, 64)
+			owed += n
+		}
+	}
+	return owed, nil
+}
+
+func (r *RedisClient) WriteReconcileState(state *ReconcileState) error {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	state.CheckedAt = util.MakeTimestamp() / 1000
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.formatKey("reconcile"), "checkedAt", strconv.FormatInt(state.CheckedAt, 10))
+		tx.HSet(r.formatKey("reconcile"), "onChain", strconv.FormatInt(state.OnChain, 10))
+		tx.HSet(r.formatKey("reconcile"), "owed", strconv.FormatInt(state.Owed, 10))
+		tx.HSet(r.formatKey("reconcile"), "drift", strconv.FormatInt(state.Drift, 10))
+		tx.HSet(r.formatKey("reconcile"), "alert", strconv.FormatBool(state.Alert))
+		tx.HSet(r.formatKey("reconcile"), "reverted", strconv.FormatInt(state.Reverted, 10))
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetReconcileState() (*ReconcileState, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("reconcile"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	v := cmd.Val()
+	state := &ReconcileState{}
+	state.CheckedAt, _ = strconv.ParseInt(v["checkedAt"], 10, 64)
+	state.OnChain, _ = strconv.ParseInt(v["onChain"], 10, 64)
+	state.Owed, _ = strconv.ParseInt(v["owed"], 10, 64)
+	state.Drift, _ = strconv.ParseInt(v["drift"], 10, 64)
+	state.Alert, _ = strconv.ParseBool(v["alert"])
+	state.Reverted, _ = strconv.ParseInt(v["reverted"], 10, 64)
+	return state, nil
+}
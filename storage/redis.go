@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/big"
+	"math/rand"
 	"sort"
 	"strconv"
 	"strings"
@@ -13,9 +16,30 @@ import (
 
 	redis "gopkg.in/redis.v3"
 
+	"github.com/yuriy0803/open-etc-pool-friends/ledger"
 	"github.com/yuriy0803/open-etc-pool-friends/util"
 )
 
+// Share difficulty represented by a single entry of the PPLNS window
+const pplnsShareUnit = 1000000000
+
+// Rolls back ledger entry of a share reward, duplicate share isn't credited
+var errDuplicateShare = errors.New("duplicate share")
+
+// Shares snapshotted into the round when a block is found
+type ShareWindow int
+
+const (
+	// Last N share units, N is the pplns setting
+	WindowLastShares ShareWindow = iota
+	// All shares since the previous block
+	WindowRound
+	// Shares submitted within a time window
+	WindowTime
+	// Block finder only
+	WindowFinder
+)
+
 type Config struct {
 	SentinelEnabled bool     `json:"sentinelEnabled"`
 	Endpoint        string   `json:"endpoint"`
@@ -24,13 +48,21 @@ type Config struct {
 	PoolSize        int      `json:"poolSize"`
 	MasterName      string   `json:"masterName"`
 	SentinelAddrs   []string `json:"sentinelAddrs"`
+	ClusterEnabled  bool     `json:"clusterEnabled"`
+	ClusterAddrs    []string `json:"clusterAddrs"`
 }
 
 type RedisClient struct {
-	client   *redis.Client
-	prefix   string
-	pplns    int64
-	CoinName string
+	client     redisClient
+	prefix     string
+	pplns      int64
+	CoinName   string
+	window     ShareWindow
+	windowTime time.Duration
+	ledger     *ledger.Ledger
+	// Daily reset of share status, per client as coins of one process have their own keys
+	deletionLock sync.Mutex
+	deletionDone bool
 }
 
 type PoolCharts struct {
@@ -103,11 +135,15 @@ type BlockData struct {
 	MixDigest      string   `json:"-"`
 	Reward         *big.Int `json:"-"`
 	ExtraReward    *big.Int `json:"-"`
+	TxFees         *big.Int `json:"-"`
 	ImmatureReward string   `json:"-"`
 	RewardString   string   `json:"reward"`
 	RoundHeight    int64    `json:"-"`
-	candidateKey   string
-	immatureKey    string
+	Solo           bool     `json:"solo"`
+	// Miners profit in Shannon kept by pool, it repays share rewards paid in advance
+	ShareRewardsRepaid int64 `json:"-"`
+	candidateKey       string
+	immatureKey        string
 }
 
 type NetCharts struct {
@@ -142,7 +178,7 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
-	return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward, b.Finder, b.ShareDiffCalc, b.Worker, b.PersonalShares)
+	return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward, b.Finder, b.ShareDiffCalc, b.Worker, b.PersonalShares, b.Solo)
 }
 
 type Miner struct {
@@ -153,6 +189,36 @@ type Miner struct {
 	Blocks    int64 `json:"blocks"`
 }
 
+// Share accepted by proxy, buffered and written with others in one batch
+type Share struct {
+	Login         string
+	Id            string
+	Params        []string
+	Diff          int64
+	ShareDiffCalc int64
+	Height        uint64
+	Expire        time.Duration
+	Hostname      string
+	PortDiff      int64
+	Solo          bool
+	// Shannon credited with the share (PPS family)
+	Reward int64
+}
+
+// Health of a proxy upstream, published with node state
+type UpstreamState struct {
+	Name    string  `json:"name"`
+	Active  bool    `json:"active"`
+	Healthy bool    `json:"healthy"`
+	Score   float64 `json:"score"`
+	Height  uint64  `json:"height"`
+	// Blocks behind the best upstream
+	Lag       uint64  `json:"lag"`
+	Peers     int64   `json:"peers"`
+	LatencyMs int64   `json:"latencyMs"`
+	ErrorRate float64 `json:"errorRate"`
+}
+
 type Worker struct {
 	Miner
 	TotalHR         int64   `json:"hr2"`
@@ -166,33 +232,42 @@ type Worker struct {
 	InvalidPercent  float64 `json:"i_per"`
 	WorkerStatus    int64   `json:"w_stat"`
 	WorkerStatushas int64   `json:"w_stat_s"`
+	Solo            bool    `json:"solo"`
 }
 
 func NewRedisClient(cfg *Config, prefix string, pplns int64, CoinName string) *RedisClient {
-	var client *redis.Client
+	if cfg.ClusterEnabled && len(cfg.ClusterAddrs) != 0 {
+		// cluster mode, all keys of the pool share one slot
+		client := newClusterClient(cfg, prefix)
+		return &RedisClient{client: client, prefix: clusterPrefix(prefix), pplns: pplns, CoinName: CoinName}
+	}
+	return &RedisClient{client: &nodeClient{newNodeClient(cfg)}, prefix: prefix, pplns: pplns, CoinName: CoinName}
+}
+
+func newNodeClient(cfg *Config) *redis.Client {
 	if cfg.SentinelEnabled && len(cfg.MasterName) != 0 && len(cfg.SentinelAddrs) != 0 {
 		// sentinel mode
-		client = redis.NewFailoverClient(&redis.FailoverOptions{
+		return redis.NewFailoverClient(&redis.FailoverOptions{
 			MasterName:    cfg.MasterName,
 			SentinelAddrs: cfg.SentinelAddrs,
 			Password:      cfg.Password,
 			DB:            cfg.Database,
 			PoolSize:      cfg.PoolSize,
 		})
-	} else {
-		// single instance
-		client = redis.NewClient(&redis.Options{
-			Addr:     cfg.Endpoint,
-			Password: cfg.Password,
-			DB:       cfg.Database,
-			PoolSize: cfg.PoolSize,
-		})
 	}
-	return &RedisClient{client: client, prefix: prefix, pplns: pplns, CoinName: CoinName}
+	// single instance
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.Endpoint,
+		Password: cfg.Password,
+		DB:       cfg.Database,
+		PoolSize: cfg.PoolSize,
+	})
 }
 
-func (r *RedisClient) Client() *redis.Client {
-	return r.client
+// Set by the reward scheme, must match across all proxies writing shares
+func (r *RedisClient) SetShareWindow(window ShareWindow, d time.Duration) {
+	r.window = window
+	r.windowTime = d
 }
 
 func (r *RedisClient) Check() (string, error) {
@@ -200,7 +275,7 @@ func (r *RedisClient) Check() (string, error) {
 }
 
 func (r *RedisClient) BgSave() (string, error) {
-	return r.client.BgSave().Result()
+	return r.client.BgSave()
 }
 
 // Always returns list of addresses. If Redis fails it will return empty list.
@@ -276,7 +351,10 @@ func (r *RedisClient) WriteShareCharts(time1 int64, time2, login string, valid,
 	s := join(time1, time2, valid_c, stale_c, workerOnline)
 	cmd := r.client.ZAdd(r.formatKey("charts", "share", login), redis.Z{Score: float64(time1), Member: s})
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 	tx.Exec(func() error {
 		tx.HSet(r.formatKey("chartsNum", "share", login), "lastvalid", strconv.FormatInt(v_s, 10))
@@ -291,7 +369,10 @@ func (r *RedisClient) WriteShareCharts(time1 int64, time2, login string, valid,
 // The function returns a slice of `PoolCharts` structures representing the pool charts and an error (if any).
 func (r *RedisClient) GetPoolCharts(poolHashLen int64) (stats []*PoolCharts, err error) {
 	// Begin a Redis transaction
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	// Compute the current timestamp (in seconds)
@@ -354,7 +435,10 @@ func convertPoolChartsResults(raw *redis.ZSliceCmd) []*PoolCharts {
 }
 
 func (r *RedisClient) GetNetCharts(netHashLen int64) (stats []*NetCharts, err error) {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
@@ -427,7 +511,7 @@ func (r *RedisClient) GetAllMinerAccount() (account []string, err error) {
 	var c int64
 	for {
 		now := util.MakeTimestamp() / 1000
-		c, keys, err := r.client.Scan(c, r.formatKey("miners", "*"), now).Result()
+		c, keys, err := r.client.Scan(c, r.formatKey("miners", "*"), now)
 
 		if err != nil {
 			return account, err
@@ -448,7 +532,10 @@ func (r *RedisClient) GetAllMinerAccount() (account []string, err error) {
 
 func (r *RedisClient) GetMinerCharts(hashNum int64, login string) (stats []*MinerCharts, err error) {
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 	now := util.MakeTimestamp() / 1000
 	cmds, err := tx.Exec(func() error {
@@ -511,7 +598,10 @@ func (r *RedisClient) DeleteOldShareData() error {
 
 func (r *RedisClient) GetShareCharts(shareNum int64, login string) (stats []*ShareCharts, err error) {
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 	now := util.MakeTimestamp() / 1000
 	cmds, err := tx.Exec(func() error {
@@ -548,7 +638,10 @@ func convertShareChartsResults(raw *redis.ZSliceCmd) []*ShareCharts {
 
 func (r *RedisClient) GetPaymentCharts(login string) (stats []*PaymentCharts, err error) {
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 	cmds, err := tx.Exec(func() error {
 		tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, 360)
@@ -563,12 +656,15 @@ func (r *RedisClient) GetPaymentCharts(login string) (stats []*PaymentCharts, er
 }
 
 func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int, blocktime float64) error {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HSet(r.formatKey("nodes"), join(id, "name"), id)
 		tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
 		tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
@@ -579,6 +675,30 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int, bl
 	return err
 }
 
+func (r *RedisClient) WriteNodeMetrics(id string, metrics map[string]int64) error {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for key, value := range metrics {
+			tx.HSet(r.formatKey("nodes"), join(id, key), strconv.FormatInt(value, 10))
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) WriteNodeUpstreams(id string, upstreams []*UpstreamState) error {
+	data, err := json.Marshal(upstreams)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(r.formatKey("nodes"), join(id, "upstreams"), string(data)).Err()
+}
+
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
 	if cmd.Err() != nil {
@@ -587,13 +707,12 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	m := make(map[string]map[string]interface{})
 	for key, value := range cmd.Val() {
 		parts := strings.Split(key, ":")
-		if val, ok := m[parts[0]]; ok {
-			val[parts[1]] = value
-		} else {
-			node := make(map[string]interface{})
-			node[parts[1]] = value
+		node, ok := m[parts[0]]
+		if !ok {
+			node = make(map[string]interface{})
 			m[parts[0]] = node
 		}
+		node[parts[1]] = nodeStateValue(parts[1], value)
 	}
 	v := make([]map[string]interface{}, len(m), len(m))
 	i := 0
@@ -604,118 +723,251 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	return v, nil
 }
 
-func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
-	// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
-	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
-	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
-	return val == 0, err
+// Upstreams are kept as JSON and returned decoded, other node fields as strings
+func nodeStateValue(field, value string) interface{} {
+	if field != "upstreams" {
+		return value
+	}
+	var upstreams []*UpstreamState
+	if err := json.Unmarshal([]byte(value), &upstreams); err != nil {
+		return nil
+	}
+	return upstreams
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, shareDiffCalc int64, height uint64, window time.Duration, hostname string) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
-	if err != nil {
-		return false, err
-	}
-	// Duplicate share, (nonce, powHash, mixDigest) pair exist
-	if exist {
-		return true, nil
+func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, shareDiffCalc int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error) {
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+	if solo {
+		return runShareScript(r.client, soloShareScript, r.soloShareKeys(login), r.soloShareArgs(ms, ts, login, id, params, diff, shareDiffCalc, height, window, hostname, portDiff))
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
+	keys := append(r.shareKeys(login), r.formatKey("finances"))
+	args := append(r.shareArgs(ms, ts, login, id, params, diff, shareDiffCalc, height, window, hostname, portDiff), strconv.FormatInt(reward, 10))
+	return r.runRewardedShareScript(poolShareScript, login, reward, keys, args)
+}
 
+// Writes the share, snapshots round shares and adds the candidate in a single script
+func (r *RedisClient) WriteBlock(login, id string, params []string, diff, shareDiffCalc int64, roundDiff int64, height uint64, window time.Duration, hostname string, portDiff int64, solo bool, reward int64) (bool, error) {
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
+	found := join(diff, params[0], id, ms)
+	candidate := join(strings.Join(params, ":"), ts, roundDiff)
+	round := r.formatRound(int64(height), params[0])
 
-	_, err = tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, shareDiffCalc, window, hostname)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
-		return nil
-	})
-	return false, err
+	if solo {
+		keys := append(r.soloShareKeys(login), r.formatKey("solo", "stats"), r.formatKey("worker", "blocks", login), round, r.formatKey("blocks", "candidates"))
+		args := append(r.soloShareArgs(ms, ts, login, id, params, diff, shareDiffCalc, height, window, hostname, portDiff), found, candidate, id)
+		return runShareScript(r.client, soloBlockScript, keys, args)
+	}
+	keys := append(r.shareKeys(login), r.formatKey("finders"), r.formatKey("worker", "blocks", login), round, r.formatKey("blocks", "candidates"), r.formatKey("finances"))
+	args := append(r.shareArgs(ms, ts, login, id, params, diff, shareDiffCalc, height, window, hostname, portDiff), found, candidate, strconv.FormatInt(reward, 10))
+	return r.runRewardedShareScript(poolBlockScript, login, reward, keys, args)
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, shareDiffCalc int64, roundDiff int64, height uint64, window time.Duration, hostname string) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
-	if err != nil {
-		return false, err
+// Share script credits the reward, its ledger entry is rolled back for a duplicate
+func (r *RedisClient) runRewardedShareScript(script *redis.Script, login string, reward int64, keys, args []string) (bool, error) {
+	if reward <= 0 {
+		return runShareScript(r.client, script, keys, args)
 	}
-	// Duplicate share, (nonce, powHash, mixDigest) pair exist
-	if exist {
+	exist := false
+	err := r.withLedger(ledger.KindShareReward, login, creditPostings(login, reward, ledger.PoolShareRewards), func() error {
+		var err error
+		exist, err = runShareScript(r.client, script, keys, args)
+		if err == nil && exist {
+			return errDuplicateShare
+		}
+		return err
+	})
+	if err == errDuplicateShare {
 		return true, nil
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
+	return exist, err
+}
 
+// Writes shares in a single script, shares of a worker are summed into one hashrate
+// entry. Returns which of the shares were duplicates and not written.
+func (r *RedisClient) WriteShares(shares []*Share) ([]bool, error) {
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
+	keys := []string{
+		r.formatKey("pow"),
+		r.formatKey("lastshares"),
+		r.formatKey("lastshares", "time"),
+		r.formatKey("shares", "roundCurrent"),
+		r.formatKey("hashrate"),
+		r.formatKey("stats"),
+		r.formatKey("solo", "shares"),
+		r.formatKey("solo", "hashrate"),
+		r.formatKey("finances"),
+	}
+	var maxHeight uint64
+	for _, v := range shares {
+		if v.Height > maxHeight {
+			maxHeight = v.Height
+		}
+	}
+	args := []string{
+		strconv.FormatInt(r.pplns, 10),
+		r.windowName(),
+		strconv.FormatInt(ms, 10),
+		strconv.FormatInt(ms-r.windowTime.Milliseconds(), 10),
+		strconv.FormatInt(ts, 10),
+		strconv.FormatUint(maxHeight, 10),
+	}
+
+	// Script reports duplicates by position in args, keep it to map them back
+	groups := make(map[string][]int)
+	var order []string
+	for i, v := range shares {
+		group := join(v.Login, v.Id, v.Solo, v.Hostname, v.PortDiff)
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], i)
+	}
+	var positions []int
+	for _, group := range order {
+		first := shares[groups[group][0]]
+		keys = append(keys, r.formatKey("miners", first.Login), r.formatKey("hashrate", first.Login))
+		args = append(args, first.Login, first.Id, join(first.Solo), first.Hostname, strconv.FormatInt(first.PortDiff, 10),
+			strconv.FormatInt(first.Expire.Milliseconds(), 10), strconv.Itoa(len(groups[group])))
+		for _, i := range groups[group] {
+			v := shares[i]
+			args = append(args, strconv.FormatUint(v.Height, 10), strings.Join(v.Params, ":"), strconv.FormatInt(v.Diff, 10),
+				strconv.Itoa(pplnsWeight(v.Diff)), strconv.FormatInt(v.ShareDiffCalc, 10), strconv.FormatInt(v.Reward, 10))
+			positions = append(positions, i)
+		}
+	}
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, shareDiffCalc, window, hostname)
-		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
-		tx.HSet(r.formatKey("miners", login), "roundShares", strconv.FormatInt(0, 10))
-		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.HGetAllMap(r.formatKey("shares", "roundCurrent"))
-		tx.Del(r.formatKey("shares", "roundCurrent"))
-		tx.LRange(r.formatKey("lastshares"), 0, r.pplns)
+	var duplicates []bool
+	write := func() error {
+		val, err := shareBatchScript.Run(r.client, keys, args).Result()
+		if err != nil {
+			return err
+		}
+		duplicates = make([]bool, len(shares))
+		list, _ := val.([]interface{})
+		rewarded := false
+		for _, v := range list {
+			if n, ok := v.(int64); ok && n > 0 && int(n) <= len(positions) {
+				duplicates[positions[n-1]] = true
+				rewarded = rewarded || shares[positions[n-1]].Reward > 0
+			}
+		}
+		// Duplicates aren't credited, ledger gets the rewards actually written instead
+		if rewarded {
+			return errDuplicateShare
+		}
 		return nil
-	})
-	r.WriteBlocksFound(ms, ts, login, id, params[0], diff)
-	if err != nil {
-		return false, err
+	}
+	var err error
+	if postings := shareRewardPostings(shares, nil); len(postings) > 0 {
+		err = r.withLedger(ledger.KindShareReward, "batch", postings, write)
 	} else {
-
-		shares := cmds[len(cmds)-1].(*redis.StringSliceCmd).Val()
-
-		tx2 := r.client.Multi()
-		defer tx2.Close()
-
-		totalshares := make(map[string]int64)
-		for _, val := range shares {
-			totalshares[val] += 1
-		}
-
-		_, err := tx2.Exec(func() error {
-			for k, v := range totalshares {
-				tx2.HIncrBy(r.formatRound(int64(height), params[0]), k, v)
+		err = write()
+	}
+	if err == errDuplicateShare {
+		if r.ledger != nil {
+			if err := r.ledger.Record(ledger.KindShareReward, "batch", shareRewardPostings(shares, duplicates)); err != nil {
+				log.Printf("CRITICAL: %v batch is written to Redis, but ledger write failed: %v", ledger.KindShareReward, err)
 			}
-			return nil
-		})
-		if err != nil {
-			return false, err
 		}
+		return duplicates, nil
+	}
+	return duplicates, err
+}
 
-		sharesMap, _ := cmds[len(cmds)-3].(*redis.StringStringMapCmd).Result()
-		totalShares := int64(0)
-		for _, v := range sharesMap {
-			n, _ := strconv.ParseInt(v, 10, 64)
-			totalShares += n
+// Rewards of shares not found to be duplicates
+func shareRewardPostings(shares []*Share, duplicates []bool) []ledger.Posting {
+	var postings []ledger.Posting
+	for i, v := range shares {
+		if v.Reward > 0 && !v.Solo && (duplicates == nil || !duplicates[i]) {
+			postings = append(postings, creditPostings(v.Login, v.Reward, ledger.PoolShareRewards)...)
 		}
+	}
+	return postings
+}
+
+// Number of PPLNS window entries for a share of given difficulty.
+// Remainder below the unit is credited with matching probability, so
+// low difficulty vardiff sessions keep their weight on average.
+func pplnsWeight(diff int64) int {
+	times := diff / pplnsShareUnit
+	if rem := diff % pplnsShareUnit; rem > 0 && rand.Int63n(pplnsShareUnit) < rem {
+		times++
+	}
+	return int(times)
+}
+
+func (r *RedisClient) windowName() string {
+	switch r.window {
+	case WindowRound:
+		return "round"
+	case WindowTime:
+		return "time"
+	case WindowFinder:
+		return "finder"
+	default:
+		return "last"
+	}
+}
+
+func (r *RedisClient) shareKeys(login string) []string {
+	return []string{
+		r.formatKey("pow"),
+		r.formatKey("lastshares"),
+		r.formatKey("lastshares", "time"),
+		r.formatKey("miners", login),
+		r.formatKey("shares", "roundCurrent"),
+		r.formatKey("hashrate"),
+		r.formatKey("hashrate", login),
+		r.formatKey("stats"),
+	}
+}
 
-		personalShares := int64(0)
-		personalShares = cmds[len(cmds)-14].(*redis.IntCmd).Val()
+func (r *RedisClient) shareArgs(ms, ts int64, login, id string, params []string, diff, shareDiffCalc int64, height uint64, expire time.Duration, hostname string, portDiff int64) []string {
+	return []string{
+		strconv.FormatUint(height, 10),
+		strings.Join(params, ":"),
+		login,
+		strconv.FormatInt(diff, 10),
+		strconv.Itoa(pplnsWeight(diff)),
+		strconv.FormatInt(r.pplns, 10),
+		r.windowName(),
+		strconv.FormatInt(ms, 10),
+		strconv.FormatInt(ms-r.windowTime.Milliseconds(), 10),
+		id,
+		join(diff, login, id, ms, hostname, portDiff),
+		join(diff, id, ms, hostname, portDiff),
+		strconv.FormatInt(expire.Milliseconds(), 10),
+		strconv.FormatInt(ts, 10),
+		strconv.FormatInt(shareDiffCalc, 10),
+	}
+}
 
-		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares, login, shareDiffCalc, id, personalShares)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
-		return false, cmd.Err()
+// Solo shares stay out of the shared round and PPLNS window
+func (r *RedisClient) soloShareKeys(login string) []string {
+	return []string{
+		r.formatKey("pow"),
+		r.formatKey("solo", "shares"),
+		r.formatKey("solo", "hashrate"),
+		r.formatKey("hashrate", login),
+		r.formatKey("miners", login),
 	}
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, shareDiffCalc int64, expire time.Duration, hostname string) {
-	times := int(diff / 1000000000)
-	for i := 0; i < times; i++ {
-		tx.LPush(r.formatKey("lastshares"), login)
+func (r *RedisClient) soloShareArgs(ms, ts int64, login, id string, params []string, diff, shareDiffCalc int64, height uint64, expire time.Duration, hostname string, portDiff int64) []string {
+	return []string{
+		strconv.FormatUint(height, 10),
+		strings.Join(params, ":"),
+		login,
+		strconv.FormatInt(diff, 10),
+		strconv.FormatInt(ts, 10),
+		join(diff, login, id, ms, hostname, portDiff),
+		join(diff, id, ms, hostname, portDiff, true),
+		strconv.FormatInt(expire.Milliseconds(), 10),
+		strconv.FormatInt(shareDiffCalc, 10),
 	}
-	tx.LTrim(r.formatKey("lastshares"), 0, r.pplns)
-	tx.HIncrBy(r.formatKey("miners", login), "roundShares", diff)
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
-	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms, hostname)})
-	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms, hostname)})
-	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
-	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
-	tx.HSet(r.formatKey("miners", login), "lastShareDiff", strconv.FormatInt(shareDiffCalc, 10))
 }
 
 func (r *RedisClient) WriteBlocksFound(ms, ts int64, login, id, share string, diff int64) {
@@ -818,7 +1070,7 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 	for {
 		var keys []string
 		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
+		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100)
 		if err != nil {
 			return nil, err
 		}
@@ -866,6 +1118,45 @@ func (r *RedisClient) GetTreshold(login string) (int64, error) {
 	return cmd.Int64()
 }
 
+type ThresholdChange struct {
+	Timestamp int64 `json:"timestamp"`
+	// In Shannon
+	Threshold int64 `json:"threshold"`
+}
+
+// Sets payout threshold chosen by miner and logs the change, ts in seconds.
+// Change is checked against the last one and written by one script, so a signed message can't be used twice.
+func (r *RedisClient) SetTreshold(login string, threshold, ts int64) (bool, error) {
+	keys := []string{r.formatKey("miners", login), r.formatKey("thresholds", login)}
+	args := []string{strconv.FormatInt(threshold, 10), strconv.FormatInt(ts, 10), join(ts, threshold)}
+	val, err := setThresholdScript.Run(r.client, keys, args).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := val.(int64)
+	return n == 1, nil
+}
+
+// Latest threshold changes of miner first
+func (r *RedisClient) GetTresholdHistory(login string) ([]*ThresholdChange, error) {
+	cmd := r.client.ZRevRangeWithScores(r.formatKey("thresholds", login), 0, -1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertThresholdResults(cmd), nil
+}
+
+func convertThresholdResults(raw *redis.ZSliceCmd) []*ThresholdChange {
+	result := make([]*ThresholdChange, 0, len(raw.Val()))
+	for _, v := range raw.Val() {
+		fields := strings.Split(v.Member.(string), ":")
+		change := &ThresholdChange{Timestamp: int64(v.Score)}
+		change.Threshold, _ = strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		result = append(result, change)
+	}
+	return result
+}
+
 func (r *RedisClient) LockPayouts(login string, amount int64) error {
 	key := r.formatKey("payments", "lock")
 	result := r.client.SetNX(key, join(login, amount), 0).Val()
@@ -915,73 +1206,234 @@ func (r *RedisClient) GetPendingPayments() []*PendingPayment {
 
 // Deduct miner's balance for payment
 func (r *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
-		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
-		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
-		return nil
+	return r.withLedger(ledger.KindDebit, login, debitPostings(login, amount), func() error {
+		_, err := tx.Exec(func() error {
+			r.debitBalance(tx, login, amount, ts)
+			return nil
+		})
+		return err
+	})
+}
+
+// Deducts balances of all miners of a batch payment or none of them
+func (r *RedisClient) UpdateBalances(payments []*PendingPayment) error {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+
+	var postings []ledger.Posting
+	for _, v := range payments {
+		postings = append(postings, debitPostings(v.Address, v.Amount)...)
+	}
+	return r.withLedger(ledger.KindDebit, "batch", postings, func() error {
+		_, err := tx.Exec(func() error {
+			for _, v := range payments {
+				r.debitBalance(tx, v.Address, v.Amount, ts)
+			}
+			return nil
+		})
+		return err
 	})
-	return err
+}
+
+func (r *RedisClient) debitBalance(tx *redis.Multi, login string, amount, ts int64) {
+	tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
+	tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
+	tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
+	tx.HIncrBy(r.formatKey("finances"), "pending", amount)
+	tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
 }
 
 func (r *RedisClient) RollbackBalance(login string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
-		return nil
+	return r.withLedger(ledger.KindRollback, login, creditBackPostings(login, amount), func() error {
+		_, err := tx.Exec(func() error {
+			r.creditBack(tx, login, amount)
+			return nil
+		})
+		return err
 	})
-	return err
+}
+
+// Credits back balances of a batch payment which was not sent and unlocks payouts
+func (r *RedisClient) RollbackBalances(payments []*PendingPayment) error {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	var postings []ledger.Posting
+	for _, v := range payments {
+		postings = append(postings, creditBackPostings(v.Address, v.Amount)...)
+	}
+	return r.withLedger(ledger.KindRollback, "batch", postings, func() error {
+		_, err := tx.Exec(func() error {
+			for _, v := range payments {
+				r.creditBack(tx, v.Address, v.Amount)
+			}
+			tx.Del(r.formatKey("payments", "lock"))
+			return nil
+		})
+		return err
+	})
+}
+
+func (r *RedisClient) creditBack(tx *redis.Multi, login string, amount int64) {
+	tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+	tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+	tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+	tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+	tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+}
+
+// Moving average of tx fees per block in Shannon
+func (r *RedisClient) GetAvgTxFees() (int64, error) {
+	cmd := r.client.HGet(r.formatKey("finances"), "avgTxFees")
+	if cmd.Err() == redis.Nil {
+		return 0, nil
+	} else if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	return cmd.Int64()
+}
+
+func (r *RedisClient) UpdateAvgTxFees(fees int64) error {
+	avg, err := r.GetAvgTxFees()
+	if err != nil {
+		return err
+	}
+	if avg == 0 {
+		avg = fees
+	} else {
+		avg += (fees - avg) / 10
+	}
+	return r.client.HSet(r.formatKey("finances"), "avgTxFees", strconv.FormatInt(avg, 10)).Err()
 }
 
 func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+
+	return r.withLedger(ledger.KindPayment, txHash, paymentPostings(login, amount), func() error {
+		_, err := tx.Exec(func() error {
+			r.logPayment(tx, login, txHash, amount, ts)
+			tx.Del(r.formatKey("payments", "lock"))
+			return nil
+		})
+		return err
+	})
+}
+
+// Logs all payments of a batch sent in a single tx and unlocks payouts
+func (r *RedisClient) WriteBatchPayment(txHash string, payments []*PendingPayment) error {
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZRemRangeByRank(r.formatKey("payments", "all"), 0, -10000)
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-		tx.ZRemRangeByRank(r.formatKey("payments", login), 0, -100)
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
-		tx.Del(r.formatKey("payments", "lock"))
-		tx.HIncrBy(r.formatKey("paymentsTotal"), "all", 1)
-		tx.HIncrBy(r.formatKey("paymentsTotal"), login, 1)
+	var postings []ledger.Posting
+	for _, v := range payments {
+		postings = append(postings, paymentPostings(v.Address, v.Amount)...)
+	}
+	return r.withLedger(ledger.KindPayment, txHash, postings, func() error {
+		_, err := tx.Exec(func() error {
+			for _, v := range payments {
+				r.logPayment(tx, v.Address, txHash, v.Amount, ts)
+			}
+			tx.Del(r.formatKey("payments", "lock"))
+			return nil
+		})
+		return err
+	})
+}
+
+// Moves logged payments of a dropped tx to the tx that replaced it, keeping their time
+func (r *RedisClient) ReplacePayment(oldTxHash, newTxHash string, payments []*PendingPayment) error {
+	scores := make([]float64, len(payments))
+	for i, v := range payments {
+		score, err := r.client.ZScore(r.formatKey("payments", "all"), join(oldTxHash, v.Address, v.Amount)).Result()
+		if err == redis.Nil {
+			score = float64(util.MakeTimestamp() / 1000)
+		} else if err != nil {
+			return err
+		}
+		scores[i] = score
+	}
+
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for i, v := range payments {
+			tx.ZRem(r.formatKey("payments", "all"), join(oldTxHash, v.Address, v.Amount))
+			tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: scores[i], Member: join(newTxHash, v.Address, v.Amount)})
+			tx.ZRem(r.formatKey("payments", v.Address), join(oldTxHash, v.Amount))
+			tx.ZAdd(r.formatKey("payments", v.Address), redis.Z{Score: scores[i], Member: join(newTxHash, v.Amount)})
+		}
+		tx.HSet(r.formatKey("payments", "replaced"), oldTxHash, newTxHash)
 		return nil
 	})
 	return err
 }
 
+func (r *RedisClient) logPayment(tx *redis.Multi, login, txHash string, amount, ts int64) {
+	tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+	tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+	tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+	tx.HIncrBy(r.formatKey("finances"), "paid", amount)
+	tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
+	tx.ZRemRangeByRank(r.formatKey("payments", "all"), 0, -10000)
+	tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+	tx.ZRemRangeByRank(r.formatKey("payments", login), 0, -100)
+	tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+	tx.HIncrBy(r.formatKey("paymentsTotal"), "all", 1)
+	tx.HIncrBy(r.formatKey("paymentsTotal"), login, 1)
+}
+
 func (r *RedisClient) WriteReward(login string, amount int64, percent *big.Rat, immature bool, block *BlockData) error {
 	if amount <= 0 {
 		return nil
 	}
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	addStr := join(amount, percent, immature, block.Hash, block.Height, block.Timestamp, block.Difficulty, block.PersonalShares)
 	remStr := join(amount, percent, !immature, block.Hash, block.Height, block.Timestamp, block.Difficulty, block.PersonalShares)
 	remscore := block.Timestamp - 3600*24*40 // Store the last 40 Days
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.ZAdd(r.formatKey("rewards", login), redis.Z{Score: float64(block.Timestamp), Member: addStr})
 		tx.ZRem(r.formatKey("rewards", login), remStr)
 		tx.ZRemRangeByScore(r.formatKey("rewards", login), "-inf", "("+strconv.FormatInt(remscore, 10))
@@ -992,10 +1444,13 @@ func (r *RedisClient) WriteReward(login string, amount int64, percent *big.Rat,
 }
 
 func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		r.writeImmatureBlock(tx, block)
 		total := int64(0)
 		for login, amount := range roundRewards {
@@ -1022,36 +1477,49 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 	ts := util.MakeTimestamp() / 1000
 	value := join(block.Hash, ts, block.Reward)
 
-	_, err = tx.Exec(func() error {
-		r.writeMaturedBlock(tx, block)
-		tx.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
-
-		// Decrement immature balances
-		totalImmature := int64(0)
-		for login, amountString := range immatureCredits.Val() {
-			amount, _ := strconv.ParseInt(amountString, 10, 64)
-			totalImmature += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
-		}
+	var postings []ledger.Posting
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		postings = append(postings, ledger.Posting{Account: ledger.Account(ledger.AccountBalance, login), Amount: amount})
+	}
+	postings = append(postings, ledger.Posting{Account: ledger.PoolRewards, Amount: -(total + block.ShareRewardsRepaid)})
+	postings = append(postings, ledger.Posting{Account: ledger.PoolShareRewards, Amount: block.ShareRewardsRepaid})
+	return r.withLedger(ledger.KindReward, block.Hash, postings, func() error {
+		_, err := tx.Exec(func() error {
+			r.writeMaturedBlock(tx, block)
+			tx.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
+
+			// Decrement immature balances
+			totalImmature := int64(0)
+			for login, amountString := range immatureCredits.Val() {
+				amount, _ := strconv.ParseInt(amountString, 10, 64)
+				totalImmature += amount
+				tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
+			}
 
-		// Increment balances
-		total := int64(0)
-		for login, amount := range roundRewards {
-			total += amount
-			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
-			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-			tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
-		}
-		tx.Del(creditKey)
-		tx.HIncrBy(r.formatKey("finances"), "balance", total)
-		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
-		tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
-		tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
-		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInShannon())
-		tx.Expire(r.formatKey("credits", block.Height, block.Hash), 604800*time.Second)
-		return nil
+			// Increment balances
+			total := int64(0)
+			for login, amount := range roundRewards {
+				total += amount
+				// NOTICE: Maybe expire round reward entry in 604800 (a week)?
+				tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+				tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+			}
+			tx.Del(creditKey)
+			tx.HIncrBy(r.formatKey("finances"), "balance", total)
+			tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
+			if block.ShareRewardsRepaid != 0 {
+				tx.HIncrBy(r.formatKey("finances"), "shareRewardsRepaid", block.ShareRewardsRepaid)
+			}
+			tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+			tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
+			tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInShannon())
+			tx.Expire(r.formatKey("credits", block.Height, block.Hash), 604800*time.Second)
+			return nil
+		})
+		return err
 	})
-	return err
 }
 
 func (r *RedisClient) WriteOrphan(block *BlockData) error {
@@ -1082,10 +1550,13 @@ func (r *RedisClient) WriteOrphan(block *BlockData) error {
 }
 
 func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		for _, block := range blocks {
 			r.writeImmatureBlock(tx, block)
 		}
@@ -1116,7 +1587,10 @@ func (r *RedisClient) IsMinerExists(login string) (bool, error) {
 func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	cmds, err := tx.Exec(func() error {
@@ -1127,6 +1601,8 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 		tx.LRange(r.formatKey("lastshares"), 0, r.pplns)
 		tx.ZRevRangeWithScores(r.formatKey("rewards", login), 0, 39)
 		tx.ZRevRangeWithScores(r.formatKey("rewards", login), 0, -1)
+		tx.HGet(r.formatKey("solo", "shares"), login)
+		tx.ZRevRangeWithScores(r.formatKey("thresholds", login), 0, -1)
 		return nil
 	})
 
@@ -1146,6 +1622,8 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 			}
 		}
 		stats["roundShares"] = csh
+		stats["soloRoundShares"], _ = cmds[7].(*redis.StringCmd).Int64()
+		stats["thresholdHistory"] = convertThresholdResults(cmds[8].(*redis.ZSliceCmd))
 	}
 
 	return stats, nil
@@ -1178,6 +1656,11 @@ func (r *RedisClient) FlushStaleStats(staleDuration, largeWindow time.Duration)
 	if err != nil {
 		return total, err
 	}
+	n, err := r.client.ZRemRangeByScore(r.formatKey("solo", "hashrate"), "-inf", maxStale).Result()
+	if err != nil {
+		return total, err
+	}
+	total += n
 
 	var cursor int64
 	// Use a map to ensure that each miner is only processed once
@@ -1189,7 +1672,7 @@ func (r *RedisClient) FlushStaleStats(staleDuration, largeWindow time.Duration)
 	for {
 		var keys []string
 		var err error
-		cursor, keys, err = r.client.Scan(cursor, r.formatKey("hashrate", "*"), 100).Result()
+		cursor, keys, err = r.client.Scan(cursor, r.formatKey("hashrate", "*"), 100)
 		if err != nil {
 			return total, err
 		}
@@ -1218,7 +1701,10 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	window := int64(smallWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
@@ -1238,6 +1724,9 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		tx.LLen(r.formatKey("lastshares"))
 		tx.ZRevRangeWithScores(r.formatKey("finders"), 0, -1)
 		tx.HGetAllMap(r.formatKey("exchange", r.CoinName))
+		tx.ZRemRangeByScore(r.formatKey("solo", "hashrate"), "-inf", fmt.Sprint("(", now-window))
+		tx.ZRangeWithScores(r.formatKey("solo", "hashrate"), 0, -1)
+		tx.HGetAllMap(r.formatKey("solo", "stats"))
 		return nil
 	})
 
@@ -1275,6 +1764,13 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	exchangedata, _ := cmds[13].(*redis.StringStringMapCmd).Result()
 	stats["exchangedata"] = exchangedata
 
+	soloHashrate, soloMiners := convertMinersStats(window, cmds[15].(*redis.ZSliceCmd))
+	stats["soloMiners"] = soloMiners
+	stats["soloMinersTotal"] = len(soloMiners)
+	stats["soloHashrate"] = soloHashrate
+	soloStats, _ := cmds[16].(*redis.StringStringMapCmd).Result()
+	stats["soloStats"] = convertStringMap(soloStats)
+
 	return stats, nil
 }
 
@@ -1283,7 +1779,10 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	largeWindow := int64(lWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
@@ -1303,6 +1802,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 
 	totalHashrate := int64(0)
 	currentHashrate := int64(0)
+	soloHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
 	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd), cmds[4].(*redis.ZSliceCmd), login, r)
@@ -1347,6 +1847,9 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
+		if worker.Solo {
+			soloHashrate += worker.HR
+		}
 		valid_share, stale_share, invalid_share, _ := r.getSharesStatus(login, id)
 		worker.ValidShares = int64(5)
 		worker.StaleShares = int64(5)
@@ -1417,6 +1920,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
+	stats["soloHashrate"] = soloHashrate
 
 	stats["rewards"] = convertRewardResults(cmds[2].(*redis.ZSliceCmd)) // last 40
 	rewards := convertRewardResults(cmds[3].(*redis.ZSliceCmd))         // all
@@ -1463,7 +1967,10 @@ func toFixed(num float64, precision int) float64 {
 func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	max := int64(windows[len(windows)-1])
@@ -1516,7 +2023,10 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 
 func (r *RedisClient) CollectLuckCharts(max int) (stats []*LuckCharts, err error) {
 	var result []*LuckCharts
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	cmds, err := tx.Exec(func() error {
@@ -1570,6 +2080,7 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 		block.ShareDiffCalc, _ = strconv.ParseInt(fields[7], 10, 64)
 		block.PersonalShares, _ = strconv.ParseInt(fields[9], 10, 64)
 		block.Worker = fields[8]
+		block.Solo = len(fields) > 10 && fields[10] == "1"
 		block.candidateKey = v.Member.(string)
 		result = append(result, &block)
 	}
@@ -1624,6 +2135,7 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 			block.ShareDiffCalc, _ = strconv.ParseInt(fields[9], 10, 64)
 			block.PersonalShares, _ = strconv.ParseInt(fields[11], 10, 64)
 			block.Worker = fields[10]
+			block.Solo = len(fields) > 12 && fields[12] == "1"
 			block.immatureKey = v.Member.(string)
 			result = append(result, &block)
 		}
@@ -1674,8 +2186,14 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd, blocks *redis.ZSlic
 			worker.HR += share
 		}
 
-		worker.PortDiff = parts[0]
+		// Entries written before ports had their own difficulty lack it
+		if len(parts) > 4 {
+			worker.PortDiff = parts[4]
+		} else {
+			worker.PortDiff = parts[0]
+		}
 		worker.WorkerHostname = hostname
+		worker.Solo = len(parts) > 5 && parts[5] == "1"
 
 		if worker.LastBeat < score {
 			worker.LastBeat = score
@@ -1812,7 +2330,11 @@ func (r *RedisClient) GetCurrentHashrate(login string) (int64, error) {
 
 // Need a function to delete on round end or whatever, and another function to get.
 func (r *RedisClient) ResetWorkerShareStatus() {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		log.Printf("Failed to reset worker share status: %v", err)
+		return
+	}
 	defer tx.Close()
 
 	tx.Exec(func() error {
@@ -1844,9 +2366,6 @@ func (r *RedisClient) getSharesStatus(login string, id string) (int64, int64, in
 
 }
 
-var deletionLock sync.Mutex
-var deletionDone bool
-
 // WriteWorkerShareStatus updates the worker's share status in Redis.
 // It takes the worker's login, ID, and status flags for valid, stale, and invalid shares.
 func (r *RedisClient) WriteWorkerShareStatus(login string, id string, valid bool, stale bool, invalid bool) {
@@ -1868,13 +2387,17 @@ func (r *RedisClient) WriteWorkerShareStatus(login string, id string, valid bool
 	t := time.Now().Local()
 	formattedTime := t.Format("15:04:05") // Time in 24-hour format
 
-	if formattedTime >= "23:59:00" && !deletionDone {
+	if formattedTime >= "23:59:00" && !r.deletionDone {
 		// Lock to ensure only one deletion occurs.
-		deletionLock.Lock()
-		defer deletionLock.Unlock()
+		r.deletionLock.Lock()
+		defer r.deletionLock.Unlock()
 
-		if !deletionDone {
-			tx := r.client.Multi()
+		if !r.deletionDone {
+			tx, err := r.client.Multi()
+			if err != nil {
+				log.Printf("Failed to write share status of %v: %v", login, err)
+				return
+			}
 			defer tx.Close()
 
 			// Reset share status to 0 for the next day.
@@ -1885,10 +2408,14 @@ func (r *RedisClient) WriteWorkerShareStatus(login string, id string, valid bool
 				return nil
 			})
 
-			deletionDone = true
+			r.deletionDone = true
 		}
 	} else {
-		tx := r.client.Multi()
+		tx, err := r.client.Multi()
+		if err != nil {
+			log.Printf("Failed to write share status of %v: %v", login, err)
+			return
+		}
 		defer tx.Close()
 
 		// Increment share counts.
@@ -1904,7 +2431,11 @@ func (r *RedisClient) WriteWorkerShareStatus(login string, id string, valid bool
 }
 
 func (r *RedisClient) NumberStratumWorker(count int) {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		log.Printf("Failed to write number of stratum workers: %v", err)
+		return
+	}
 	defer tx.Close()
 
 	tx.Exec(func() error {
@@ -1916,7 +2447,11 @@ func (r *RedisClient) NumberStratumWorker(count int) {
 }
 
 func (r *RedisClient) StoreExchangeData(ExchangeData []map[string]interface{}) {
-	tx := r.client.Multi()
+	tx, err := r.client.Multi()
+	if err != nil {
+		log.Printf("Failed to store exchange data: %v", err)
+		return
+	}
 	defer tx.Close()
 
 	log.Printf("ExchangeData: %s", ExchangeData)
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	redis "gopkg.in/redis.v3"
+)
+
+// Share and block writes run as scripts, so a crash can't leave a share counted
+// without its round or a round snapshot without its candidate.
+// Every key is passed in KEYS to keep scripts valid on a cluster.
+
+// KEYS[1] pow, ARGV[1] height, ARGV[2] nonce:powHash:mixDigest
+const powCheckLua = `
+local height = tonumber(ARGV[1])
+-- Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. string.format('%.0f', height - 8))
+-- Duplicate share, (nonce, powHash, mixDigest) pair exist
+if redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 1
+end
+`
+
+// KEYS[2] lastshares, KEYS[3] lastshares:time, KEYS[4] miners:<login>, KEYS[5] shares:roundCurrent,
+// KEYS[6] hashrate, KEYS[7] hashrate:<login>, KEYS[8] stats
+// ARGV[3] login, ARGV[4] diff, ARGV[5] PPLNS entries, ARGV[6] pplns, ARGV[7] window,
+// ARGV[8] ms, ARGV[9] time window start in ms, ARGV[10] worker id, ARGV[11] pool hashrate entry,
+// ARGV[12] miner hashrate entry, ARGV[13] hashrate expiration in ms, ARGV[14] ts, ARGV[15] share difficulty
+const poolShareLua = `
+local login, diff, ts = ARGV[3], ARGV[4], ARGV[14]
+for i = 1, tonumber(ARGV[5]) do
+	redis.call('LPUSH', KEYS[2], login)
+end
+redis.call('LTRIM', KEYS[2], 0, ARGV[6])
+if ARGV[7] == 'time' then
+	redis.call('ZADD', KEYS[3], ARGV[8], login .. ':' .. diff .. ':' .. ARGV[8] .. ':' .. ARGV[10])
+	redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', '(' .. ARGV[9])
+end
+redis.call('HINCRBY', KEYS[4], 'roundShares', diff)
+local personal = redis.call('HINCRBY', KEYS[5], login, diff)
+redis.call('ZADD', KEYS[6], ts, ARGV[11])
+redis.call('ZADD', KEYS[7], ts, ARGV[12])
+-- Will delete hashrates for miners that gone
+redis.call('PEXPIRE', KEYS[7], ARGV[13])
+redis.call('HSET', KEYS[4], 'lastShare', ts)
+redis.call('HSET', KEYS[4], 'lastShareDiff', ARGV[15])
+`
+
+// Share paid at once by PPS family schemes, last of KEYS finances, last of ARGV reward in Shannon
+const shareRewardLua = `
+local reward = ARGV[#ARGV]
+if reward ~= '0' then
+	redis.call('HINCRBY', KEYS[4], 'balance', reward)
+	redis.call('HINCRBY', KEYS[4], 'shareRewards', reward)
+	redis.call('HINCRBY', KEYS[#KEYS], 'balance', reward)
+	redis.call('HINCRBY', KEYS[#KEYS], 'shareRewards', reward)
+end
+`
+
+// KEYS[9] finders, KEYS[10] worker:blocks:<login>, KEYS[11] round, KEYS[12] blocks:candidates
+// ARGV[16] found block entry, ARGV[17] candidate head, nonce:powHash:mixDigest:ts:roundDiff
+const poolBlockLua = `
+redis.call('ZADD', KEYS[10], ts, ARGV[16])
+redis.call('HSET', KEYS[8], 'lastBlockFound', ts)
+redis.call('HDEL', KEYS[8], 'roundShares')
+redis.call('HSET', KEYS[4], 'roundShares', 0)
+redis.call('ZINCRBY', KEYS[9], 1, login)
+redis.call('HINCRBY', KEYS[4], 'blocksFound', 1)
+
+local current = redis.call('HGETALL', KEYS[5])
+redis.call('DEL', KEYS[5])
+local total = 0
+for i = 2, #current, 2 do
+	total = total + tonumber(current[i])
+end
+
+local window = ARGV[7]
+if window == 'round' then
+	for i = 1, #current, 2 do
+		redis.call('HINCRBY', KEYS[11], current[i], current[i + 1])
+	end
+elseif window == 'finder' then
+	redis.call('HINCRBY', KEYS[11], login, 1)
+else
+	local shares = {}
+	if window == 'time' then
+		-- login:diff:ms:id
+		for _, v in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], ARGV[9], '+inf')) do
+			local l, d = string.match(v, '^([^:]*):([^:]*)')
+			shares[l] = (shares[l] or 0) + tonumber(d)
+		end
+	else
+		for _, l in ipairs(redis.call('LRANGE', KEYS[2], 0, ARGV[6])) do
+			shares[l] = (shares[l] or 0) + 1
+		end
+	end
+	for l, n in pairs(shares) do
+		redis.call('HINCRBY', KEYS[11], l, string.format('%.0f', n))
+	end
+end
+
+local candidate = ARGV[17] .. ':' .. string.format('%.0f', total) .. ':' .. login .. ':' .. ARGV[15] .. ':' .. ARGV[10] .. ':' .. string.format('%.0f', personal)
+redis.call('ZADD', KEYS[12], ARGV[1], candidate)
+return 0
+`
+
+// KEYS[2] solo:shares, KEYS[3] solo:hashrate, KEYS[4] hashrate:<login>, KEYS[5] miners:<login>
+// ARGV[3] login, ARGV[4] diff, ARGV[5] ts, ARGV[6] solo hashrate entry, ARGV[7] miner hashrate entry,
+// ARGV[8] hashrate expiration in ms, ARGV[9] share difficulty
+const soloShareLua = `
+local login, ts = ARGV[3], ARGV[5]
+redis.call('HINCRBY', KEYS[2], login, ARGV[4])
+redis.call('ZADD', KEYS[3], ts, ARGV[6])
+redis.call('ZADD', KEYS[4], ts, ARGV[7])
+redis.call('PEXPIRE', KEYS[4], ARGV[8])
+redis.call('HSET', KEYS[5], 'lastShare', ts)
+redis.call('HSET', KEYS[5], 'lastShareDiff', ARGV[9])
+`
+
+// KEYS[6] solo:stats, KEYS[7] worker:blocks:<login>, KEYS[8] round, KEYS[9] blocks:candidates
+// ARGV[10] found block entry, ARGV[11] candidate head, nonce:powHash:mixDigest:ts:roundDiff, ARGV[12] worker id
+const soloBlockLua = `
+redis.call('ZADD', KEYS[7], ts, ARGV[10])
+redis.call('HSET', KEYS[6], 'lastBlockFound', ts)
+redis.call('HINCRBY', KEYS[6], 'blocksFound', 1)
+redis.call('HINCRBY', KEYS[5], 'soloBlocksFound', 1)
+local shares = redis.call('HGET', KEYS[2], login)
+redis.call('HDEL', KEYS[2], login)
+-- Finder takes the whole round, unlocker renames and deletes it as usual
+redis.call('HINCRBY', KEYS[8], login, shares)
+local candidate = ARGV[11] .. ':' .. shares .. ':' .. login .. ':' .. ARGV[9] .. ':' .. ARGV[12] .. ':' .. shares .. ':1'
+redis.call('ZADD', KEYS[9], ARGV[1], candidate)
+return 0
+`
+
+// KEYS[1] pow, KEYS[2] lastshares, KEYS[3] lastshares:time, KEYS[4] shares:roundCurrent,
+// KEYS[5] hashrate, KEYS[6] stats, KEYS[7] solo:shares, KEYS[8] solo:hashrate, KEYS[9] finances,
+// then miners:<login> and hashrate:<login> of every worker
+// ARGV[1] pplns, ARGV[2] window, ARGV[3] ms, ARGV[4] time window start in ms, ARGV[5] ts, ARGV[6] max height,
+// then every worker as login, id, solo, hostname, port difficulty, hashrate expiration in ms, number of shares,
+// followed by its shares as height, nonce:powHash:mixDigest, diff, PPLNS entries, share difficulty, reward.
+// Returns positions of duplicate shares.
+const shareBatchLua = `
+local pplns, window, ms, ts = ARGV[1], ARGV[2], ARGV[3], ARGV[5]
+-- Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. string.format('%.0f', tonumber(ARGV[6]) - 8))
+
+local duplicates = {}
+local position = 0
+local roundShares, rewards = 0, 0
+local a, k = 6, 9
+while a < #ARGV do
+	local login, id, solo, hostname, portDiff, expire, count = ARGV[a + 1], ARGV[a + 2], ARGV[a + 3], ARGV[a + 4], ARGV[a + 5], ARGV[a + 6], tonumber(ARGV[a + 7])
+	local minerKey, hashrateKey = KEYS[k + 1], KEYS[k + 2]
+	a, k = a + 7, k + 2
+
+	local diff, weight, reward, shareDiff = 0, 0, 0, nil
+	for i = 1, count do
+		position = position + 1
+		-- Duplicate share, (nonce, powHash, mixDigest) pair exist
+		if redis.call('ZADD', KEYS[1], ARGV[a + 1], ARGV[a + 2]) == 0 then
+			table.insert(duplicates, position)
+		else
+			diff = diff + tonumber(ARGV[a + 3])
+			weight = weight + tonumber(ARGV[a + 4])
+			shareDiff = ARGV[a + 5]
+			reward = reward + tonumber(ARGV[a + 6])
+		end
+		a = a + 6
+	end
+
+	if shareDiff then
+		local d = string.format('%.0f', diff)
+		local entry = table.concat({d, id, ms, hostname, portDiff}, ':')
+		if solo == '1' then
+			-- Solo shares stay out of the shared round and PPLNS window
+			redis.call('HINCRBY', KEYS[7], login, d)
+			redis.call('ZADD', KEYS[8], ts, table.concat({d, login, id, ms, hostname, portDiff}, ':'))
+			redis.call('ZADD', hashrateKey, ts, entry .. ':1')
+		else
+			for i = 1, weight do
+				redis.call('LPUSH', KEYS[2], login)
+			end
+			if window == 'time' then
+				redis.call('ZADD', KEYS[3], ms, table.concat({login, d, ms, id}, ':'))
+			end
+			redis.call('HINCRBY', minerKey, 'roundShares', d)
+			redis.call('HINCRBY', KEYS[4], login, d)
+			redis.call('ZADD', KEYS[5], ts, table.concat({d, login, id, ms, hostname, portDiff}, ':'))
+			redis.call('ZADD', hashrateKey, ts, entry)
+			roundShares = roundShares + diff
+			if reward > 0 then
+				local r = string.format('%.0f', reward)
+				redis.call('HINCRBY', minerKey, 'balance', r)
+				redis.call('HINCRBY', minerKey, 'shareRewards', r)
+				rewards = rewards + reward
+			end
+		end
+		-- Will delete hashrates for miners that gone
+		redis.call('PEXPIRE', hashrateKey, expire)
+		redis.call('HSET', minerKey, 'lastShare', ts)
+		redis.call('HSET', minerKey, 'lastShareDiff', shareDiff)
+	end
+end
+
+redis.call('LTRIM', KEYS[2], 0, pplns)
+if window == 'time' then
+	redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', '(' .. ARGV[4])
+end
+if roundShares > 0 then
+	redis.call('HINCRBY', KEYS[6], 'roundShares', string.format('%.0f', roundShares))
+end
+if rewards > 0 then
+	redis.call('HINCRBY', KEYS[9], 'balance', string.format('%.0f', rewards))
+	redis.call('HINCRBY', KEYS[9], 'shareRewards', string.format('%.0f', rewards))
+end
+return duplicates
+`
+
+// KEYS[1] miners:<login>, KEYS[2] thresholds:<login>
+// ARGV[1] threshold, ARGV[2] ts, ARGV[3] history entry
+const setThresholdLua = `
+-- Signed change must be newer than the last one
+local last = redis.call('ZREVRANGE', KEYS[2], 0, 0, 'WITHSCORES')
+if #last > 0 and tonumber(last[2]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'payouttreshold', ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -21)
+return 1
+`
+
+var (
+	poolShareScript = redis.NewScript(powCheckLua + poolShareLua + shareRewardLua + `
+redis.call('HINCRBY', KEYS[8], 'roundShares', diff)
+return 0
+`)
+	poolBlockScript    = redis.NewScript(powCheckLua + poolShareLua + shareRewardLua + poolBlockLua)
+	soloShareScript    = redis.NewScript(powCheckLua + soloShareLua + "return 0\n")
+	soloBlockScript    = redis.NewScript(powCheckLua + soloShareLua + soloBlockLua)
+	shareBatchScript   = redis.NewScript(shareBatchLua)
+	setThresholdScript = redis.NewScript(setThresholdLua)
+)
+
+// Returns true for duplicate share
+func runShareScript(client redisClient, script *redis.Script, keys, args []string) (bool, error) {
+	val, err := script.Run(client, keys, args).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := val.(int64)
+	return n == 1, nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRedis(t *testing.T) *RedisClient {
+	return newTestRedis(t, &Config{Endpoint: testRedisEndpoint(t), PoolSize: 2})
+}
+
+func TestShareScriptReloads(t *testing.T) {
+	r := testRedis(t)
+	r.client.(*nodeClient).ScriptFlush()
+
+	exist, err := r.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 3000, 3000, 100, time.Minute, "host", 3000, false, 0)
+	if err != nil || exist {
+		t.Fatalf("Failed to write share after script flush: %v, %v", exist, err)
+	}
+	if n, _ := r.client.HGet(r.formatKey("stats"), "roundShares").Int64(); n != 3000 {
+		t.Errorf("Expected 3000 round shares, got %v", n)
+	}
+	if ttl, _ := r.client.(*nodeClient).PTTL(r.formatKey("hashrate", "0xa")).Result(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected miner hashrate to expire within a minute, got %v", ttl)
+	}
+}
+
+func TestBlockScriptResetsRound(t *testing.T) {
+	r := testRedis(t)
+	r.SetShareWindow(WindowRound, 0)
+	r.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 3000, 3000, 100, time.Minute, "", 3000, false, 0)
+	if _, err := r.WriteBlock("0xb", "rig", []string{"0x2", "0xh2", "0xm2"}, 1000, 90000, 50000, 100, time.Minute, "", 1000, false, 0); err != nil {
+		t.Fatalf("Failed to write block: %v", err)
+	}
+
+	if ok, _ := r.client.Exists(r.formatKey("shares", "roundCurrent")).Result(); ok {
+		t.Error("Expected current round to be removed")
+	}
+	stats, _ := r.client.HGetAllMap(r.formatKey("stats")).Result()
+	if _, ok := stats["roundShares"]; ok || len(stats["lastBlockFound"]) == 0 {
+		t.Errorf("Expected round shares reset and block time set, got %v", stats)
+	}
+	miner, _ := r.client.HGetAllMap(r.formatKey("miners", "0xb")).Result()
+	if miner["roundShares"] != "0" || miner["blocksFound"] != "1" || miner["lastShareDiff"] != "90000" {
+		t.Errorf("Unexpected finder stats %v", miner)
+	}
+	if n, _ := r.client.ZScore(r.formatKey("finders"), "0xb").Result(); n != 1 {
+		t.Errorf("Expected finder to be counted, got %v", n)
+	}
+	if n, _ := r.client.(*nodeClient).ZCard(r.formatKey("worker", "blocks", "0xb")).Result(); n != 1 {
+		t.Errorf("Expected found block of worker, got %v", n)
+	}
+}
+
+func TestSoloBlockScript(t *testing.T) {
+	r := testRedis(t)
+	r.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 4000, 4000, 200, time.Minute, "", 4000, true, 0)
+	if _, err := r.WriteBlock("0xa", "rig", []string{"0x2", "0xh2", "0xm2"}, 1000, 90000, 50000, 200, time.Minute, "", 1000, true, 0); err != nil {
+		t.Fatalf("Failed to write solo block: %v", err)
+	}
+	if shares, _ := r.client.HGetAllMap(r.formatKey("solo", "shares")).Result(); len(shares) != 0 {
+		t.Errorf("Expected solo shares of finder to be taken, got %v", shares)
+	}
+	stats, _ := r.client.HGetAllMap(r.formatKey("solo", "stats")).Result()
+	if stats["blocksFound"] != "1" {
+		t.Errorf("Expected solo block to be counted, got %v", stats)
+	}
+	if n, _ := r.client.HGet(r.formatKey("miners", "0xa"), "soloBlocksFound").Int64(); n != 1 {
+		t.Errorf("Expected solo block of miner to be counted, got %v", n)
+	}
+	candidates, _ := r.GetCandidates(200)
+	if len(candidates) != 1 {
+		t.Fatalf("Expected a candidate, got %v", candidates)
+	}
+	if block := candidates[0]; !block.Solo || block.Finder != "0xa" || block.Worker != "rig" || block.TotalShares != 5000 || block.PersonalShares != 5000 || block.Difficulty != 50000 {
+		t.Errorf("Unexpected solo candidate %+v", block)
+	}
+}
+
+// Candidate is nonce:powHash:mixDigest:ts:roundDiff:totalShares:finder:shareDiff:worker:personalShares[:solo]
+func TestBlockScriptCandidates(t *testing.T) {
+	r := testRedis(t)
+	r.SetShareWindow(WindowRound, 0)
+	r.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 3000, 3000, 100, time.Minute, "", 3000, false, 0)
+	r.WriteShare("0xb", "rig", []string{"0x2", "0xh2", "0xm2"}, 2000, 2000, 100, time.Minute, "", 2000, false, 0)
+	r.WriteBlock("0xb", "rig1", []string{"0x3", "0xh3", "0xm3"}, 1000, 90000, 50000, 100, time.Minute, "", 1000, false, 0)
+	r.WriteShare("0xc", "rig", []string{"0x4", "0xh4", "0xm4"}, 4000, 4000, 101, time.Minute, "", 4000, true, 0)
+	r.WriteBlock("0xc", "rig2", []string{"0x5", "0xh5", "0xm5"}, 1000, 80000, 60000, 101, time.Minute, "", 1000, true, 0)
+
+	members, err := r.client.(*nodeClient).ZRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1).Result()
+	if err != nil || len(members) != 2 {
+		t.Fatalf("Expected 2 candidates, got %v, %v", members, err)
+	}
+	expected := []struct {
+		height float64
+		fields []string
+	}{
+		{100, []string{"0x3", "0xh3", "0xm3", "", "50000", "6000", "0xb", "90000", "rig1", "3000"}},
+		{101, []string{"0x5", "0xh5", "0xm5", "", "60000", "5000", "0xc", "80000", "rig2", "5000", "1"}},
+	}
+	for i, e := range expected {
+		fields := strings.Split(members[i].Member.(string), ":")
+		if members[i].Score != e.height || len(fields) != len(e.fields) {
+			t.Fatalf("Unexpected candidate %v at %v", members[i].Member, members[i].Score)
+		}
+		// Timestamp of the script run
+		if ts, err := strconv.ParseInt(fields[3], 10, 64); err != nil || ts <= 0 {
+			t.Errorf("Expected timestamp in candidate %v", members[i].Member)
+		}
+		for j, f := range e.fields {
+			if j != 3 && fields[j] != f {
+				t.Errorf("Expected field %v of candidate %v to be %v, got %v", j, members[i].Member, f, fields[j])
+			}
+		}
+	}
+
+	candidates, _ := r.GetCandidates(101)
+	if len(candidates) != 2 || candidates[0].Solo || !candidates[1].Solo {
+		t.Errorf("Expected pool and solo candidate, got %+v %+v", candidates[0], candidates[1])
+	}
+}
+
+func TestShareScriptsTrimPPLNSWindow(t *testing.T) {
+	r := testRedis(t)
+	r.SetShareWindow(WindowLastShares, 0)
+	unit := int64(pplnsShareUnit)
+	// 120 window entries, only pplns+1 most recent are kept
+	r.WriteShare("0xa", "rig", []string{"0x1", "0xh1", "0xm1"}, 60*unit, 60*unit, 100, time.Minute, "", unit, false, 0)
+	r.WriteShares([]*Share{{Login: "0xb", Id: "rig", Params: []string{"0x2", "0xh2", "0xm2"}, Diff: 60 * unit, Height: 100, Expire: time.Minute}})
+	if n, _ := r.client.(*nodeClient).LLen(r.formatKey("lastshares")).Result(); n != 101 {
+		t.Errorf("Expected 101 window entries, got %v", n)
+	}
+
+	r.WriteBlock("0xc", "rig", []string{"0x3", "0xh3", "0xm3"}, unit, unit, 50000, 100, time.Minute, "", unit, false, 0)
+	if n, _ := r.client.(*nodeClient).LLen(r.formatKey("lastshares")).Result(); n != 101 {
+		t.Errorf("Expected 101 window entries, got %v", n)
+	}
+	shares, _ := r.GetRoundShares(100, "0x3")
+	if len(shares) != 3 || shares["0xc"] != 1 || shares["0xb"] != 60 || shares["0xa"] != 40 {
+		t.Errorf("Expected round of the last 101 window entries, got %v", shares)
+	}
+}
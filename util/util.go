@@ -2,14 +2,18 @@ package util
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"math/big"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 var Ether = math.BigPow(10, 18)
@@ -133,3 +137,25 @@ func DecodeValueHex(val string) string {
 		return x.String()
 	}
 }
+
+// Recovers lowercase address which signed message with personal_sign (EIP-191)
+func RecoverPersonalSign(message, signature string) (string, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return "", fmt.Errorf("Malformed signature: %v", err)
+	}
+	if len(sig) != crypto.SignatureLength {
+		return "", errors.New("Signature must be 65 bytes long")
+	}
+	// Wallets use 27/28 recovery id, crypto expects 0/1
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	prefix := fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(message))
+	hash := crypto.Keccak256([]byte(prefix), []byte(message))
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(crypto.PubkeyToAddress(*pub).Hex()), nil
+}
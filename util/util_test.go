@@ -0,0 +1,48 @@
+package util
+
+import (
+	"testing"
+)
+
+// personal_sign of "Some data" by key 0x4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318
+const (
+	signedMessage = "Some data"
+	signerAddress = "0x2c7536e3605d9c16a7a3d7b1898e529396a65c23"
+	signature     = "0xb91467e570a6466aa9e9876cbcd013baba02900b8979d43fe208a4a4f339f5fd6007e74cd82e037b800186422fc2da167c747ef045e5d18a5f5d4300f8e1a0291c"
+)
+
+func TestRecoverPersonalSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		signature string
+		signer    string
+		fails     bool
+	}{
+		{"recovery id 27/28", signedMessage, signature, signerAddress, false},
+		{"recovery id 0/1", signedMessage, signature[:130] + "01", signerAddress, false},
+		{"other message", "Other data", signature, "", false},
+		{"not hex", signedMessage, "0xzz", "", true},
+		{"short", signedMessage, signature[:128], "", true},
+		{"bad recovery id", signedMessage, signature[:130] + "05", "", true},
+	}
+	for _, tt := range tests {
+		signer, err := RecoverPersonalSign(tt.message, tt.signature)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%v: expected error, got signer %v", tt.name, signer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tt.name, err)
+			continue
+		}
+		if len(tt.signer) > 0 && signer != tt.signer {
+			t.Errorf("%v: expected signer %v, got %v", tt.name, tt.signer, signer)
+		}
+		if len(tt.signer) == 0 && signer == signerAddress {
+			t.Errorf("%v: signature must not match signer of another message", tt.name)
+		}
+	}
+}